@@ -2,4 +2,4 @@ module github.com/flashlabs/kiss-samples/fuzzing
 
 go 1.24.1
 
-require github.com/gorilla/mux v1.8.1 // indirect
+require github.com/gorilla/mux v1.8.1
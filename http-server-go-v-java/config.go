@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix of the environment variables, e.g. HTTP_MAX_IN_FLIGHT
+const envPrefix = "HTTP_"
+
+// config is the effective configuration of the server.
+type config struct {
+	Addr                string
+	AdminAddr           string
+	MaxInFlight         int
+	QueueSize           int
+	QueueTimeout        time.Duration
+	ReadTimeout         time.Duration
+	ReadHeaderTimeout   time.Duration
+	WriteTimeout        time.Duration
+	IdleTimeout         time.Duration
+	ShutdownTimeout     time.Duration
+	ShutdownDelay       time.Duration
+	MaxHeaderBytes      int
+	RateLimit           int
+	RateLimitPeriod     time.Duration
+	TrustedProxies      string
+	RedisAddr           string
+	OTelExporter        string
+	UpstreamURL         string
+	UpstreamTimeout     time.Duration
+	UpstreamMaxInFlight int
+
+	// File is the config file, if any
+	File string
+	// sources tells where every setting came from, for --print-config
+	sources map[string]string
+}
+
+func defaultConfig() *config {
+	return &config{
+		Addr:                ":8080",
+		AdminAddr:           ":9090",
+		MaxInFlight:         100,
+		QueueSize:           50,
+		QueueTimeout:        50 * time.Millisecond,
+		ReadTimeout:         5 * time.Second,
+		ReadHeaderTimeout:   2 * time.Second,
+		WriteTimeout:        10 * time.Second,
+		IdleTimeout:         60 * time.Second,
+		ShutdownTimeout:     10 * time.Second,
+		ShutdownDelay:       5 * time.Second,
+		MaxHeaderBytes:      1 << 20,
+		RateLimitPeriod:     time.Minute,
+		OTelExporter:        exporterNone,
+		UpstreamTimeout:     time.Second,
+		UpstreamMaxInFlight: 50,
+		sources:             map[string]string{},
+	}
+}
+
+// setting is a config field under its file key. The flag is the key with
+// dashes and the environment variable the key in upper case with envPrefix.
+type setting struct {
+	key   string
+	usage string
+	value flag.Value
+}
+
+func (c *config) settings() []setting {
+	return []setting{
+		{"addr", "address to listen on", (*stringValue)(&c.Addr)},
+		{"admin_addr", "address of the admin listener serving /metrics, none if empty", (*stringValue)(&c.AdminAddr)},
+		{"max_in_flight", "most requests served at once, the limit adapts to the latency below it", (*intValue)(&c.MaxInFlight)},
+		{"queue_size", "requests waiting for a slot before the others get a 429", (*intValue)(&c.QueueSize)},
+		{"queue_timeout", "time a request waits for a slot", (*durationValue)(&c.QueueTimeout)},
+		{"read_timeout", "time to read a whole request", (*durationValue)(&c.ReadTimeout)},
+		{"read_header_timeout", "time to read the request headers", (*durationValue)(&c.ReadHeaderTimeout)},
+		{"write_timeout", "time to write a response", (*durationValue)(&c.WriteTimeout)},
+		{"idle_timeout", "time an idle keep-alive connection stays open", (*durationValue)(&c.IdleTimeout)},
+		{"shutdown_timeout", "time the in-flight requests get to finish on shutdown", (*durationValue)(&c.ShutdownTimeout)},
+		{"shutdown_delay", "time the server keeps serving with /readyz failing before draining on shutdown", (*durationValue)(&c.ShutdownDelay)},
+		{"max_header_bytes", "largest request headers in bytes", (*intValue)(&c.MaxHeaderBytes)},
+		{"rate_limit", "requests per period and client, by API key or else IP, 0 for no limit", (*intValue)(&c.RateLimit)},
+		{"rate_limit_period", "period of rate_limit", (*durationValue)(&c.RateLimitPeriod)},
+		{"trusted_proxies", "comma-separated IPs or CIDRs of the proxies whose X-Forwarded-For is trusted", (*stringValue)(&c.TrustedProxies)},
+		{"redis_addr", "Redis host:port keeping the rate limits, in memory if empty", (*stringValue)(&c.RedisAddr)},
+		{"otel_exporter", "where the trace spans go: none, stdout or otlp", (*stringValue)(&c.OTelExporter)},
+		{"upstream_url", "base URL of the items service, a simulated one if empty", (*stringValue)(&c.UpstreamURL)},
+		{"upstream_timeout", "longest attempt of a call to the items service", (*durationValue)(&c.UpstreamTimeout)},
+		{"upstream_max_in_flight", "most calls to the items service at once, 0 for no limit", (*intValue)(&c.UpstreamMaxInFlight)},
+	}
+}
+
+func (s setting) flagName() string {
+	return strings.ReplaceAll(s.key, "_", "-")
+}
+
+func (s setting) envName() string {
+	return envPrefix + strings.ToUpper(s.key)
+}
+
+// loadConfig builds the config from, by increasing precedence, the defaults,
+// the config file (-config or HTTP_CONFIG, YAML or TOML by its extension),
+// the environment and the flags. It reports every invalid setting at once.
+// printConfig is set by --print-config.
+func loadConfig(args []string, getenv func(string) string) (cfg *config, printConfig bool, err error) {
+	cfg = defaultConfig()
+	settings := cfg.settings()
+
+	// The flags are parsed first to find the file, and applied last
+	fs := flag.NewFlagSet("http-server", flag.ContinueOnError)
+	flagValues := map[string]*string{}
+	for _, s := range settings {
+		flagValues[s.key] = fs.String(s.flagName(), s.value.String(), fmt.Sprintf("%s (env %s)", s.usage, s.envName()))
+	}
+	file := fs.String("config", getenv(envPrefix+"CONFIG"), "YAML or TOML config file (env "+envPrefix+"CONFIG)")
+	fs.BoolVar(&printConfig, "print-config", false, "print the effective config and exit")
+	if err := fs.Parse(args); err != nil {
+		return nil, false, err
+	}
+	if fs.NArg() > 0 {
+		return nil, false, fmt.Errorf("unexpected arguments %q", fs.Args())
+	}
+
+	var errs []error
+	set := func(s setting, value, source string) {
+		if err := s.value.Set(value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", source, err))
+
+			return
+		}
+		cfg.sources[s.key] = source
+	}
+
+	if *file != "" {
+		cfg.File = *file
+		values, err := readConfigFile(*file)
+		if err != nil {
+			return nil, false, err
+		}
+		for _, s := range settings {
+			if v, ok := values[s.key]; ok {
+				set(s, v, fmt.Sprintf("file %s key %s", filepath.Base(*file), s.key))
+				delete(values, s.key)
+			}
+		}
+		for _, key := range slices.Sorted(maps.Keys(values)) {
+			errs = append(errs, fmt.Errorf("file %s: unknown key %s", filepath.Base(*file), key))
+		}
+	}
+
+	for _, s := range settings {
+		if v := getenv(s.envName()); v != "" {
+			set(s, v, "env "+s.envName())
+		}
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.flagName() == f.Name {
+				set(s, *flagValues[s.key], "flag -"+f.Name)
+			}
+		}
+	})
+
+	// A setting that failed to parse kept its valid default
+	errs = append(errs, cfg.validate()...)
+	if err := errors.Join(errs...); err != nil {
+		return nil, false, fmt.Errorf("invalid config:\n%w", err)
+	}
+
+	return cfg, printConfig, nil
+}
+
+// readConfigFile reads the flat key/value file as strings, parsed like the
+// flags and the environment.
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file: %w", err)
+	}
+
+	raw := map[string]any{}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		if err := yaml.NewDecoder(bytes.NewReader(data)).Decode(&raw); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("error parsing config file %s: %w", path, err)
+		}
+	case ".toml":
+		if err := toml.Unmarshal(data, &raw); err != nil {
+			return nil, fmt.Errorf("error parsing config file %s: %w", path, err)
+		}
+	default:
+		return nil, fmt.Errorf("config file %s must be .yaml, .yml or .toml", path)
+	}
+
+	values := make(map[string]string, len(raw))
+	for key, v := range raw {
+		switch v.(type) {
+		case string, int, int64, float64, bool:
+			values[key] = fmt.Sprint(v)
+		default:
+			return nil, fmt.Errorf("config file %s: %s must be a single value", path, key)
+		}
+	}
+
+	return values, nil
+}
+
+// validate checks the settings together, naming where the bad ones came
+// from.
+func (c *config) validate() []error {
+	var errs []error
+	check := func(ok bool, key, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s (%s): %s", key, c.source(key), fmt.Sprintf(format, args...)))
+		}
+	}
+
+	_, port, err := net.SplitHostPort(c.Addr)
+	check(err == nil, "addr", "%q is not a host:port address", c.Addr)
+	if err == nil {
+		n, err := strconv.Atoi(port)
+		check(err == nil && n >= 0 && n <= 65535, "addr", "invalid port %q", port)
+	}
+	if c.AdminAddr != "" {
+		_, _, err := net.SplitHostPort(c.AdminAddr)
+		check(err == nil, "admin_addr", "%q is not a host:port address", c.AdminAddr)
+		check(c.AdminAddr != c.Addr, "admin_addr", "must differ from addr %s", c.Addr)
+	}
+	check(c.MaxInFlight >= 1, "max_in_flight", "must be at least 1, got %d", c.MaxInFlight)
+	check(c.QueueSize >= 0, "queue_size", "must not be negative, got %d", c.QueueSize)
+	check(c.QueueTimeout >= 0, "queue_timeout", "must not be negative, got %s", c.QueueTimeout)
+	check(c.ReadTimeout > 0, "read_timeout", "must be positive, got %s", c.ReadTimeout)
+	check(c.ReadHeaderTimeout > 0, "read_header_timeout", "must be positive, got %s", c.ReadHeaderTimeout)
+	check(c.ReadHeaderTimeout <= c.ReadTimeout, "read_header_timeout", "%s is longer than read_timeout %s", c.ReadHeaderTimeout, c.ReadTimeout)
+	check(c.WriteTimeout > 0, "write_timeout", "must be positive, got %s", c.WriteTimeout)
+	check(c.IdleTimeout >= 0, "idle_timeout", "must not be negative, got %s", c.IdleTimeout)
+	check(c.ShutdownTimeout > 0, "shutdown_timeout", "must be positive, got %s", c.ShutdownTimeout)
+	check(c.ShutdownDelay >= 0, "shutdown_delay", "must not be negative, got %s", c.ShutdownDelay)
+	check(c.RateLimit >= 0, "rate_limit", "must not be negative, got %d", c.RateLimit)
+	check(c.RateLimitPeriod > 0, "rate_limit_period", "must be positive, got %s", c.RateLimitPeriod)
+	_, err = c.trustedProxies()
+	check(err == nil, "trusted_proxies", "%v", err)
+	if c.RedisAddr != "" {
+		_, _, err := net.SplitHostPort(c.RedisAddr)
+		check(err == nil, "redis_addr", "%q is not a host:port address", c.RedisAddr)
+	}
+	check(slices.Contains([]string{exporterNone, exporterStdout, exporterOTLP}, c.OTelExporter), "otel_exporter", "must be none, stdout or otlp, got %q", c.OTelExporter)
+	if c.UpstreamURL != "" {
+		u, err := url.Parse(c.UpstreamURL)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "upstream_url", "%q is not an http(s) URL", c.UpstreamURL)
+	}
+	check(c.UpstreamTimeout > 0, "upstream_timeout", "must be positive, got %s", c.UpstreamTimeout)
+	check(c.UpstreamMaxInFlight >= 0, "upstream_max_in_flight", "must not be negative, got %d", c.UpstreamMaxInFlight)
+	check(c.MaxHeaderBytes >= 4<<10 && c.MaxHeaderBytes <= 64<<20, "max_header_bytes", "must be between 4 KiB and 64 MiB, got %d", c.MaxHeaderBytes)
+
+	return errs
+}
+
+// trustedProxies parses TrustedProxies, a single IP being a prefix of
+// itself.
+func (c *config) trustedProxies() ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range strings.Split(c.TrustedProxies, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		if addr, err := netip.ParseAddr(s); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+
+			continue
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("%q is neither an IP nor a CIDR", s)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+
+	return prefixes, nil
+}
+
+func (c *config) source(key string) string {
+	if s, ok := c.sources[key]; ok {
+		return s
+	}
+
+	return "default"
+}
+
+// print writes the effective config as YAML, which is a valid config file,
+// with the source of every setting.
+func (c *config) print(w io.Writer) error {
+	var buf bytes.Buffer
+	if c.File != "" {
+		fmt.Fprintf(&buf, "# config file: %s\n", c.File)
+	}
+	for _, s := range c.settings() {
+		value := []byte(s.value.String())
+		if _, ok := s.value.(*stringValue); ok {
+			quoted, err := yaml.Marshal(s.value.String())
+			if err != nil {
+				return err
+			}
+			value = bytes.TrimSpace(quoted)
+		}
+		fmt.Fprintf(&buf, "%s: %s # %s\n", s.key, value, c.source(s.key))
+	}
+	_, err := w.Write(buf.Bytes())
+
+	return err
+}
+
+// ---- flag values ----
+
+type stringValue string
+
+func (v *stringValue) String() string { return string(*v) }
+
+func (v *stringValue) Set(s string) error {
+	*v = stringValue(s)
+
+	return nil
+}
+
+type intValue int
+
+func (v *intValue) String() string { return strconv.Itoa(int(*v)) }
+
+func (v *intValue) Set(s string) error {
+	n, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil {
+		return fmt.Errorf("invalid integer %q", s)
+	}
+	*v = intValue(n)
+
+	return nil
+}
+
+type durationValue time.Duration
+
+func (v *durationValue) String() string { return time.Duration(*v).String() }
+
+func (v *durationValue) Set(s string) error {
+	d, err := time.ParseDuration(strings.TrimSpace(s))
+	if err != nil {
+		return fmt.Errorf("invalid duration %q, use e.g. 5s or 500ms", s)
+	}
+	*v = durationValue(d)
+
+	return nil
+}
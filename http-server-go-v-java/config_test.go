@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func env(vars map[string]string) func(string) string {
+	return func(key string) string {
+		return vars[key]
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	yamlFile := writeFile(t, "server.yaml", "addr: \":9000\"\nmax_in_flight: 10\nread_timeout: 3s\nidle_timeout: 2m\n")
+	tomlFile := writeFile(t, "server.toml", "addr = \":9000\"\nmax_in_flight = 10\nread_timeout = \"3s\"\nidle_timeout = \"2m\"\n")
+
+	for _, file := range []string{yamlFile, tomlFile} {
+		t.Run(filepath.Ext(file), func(t *testing.T) {
+			vars := map[string]string{
+				"HTTP_CONFIG":        file,
+				"HTTP_MAX_IN_FLIGHT": "20",
+				"HTTP_READ_TIMEOUT":  "4s",
+			}
+			cfg, printConfig, err := loadConfig([]string{"-read-timeout", "6s"}, env(vars))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tests := []struct {
+				key    string
+				got    any
+				want   any
+				source string
+			}{
+				{"addr", cfg.Addr, ":9000", "file " + filepath.Base(file) + " key addr"},
+				{"max_in_flight", cfg.MaxInFlight, 20, "env HTTP_MAX_IN_FLIGHT"},
+				{"queue_timeout", cfg.QueueTimeout, 50 * time.Millisecond, "default"},
+				{"read_timeout", cfg.ReadTimeout, 6 * time.Second, "flag -read-timeout"},
+				{"idle_timeout", cfg.IdleTimeout, 2 * time.Minute, "file " + filepath.Base(file) + " key idle_timeout"},
+				{"write_timeout", cfg.WriteTimeout, 10 * time.Second, "default"},
+			}
+			for _, tt := range tests {
+				if tt.got != tt.want || cfg.source(tt.key) != tt.source {
+					t.Errorf("%s = %v from %s, want %v from %s", tt.key, tt.got, cfg.source(tt.key), tt.want, tt.source)
+				}
+			}
+			if printConfig {
+				t.Error("printConfig = true, want false")
+			}
+		})
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+		file string
+		want []string
+	}{
+		{
+			name: "invalid values",
+			args: []string{"-addr", "localhost", "-max-in-flight", "0"},
+			env:  map[string]string{"HTTP_READ_TIMEOUT": "5", "HTTP_MAX_HEADER_BYTES": "10", "HTTP_TRUSTED_PROXIES": "10.0.0.0/8, nope", "HTTP_SHUTDOWN_DELAY": "-1s", "HTTP_UPSTREAM_URL": "items:8080"},
+			want: []string{
+				`env HTTP_READ_TIMEOUT: invalid duration "5"`,
+				`addr (flag -addr): "localhost" is not a host:port address`,
+				"max_in_flight (flag -max-in-flight): must be at least 1, got 0",
+				"max_header_bytes (env HTTP_MAX_HEADER_BYTES): must be between 4 KiB and 64 MiB, got 10",
+				`trusted_proxies (env HTTP_TRUSTED_PROXIES): "nope" is neither an IP nor a CIDR`,
+				"shutdown_delay (env HTTP_SHUTDOWN_DELAY): must not be negative, got -1s",
+				`upstream_url (env HTTP_UPSTREAM_URL): "items:8080" is not an http(s) URL`,
+			},
+		},
+		{
+			name: "inconsistent timeouts",
+			env:  map[string]string{"HTTP_READ_HEADER_TIMEOUT": "10s"},
+			want: []string{"read_header_timeout (env HTTP_READ_HEADER_TIMEOUT): 10s is longer than read_timeout 5s"},
+		},
+		{
+			name: "unknown keys",
+			file: "server.yaml",
+			want: []string{"file server.yaml: unknown key max_inflight", "file server.yaml: unknown key port"},
+		},
+		{
+			name: "unsupported file",
+			file: "server.json",
+			want: []string{"must be .yaml, .yml or .toml"},
+		},
+		{
+			name: "arguments",
+			args: []string{"serve"},
+			want: []string{`unexpected arguments ["serve"]`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := tt.args
+			if tt.file != "" {
+				args = append(args, "-config", writeFile(t, tt.file, "max_inflight: 1\nport: 80\n"))
+			}
+
+			_, _, err := loadConfig(args, env(tt.env))
+			if err == nil {
+				t.Fatal("loadConfig() error = nil, want an error")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("loadConfig() error = %q, want it to contain %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestPrintConfig(t *testing.T) {
+	cfg, printConfig, err := loadConfig([]string{"--print-config", "-addr", "127.0.0.1:9000", "-shutdown-timeout", "30s"}, env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !printConfig {
+		t.Error("printConfig = false, want true")
+	}
+
+	var buf bytes.Buffer
+	if err := cfg.print(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"addr: 127.0.0.1:9000 # flag -addr\n", "shutdown_timeout: 30s # flag -shutdown-timeout\n", "max_in_flight: 100 # default\n"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("print() = %q, want it to contain %q", buf.String(), want)
+		}
+	}
+
+	// The output is a valid config file giving the same config
+	file := writeFile(t, "printed.yaml", buf.String())
+	reloaded, _, err := loadConfig([]string{"-config", file}, env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.Addr != cfg.Addr || reloaded.ShutdownTimeout != cfg.ShutdownTimeout || reloaded.IdleTimeout != cfg.IdleTimeout {
+		t.Errorf("reloaded config = %+v, want %+v", reloaded, cfg)
+	}
+}
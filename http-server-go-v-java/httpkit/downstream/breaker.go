@@ -0,0 +1,139 @@
+package downstream
+
+import (
+	"sync"
+	"time"
+)
+
+// State is the state of the circuit breaker of a Client.
+type State int
+
+const (
+	// StateClosed lets the calls through.
+	StateClosed State = iota
+	// StateOpen fails the calls at once, for the downstream to recover.
+	StateOpen
+	// StateHalfOpen lets one call through to probe the downstream.
+	StateHalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateOpen:
+		return "open"
+	case StateHalfOpen:
+		return "half-open"
+	}
+
+	return "unknown"
+}
+
+// outcome is what a call tells about the health of the downstream.
+type outcome int
+
+const (
+	succeeded outcome = iota
+	failed
+	// ignored is a call telling nothing, like one the caller gave up
+	ignored
+)
+
+// breaker opens once ratio of the last window calls failed, and after
+// cooldown lets a probe through, whose success closes it again.
+type breaker struct {
+	mu       sync.Mutex
+	state    State
+	outcomes []bool // the last calls, true if failed
+	next     int
+	failures int
+	openedAt time.Time
+	probing  bool
+
+	window   int
+	ratio    float64
+	cooldown time.Duration
+	now      func() time.Time
+}
+
+// allow tells whether a call may go through, the state before and after.
+// The call must be recorded.
+func (b *breaker) allow() (ok bool, from, to State) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	from = b.state
+	if b.window == 0 {
+		return true, from, from
+	}
+
+	if b.state == StateOpen {
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return false, from, from
+		}
+		b.state = StateHalfOpen
+	}
+	if b.state == StateHalfOpen {
+		if b.probing {
+			return false, from, b.state
+		}
+		b.probing = true
+	}
+
+	return true, from, b.state
+}
+
+// record counts the outcome of an allowed call, and returns the state
+// before and after.
+func (b *breaker) record(o outcome) (from, to State) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	from = b.state
+	if b.window == 0 {
+		return from, from
+	}
+
+	switch b.state {
+	case StateHalfOpen:
+		b.probing = false
+		switch o {
+		case succeeded:
+			b.state = StateClosed
+			b.outcomes = b.outcomes[:0]
+			b.next, b.failures = 0, 0
+		case failed:
+			b.open()
+		}
+	case StateClosed:
+		if o == ignored {
+			break
+		}
+		if len(b.outcomes) < b.window {
+			b.outcomes = append(b.outcomes, false)
+		} else if b.outcomes[b.next] {
+			b.failures--
+		}
+		b.outcomes[b.next] = o == failed
+		if o == failed {
+			b.failures++
+		}
+		b.next = (b.next + 1) % b.window
+		if len(b.outcomes) == b.window && float64(b.failures) >= b.ratio*float64(b.window) {
+			b.open()
+		}
+	}
+
+	return from, b.state
+}
+
+func (b *breaker) open() {
+	b.state = StateOpen
+	b.openedAt = b.now()
+}
+
+func (b *breaker) current() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state
+}
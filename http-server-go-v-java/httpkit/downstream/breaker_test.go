@@ -0,0 +1,65 @@
+package downstream
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	const s, f, i = succeeded, failed, ignored
+
+	tests := []struct {
+		name     string
+		outcomes []outcome
+		want     State
+	}{
+		{"no calls", nil, StateClosed},
+		{"half failed", []outcome{f, s, f, s}, StateOpen},
+		{"window not full", []outcome{f, f, f}, StateClosed},
+		{"failures out of the window", []outcome{f, s, s, s, f, s}, StateClosed},
+		{"ignored calls don't count", []outcome{f, i, i, s, f}, StateClosed},
+		{"failures in the window", []outcome{s, s, s, s, f, s, f}, StateOpen},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &breaker{window: 4, ratio: 0.5, cooldown: time.Second, now: time.Now}
+			for _, o := range tt.outcomes {
+				if ok, _, _ := b.allow(); !ok {
+					t.Fatalf("call refused in state %s", b.current())
+				}
+				b.record(o)
+			}
+			if got := b.current(); got != tt.want {
+				t.Errorf("state = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBreakerHalfOpen(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := &breaker{window: 1, ratio: 1, cooldown: time.Second, now: func() time.Time { return now }}
+	b.allow()
+	b.record(failed)
+
+	if ok, _, _ := b.allow(); ok {
+		t.Error("call allowed during the cooldown")
+	}
+	now = now.Add(time.Second)
+	if ok, from, to := b.allow(); !ok || from != StateOpen || to != StateHalfOpen {
+		t.Errorf("probe = %v from %s to %s, want allowed from open to half-open", ok, from, to)
+	}
+	if ok, _, _ := b.allow(); ok {
+		t.Error("second call allowed during the probe")
+	}
+
+	// A probe given up on lets another one through
+	b.record(ignored)
+	if ok, _, _ := b.allow(); !ok {
+		t.Error("no probe after an ignored one")
+	}
+	if from, to := b.record(succeeded); from != StateHalfOpen || to != StateClosed {
+		t.Errorf("successful probe from %s to %s, want from half-open to closed", from, to)
+	}
+}
@@ -0,0 +1,423 @@
+// Package downstream is the HTTP client of a service calling others. Every
+// downstream gets a Client bounding its calls by the deadline of the
+// inbound request, retrying them within a budget, failing them fast through
+// a circuit breaker and a bulkhead while the downstream struggles, and
+// passing the request ID and the trace on.
+package downstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/flashlabs/kiss-samples/http-server-go-v-java/httpkit"
+)
+
+// tracerName is the instrumentation scope of the spans.
+const tracerName = "github.com/flashlabs/kiss-samples/http-server-go-v-java/httpkit/downstream"
+
+var (
+	// ErrCircuitOpen fails the calls while the circuit breaker is open.
+	ErrCircuitOpen = errors.New("circuit breaker open")
+	// ErrBulkheadFull fails the calls over the bulkhead.
+	ErrBulkheadFull = errors.New("too many calls in flight")
+	// ErrNoTime fails the calls made too close to the deadline to succeed.
+	ErrNoTime = errors.New("no time left before the deadline")
+)
+
+// Client calls one downstream service. Every attempt of a call gets the
+// timeout of the client, cut to the deadline of the context less a reserve
+// for the caller to answer. The calls that failed, timed out or were told
+// to come back (429, 502, 503, 504) are retried after a random backoff if
+// they are idempotent, within the retry budget and the deadline. Failures
+// and 5xx responses open the circuit breaker.
+type Client struct {
+	name     string
+	baseURL  string
+	client   *http.Client
+	timeout  time.Duration
+	reserve  time.Duration
+	retries  int
+	backoff  [2]time.Duration
+	budget   *retryBudget
+	breaker  *breaker
+	bulkhead chan struct{}
+	wait     time.Duration
+
+	requestIDHeader string
+	propagator      propagation.TextMapPropagator
+	provider        trace.TracerProvider
+	tracer          trace.Tracer
+	jitter          func() float64
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient sets the client making the calls, one sharing
+// http.DefaultTransport by default. Its Timeout had better be 0, the calls
+// being bounded by their context.
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *Client) {
+		c.client = client
+	}
+}
+
+// WithTimeout sets the longest attempt, 1 second by default.
+func WithTimeout(d time.Duration) Option {
+	return func(c *Client) {
+		c.timeout = d
+	}
+}
+
+// WithDeadlineReserve sets the time left to the caller before the deadline
+// of its context, to answer once the call failed, 50ms by default.
+func WithDeadlineReserve(d time.Duration) Option {
+	return func(c *Client) {
+		c.reserve = d
+	}
+}
+
+// WithRetries sets the most retries of a call, 2 by default, and the
+// backoff before them, random up to base doubling with every retry up to
+// limit, 25ms and 1s by default. 0 retries disables them.
+func WithRetries(n int, base, limit time.Duration) Option {
+	return func(c *Client) {
+		c.retries = n
+		c.backoff = [2]time.Duration{base, limit}
+	}
+}
+
+// WithRetryBudget caps the retries at ratio of the calls, 0.2 by default,
+// allowing burst at once, 10 by default.
+func WithRetryBudget(ratio float64, burst int) Option {
+	return func(c *Client) {
+		c.budget = newRetryBudget(ratio, burst)
+	}
+}
+
+// WithBreaker opens the circuit breaker once ratio of the last window calls
+// failed, and lets a probe through after cooldown, 50% of 20 calls and 5
+// seconds by default. A window of 0 disables it.
+func WithBreaker(ratio float64, window int, cooldown time.Duration) Option {
+	return func(c *Client) {
+		c.breaker.ratio = ratio
+		c.breaker.window = window
+		c.breaker.cooldown = cooldown
+	}
+}
+
+// WithBulkhead allows max calls in flight, until their response is closed,
+// the others waiting up to wait for a slot, so that a slow downstream can't
+// hold every request of the server. Unlimited by default or if max is 0.
+func WithBulkhead(max int, wait time.Duration) Option {
+	return func(c *Client) {
+		c.bulkhead = nil
+		if max > 0 {
+			c.bulkhead = make(chan struct{}, max)
+		}
+		c.wait = wait
+	}
+}
+
+// WithRequestIDHeader sets the header passing the ID of the request on,
+// X-Request-ID by default.
+func WithRequestIDHeader(name string) Option {
+	return func(c *Client) {
+		c.requestIDHeader = name
+	}
+}
+
+// WithTracerProvider sets the provider of the tracer, the global one of
+// otel by default.
+func WithTracerProvider(provider trace.TracerProvider) Option {
+	return func(c *Client) {
+		c.provider = provider
+	}
+}
+
+// WithPropagator sets how the trace context is written to the calls, the
+// global propagator of otel by default.
+func WithPropagator(propagator propagation.TextMapPropagator) Option {
+	return func(c *Client) {
+		c.propagator = propagator
+	}
+}
+
+// New creates the client of the downstream name at baseURL, which the paths
+// of NewRequest are appended to.
+func New(name, baseURL string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("downstream %s: %q is not an http(s) URL", name, baseURL)
+	}
+
+	c := &Client{
+		name:            name,
+		baseURL:         strings.TrimSuffix(baseURL, "/"),
+		client:          &http.Client{},
+		timeout:         time.Second,
+		reserve:         50 * time.Millisecond,
+		retries:         2,
+		backoff:         [2]time.Duration{25 * time.Millisecond, time.Second},
+		budget:          newRetryBudget(0.2, 10),
+		breaker:         &breaker{window: 20, ratio: 0.5, cooldown: 5 * time.Second, now: time.Now},
+		requestIDHeader: "X-Request-ID",
+		propagator:      otel.GetTextMapPropagator(),
+		provider:        otel.GetTracerProvider(),
+		jitter:          rand.Float64,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.tracer = c.provider.Tracer(tracerName)
+
+	return c, nil
+}
+
+// Name returns the name of the downstream.
+func (c *Client) Name() string {
+	return c.name
+}
+
+// State returns the state of the circuit breaker.
+func (c *Client) State() State {
+	return c.breaker.current()
+}
+
+// NewRequest creates a request of path at the base URL.
+func (c *Client) NewRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	return http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+}
+
+// Get gets path at the base URL.
+func (c *Client) Get(ctx context.Context, path string) (*http.Response, error) {
+	req, err := c.NewRequest(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.Do(req)
+}
+
+// Do makes the call, retrying it if need be. The response of the last
+// attempt is returned, whatever its status, and must be closed. A request
+// with a body is only retried if it has GetBody, as from http.NewRequest,
+// and an idempotent method or an Idempotency-Key header.
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	release, err := c.acquire(ctx)
+	if err != nil {
+		return nil, c.wrap(err)
+	}
+	c.budget.deposit()
+	replayable := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+	canRetry := replayable && (idempotent[req.Method] || req.Header.Get("Idempotency-Key") != "")
+
+	for attempt := 0; ; attempt++ {
+		resp, cancel, err := c.attempt(ctx, req, attempt)
+
+		retry, wait := retryable(ctx, resp, err)
+		delay := max(wait, backoff(c.backoff[0], c.backoff[1], attempt, c.jitter()))
+		if !canRetry || !retry || errors.Is(err, ErrCircuitOpen) || errors.Is(err, ErrNoTime) ||
+			attempt >= c.retries || !c.fits(ctx, delay) || !c.budget.withdraw() {
+			if err != nil {
+				release()
+
+				return nil, c.wrap(err)
+			}
+			resp.Body = &body{ReadCloser: resp.Body, done: func() {
+				cancel()
+				release()
+			}}
+
+			return resp, nil
+		}
+
+		logger := httpkit.LoggerFromContext(ctx).With(slog.String("downstream", c.name), slog.Int("attempt", attempt+1))
+		if err != nil {
+			logger.Debug("retrying", slog.Duration("delay", delay), slog.String("error", err.Error()))
+		} else {
+			logger.Debug("retrying", slog.Duration("delay", delay), slog.Int("status", resp.StatusCode))
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+			_ = resp.Body.Close()
+			cancel()
+		}
+		if err := sleep(ctx, delay); err != nil {
+			release()
+
+			return nil, c.wrap(err)
+		}
+	}
+}
+
+// attempt makes one attempt of the call through the circuit breaker. cancel
+// ends the attempt once its response is read.
+func (c *Client) attempt(ctx context.Context, req *http.Request, n int) (resp *http.Response, cancel context.CancelFunc, err error) {
+	ok, from, to := c.breaker.allow()
+	c.logState(ctx, from, to)
+	if !ok {
+		return nil, nil, ErrCircuitOpen
+	}
+	result := ignored
+	defer func() {
+		from, to := c.breaker.record(result)
+		c.logState(ctx, from, to)
+	}()
+
+	attemptCtx, cancel, err := c.attemptContext(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	r := req.Clone(attemptCtx)
+	if n > 0 && req.GetBody != nil {
+		if r.Body, err = req.GetBody(); err != nil {
+			cancel()
+
+			return nil, nil, err
+		}
+	}
+
+	spanCtx, span := c.tracer.Start(attemptCtx, r.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("server.address", r.URL.Hostname()),
+			attribute.String("url.full", r.URL.Redacted()),
+			attribute.String("peer.service", c.name),
+		),
+	)
+	defer span.End()
+	if n > 0 {
+		span.SetAttributes(attribute.Int("http.request.resend_count", n))
+	}
+	if port, err := strconv.Atoi(r.URL.Port()); err == nil {
+		span.SetAttributes(attribute.Int("server.port", port))
+	}
+	c.propagator.Inject(spanCtx, propagation.HeaderCarrier(r.Header))
+	if id := httpkit.RequestIDFromContext(ctx); id != "" && r.Header.Get(c.requestIDHeader) == "" {
+		r.Header.Set(c.requestIDHeader, id)
+	}
+
+	resp, err = c.client.Do(r)
+	if err != nil {
+		cancel()
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		if ctx.Err() == nil {
+			result = failed
+		}
+
+		return nil, nil, err
+	}
+
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	switch {
+	case resp.StatusCode >= http.StatusInternalServerError:
+		span.SetStatus(codes.Error, "")
+		result = failed
+	case resp.StatusCode != http.StatusTooManyRequests:
+		result = succeeded
+	}
+
+	return resp, cancel, nil
+}
+
+// attemptContext bounds an attempt by the timeout, and by the deadline of
+// ctx less the reserve.
+func (c *Client) attemptContext(ctx context.Context) (context.Context, context.CancelFunc, error) {
+	deadline := time.Now().Add(c.timeout)
+	if d, ok := ctx.Deadline(); ok {
+		d = d.Add(-c.reserve)
+		if !d.After(time.Now()) {
+			return nil, nil, ErrNoTime
+		}
+		if d.Before(deadline) {
+			deadline = d
+		}
+	}
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+
+	return ctx, cancel, nil
+}
+
+// fits tells whether an attempt still fits before the deadline of ctx after
+// waiting delay.
+func (c *Client) fits(ctx context.Context, delay time.Duration) bool {
+	d, ok := ctx.Deadline()
+
+	return !ok || time.Now().Add(delay).Before(d.Add(-c.reserve))
+}
+
+// acquire takes a slot of the bulkhead, if any, released by release.
+func (c *Client) acquire(ctx context.Context) (release func(), err error) {
+	if c.bulkhead == nil {
+		return func() {}, nil
+	}
+	release = func() { <-c.bulkhead }
+
+	select {
+	case c.bulkhead <- struct{}{}:
+		return release, nil
+	default:
+	}
+	if c.wait <= 0 {
+		return nil, ErrBulkheadFull
+	}
+	timer := time.NewTimer(c.wait)
+	defer timer.Stop()
+	select {
+	case c.bulkhead <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+		return nil, ErrBulkheadFull
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *Client) logState(ctx context.Context, from, to State) {
+	if from == to {
+		return
+	}
+	level := slog.LevelInfo
+	if to == StateOpen {
+		level = slog.LevelWarn
+	}
+	httpkit.LoggerFromContext(ctx).Log(ctx, level, "circuit breaker",
+		slog.String("downstream", c.name), slog.String("from", from.String()), slog.String("to", to.String()))
+}
+
+func (c *Client) wrap(err error) error {
+	return fmt.Errorf("downstream %s: %w", c.name, err)
+}
+
+// body calls done once the response is closed, ending the attempt and
+// freeing its bulkhead slot.
+type body struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (b *body) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.done)
+
+	return err
+}
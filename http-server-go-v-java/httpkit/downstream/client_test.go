@@ -0,0 +1,391 @@
+package downstream
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/flashlabs/kiss-samples/http-server-go-v-java/httpkit"
+)
+
+// upstream serves with handler, given the number of the call from 1, and
+// counts the calls.
+func upstream(t *testing.T, handler func(n int, w http.ResponseWriter, r *http.Request)) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+
+	var calls atomic.Int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler(int(calls.Add(1)), w, r)
+	}))
+	t.Cleanup(s.Close)
+
+	return s, &calls
+}
+
+// failing fails the first n calls with status, 0 dropping the connection
+// and -1 taking too long.
+func failing(n, status int) func(int, http.ResponseWriter, *http.Request) {
+	return func(call int, w http.ResponseWriter, r *http.Request) {
+		if body, _ := io.ReadAll(r.Body); r.Method == http.MethodPost && string(body) != "payload" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if call > n {
+			_, _ = io.WriteString(w, "ok")
+			return
+		}
+		switch status {
+		case 0:
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			_ = conn.Close()
+		case -1:
+			time.Sleep(300 * time.Millisecond)
+		default:
+			w.WriteHeader(status)
+		}
+	}
+}
+
+func TestClientRetries(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		key        string
+		handler    func(int, http.ResponseWriter, *http.Request)
+		wantCalls  int32
+		wantStatus int
+		wantErr    bool
+	}{
+		{"success", http.MethodGet, "", failing(0, 0), 1, 200, false},
+		{"unavailable then ok", http.MethodGet, "", failing(2, http.StatusServiceUnavailable), 3, 200, false},
+		{"bad gateway then ok", http.MethodGet, "", failing(1, http.StatusBadGateway), 2, 200, false},
+		{"always unavailable", http.MethodGet, "", failing(5, http.StatusServiceUnavailable), 3, 503, false},
+		{"server error not retried", http.MethodGet, "", failing(1, http.StatusInternalServerError), 1, 500, false},
+		{"client error not retried", http.MethodGet, "", failing(1, http.StatusNotFound), 1, 404, false},
+		{"connection dropped", http.MethodGet, "", failing(1, 0), 2, 200, false},
+		{"attempt timeout", http.MethodGet, "", failing(1, -1), 2, 200, false},
+		{"always dropped", http.MethodGet, "", failing(5, 0), 3, 0, true},
+		{"post not retried", http.MethodPost, "", failing(1, http.StatusServiceUnavailable), 1, 503, false},
+		{"post with an idempotency key", http.MethodPost, "key-1", failing(1, http.StatusServiceUnavailable), 2, 200, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, calls := upstream(t, tt.handler)
+			c, err := New("items", s.URL,
+				WithTimeout(100*time.Millisecond),
+				WithRetries(2, time.Millisecond, time.Millisecond),
+				WithBreaker(0, 0, 0),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req, err := c.NewRequest(context.Background(), tt.method, "/items/1", strings.NewReader("payload"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.key != "" {
+				req.Header.Set("Idempotency-Key", tt.key)
+			}
+			resp, err := c.Do(req)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Do() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil {
+				// The body outlives Do
+				body, err := io.ReadAll(resp.Body)
+				_ = resp.Body.Close()
+				if err != nil {
+					t.Errorf("reading the body: %v", err)
+				}
+				if resp.StatusCode != tt.wantStatus || tt.wantStatus == 200 && string(body) != "ok" {
+					t.Errorf("response = %d %q, want %d", resp.StatusCode, body, tt.wantStatus)
+				}
+			}
+			if got := calls.Load(); got != tt.wantCalls {
+				t.Errorf("%d calls, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestClientRetryBudget(t *testing.T) {
+	s, calls := upstream(t, failing(100, http.StatusServiceUnavailable))
+	c, err := New("items", s.URL, WithRetries(2, time.Millisecond, time.Millisecond), WithRetryBudget(0, 1), WithBreaker(0, 0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The budget allows one retry, and the calls add nothing to it
+	for i, want := range []int32{2, 3, 4} {
+		resp, err := c.Get(context.Background(), "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if got := calls.Load(); got != want {
+			t.Errorf("call %d: %d calls in all, want %d", i+1, got, want)
+		}
+	}
+}
+
+func TestClientRetryAfter(t *testing.T) {
+	s, calls := upstream(t, func(_ int, w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+	c, err := New("items", s.URL, WithRetries(2, time.Millisecond, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Waiting the second asked for would miss the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	resp, err := c.Get(ctx, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests || calls.Load() != 1 || time.Since(start) > 200*time.Millisecond {
+		t.Errorf("got %d after %d calls in %s, want the 429 at once", resp.StatusCode, calls.Load(), time.Since(start))
+	}
+}
+
+func TestClientDeadline(t *testing.T) {
+	s, calls := upstream(t, func(_ int, _ http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(2 * time.Second):
+		case <-r.Context().Done():
+		}
+	})
+	c, err := New("items", s.URL, WithTimeout(5*time.Second), WithDeadlineReserve(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		deadline  time.Duration
+		want      error
+		wantCalls int32
+		wantTook  time.Duration
+	}{
+		{"cut to the inbound deadline", 200 * time.Millisecond, context.DeadlineExceeded, 1, 150 * time.Millisecond},
+		{"no time left", 30 * time.Millisecond, ErrNoTime, 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls.Store(0)
+			ctx, cancel := context.WithTimeout(context.Background(), tt.deadline)
+			defer cancel()
+
+			start := time.Now()
+			_, err := c.Get(ctx, "/")
+			took := time.Since(start)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Get() = %v, want %v", err, tt.want)
+			}
+			if took < tt.wantTook || took > tt.wantTook+100*time.Millisecond {
+				t.Errorf("Get() took %s, want %s", took, tt.wantTook)
+			}
+			if got := calls.Load(); got != tt.wantCalls {
+				t.Errorf("%d calls, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestClientBreaker(t *testing.T) {
+	var down atomic.Bool
+	down.Store(true)
+	s, calls := upstream(t, func(_ int, w http.ResponseWriter, _ *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+	c, err := New("items", s.URL, WithBreaker(0.5, 4, 5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(0, 0)
+	c.breaker.now = func() time.Time { return now }
+
+	get := func() error {
+		resp, err := c.Get(context.Background(), "/")
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+
+		return err
+	}
+
+	for range 4 {
+		if err := get(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := get(); !errors.Is(err, ErrCircuitOpen) || c.State() != StateOpen || calls.Load() != 4 {
+		t.Errorf("after 4 failures: Get() = %v, state %s, %d calls, want open without a call", err, c.State(), calls.Load())
+	}
+
+	// A failed probe opens it again
+	now = now.Add(5 * time.Second)
+	if err := get(); err != nil || c.State() != StateOpen || calls.Load() != 5 {
+		t.Errorf("failed probe: Get() = %v, state %s, %d calls, want open after a call", err, c.State(), calls.Load())
+	}
+
+	now = now.Add(5 * time.Second)
+	down.Store(false)
+	if err := get(); err != nil || c.State() != StateClosed {
+		t.Errorf("probe: Get() = %v, state %s, want closed", err, c.State())
+	}
+}
+
+func TestClientBulkhead(t *testing.T) {
+	s, _ := upstream(t, failing(0, 0))
+
+	t.Run("full", func(t *testing.T) {
+		c, err := New("items", s.URL, WithBulkhead(1, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		first, err := c.Get(context.Background(), "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The slot is held until the body is closed
+		if _, err := c.Get(context.Background(), "/"); !errors.Is(err, ErrBulkheadFull) {
+			t.Errorf("Get() with the slot held = %v, want %v", err, ErrBulkheadFull)
+		}
+		_ = first.Body.Close()
+		resp, err := c.Get(context.Background(), "/")
+		if err != nil {
+			t.Fatalf("Get() with the slot freed = %v", err)
+		}
+		_ = resp.Body.Close()
+	})
+
+	t.Run("wait", func(t *testing.T) {
+		c, err := New("items", s.URL, WithBulkhead(1, time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		first, err := c.Get(context.Background(), "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.AfterFunc(50*time.Millisecond, func() { _ = first.Body.Close() })
+
+		resp, err := c.Get(context.Background(), "/")
+		if err != nil {
+			t.Fatalf("Get() waiting for the slot = %v", err)
+		}
+		_ = resp.Body.Close()
+	})
+}
+
+func TestClientPropagation(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		headers http.Header
+	)
+	s, _ := upstream(t, func(_ int, _ http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		headers = r.Header.Clone()
+	})
+	// The global propagator is the default, baggage included as main sets it
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	c, err := New("items", s.URL, WithTracerProvider(provider))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := httpkit.NewChain(
+		httpkit.Tracing(httpkit.WithTracerProvider(provider)),
+		httpkit.RequestID(),
+	).Then(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		resp, err := c.Get(r.Context(), "/items/1")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		_ = resp.Body.Close()
+	}))
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Request-ID", "req-42")
+	r.Header.Set("baggage", "tenant=acme")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want the client and server ones", len(spans))
+	}
+	client, server := spans[0], spans[1]
+	if client.SpanKind() != trace.SpanKindClient || client.Parent().SpanID() != server.SpanContext().SpanID() {
+		t.Errorf("client span %s of kind %s, want a client child of the server span", client.Name(), client.SpanKind())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if got := headers.Get("X-Request-ID"); got != "req-42" {
+		t.Errorf("X-Request-ID = %q, want req-42", got)
+	}
+	want := "00-" + client.SpanContext().TraceID().String() + "-" + client.SpanContext().SpanID().String() + "-01"
+	if got := headers.Get("traceparent"); got != want {
+		t.Errorf("traceparent = %q, want %q", got, want)
+	}
+	if got := headers.Get("baggage"); got != "tenant=acme" {
+		t.Errorf("baggage = %q, want tenant=acme", got)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempt int
+		random  float64
+		want    time.Duration
+	}{
+		{0, 1, 25 * time.Millisecond},
+		{1, 1, 50 * time.Millisecond},
+		{3, 1, 200 * time.Millisecond},
+		{3, 0.5, 100 * time.Millisecond},
+		{6, 1, time.Second},
+		{100, 1, time.Second},
+		{2, 0, 0},
+	}
+
+	for _, tt := range tests {
+		if got := backoff(25*time.Millisecond, time.Second, tt.attempt, tt.random); got != tt.want {
+			t.Errorf("backoff(%d, %v) = %s, want %s", tt.attempt, tt.random, got, tt.want)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, url := range []string{"", "localhost:8080", "ftp://host", "http://"} {
+		if _, err := New("items", url); err == nil {
+			t.Errorf("New(%q) = nil error, want one", url)
+		}
+	}
+}
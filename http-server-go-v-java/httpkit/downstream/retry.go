@@ -0,0 +1,95 @@
+package downstream
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// idempotent are the methods retried without an Idempotency-Key header.
+var idempotent = map[string]bool{
+	http.MethodGet: true, http.MethodHead: true, http.MethodOptions: true,
+	http.MethodPut: true, http.MethodDelete: true, http.MethodTrace: true,
+}
+
+// retryBudget caps the retries at ratio of the calls, so that a struggling
+// downstream doesn't get its load multiplied by them. It is a bucket of at
+// most burst tokens, the retries a quiet client may make at once: every
+// call adds ratio of a token and every retry takes one.
+type retryBudget struct {
+	mu     sync.Mutex
+	tokens float64
+	ratio  float64
+	burst  float64
+}
+
+func newRetryBudget(ratio float64, burst int) *retryBudget {
+	return &retryBudget{tokens: float64(burst), ratio: ratio, burst: float64(burst)}
+}
+
+func (b *retryBudget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = min(b.burst, b.tokens+b.ratio)
+}
+
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+
+	return true
+}
+
+// backoff is the delay before the retry after attempt, 0 being the first:
+// random up to base doubling with every attempt, capped at limit, so that
+// the clients retrying don't all come back at once.
+func backoff(base, limit time.Duration, attempt int, random float64) time.Duration {
+	d := limit
+	if attempt < 30 {
+		d = min(limit, base<<attempt)
+	}
+
+	return time.Duration(random * float64(d))
+}
+
+// retryable tells whether the attempt may be retried: a failed connection
+// or attempt timeout, or a status telling to come back. wait is the
+// Retry-After asked for, if any.
+func retryable(ctx context.Context, resp *http.Response, err error) (retry bool, wait time.Duration) {
+	if ctx.Err() != nil {
+		return false, 0
+	}
+	if err != nil {
+		return true, 0
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			wait = time.Duration(seconds) * time.Second
+		}
+
+		return true, wait
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		return true, 0
+	}
+
+	return false, 0
+}
+
+// sleep waits d unless ctx is done first.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
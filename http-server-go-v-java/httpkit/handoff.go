@@ -0,0 +1,256 @@
+package httpkit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The environment of an inherited socket, the same as systemd socket
+// activation: LISTEN_FDS sockets from fd 3 on, named by LISTEN_FDNAMES,
+// for the process LISTEN_PID if set. A handoff names them by address.
+const (
+	listenFDsStart = 3
+	envListenFDs   = "LISTEN_FDS"
+	envListenPID   = "LISTEN_PID"
+	envFDNames     = "LISTEN_FDNAMES"
+	// envReadyFD is the pipe a new process closes once it serves
+	envReadyFD = "HTTPKIT_READY_FD"
+)
+
+// ErrUpgraded is returned by Handoff.Upgrade once a new process has taken
+// over, and is the cause of the end of the context of UpgradeOnSignal.
+var ErrUpgraded = errors.New("httpkit: already handed over to a new process")
+
+// Handoff passes the listening sockets on to a new process of the server,
+// so that a restart or a new binary doesn't refuse a single connection:
+// the kernel keeps queueing them on the same socket while the new process
+// starts, and the old one drains its requests before exiting.
+//
+// Listen takes the socket of an address from the parent process or systemd
+// socket activation if there is one, and else opens it. Upgrade only works
+// on Unix systems.
+type Handoff struct {
+	mu        sync.Mutex
+	inherited []namedListener
+	listeners []namedListener
+	upgraded  bool
+	readyOnce sync.Once
+	ready     *os.File
+
+	path         string
+	args         []string
+	readyTimeout time.Duration
+	logger       *log.Logger
+}
+
+type namedListener struct {
+	name string
+	ln   net.Listener
+}
+
+// HandoffOption configures a Handoff.
+type HandoffOption func(*Handoff)
+
+// WithExecutable sets the program started by Upgrade, the running one with
+// the same arguments by default. Replacing the file of the running program
+// upgrades it.
+func WithExecutable(path string, args ...string) HandoffOption {
+	return func(h *Handoff) {
+		h.path = path
+		h.args = args
+	}
+}
+
+// WithReadyTimeout sets how long Upgrade waits for the new process to
+// serve, 30 seconds by default.
+func WithReadyTimeout(d time.Duration) HandoffOption {
+	return func(h *Handoff) {
+		h.readyTimeout = d
+	}
+}
+
+// WithHandoffLogger sets the logger, the standard logger by default.
+func WithHandoffLogger(logger *log.Logger) HandoffOption {
+	return func(h *Handoff) {
+		h.logger = logger
+	}
+}
+
+// NewHandoff takes the sockets passed by the parent process or systemd, if
+// any, and removes their variables from the environment.
+func NewHandoff(opts ...HandoffOption) (*Handoff, error) {
+	h := &Handoff{
+		args:         os.Args[1:],
+		readyTimeout: 30 * time.Second,
+		logger:       log.Default(),
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+
+	defer func() {
+		for _, key := range []string{envListenFDs, envListenPID, envFDNames, envReadyFD} {
+			_ = os.Unsetenv(key)
+		}
+	}()
+
+	if fd, err := strconv.Atoi(os.Getenv(envReadyFD)); err == nil {
+		h.ready = os.NewFile(uintptr(fd), "ready")
+	}
+
+	n, err := strconv.Atoi(os.Getenv(envListenFDs))
+	if err != nil || n <= 0 {
+		return h, nil
+	}
+	if pid := os.Getenv(envListenPID); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return h, nil
+	}
+	names := strings.Split(os.Getenv(envFDNames), ":")
+	for i := range n {
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		f := os.NewFile(uintptr(listenFDsStart+i), name)
+		ln, err := net.FileListener(f)
+		if e := f.Close(); e != nil {
+			h.logger.Println("Failed to close the inherited socket", e)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error inheriting socket %d %q: %w", listenFDsStart+i, name, err)
+		}
+		h.inherited = append(h.inherited, namedListener{name: name, ln: ln})
+	}
+
+	return h, nil
+}
+
+// Listen returns the inherited socket of the address, found by name or by
+// address, or else a new one. Upgrade passes it on.
+func (h *Handoff) Listen(network, addr string) (net.Listener, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, inherited := range h.inherited {
+		if inherited.name == addr || sameAddr(inherited.ln.Addr(), network, addr) {
+			h.inherited = append(h.inherited[:i], h.inherited[i+1:]...)
+			h.listeners = append(h.listeners, namedListener{name: addr, ln: inherited.ln})
+			h.logger.Printf("listening on %s inherited from the parent process", inherited.ln.Addr())
+
+			return inherited.ln, nil
+		}
+	}
+
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	h.listeners = append(h.listeners, namedListener{name: addr, ln: ln})
+
+	return ln, nil
+}
+
+// sameAddr tells whether the listener is on addr, as systemd names the
+// sockets after their unit rather than their address.
+func sameAddr(got net.Addr, network, addr string) bool {
+	want, err := net.ResolveTCPAddr(network, addr)
+	tcp, ok := got.(*net.TCPAddr)
+	if err != nil || !ok {
+		return got.String() == addr
+	}
+
+	return tcp.Port == want.Port && (tcp.IP.Equal(want.IP) || want.IP == nil && tcp.IP.IsUnspecified())
+}
+
+// Ready tells the parent process that this one serves, so that it drains
+// and exits. It is called once the listeners are taken, and closes the
+// inherited ones left, as an address that changed would otherwise queue
+// connections nobody accepts.
+func (h *Handoff) Ready() {
+	h.readyOnce.Do(func() {
+		h.mu.Lock()
+		for _, l := range h.inherited {
+			if e := l.ln.Close(); e != nil {
+				h.logger.Println("Failed to close an unused inherited socket", e)
+			}
+		}
+		h.inherited = nil
+		h.mu.Unlock()
+
+		if h.ready == nil {
+			return
+		}
+		if _, err := h.ready.Write([]byte{1}); err != nil {
+			h.logger.Println("Failed to tell the parent process it's ready", err)
+		}
+		if e := h.ready.Close(); e != nil {
+			h.logger.Println("Failed to close the ready pipe", e)
+		}
+	})
+}
+
+// handoffEnviron is the environment without the variables of a handoff.
+func handoffEnviron() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		key, _, _ := strings.Cut(kv, "=")
+		switch key {
+		case envListenFDs, envListenPID, envFDNames, envReadyFD:
+		default:
+			env = append(env, kv)
+		}
+	}
+
+	return env
+}
+
+// UpgradeOnSignal upgrades on the signals, usually SIGHUP and SIGUSR2, and
+// returns a context done once a new process took over, for the servers to
+// shut down gracefully. A failed upgrade is logged and the servers go on.
+// Without signals it never upgrades.
+func (h *Handoff) UpgradeOnSignal(ctx context.Context, signals ...os.Signal) context.Context {
+	// signal.Notify would relay every signal
+	if len(signals) == 0 {
+		return ctx
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, signals...)
+
+	go func() {
+		defer signal.Stop(c)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case sig := <-c:
+				h.logger.Printf("%s: starting a new process", sig)
+				p, err := h.Upgrade()
+				if err != nil {
+					h.logger.Printf("upgrade failed, still serving: %v", err)
+
+					continue
+				}
+				h.logger.Printf("new process %d took over", p.Pid)
+				cancel(ErrUpgraded)
+
+				return
+			}
+		}
+	}()
+
+	return ctx
+}
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package httpkit
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+)
+
+// Upgrade needs to pass sockets on to a child process, which only Unix
+// systems do, and fails with errors.ErrUnsupported elsewhere.
+func (h *Handoff) Upgrade() (*os.Process, error) {
+	return nil, fmt.Errorf("httpkit: socket handoff on %s: %w", runtime.GOOS, errors.ErrUnsupported)
+}
@@ -0,0 +1,212 @@
+//go:build unix
+
+package httpkit
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// envHandoffChild makes the test binary the new process of a handoff:
+// "serve" serves with the inherited socket and "fail" exits at once.
+const envHandoffChild = "HTTPKIT_HANDOFF_CHILD"
+
+// handoffAddr is the address of the handed off socket, the same name in the
+// parent and the child.
+const handoffAddr = "127.0.0.1:0"
+
+func TestMain(m *testing.M) {
+	switch os.Getenv(envHandoffChild) {
+	case "serve":
+		os.Exit(handoffChild())
+	case "fail":
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+// handoffChild answers "child <pid>" until SIGTERM.
+func handoffChild() int {
+	h, err := NewHandoff(WithHandoffLogger(log.New(io.Discard, "", 0)))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	ln, err := h.Listen("tcp", handoffAddr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	s := NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "child "+strconv.Itoa(os.Getpid()))
+	}), WithServerLogger(log.New(io.Discard, "", 0)))
+	h.Ready()
+	if err := s.Serve(context.Background(), ln); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	return 0
+}
+
+func newTestHandoff(t *testing.T, child string) (*Handoff, net.Listener) {
+	t.Helper()
+
+	t.Setenv(envHandoffChild, child)
+	h, err := NewHandoff(
+		WithExecutable(os.Args[0]),
+		WithReadyTimeout(10*time.Second),
+		WithHandoffLogger(log.New(io.Discard, "", 0)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := h.Listen("tcp", handoffAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return h, ln
+}
+
+func TestHandoff(t *testing.T) {
+	h, ln := newTestHandoff(t, "serve")
+	url := "http://" + ln.Addr().String()
+	ctx := h.UpgradeOnSignal(context.Background(), syscall.SIGUSR2)
+
+	s := NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		_, _ = io.WriteString(w, "parent")
+	}), WithSignals(), WithServerLogger(log.New(io.Discard, "", 0)))
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.Serve(ctx, ln)
+	}()
+
+	// Clients send requests all along the handoff, on new connections and
+	// kept alive ones
+	var (
+		mu       sync.Mutex
+		failures []error
+		served   = map[string]int{}
+		childPID int
+	)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range 8 {
+		client := &http.Client{Transport: &http.Transport{DisableKeepAlives: i%2 == 0}, Timeout: 5 * time.Second}
+		wg.Go(func() {
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				resp, err := client.Get(url)
+				if err != nil {
+					mu.Lock()
+					failures = append(failures, err)
+					mu.Unlock()
+
+					continue
+				}
+				b, err := io.ReadAll(resp.Body)
+				_ = resp.Body.Close()
+				mu.Lock()
+				switch body := string(b); {
+				case err != nil || resp.StatusCode != http.StatusOK:
+					failures = append(failures, fmt.Errorf("status %d %q: %v", resp.StatusCode, b, err))
+				case strings.HasPrefix(body, "child "):
+					served["child"]++
+					childPID, _ = strconv.Atoi(strings.TrimPrefix(body, "child "))
+				default:
+					served[body]++
+				}
+				mu.Unlock()
+			}
+		})
+	}
+	t.Cleanup(func() {
+		if childPID != 0 {
+			_ = syscall.Kill(childPID, syscall.SIGTERM)
+		}
+	})
+
+	time.Sleep(200 * time.Millisecond)
+	if err := syscall.Kill(os.Getpid(), syscall.SIGUSR2); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Errorf("Serve() = %v, want the parent to drain", err)
+		}
+	case <-time.After(15 * time.Second):
+		t.Fatal("the parent still serves after the upgrade")
+	}
+	time.Sleep(200 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	if len(failures) > 0 {
+		t.Errorf("%d requests failed during the handoff, first: %v", len(failures), failures[0])
+	}
+	if served["parent"] == 0 || served["child"] == 0 {
+		t.Errorf("served %v, want requests served by the parent and then the child", served)
+	}
+	if _, err := h.Upgrade(); err != ErrUpgraded {
+		t.Errorf("second Upgrade() = %v, want %v", err, ErrUpgraded)
+	}
+}
+
+func TestHandoffFailedUpgrade(t *testing.T) {
+	h, ln := newTestHandoff(t, "fail")
+	defer func() {
+		if e := ln.Close(); e != nil {
+			t.Error(e)
+		}
+	}()
+
+	if _, err := h.Upgrade(); err == nil {
+		t.Fatal("Upgrade() = nil, want an error as the new process exits")
+	}
+
+	// The socket is still this process's to serve
+	go func() {
+		_ = http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			_, _ = io.WriteString(w, "parent")
+		}))
+	}()
+	resp, err := http.Get("http://" + ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+}
+
+func TestNewHandoffOtherProcess(t *testing.T) {
+	t.Setenv(envListenFDs, "1")
+	t.Setenv(envListenPID, strconv.Itoa(os.Getpid()+1))
+
+	h, err := NewHandoff()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.inherited) != 0 {
+		t.Errorf("inherited %v, want none as the sockets are for another process", h.inherited)
+	}
+	if v, ok := os.LookupEnv(envListenFDs); ok {
+		t.Errorf("%s = %q, want it removed", envListenFDs, v)
+	}
+}
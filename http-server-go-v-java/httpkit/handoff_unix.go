@@ -0,0 +1,139 @@
+//go:build unix
+
+package httpkit
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Upgrade starts a new process with the listeners and waits for it to be
+// ready. On error the new process is killed and this one goes on serving.
+func (h *Handoff) Upgrade() (*os.Process, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.upgraded {
+		return nil, ErrUpgraded
+	}
+
+	path := h.path
+	if path == "" {
+		var err error
+		if path, err = os.Executable(); err != nil {
+			return nil, fmt.Errorf("error finding the executable: %w", err)
+		}
+	}
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			if e := f.Close(); e != nil {
+				h.logger.Println("Failed to close a socket copy", e)
+			}
+		}
+	}()
+	names := make([]string, 0, len(h.listeners))
+	for _, l := range h.listeners {
+		f, err := listenerFile(l.ln)
+		if err != nil {
+			return nil, fmt.Errorf("error passing on listener %s: %w", l.name, err)
+		}
+		files = append(files, f)
+		// The names are separated by colons, which addresses have
+		names = append(names, url.QueryEscape(l.name))
+	}
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("error creating the ready pipe: %w", err)
+	}
+	defer func() {
+		if e := readyR.Close(); e != nil {
+			h.logger.Println("Failed to close the ready pipe", e)
+		}
+	}()
+
+	cmd := exec.Command(path, h.args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, readyW)
+	cmd.Env = append(handoffEnviron(),
+		envListenFDs+"="+strconv.Itoa(len(files)),
+		envFDNames+"="+strings.Join(names, ":"),
+		envReadyFD+"="+strconv.Itoa(listenFDsStart+len(files)),
+	)
+	err = cmd.Start()
+	if e := readyW.Close(); e != nil {
+		h.logger.Println("Failed to close the ready pipe", e)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error starting %s: %w", path, err)
+	}
+	// Reaps the new process if it dies while this one still runs
+	go func() {
+		_ = cmd.Wait()
+	}()
+
+	// The pipe gets a byte once the new process is ready, or EOF if it dies
+	ready := make(chan bool, 1)
+	go func() {
+		b := make([]byte, 1)
+		n, _ := io.ReadFull(readyR, b)
+		ready <- n == 1
+	}()
+
+	select {
+	case ok := <-ready:
+		if ok {
+			h.upgraded = true
+
+			return cmd.Process, nil
+		}
+		err = errors.New("it exited before being ready")
+	case <-time.After(h.readyTimeout):
+		err = fmt.Errorf("it wasn't ready within %s", h.readyTimeout)
+	}
+	if e := cmd.Process.Kill(); e != nil && !errors.Is(e, os.ErrProcessDone) {
+		h.logger.Println("Failed to kill the new process", e)
+	}
+
+	return nil, fmt.Errorf("new process %d: %w", cmd.Process.Pid, err)
+}
+
+// listenerFile duplicates the socket of ln. Unlike the File method of the
+// listeners, it leaves ln non-blocking, so that it still closes if the
+// upgrade fails.
+func listenerFile(ln net.Listener) (*os.File, error) {
+	sc, ok := ln.(syscall.Conn)
+	if !ok {
+		return nil, fmt.Errorf("%T has no socket", ln)
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		dup    int
+		dupErr error
+	)
+	err = rc.Control(func(fd uintptr) {
+		syscall.ForkLock.RLock()
+		defer syscall.ForkLock.RUnlock()
+		if dup, dupErr = syscall.Dup(int(fd)); dupErr == nil {
+			syscall.CloseOnExec(dup)
+		}
+	})
+	if err = errors.Join(err, dupErr); err != nil {
+		return nil, err
+	}
+
+	return os.NewFile(uintptr(dup), ln.Addr().String()), nil
+}
@@ -0,0 +1,253 @@
+package httpkit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Check tells whether something the server needs works, nil meaning it does.
+// It should return once ctx is done.
+type Check func(ctx context.Context) error
+
+// Health serves the liveness and readiness of the server from registered
+// checks, run concurrently by every probe:
+//
+//   - /livez fails when the process must be restarted, from the checks
+//     registered WithLiveness only
+//   - /readyz fails when the server must get no requests, from every check,
+//     and from the start of the shutdown on
+type Health struct {
+	mu       sync.Mutex
+	checks   []*check
+	shutdown atomic.Bool
+	now      func() time.Time
+}
+
+type check struct {
+	name     string
+	check    Check
+	timeout  time.Duration
+	ttl      time.Duration
+	liveness bool
+
+	// mu serializes the runs, so that the probes waiting share one
+	mu     sync.Mutex
+	result CheckResult
+}
+
+// CheckResult is the outcome of a check as served in JSON.
+type CheckResult struct {
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	Duration  string    `json:"duration"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// HealthStatus is the JSON of /livez and /readyz.
+type HealthStatus struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+// Statuses of HealthStatus and CheckResult.
+const (
+	StatusOK           = "ok"
+	StatusFail         = "fail"
+	StatusShuttingDown = "shutting_down"
+)
+
+// CheckOption configures a check.
+type CheckOption func(*check)
+
+// WithCheckTimeout sets how long the check may take before failing, 2
+// seconds by default.
+func WithCheckTimeout(d time.Duration) CheckOption {
+	return func(c *check) {
+		c.timeout = d
+	}
+}
+
+// WithCheckCache reuses the result of the check for ttl, so that frequent
+// probes don't load the dependency. Not cached by default.
+func WithCheckCache(ttl time.Duration) CheckOption {
+	return func(c *check) {
+		c.ttl = ttl
+	}
+}
+
+// WithLiveness makes the check count for /livez too. It is for the state of
+// the process itself: a dependency down doesn't get better by restarting.
+func WithLiveness() CheckOption {
+	return func(c *check) {
+		c.liveness = true
+	}
+}
+
+// NewHealth creates a Health without checks, live and ready.
+func NewHealth() *Health {
+	return &Health{now: time.Now}
+}
+
+// Register adds a check under name.
+func (h *Health) Register(name string, fn Check, opts ...CheckOption) {
+	c := &check{name: name, check: fn, timeout: 2 * time.Second}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checks = append(h.checks, c)
+}
+
+// ObserveShutdown is a server option failing the readiness as soon as the
+// shutdown starts, before the server stops accepting requests.
+func (h *Health) ObserveShutdown() ServerOption {
+	return WithOnShutdown(func() { h.shutdown.Store(true) })
+}
+
+// Livez serves the liveness, 200 or 503 with the HealthStatus.
+func (h *Health) Livez() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, h.Run(r.Context(), true))
+	})
+}
+
+// Readyz serves the readiness, 200 or 503 with the HealthStatus.
+func (h *Health) Readyz() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.shutdown.Load() {
+			writeHealth(w, HealthStatus{Status: StatusShuttingDown, Checks: map[string]CheckResult{}})
+
+			return
+		}
+		writeHealth(w, h.Run(r.Context(), false))
+	})
+}
+
+func writeHealth(w http.ResponseWriter, status HealthStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if status.Status != StatusOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(status)
+}
+
+// Run runs the checks, the liveness ones only if liveness is set.
+func (h *Health) Run(ctx context.Context, liveness bool) HealthStatus {
+	h.mu.Lock()
+	checks := make([]*check, 0, len(h.checks))
+	for _, c := range h.checks {
+		if c.liveness || !liveness {
+			checks = append(checks, c)
+		}
+	}
+	h.mu.Unlock()
+
+	results := make([]CheckResult, len(checks))
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Go(func() {
+			results[i] = h.run(ctx, c)
+		})
+	}
+	wg.Wait()
+
+	status := HealthStatus{Status: StatusOK, Checks: make(map[string]CheckResult, len(checks))}
+	for i, c := range checks {
+		status.Checks[c.name] = results[i]
+		if results[i].Status != StatusOK {
+			status.Status = StatusFail
+		}
+	}
+
+	return status
+}
+
+// run runs the check unless its result is fresh enough.
+func (h *Health) run(ctx context.Context, c *check) CheckResult {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.result.CheckedAt.IsZero() && h.now().Sub(c.result.CheckedAt) < c.ttl {
+		return c.result
+	}
+
+	// A probe going away mustn't fail the result the others get
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), c.timeout)
+	defer cancel()
+	start := h.now()
+	err := runCheck(ctx, c.check)
+	c.result = CheckResult{Status: StatusOK, Duration: h.now().Sub(start).String(), CheckedAt: start}
+	if err != nil {
+		c.result.Status = StatusFail
+		c.result.Error = err.Error()
+	}
+
+	return c.result
+}
+
+// runCheck returns the error of the check, its panic, or the end of ctx if
+// the check ignores it.
+func runCheck(ctx context.Context, fn Check) error {
+	errs := make(chan error, 1)
+	go func() {
+		defer func() {
+			if v := recover(); v != nil {
+				errs <- fmt.Errorf("panic: %v", v)
+			}
+		}()
+		errs <- fn(ctx)
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ---- checks ----
+
+// Pinger is a dependency with a ping, like *sql.DB.
+type Pinger interface {
+	PingContext(ctx context.Context) error
+}
+
+// PingCheck checks the dependency answers its ping.
+func PingCheck(p Pinger) Check {
+	return p.PingContext
+}
+
+// HTTPCheck checks that a GET of url answers a status below 400, with the
+// client or http.DefaultClient if nil.
+func HTTPCheck(client *http.Client, url string) Check {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		if e := resp.Body.Close(); e != nil {
+			return e
+		}
+		if resp.StatusCode >= http.StatusBadRequest {
+			return fmt.Errorf("GET %s: %s", url, resp.Status)
+		}
+
+		return nil
+	}
+}
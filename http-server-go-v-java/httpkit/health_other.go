@@ -0,0 +1,18 @@
+//go:build !(linux || darwin || freebsd || dragonfly || windows)
+
+package httpkit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+)
+
+// DiskSpaceCheck fails with errors.ErrUnsupported on the systems it can't
+// read the free space of.
+func DiskSpaceCheck(path string, _ uint64) Check {
+	return func(context.Context) error {
+		return fmt.Errorf("disk space of %s on %s: %w", path, runtime.GOOS, errors.ErrUnsupported)
+	}
+}
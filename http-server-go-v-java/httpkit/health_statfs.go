@@ -0,0 +1,25 @@
+//go:build linux || darwin || freebsd || dragonfly
+
+package httpkit
+
+import (
+	"context"
+	"fmt"
+	"syscall"
+)
+
+// DiskSpaceCheck checks the file system of path has minFree bytes free for
+// unprivileged users.
+func DiskSpaceCheck(path string, minFree uint64) Check {
+	return func(context.Context) error {
+		var fs syscall.Statfs_t
+		if err := syscall.Statfs(path, &fs); err != nil {
+			return err
+		}
+		if free := uint64(fs.Bavail) * uint64(fs.Bsize); free < minFree {
+			return fmt.Errorf("%s has %d bytes free, want %d", path, free, minFree)
+		}
+
+		return nil
+	}
+}
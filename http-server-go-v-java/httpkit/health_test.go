@@ -0,0 +1,195 @@
+package httpkit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func serveHealth(t *testing.T, handler http.Handler) (int, HealthStatus) {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	var status HealthStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatalf("body %q: %v", rec.Body, err)
+	}
+
+	return rec.Code, status
+}
+
+func TestHealth(t *testing.T) {
+	ok := func(context.Context) error { return nil }
+	down := func(context.Context) error { return errors.New("connection refused") }
+	slow := func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	stuck := func(context.Context) error {
+		time.Sleep(time.Second)
+		return nil
+	}
+	panics := func(context.Context) error { panic("boom") }
+
+	type registered struct {
+		name  string
+		check Check
+		opts  []CheckOption
+	}
+	tests := []struct {
+		name       string
+		checks     []registered
+		wantLive   int
+		wantReady  int
+		wantErrors map[string]string
+	}{
+		{"no checks", nil, 200, 200, nil},
+		{"all ok", []registered{{"db", ok, nil}, {"self", ok, []CheckOption{WithLiveness()}}}, 200, 200, nil},
+		{"dependency down", []registered{{"db", down, nil}, {"self", ok, []CheckOption{WithLiveness()}}}, 200, 503,
+			map[string]string{"db": "connection refused"}},
+		{"liveness down", []registered{{"self", down, []CheckOption{WithLiveness()}}}, 503, 503,
+			map[string]string{"self": "connection refused"}},
+		{"timeout", []registered{{"db", slow, []CheckOption{WithCheckTimeout(10 * time.Millisecond)}}}, 200, 503,
+			map[string]string{"db": "context deadline exceeded"}},
+		{"check ignoring the timeout", []registered{{"db", stuck, []CheckOption{WithCheckTimeout(10 * time.Millisecond)}}}, 200, 503,
+			map[string]string{"db": "context deadline exceeded"}},
+		{"panic", []registered{{"db", panics, nil}}, 200, 503, map[string]string{"db": "panic: boom"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHealth()
+			for _, c := range tt.checks {
+				h.Register(c.name, c.check, c.opts...)
+			}
+
+			if code, _ := serveHealth(t, h.Livez()); code != tt.wantLive {
+				t.Errorf("/livez = %d, want %d", code, tt.wantLive)
+			}
+			code, status := serveHealth(t, h.Readyz())
+			if code != tt.wantReady {
+				t.Errorf("/readyz = %d, want %d", code, tt.wantReady)
+			}
+			if wantStatus := map[bool]string{true: StatusOK, false: StatusFail}[code == 200]; status.Status != wantStatus {
+				t.Errorf("status = %q, want %q", status.Status, wantStatus)
+			}
+			if len(status.Checks) != len(tt.checks) {
+				t.Errorf("checks = %v, want %d", status.Checks, len(tt.checks))
+			}
+			for name, result := range status.Checks {
+				if result.Error != tt.wantErrors[name] {
+					t.Errorf("%s error = %q, want %q", name, result.Error, tt.wantErrors[name])
+				}
+				if (result.Error == "") != (result.Status == StatusOK) {
+					t.Errorf("%s = %+v, want the status matching the error", name, result)
+				}
+			}
+		})
+	}
+}
+
+func TestHealthCache(t *testing.T) {
+	h := NewHealth()
+	now := time.Unix(0, 0)
+	h.now = func() time.Time { return now }
+	runs := 0
+	h.Register("db", func(context.Context) error {
+		runs++
+		return nil
+	}, WithCheckCache(5*time.Second))
+
+	for _, step := range []struct {
+		after    time.Duration
+		wantRuns int
+	}{
+		{0, 1},
+		{4 * time.Second, 1},
+		{time.Second, 2},
+		{time.Second, 2},
+	} {
+		now = now.Add(step.after)
+		h.Run(context.Background(), false)
+		if runs != step.wantRuns {
+			t.Errorf("after %s: %d runs, want %d", now.Sub(time.Unix(0, 0)), runs, step.wantRuns)
+		}
+	}
+}
+
+func TestHealthShutdown(t *testing.T) {
+	h := NewHealth()
+	mux := http.NewServeMux()
+	mux.Handle("/readyz", h.Readyz())
+	mux.Handle("/livez", h.Livez())
+
+	clock := newFakeClock()
+	ctx, cancel := context.WithCancel(context.Background())
+	url, errs := startServer(t, ctx, mux, WithSignals(), h.ObserveShutdown(), WithShutdownDelay(200*time.Millisecond), withClock(clock))
+	get := func(path string) int {
+		resp, err := http.Get(url + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+
+		return resp.StatusCode
+	}
+	if code := get("/readyz"); code != http.StatusOK {
+		t.Errorf("/readyz before the shutdown = %d, want 200", code)
+	}
+
+	// The server still answers during the delay, not ready but live
+	cancel()
+	<-clock.armed
+	if code := get("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz during the shutdown = %d, want 503", code)
+	}
+	if code := get("/livez"); code != http.StatusOK {
+		t.Errorf("/livez during the shutdown = %d, want 200", code)
+	}
+	clock.Advance(200 * time.Millisecond)
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
+
+type fakePinger struct{ err error }
+
+func (p fakePinger) PingContext(context.Context) error { return p.err }
+
+func TestChecks(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/down" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		name    string
+		check   Check
+		wantErr bool
+	}{
+		{"ping", PingCheck(fakePinger{}), false},
+		{"ping failing", PingCheck(fakePinger{errors.New("no route")}), true},
+		{"http", HTTPCheck(nil, upstream.URL+"/up"), false},
+		{"http error status", HTTPCheck(upstream.Client(), upstream.URL+"/down"), true},
+		{"http unreachable", HTTPCheck(nil, "http://127.0.0.1:1"), true},
+		{"disk space", DiskSpaceCheck(t.TempDir(), 1), false},
+		{"disk full", DiskSpaceCheck(t.TempDir(), math.MaxUint64), true},
+		{"disk missing", DiskSpaceCheck("/does/not/exist", 1), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.check(context.Background()); (err != nil) != tt.wantErr {
+				t.Errorf("check() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
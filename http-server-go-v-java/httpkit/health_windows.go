@@ -0,0 +1,30 @@
+package httpkit
+
+import (
+	"context"
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+var getDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+// DiskSpaceCheck checks the file system of path has minFree bytes free for
+// the user of the process, quotas included.
+func DiskSpaceCheck(path string, minFree uint64) Check {
+	return func(context.Context) error {
+		p, err := syscall.UTF16PtrFromString(path)
+		if err != nil {
+			return err
+		}
+		var free uint64
+		if ok, _, err := getDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&free)), 0, 0); ok == 0 {
+			return fmt.Errorf("GetDiskFreeSpaceEx %s: %w", path, err)
+		}
+		if free < minFree {
+			return fmt.Errorf("%s has %d bytes free, want %d", path, free, minFree)
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,321 @@
+package httpkit
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Priority ranks requests when the server is overloaded: waiting requests
+// of a higher priority get a free slot first.
+type Priority int
+
+const (
+	PriorityLow Priority = iota
+	PriorityNormal
+	PriorityHigh
+	// PriorityCritical requests, like health checks, are never queued nor
+	// shed, and don't count against the limit.
+	PriorityCritical
+)
+
+// LimiterStats is a snapshot of an AdaptiveLimiter.
+type LimiterStats struct {
+	Limit    int
+	InFlight int
+	Queued   int
+	Rejected uint64
+}
+
+// clock is time, replaced by a fake one in tests.
+type clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) (<-chan time.Time, func() bool)
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTimer(d time.Duration) (<-chan time.Time, func() bool) {
+	t := time.NewTimer(d)
+
+	return t.C, t.Stop
+}
+
+// AdaptiveLimiter limits the requests in flight with a limit following the
+// latency, AIMD style: a request as fast as the fastest seen so far raises it
+// by one while it is in use, and a slow one cuts it by the backoff ratio,
+// each at most once per round of requests. The requests over the limit
+// wait in a short queue by priority, and are rejected with a Retry-After
+// header when it is full or they waited too long.
+type AdaptiveLimiter struct {
+	mu       sync.Mutex
+	limit    float64
+	inFlight int
+	waiting  [PriorityCritical][]*waiter
+	queued   int
+	rejected uint64
+
+	// minRTT is the baseline latency, the fastest request of the previous
+	// window, so that it follows a backend getting slower for good
+	minRTT, windowMinRTT time.Duration
+	samples              int
+	// A round is the requests started since the last change in that
+	// direction, so the limit moves at most once per round trip
+	lastIncrease, lastDecrease time.Time
+
+	minLimit, maxLimit float64
+	tolerance          float64
+	backoff            float64
+	window             int
+	maxQueue           int
+	queueTimeout       time.Duration
+	retryAfter         time.Duration
+	classify           func(*http.Request) Priority
+	reject             http.Handler
+	clock              clock
+}
+
+type waiter struct {
+	ready   chan struct{}
+	granted bool
+}
+
+// AdaptiveOption configures an AdaptiveLimiter.
+type AdaptiveOption func(*AdaptiveLimiter)
+
+// WithLimits sets the initial limit and its bounds, 20 between 1 and 100 by
+// default.
+func WithLimits(initial, minLimit, maxLimit int) AdaptiveOption {
+	return func(l *AdaptiveLimiter) {
+		l.limit = float64(initial)
+		l.minLimit = float64(minLimit)
+		l.maxLimit = float64(maxLimit)
+	}
+}
+
+// WithLatencyTolerance sets how many times slower than the baseline a
+// request may be before the limit backs off, 2 by default.
+func WithLatencyTolerance(tolerance float64) AdaptiveOption {
+	return func(l *AdaptiveLimiter) {
+		l.tolerance = tolerance
+	}
+}
+
+// WithBackoffRatio sets the ratio the limit is multiplied by on a slow
+// request, 0.9 by default.
+func WithBackoffRatio(ratio float64) AdaptiveOption {
+	return func(l *AdaptiveLimiter) {
+		l.backoff = ratio
+	}
+}
+
+// WithQueue sets the most requests waiting for a slot and how long they
+// wait, 50 and 50ms by default. A size of 0 rejects right away.
+func WithQueue(size int, timeout time.Duration) AdaptiveOption {
+	return func(l *AdaptiveLimiter) {
+		l.maxQueue = size
+		l.queueTimeout = timeout
+	}
+}
+
+// WithRetryAfter sets the Retry-After header of the rejected requests,
+// rounded up to seconds, 1 second by default.
+func WithRetryAfter(d time.Duration) AdaptiveOption {
+	return func(l *AdaptiveLimiter) {
+		l.retryAfter = d
+	}
+}
+
+// WithPriority sets the priority of the requests, PriorityNormal for all by
+// default.
+func WithPriority(classify func(*http.Request) Priority) AdaptiveOption {
+	return func(l *AdaptiveLimiter) {
+		l.classify = classify
+	}
+}
+
+// WithAdaptiveRejectHandler replaces the 429 "too many requests" response of
+// the rejected requests. The Retry-After header is set before it is called.
+func WithAdaptiveRejectHandler(h http.Handler) AdaptiveOption {
+	return func(l *AdaptiveLimiter) {
+		l.reject = h
+	}
+}
+
+// NewAdaptiveLimiter creates a limiter, see Middleware to use it.
+func NewAdaptiveLimiter(opts ...AdaptiveOption) *AdaptiveLimiter {
+	l := &AdaptiveLimiter{
+		limit:        20,
+		minLimit:     1,
+		maxLimit:     100,
+		tolerance:    2,
+		backoff:      0.9,
+		window:       1000,
+		maxQueue:     50,
+		queueTimeout: 50 * time.Millisecond,
+		retryAfter:   time.Second,
+		classify:     func(*http.Request) Priority { return PriorityNormal },
+		reject: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+		}),
+		clock: realClock{},
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	l.minLimit = max(l.minLimit, 1)
+	l.limit = min(max(l.limit, l.minLimit), l.maxLimit)
+
+	return l
+}
+
+// Middleware limits the requests through it.
+func (l *AdaptiveLimiter) Middleware() Middleware {
+	retryAfter := seconds(l.retryAfter)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			done, ok := l.Acquire(r.Context(), l.classify(r))
+			if !ok {
+				w.Header().Set("Retry-After", retryAfter)
+				l.reject.ServeHTTP(w, r)
+
+				return
+			}
+			defer done()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Acquire waits for a slot for a request of the priority. It returns false
+// if the request is shed, or else a function to call once the request is
+// done, which feeds its latency to the limit.
+func (l *AdaptiveLimiter) Acquire(ctx context.Context, p Priority) (done func(), ok bool) {
+	if p >= PriorityCritical {
+		return func() {}, true
+	}
+	p = max(p, PriorityLow)
+
+	l.mu.Lock()
+	if l.inFlight < int(l.limit) && l.queued == 0 {
+		l.inFlight++
+		l.mu.Unlock()
+
+		return l.doneFunc(), true
+	}
+	if l.queued >= l.maxQueue || l.queueTimeout <= 0 {
+		l.rejected++
+		l.mu.Unlock()
+
+		return nil, false
+	}
+	w := &waiter{ready: make(chan struct{})}
+	l.waiting[p] = append(l.waiting[p], w)
+	l.queued++
+	l.mu.Unlock()
+
+	timeout, stop := l.clock.NewTimer(l.queueTimeout)
+	defer stop()
+	select {
+	case <-w.ready:
+		return l.doneFunc(), true
+	case <-timeout:
+	case <-ctx.Done():
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// The slot may have been granted right after the timeout
+	if w.granted {
+		return l.doneFunc(), true
+	}
+	for i, other := range l.waiting[p] {
+		if other == w {
+			l.waiting[p] = append(l.waiting[p][:i], l.waiting[p][i+1:]...)
+
+			break
+		}
+	}
+	l.queued--
+	l.rejected++
+
+	return nil, false
+}
+
+func (l *AdaptiveLimiter) doneFunc() func() {
+	start := l.clock.Now()
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.sample(start, l.clock.Now().Sub(start))
+			l.inFlight--
+			l.grant()
+		})
+	}
+}
+
+// sample adjusts the limit to the latency of a request started at start.
+// l.mu must be held.
+func (l *AdaptiveLimiter) sample(start time.Time, rtt time.Duration) {
+	if l.minRTT == 0 || rtt < l.minRTT {
+		l.minRTT = rtt
+	}
+	if l.windowMinRTT == 0 || rtt < l.windowMinRTT {
+		l.windowMinRTT = rtt
+	}
+	if l.samples++; l.samples >= l.window {
+		l.minRTT, l.windowMinRTT, l.samples = l.windowMinRTT, 0, 0
+	}
+
+	if float64(rtt) > float64(l.minRTT)*l.tolerance {
+		// The requests started before the last decrease are slow because
+		// of the old limit, backing off for them too would overshoot
+		if !start.Before(l.lastDecrease) {
+			l.limit = max(l.minLimit, l.limit*l.backoff)
+			l.lastDecrease = l.clock.Now()
+		}
+
+		return
+	}
+	// Raising a limit far from being reached proves nothing, and the
+	// requests started before the last increase don't know about it yet
+	if float64(l.inFlight)*2 >= l.limit && !start.Before(l.lastIncrease) {
+		l.limit = min(l.maxLimit, l.limit+1)
+		l.lastIncrease = l.clock.Now()
+	}
+}
+
+// grant hands the free slots to the waiting requests, by priority. l.mu
+// must be held.
+func (l *AdaptiveLimiter) grant() {
+	for p := len(l.waiting) - 1; p >= 0; p-- {
+		for len(l.waiting[p]) > 0 && l.inFlight < int(l.limit) {
+			w := l.waiting[p][0]
+			l.waiting[p] = l.waiting[p][1:]
+			l.queued--
+			l.inFlight++
+			w.granted = true
+			close(w.ready)
+		}
+	}
+}
+
+// Stats returns the current state of the limiter.
+func (l *AdaptiveLimiter) Stats() LimiterStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return LimiterStats{
+		Limit:    int(l.limit),
+		InFlight: l.inFlight,
+		Queued:   l.queued,
+		Rejected: l.rejected,
+	}
+}
@@ -0,0 +1,314 @@
+package httpkit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock moved by hand.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []fakeTimer
+	// armed gets a value whenever a timer is created
+	armed chan struct{}
+}
+
+type fakeTimer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(0, 0), armed: make(chan struct{}, 100)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) (<-chan time.Time, func() bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := fakeTimer{at: c.now.Add(d), c: make(chan time.Time, 1)}
+	c.timers = append(c.timers, t)
+	c.armed <- struct{}{}
+
+	return t.c, func() bool { return true }
+}
+
+// Advance moves the clock, firing the timers due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, t := range c.timers {
+		if t.at.After(c.now) {
+			pending = append(pending, t)
+
+			continue
+		}
+		t.c <- c.now
+	}
+	c.timers = pending
+}
+
+func newTestLimiter(clock *fakeClock, opts ...AdaptiveOption) *AdaptiveLimiter {
+	l := NewAdaptiveLimiter(opts...)
+	l.clock = clock
+
+	return l
+}
+
+// simulate runs rounds of requests filling the limit against a backend with
+// the latency, and returns the limit after them.
+func simulate(t *testing.T, l *AdaptiveLimiter, clock *fakeClock, rounds int, latency time.Duration) int {
+	t.Helper()
+
+	for range rounds {
+		var dones []func()
+		for {
+			done, ok := l.Acquire(context.Background(), PriorityNormal)
+			if !ok {
+				break
+			}
+			dones = append(dones, done)
+			if l.Stats().InFlight >= l.Stats().Limit {
+				break
+			}
+		}
+		clock.Advance(latency)
+		for _, done := range dones {
+			done()
+		}
+	}
+
+	return l.Stats().Limit
+}
+
+func TestAdaptiveLimiterLatency(t *testing.T) {
+	clock := newFakeClock()
+	l := newTestLimiter(clock, WithLimits(10, 2, 50), WithQueue(0, 0))
+
+	// A steady backend lets the limit grow up to its bound
+	if got := simulate(t, l, clock, 40, 10*time.Millisecond); got != 50 {
+		t.Fatalf("limit with a steady backend = %d, want 50", got)
+	}
+
+	// A backend slowing down makes it back off, once per round
+	got := simulate(t, l, clock, 3, 50*time.Millisecond)
+	if want := 36; got != want { // 50 × 0.9³
+		t.Errorf("limit after 3 slow rounds = %d, want %d", got, want)
+	}
+	if got := simulate(t, l, clock, 100, 50*time.Millisecond); got != 2 {
+		t.Errorf("limit with a slow backend = %d, want the minimum 2", got)
+	}
+
+	// And grow again once it recovers
+	if got := simulate(t, l, clock, 5, 10*time.Millisecond); got <= 2 {
+		t.Errorf("limit after the backend recovered = %d, want it growing", got)
+	}
+}
+
+func TestAdaptiveLimiterRampRate(t *testing.T) {
+	tests := []struct {
+		name   string
+		rounds int
+		want   int
+	}{
+		{"one round", 1, 11},
+		{"five rounds", 5, 15},
+		{"up to the bound", 100, 50},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newFakeClock()
+			l := newTestLimiter(clock, WithLimits(10, 1, 50), WithQueue(0, 0))
+
+			// However many requests a round has, the limit grows by one
+			if got := simulate(t, l, clock, tt.rounds, 10*time.Millisecond); got != tt.want {
+				t.Errorf("limit after %d fast rounds = %d, want %d", tt.rounds, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAdaptiveLimiterUnusedLimit(t *testing.T) {
+	clock := newFakeClock()
+	l := newTestLimiter(clock, WithLimits(10, 1, 50))
+
+	// One request at a time never uses half of the limit
+	for range 20 {
+		done, _ := l.Acquire(context.Background(), PriorityNormal)
+		clock.Advance(10 * time.Millisecond)
+		done()
+	}
+	if got := l.Stats().Limit; got != 10 {
+		t.Errorf("limit = %d, want 10 unchanged", got)
+	}
+}
+
+// acquireAsync acquires in a goroutine once the request is queued.
+func acquireAsync(l *AdaptiveLimiter, clock *fakeClock, ctx context.Context, p Priority) <-chan bool {
+	result := make(chan bool, 1)
+	go func() {
+		done, ok := l.Acquire(ctx, p)
+		if ok {
+			done()
+		}
+		result <- ok
+	}()
+	<-clock.armed
+
+	return result
+}
+
+func TestAdaptiveLimiterQueue(t *testing.T) {
+	clock := newFakeClock()
+	l := newTestLimiter(clock, WithLimits(1, 1, 1), WithQueue(2, 100*time.Millisecond))
+	done, ok := l.Acquire(context.Background(), PriorityNormal)
+	if !ok {
+		t.Fatal("first Acquire() failed")
+	}
+
+	// Waiting until the slot is free
+	first := acquireAsync(l, clock, context.Background(), PriorityNormal)
+	clock.Advance(50 * time.Millisecond)
+	done()
+	if !<-first {
+		t.Error("queued request wasn't granted the free slot")
+	}
+
+	// Waiting too long
+	done, _ = l.Acquire(context.Background(), PriorityNormal)
+	defer done()
+	late := acquireAsync(l, clock, context.Background(), PriorityNormal)
+	clock.Advance(100 * time.Millisecond)
+	if <-late {
+		t.Error("request queued past the timeout was granted")
+	}
+
+	// Leaving with the client
+	ctx, cancel := context.WithCancel(context.Background())
+	gone := acquireAsync(l, clock, ctx, PriorityNormal)
+	cancel()
+	if <-gone {
+		t.Error("cancelled request was granted")
+	}
+
+	// The queue is full
+	a := acquireAsync(l, clock, context.Background(), PriorityNormal)
+	b := acquireAsync(l, clock, context.Background(), PriorityNormal)
+	if _, ok := l.Acquire(context.Background(), PriorityNormal); ok {
+		t.Error("Acquire() with a full queue succeeded")
+	}
+	clock.Advance(time.Second)
+	<-a
+	<-b
+
+	if got := l.Stats(); got.Rejected != 5 || got.Queued != 0 || got.InFlight != 1 {
+		t.Errorf("Stats() = %+v, want 5 rejected, none queued and 1 in flight", got)
+	}
+}
+
+func TestAdaptiveLimiterPriority(t *testing.T) {
+	clock := newFakeClock()
+	l := newTestLimiter(clock, WithLimits(1, 1, 1), WithQueue(10, time.Second))
+	done, _ := l.Acquire(context.Background(), PriorityNormal)
+
+	// Critical requests go through a full server
+	critical, ok := l.Acquire(context.Background(), PriorityCritical)
+	if !ok {
+		t.Fatal("critical request was shed")
+	}
+	critical()
+
+	// The high priority request queued last is served first
+	var mu sync.Mutex
+	var order []Priority
+	results := make(chan bool, 2)
+	for _, p := range []Priority{PriorityLow, PriorityHigh} {
+		go func() {
+			done, ok := l.Acquire(context.Background(), p)
+			if ok {
+				mu.Lock()
+				order = append(order, p)
+				mu.Unlock()
+				done()
+			}
+			results <- ok
+		}()
+		<-clock.armed
+	}
+	done()
+	<-results
+	<-results
+
+	if len(order) != 2 || order[0] != PriorityHigh || order[1] != PriorityLow {
+		t.Errorf("served %v, want high then low", order)
+	}
+}
+
+func TestAdaptiveLimiterMiddleware(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			started <- struct{}{}
+			<-release
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	critical := func(r *http.Request) Priority {
+		if r.URL.Path == "/health" {
+			return PriorityCritical
+		}
+
+		return PriorityNormal
+	}
+
+	tests := []struct {
+		name       string
+		opts       []AdaptiveOption
+		path       string
+		wantStatus int
+		retryAfter string
+	}{
+		{"shed", nil, "/", http.StatusTooManyRequests, "1"},
+		{"retry after", []AdaptiveOption{WithRetryAfter(2500 * time.Millisecond)}, "/", http.StatusTooManyRequests, "3"},
+		{"reject handler", []AdaptiveOption{WithAdaptiveRejectHandler(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))}, "/", http.StatusServiceUnavailable, "1"},
+		{"never shed", []AdaptiveOption{WithPriority(critical)}, "/health", http.StatusOK, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := append([]AdaptiveOption{WithLimits(1, 1, 1), WithQueue(0, 0)}, tt.opts...)
+			h := NewAdaptiveLimiter(opts...).Middleware()(handler)
+
+			go h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/slow", nil))
+			<-started
+			defer func() { release <- struct{}{} }()
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := rec.Header().Get("Retry-After"); got != tt.retryAfter {
+				t.Errorf("Retry-After = %q, want %q", got, tt.retryAfter)
+			}
+		})
+	}
+}
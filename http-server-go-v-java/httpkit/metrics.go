@@ -0,0 +1,186 @@
+package httpkit
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// DefaultBuckets are the duration buckets in seconds advised by the
+// OpenTelemetry semantic conventions for http.server.request.duration.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.075, 0.1, 0.25, 0.5, 0.75, 1, 2.5, 5, 7.5, 10}
+
+// knownMethods are the methods kept as label values, the others being
+// _OTHER so that clients can't make up series.
+var knownMethods = map[string]bool{
+	http.MethodGet: true, http.MethodHead: true, http.MethodPost: true, http.MethodPut: true,
+	http.MethodPatch: true, http.MethodDelete: true, http.MethodConnect: true,
+	http.MethodOptions: true, http.MethodTrace: true,
+}
+
+// Metrics are the Prometheus RED metrics of a server, named after the
+// OpenTelemetry semantic conventions as exported to Prometheus, the same as
+// a Java service instrumented by the OpenTelemetry agent:
+//
+//   - http_server_request_duration_seconds, a histogram by
+//     http_request_method, http_route and http_response_status_code, whose
+//     count gives the rate and, by status, the errors
+//   - http_server_active_requests, the requests in flight by method
+type Metrics struct {
+	registerer prometheus.Registerer
+	gatherer   prometheus.Gatherer
+	duration   *prometheus.HistogramVec
+	active     *prometheus.GaugeVec
+	mux        *http.ServeMux
+	now        func() time.Time
+}
+
+type metricsOptions struct {
+	buckets []float64
+	mux     *http.ServeMux
+	now     func() time.Time
+}
+
+// MetricsOption configures Metrics.
+type MetricsOption func(*metricsOptions)
+
+// WithBuckets replaces DefaultBuckets.
+func WithBuckets(buckets []float64) MetricsOption {
+	return func(o *metricsOptions) {
+		o.buckets = buckets
+	}
+}
+
+// WithMetricsRoutes labels the requests with the pattern of mux matching
+// them. Without it the pattern is only known if the middleware comes right
+// before the mux.
+func WithMetricsRoutes(mux *http.ServeMux) MetricsOption {
+	return func(o *metricsOptions) {
+		o.mux = mux
+	}
+}
+
+// NewMetrics creates the metrics in a new registry, with the Go runtime and
+// process metrics.
+func NewMetrics(opts ...MetricsOption) *Metrics {
+	o := metricsOptions{buckets: DefaultBuckets, now: time.Now}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	reg := prometheus.NewRegistry()
+	m := &Metrics{
+		registerer: reg,
+		gatherer:   reg,
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_server_request_duration_seconds",
+			Help:    "Duration of HTTP server requests.",
+			Buckets: o.buckets,
+		}, []string{"http_request_method", "http_route", "http_response_status_code"}),
+		active: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "http_server_active_requests",
+			Help: "Number of active HTTP server requests.",
+		}, []string{"http_request_method"}),
+		mux: o.mux,
+		now: o.now,
+	}
+	reg.MustRegister(
+		m.duration,
+		m.active,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	return m
+}
+
+// Handler serves the metrics to Prometheus.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.gatherer, promhttp.HandlerOpts{})
+}
+
+// Middleware records the requests through it. The requests matching no
+// route are labelled "unmatched", so that random paths don't make series.
+func (m *Metrics) Middleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := m.now()
+			method := r.Method
+			if !knownMethods[method] {
+				method = "_OTHER"
+			}
+			active := m.active.WithLabelValues(method)
+			active.Inc()
+			defer active.Dec()
+
+			route := ""
+			if m.mux != nil {
+				_, pattern := m.mux.Handler(r)
+				route = routePath(pattern)
+			}
+			rw := &responseWriter{ResponseWriter: w}
+			next.ServeHTTP(rw, r)
+
+			if route == "" {
+				route = routePath(r.Pattern)
+			}
+			if route == "" {
+				route = "unmatched"
+			}
+			m.duration.WithLabelValues(method, route, strconv.Itoa(rw.statusCode())).
+				Observe(m.now().Sub(start).Seconds())
+		})
+	}
+}
+
+// ObserveLimiter exports the state of the limiter:
+// http_server_limiter_limit, http_server_limiter_in_flight,
+// http_server_limiter_queued and http_server_limiter_rejected_requests_total.
+func (m *Metrics) ObserveLimiter(l *AdaptiveLimiter) {
+	gauge := func(name, help string, value func(LimiterStats) int) prometheus.Collector {
+		return prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: name, Help: help}, func() float64 {
+			return float64(value(l.Stats()))
+		})
+	}
+	m.registerer.MustRegister(
+		gauge("http_server_limiter_limit", "Current adaptive concurrency limit.",
+			func(s LimiterStats) int { return s.Limit }),
+		gauge("http_server_limiter_in_flight", "Requests holding a slot of the limiter.",
+			func(s LimiterStats) int { return s.InFlight }),
+		gauge("http_server_limiter_queued", "Requests waiting for a slot of the limiter.",
+			func(s LimiterStats) int { return s.Queued }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "http_server_limiter_rejected_requests_total",
+			Help: "Requests shed by the concurrency limiter.",
+		}, func() float64 {
+			return float64(l.Stats().Rejected)
+		}),
+	)
+}
+
+// ObserveShutdown is a server option exporting the graceful shutdown:
+// http_server_shutdown_draining is 1 while the in-flight requests finish,
+// and http_server_shutdown_drain_duration_seconds the time they took.
+func (m *Metrics) ObserveShutdown() ServerOption {
+	draining := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "http_server_shutdown_draining",
+		Help: "Whether the server is draining its requests to shut down.",
+	})
+	drain := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "http_server_shutdown_drain_duration_seconds",
+		Help: "Time the last shutdown took to drain the requests in flight.",
+	})
+	m.registerer.MustRegister(draining, drain)
+
+	return func(s *Server) {
+		WithOnShutdown(func() { draining.Set(1) })(s)
+		WithOnDrained(func(d time.Duration) {
+			draining.Set(0)
+			drain.Set(d.Seconds())
+		})(s)
+	}
+}
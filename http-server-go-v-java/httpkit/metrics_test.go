@@ -0,0 +1,207 @@
+package httpkit
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// series returns the count and sum of the duration histogram by
+// "method route status".
+func series(t *testing.T, m *Metrics) map[string][2]float64 {
+	t.Helper()
+
+	families, err := m.gatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string][2]float64{}
+	for _, f := range families {
+		if f.GetName() != "http_server_request_duration_seconds" {
+			continue
+		}
+		for _, metric := range f.GetMetric() {
+			labels := map[string]string{}
+			for _, l := range metric.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			key := labels["http_request_method"] + " " + labels["http_route"] + " " + labels["http_response_status_code"]
+			h := metric.GetHistogram()
+			got[key] = [2]float64{float64(h.GetSampleCount()), h.GetSampleSum()}
+		}
+	}
+
+	return got
+}
+
+func TestMetrics(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/items/{id}", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "{}")
+	})
+	mux.HandleFunc("/fail", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	tests := []struct {
+		name string
+		opts []MetricsOption
+	}{
+		{"routes from the mux", []MetricsOption{WithMetricsRoutes(mux)}},
+		{"routes after the handler", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewMetrics(tt.opts...)
+			// Every request takes 50ms on the fake clock
+			now := time.Unix(0, 0)
+			m.now = func() time.Time {
+				now = now.Add(50 * time.Millisecond)
+				return now
+			}
+			handler := m.Middleware()(mux)
+			for _, r := range []struct{ method, path string }{
+				{http.MethodGet, "/api/v1/items/1"},
+				{http.MethodGet, "/api/v1/items/2"},
+				{http.MethodPost, "/fail"},
+				{http.MethodGet, "/nope"},
+				{"BREW", "/fail"},
+			} {
+				handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(r.method, r.path, nil))
+			}
+
+			want := map[string][2]float64{
+				"GET /api/v1/items/{id} 200": {2, 0.1},
+				"POST /fail 500":             {1, 0.05},
+				"_OTHER /fail 500":           {1, 0.05},
+				"GET unmatched 404":          {1, 0.05},
+			}
+			got := series(t, m)
+			if len(got) != len(want) {
+				t.Errorf("series = %v, want %v", got, want)
+			}
+			for key, w := range want {
+				if g := got[key]; g[0] != w[0] || g[1] < w[1]-1e-9 || g[1] > w[1]+1e-9 {
+					t.Errorf("%s: count, sum = %v, want %v", key, g, w)
+				}
+			}
+		})
+	}
+}
+
+func TestMetricsActiveRequests(t *testing.T) {
+	m := NewMetrics()
+	var during float64
+	handler := m.Middleware()(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		during = testutil.ToFloat64(m.active.WithLabelValues(http.MethodGet))
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if after := testutil.ToFloat64(m.active.WithLabelValues(http.MethodGet)); during != 1 || after != 0 {
+		t.Errorf("active requests = %v during and %v after, want 1 and 0", during, after)
+	}
+}
+
+func TestMetricsLimiter(t *testing.T) {
+	m := NewMetrics()
+	l := NewAdaptiveLimiter(WithLimits(1, 1, 1), WithQueue(0, 0))
+	m.ObserveLimiter(l)
+
+	done, _ := l.Acquire(context.Background(), PriorityNormal)
+	defer done()
+	_, _ = l.Acquire(context.Background(), PriorityNormal)
+
+	want := `
+# HELP http_server_limiter_in_flight Requests holding a slot of the limiter.
+# TYPE http_server_limiter_in_flight gauge
+http_server_limiter_in_flight 1
+# HELP http_server_limiter_limit Current adaptive concurrency limit.
+# TYPE http_server_limiter_limit gauge
+http_server_limiter_limit 1
+# HELP http_server_limiter_queued Requests waiting for a slot of the limiter.
+# TYPE http_server_limiter_queued gauge
+http_server_limiter_queued 0
+# HELP http_server_limiter_rejected_requests_total Requests shed by the concurrency limiter.
+# TYPE http_server_limiter_rejected_requests_total counter
+http_server_limiter_rejected_requests_total 1
+`
+	if err := testutil.GatherAndCompare(m.gatherer, strings.NewReader(want),
+		"http_server_limiter_in_flight", "http_server_limiter_limit",
+		"http_server_limiter_queued", "http_server_limiter_rejected_requests_total"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMetricsShutdown(t *testing.T) {
+	m := NewMetrics()
+	started := make(chan struct{})
+	var draining float64
+	handler := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		draining = gatherValue(t, m, "http_server_shutdown_draining")
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	url, errs := startServer(t, ctx, handler, WithSignals(), m.ObserveShutdown())
+	go func() {
+		if resp, err := http.Get(url); err == nil {
+			_ = resp.Body.Close()
+		}
+	}()
+	<-started
+	cancel()
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	if draining != 1 {
+		t.Errorf("draining during the shutdown = %v, want 1", draining)
+	}
+	if got := gatherValue(t, m, "http_server_shutdown_draining"); got != 0 {
+		t.Errorf("draining after the shutdown = %v, want 0", got)
+	}
+	if got := gatherValue(t, m, "http_server_shutdown_drain_duration_seconds"); got < 0.05 || got > 5 {
+		t.Errorf("drain duration = %vs, want about the 0.1s of the request left", got)
+	}
+}
+
+// gatherValue returns the value of a gauge without labels.
+func gatherValue(t *testing.T, m *Metrics, name string) float64 {
+	t.Helper()
+
+	families, err := m.gatherer.Gather()
+	if err != nil {
+		t.Error(err)
+
+		return 0
+	}
+	for _, f := range families {
+		if f.GetName() == name {
+			return f.GetMetric()[0].GetGauge().GetValue()
+		}
+	}
+	t.Errorf("no metric %s", name)
+
+	return 0
+}
+
+func TestMetricsHandler(t *testing.T) {
+	m := NewMetrics()
+	m.Middleware()(http.NotFoundHandler()).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, want := range []string{"http_server_request_duration_seconds_count", "http_server_active_requests", "go_goroutines", "process_"} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("/metrics doesn't contain %s", want)
+		}
+	}
+}
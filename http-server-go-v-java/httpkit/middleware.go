@@ -0,0 +1,324 @@
+// Package httpkit is the production groundwork of an HTTP service: a server
+// with timeouts and graceful shutdown, and the middlewares every service
+// needs, so that they are imported instead of copied.
+package httpkit
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Middleware wraps a handler.
+type Middleware func(http.Handler) http.Handler
+
+// Chain is a list of middlewares, the first one being the outermost.
+type Chain []Middleware
+
+// NewChain creates a chain of the middlewares.
+func NewChain(m ...Middleware) Chain {
+	return Chain(m)
+}
+
+// Append returns a new chain with the middlewares added at the end, leaving
+// c unchanged.
+func (c Chain) Append(m ...Middleware) Chain {
+	return append(c[:len(c):len(c)], m...)
+}
+
+// Then wraps the handler with the chain, so that a request goes through the
+// middlewares in order before reaching h.
+func (c Chain) Then(h http.Handler) http.Handler {
+	for i := len(c) - 1; i >= 0; i-- {
+		h = c[i](h)
+	}
+
+	return h
+}
+
+// ---- request ID ----
+
+type requestIDKey struct{}
+
+// RequestIDFromContext returns the ID set by the RequestID middleware, or ""
+// outside of it.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+
+	return id
+}
+
+type requestIDOptions struct {
+	header   string
+	generate func() string
+}
+
+// RequestIDOption configures the RequestID middleware.
+type RequestIDOption func(*requestIDOptions)
+
+// WithRequestIDHeader sets the response header of the ID, X-Request-ID by
+// default.
+func WithRequestIDHeader(name string) RequestIDOption {
+	return func(o *requestIDOptions) {
+		o.header = name
+	}
+}
+
+// WithRequestIDGenerator replaces the random hex IDs. The generator is
+// called concurrently.
+func WithRequestIDGenerator(generate func() string) RequestIDOption {
+	return func(o *requestIDOptions) {
+		o.generate = generate
+	}
+}
+
+// newRequestID is 16 random hex digits. The functions of math/rand/v2 are
+// safe for concurrent use, each goroutine drawing from its own state.
+func newRequestID() string {
+	return fmt.Sprintf("%016x", rand.Uint64())
+}
+
+// validRequestID tells whether an inbound ID can be taken as is: at most 128
+// letters, digits and -_.:+/= so that it can't forge a log line or header.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range []byte(id) {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case strings.IndexByte("-_.:+/=", c) >= 0:
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// RequestID gives every request an ID, stored in its context and sent back
+// in a response header. A valid ID in the same request header, from a
+// client or a proxy, is kept so that the logs of the services match.
+func RequestID(opts ...RequestIDOption) Middleware {
+	o := requestIDOptions{
+		header:   "X-Request-ID",
+		generate: newRequestID,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(o.header)
+			if !validRequestID(id) {
+				id = o.generate()
+			}
+			ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+			w.Header().Set(o.header, id)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// ---- logging ----
+
+type loggerKey struct{}
+
+// LoggerFromContext returns the logger of the request, which adds its ID to
+// every record, or slog.Default() outside of the Logging middleware.
+func LoggerFromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+
+	return slog.Default()
+}
+
+type loggingOptions struct {
+	logger *slog.Logger
+	now    func() time.Time
+}
+
+// LoggingOption configures the Logging middleware.
+type LoggingOption func(*loggingOptions)
+
+// WithLogger sets the logger, JSON on stderr by default.
+func WithLogger(logger *slog.Logger) LoggingOption {
+	return func(o *loggingOptions) {
+		o.logger = logger
+	}
+}
+
+// Logging logs the method, path, status, response size, duration and
+// request ID of every request once it is handled, and gives the handler a
+// logger with the ID through LoggerFromContext. After Tracing, the records
+// carry the trace and span IDs too. A panic in the handler is
+// logged with its stack and answered with a 500 if nothing was sent yet.
+// It must come after RequestID in the chain to see the ID.
+func Logging(opts ...LoggingOption) Middleware {
+	o := loggingOptions{logger: slog.New(slog.NewJSONHandler(os.Stderr, nil)), now: time.Now}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := o.now()
+			logger := o.logger
+			if id := RequestIDFromContext(r.Context()); id != "" {
+				logger = logger.With(slog.String("request_id", id))
+			}
+			if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+				logger = logger.With(slog.String("trace_id", sc.TraceID().String()), slog.String("span_id", sc.SpanID().String()))
+			}
+			rw := &responseWriter{ResponseWriter: w}
+
+			defer func() {
+				level := slog.LevelInfo
+				var panicAttrs []slog.Attr
+				if v := recover(); v != nil {
+					// ErrAbortHandler is the way to abort a response on purpose
+					if v == http.ErrAbortHandler {
+						panic(v)
+					}
+					if !rw.wroteHeader {
+						http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+					}
+					level = slog.LevelError
+					panicAttrs = []slog.Attr{slog.Any("panic", v), slog.String("stack", string(debug.Stack()))}
+				}
+				if rw.statusCode() >= http.StatusInternalServerError {
+					level = slog.LevelError
+				}
+				attrs := append([]slog.Attr{
+					slog.String("method", r.Method),
+					slog.String("path", r.URL.Path),
+					slog.Int("status", rw.statusCode()),
+					slog.Int64("bytes", rw.bytes),
+					slog.Duration("duration", o.now().Sub(start)),
+				}, panicAttrs...)
+				logger.LogAttrs(r.Context(), level, "request", attrs...)
+			}()
+
+			ctx := context.WithValue(r.Context(), loggerKey{}, logger)
+			next.ServeHTTP(rw, r.WithContext(ctx))
+		})
+	}
+}
+
+// responseWriter records the status and size of the response.
+type responseWriter struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+func (w *responseWriter) WriteHeader(code int) {
+	// 1xx responses are informational, the final status comes after
+	if !w.wroteHeader && code >= 200 {
+		w.status = code
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+
+	return n, err
+}
+
+// Flush keeps streaming handlers working through the wrapper.
+func (w *responseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	_ = http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the other features of the
+// underlying writer.
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// statusCode is the status sent, 200 if the handler wrote nothing.
+func (w *responseWriter) statusCode() int {
+	if !w.wroteHeader {
+		return http.StatusOK
+	}
+
+	return w.status
+}
+
+// ---- backpressure ----
+
+type limitOptions struct {
+	reject http.Handler
+}
+
+// LimitOption configures the LimitConcurrency middleware.
+type LimitOption func(*limitOptions)
+
+// WithRejectHandler replaces the 429 "too many requests" response of the
+// requests over the limit.
+func WithRejectHandler(h http.Handler) LimitOption {
+	return func(o *limitOptions) {
+		o.reject = h
+	}
+}
+
+// LimitConcurrency serves at most max requests at once and rejects the
+// others right away, instead of queueing them until they time out.
+func LimitConcurrency(max int, opts ...LimitOption) Middleware {
+	o := limitOptions{
+		reject: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+		}),
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	sem := make(chan struct{}, max)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+				next.ServeHTTP(w, r)
+			default:
+				o.reject.ServeHTTP(w, r)
+			}
+		})
+	}
+}
+
+// ---- deadlines ----
+
+// Deadline gives every request a context deadline d after it starts, so that
+// its calls downstream give up in time for the response. d is usually the
+// write timeout of the server, after which the response is lost anyway.
+func Deadline(d time.Duration) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), d)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
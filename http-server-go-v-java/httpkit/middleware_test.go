@@ -0,0 +1,376 @@
+package httpkit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tag is a middleware appending its name to the X-Order header.
+func tag(name string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("X-Order", name)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func TestChain(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Add("X-Order", "handler")
+	})
+
+	base := NewChain(tag("a"), tag("b"))
+	tests := []struct {
+		name  string
+		chain Chain
+		want  string
+	}{
+		{"empty", NewChain(), "handler"},
+		{"in order", base, "a,b,handler"},
+		{"appended", base.Append(tag("c")), "a,b,c,handler"},
+		// Appending to base again must not overwrite "c" above
+		{"appended again", base.Append(tag("d")), "a,b,d,handler"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			tt.chain.Then(handler).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if got := strings.Join(rec.Header().Values("X-Order"), ","); got != tt.want {
+				t.Errorf("order = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	var seen string
+	handler := http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		seen = RequestIDFromContext(r.Context())
+	})
+
+	tests := []struct {
+		name   string
+		opts   []RequestIDOption
+		header string
+		want   string
+	}{
+		{"default", nil, "X-Request-ID", ""},
+		{"custom header", []RequestIDOption{WithRequestIDHeader("X-Trace")}, "X-Trace", ""},
+		{"custom generator", []RequestIDOption{WithRequestIDGenerator(func() string { return "fixed" })}, "X-Request-ID", "fixed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			RequestID(tt.opts...)(handler).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			got := rec.Header().Get(tt.header)
+			if got == "" || got != seen {
+				t.Errorf("header %s = %q, context = %q, want the same ID", tt.header, got, seen)
+			}
+			if tt.want != "" && got != tt.want {
+				t.Errorf("ID = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if got := RequestIDFromContext(httptest.NewRequest(http.MethodGet, "/", nil).Context()); got != "" {
+		t.Errorf("RequestIDFromContext() outside the middleware = %q, want empty", got)
+	}
+}
+
+func TestRequestIDInbound(t *testing.T) {
+	handler := RequestID(WithRequestIDGenerator(func() string { return "generated" }))(
+		http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+	tests := []struct {
+		name    string
+		inbound string
+		want    string
+	}{
+		{"none", "", "generated"},
+		{"kept", "7f3a-proxy.42", "7f3a-proxy.42"},
+		{"uuid", "0f8fad5b-d9cb-469f-a165-70867728950e", "0f8fad5b-d9cb-469f-a165-70867728950e"},
+		{"forged log line", "abc\nlevel=ERROR", "generated"},
+		{"spaces", "a b", "generated"},
+		{"too long", strings.Repeat("a", 129), "generated"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("X-Request-ID", tt.inbound)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, r)
+
+			if got := rec.Header().Get("X-Request-ID"); got != tt.want {
+				t.Errorf("ID = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewRequestID(t *testing.T) {
+	for range 100 {
+		if id := newRequestID(); len(id) != 16 || !validRequestID(id) {
+			t.Fatalf("newRequestID() = %q, want 16 hex digits", id)
+		}
+	}
+}
+
+func TestRequestIDConcurrent(t *testing.T) {
+	handler := RequestID()(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+	var mu sync.Mutex
+	ids := map[string]bool{}
+	var wg sync.WaitGroup
+	for range 50 {
+		wg.Go(func() {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+			mu.Lock()
+			ids[rec.Header().Get("X-Request-ID")] = true
+			mu.Unlock()
+		})
+	}
+	wg.Wait()
+
+	if len(ids) != 50 {
+		t.Errorf("got %d distinct IDs for 50 requests", len(ids))
+	}
+}
+
+// decodeLogs parses the JSON records of buf.
+func decodeLogs(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+
+	var records []map[string]any
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var record map[string]any
+		if err := dec.Decode(&record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+
+	return records
+}
+
+func TestLogging(t *testing.T) {
+	// A fake clock makes the duration predictable
+	now := time.Unix(0, 0)
+	clock := func(o *loggingOptions) {
+		o.now = func() time.Time {
+			now = now.Add(50 * time.Millisecond)
+			return now
+		}
+	}
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		status  int
+		bytes   float64
+		level   string
+		panic   bool
+	}{
+		{"implicit 200", func(http.ResponseWriter, *http.Request) {}, 200, 0, "INFO", false},
+		{"body", func(w http.ResponseWriter, _ *http.Request) {
+			_, _ = io.WriteString(w, "hello")
+		}, 200, 5, "INFO", false},
+		{"status", func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = io.WriteString(w, "nope")
+		}, 404, 4, "INFO", false},
+		{"server error", func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusBadGateway)
+		}, 502, 0, "ERROR", false},
+		{"panic", func(http.ResponseWriter, *http.Request) {
+			panic("boom")
+		}, 500, 22, "ERROR", true},
+		{"panic after the header", func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusAccepted)
+			panic("boom")
+		}, 202, 0, "ERROR", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logging := Logging(WithLogger(slog.New(slog.NewJSONHandler(&buf, nil))), clock)
+			handler := NewChain(RequestID(WithRequestIDGenerator(func() string { return "abc" })), logging).Then(tt.handler)
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v1/items/7", nil))
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+
+			records := decodeLogs(t, &buf)
+			if len(records) != 1 {
+				t.Fatalf("got %d records, want 1", len(records))
+			}
+			r := records[0]
+			want := map[string]any{
+				"level":      tt.level,
+				"msg":        "request",
+				"method":     "POST",
+				"path":       "/api/v1/items/7",
+				"status":     float64(tt.status),
+				"bytes":      tt.bytes,
+				"duration":   float64(50 * time.Millisecond),
+				"request_id": "abc",
+			}
+			for key, value := range want {
+				if r[key] != value {
+					t.Errorf("%s = %v, want %v", key, r[key], value)
+				}
+			}
+			if _, ok := r["panic"]; ok != tt.panic {
+				t.Errorf("panic logged = %v, want %v", ok, tt.panic)
+			}
+			if stack, _ := r["stack"].(string); tt.panic && !strings.Contains(stack, "middleware_test.go") {
+				t.Errorf("stack = %q, want the handler in it", stack)
+			}
+		})
+	}
+}
+
+func TestLoggingAbortHandler(t *testing.T) {
+	logging := Logging(WithLogger(slog.New(slog.NewJSONHandler(io.Discard, nil))))
+	handler := logging(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+
+	defer func() {
+		if v := recover(); v != http.ErrAbortHandler {
+			t.Errorf("recovered %v, want http.ErrAbortHandler to go through", v)
+		}
+	}()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+}
+
+func TestLoggerFromContext(t *testing.T) {
+	var buf bytes.Buffer
+	logging := Logging(WithLogger(slog.New(slog.NewJSONHandler(&buf, nil))))
+	handler := NewChain(RequestID(WithRequestIDGenerator(func() string { return "abc" })), logging).
+		Then(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+			LoggerFromContext(r.Context()).Info("inside", slog.Int("n", 1))
+		}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	records := decodeLogs(t, &buf)
+	if len(records) != 2 {
+		t.Fatalf("got %d records, want 2", len(records))
+	}
+	if r := records[0]; r["msg"] != "inside" || r["request_id"] != "abc" || r["n"] != float64(1) {
+		t.Errorf("handler record = %v, want the request ID attached", r)
+	}
+
+	if got := LoggerFromContext(context.Background()); got != slog.Default() {
+		t.Errorf("LoggerFromContext() outside the middleware = %v, want slog.Default()", got)
+	}
+}
+
+func TestResponseWriterFlush(t *testing.T) {
+	logging := Logging(WithLogger(slog.New(slog.NewJSONHandler(io.Discard, nil))))
+	handler := logging(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if _, ok := w.(http.Flusher); !ok {
+			t.Error("wrapped writer isn't an http.Flusher")
+		}
+		if err := http.NewResponseController(w).Flush(); err != nil {
+			t.Errorf("Flush() = %v", err)
+		}
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if !rec.Flushed {
+		t.Error("response wasn't flushed")
+	}
+}
+
+func TestLimitConcurrency(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+	slow := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		started <- struct{}{}
+		<-release
+	})
+
+	tests := []struct {
+		name       string
+		opts       []LimitOption
+		wantStatus int
+	}{
+		{"default", nil, http.StatusTooManyRequests},
+		{"reject handler", []LimitOption{WithRejectHandler(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))}, http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := LimitConcurrency(2, tt.opts...)(slow)
+
+			var wg sync.WaitGroup
+			for range 2 {
+				wg.Go(func() {
+					rec := httptest.NewRecorder()
+					handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+					if rec.Code != http.StatusOK {
+						t.Errorf("request under the limit status = %d, want 200", rec.Code)
+					}
+				})
+			}
+			<-started
+			<-started
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+			if rec.Code != tt.wantStatus {
+				t.Errorf("request over the limit status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+
+			// A slot is free again once a request is done
+			release <- struct{}{}
+			release <- struct{}{}
+			wg.Wait()
+			go func() { <-started; release <- struct{}{} }()
+			rec = httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+			if rec.Code != http.StatusOK {
+				t.Errorf("request after the others finished status = %d, want 200", rec.Code)
+			}
+		})
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	var (
+		deadline time.Time
+		ok       bool
+	)
+	handler := Deadline(time.Second)(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		deadline, ok = r.Context().Deadline()
+	}))
+	start := time.Now()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if left := deadline.Sub(start); !ok || left < time.Second || left > 1500*time.Millisecond {
+		t.Errorf("deadline in %s (set %v), want in 1s", left, ok)
+	}
+}
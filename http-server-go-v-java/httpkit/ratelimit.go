@@ -0,0 +1,303 @@
+package httpkit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rate is a number of requests per period, which may all come at once.
+type Rate struct {
+	Limit  int
+	Period time.Duration
+}
+
+// Interval is the time a request takes back from the quota.
+func (r Rate) Interval() time.Duration {
+	return r.Period / time.Duration(r.Limit)
+}
+
+// RateResult is the answer of a RateStore for one request.
+type RateResult struct {
+	Allowed bool
+	// Remaining is the requests still allowed right away
+	Remaining int
+	// Reset is the time until the whole quota is available again
+	Reset time.Duration
+	// RetryAfter is the time until the next request is allowed, if this one
+	// wasn't
+	RetryAfter time.Duration
+}
+
+// RateStore keeps the state of the rate limits. It is a token bucket kept
+// as a single time per key (GCRA): the time at which the bucket is full
+// again, so that a store only needs to update it atomically.
+type RateStore interface {
+	Allow(ctx context.Context, key string, rate Rate, now time.Time) (RateResult, error)
+}
+
+// GCRA takes a request from the bucket full at tat, returning the new tat
+// to store if the request is allowed. A zero tat is a full bucket. Stores
+// which can't run Go next to the data implement the same.
+func GCRA(rate Rate, tat, now time.Time) (newTAT time.Time, result RateResult) {
+	interval := rate.Interval()
+	if tat.Before(now) {
+		tat = now
+	}
+	newTAT = tat.Add(interval)
+	allowAt := newTAT.Add(-rate.Period)
+	if now.Before(allowAt) {
+		return tat, RateResult{Reset: tat.Sub(now), RetryAfter: allowAt.Sub(now)}
+	}
+	reset := newTAT.Sub(now)
+
+	return newTAT, RateResult{
+		Allowed:   true,
+		Remaining: rate.Limit - int((reset+interval-1)/interval),
+		Reset:     reset,
+	}
+}
+
+// MemoryStore is a RateStore in memory, for a single instance.
+type MemoryStore struct {
+	mu    sync.Mutex
+	tats  map[string]time.Time
+	calls int
+}
+
+// NewMemoryStore creates an empty store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{tats: map[string]time.Time{}}
+}
+
+// Allow implements RateStore.
+func (s *MemoryStore) Allow(_ context.Context, key string, rate Rate, now time.Time) (RateResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The full buckets are dropped once in a while, the same as missing ones
+	if s.calls++; s.calls%1000 == 0 {
+		for k, tat := range s.tats {
+			if !tat.After(now) {
+				delete(s.tats, k)
+			}
+		}
+	}
+
+	tat, result := GCRA(rate, s.tats[key], now)
+	s.tats[key] = tat
+
+	return result, nil
+}
+
+// Len returns the number of keys kept.
+func (s *MemoryStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.tats)
+}
+
+// ---- rate limit keys ----
+
+// KeyFunc returns the key a request is rate limited by. An empty key
+// leaves the request out of the limit.
+type KeyFunc func(*http.Request) string
+
+// ClientIP keys by the IP of the client. X-Forwarded-For is trusted only
+// from the proxies, read from the right to the first address that isn't
+// one of them: the left part can be made up by the client.
+func ClientIP(trustedProxies ...netip.Prefix) KeyFunc {
+	trusted := func(addr netip.Addr) bool {
+		for _, p := range trustedProxies {
+			if p.Contains(addr) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	return func(r *http.Request) string {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		client, err := netip.ParseAddr(host)
+		if err != nil {
+			return "ip:" + host
+		}
+		client = client.Unmap()
+
+		hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+		for i := len(hops) - 1; i >= 0 && trusted(client); i-- {
+			hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+			if err != nil {
+				break
+			}
+			client = hop.Unmap()
+		}
+
+		return "ip:" + client.String()
+	}
+}
+
+// Header keys by a request header like an API key, hashed so that the
+// store doesn't hold secrets. Requests without it are left out.
+func Header(name string) KeyFunc {
+	return func(r *http.Request) string {
+		value := r.Header.Get(name)
+		if value == "" {
+			return ""
+		}
+		sum := sha256.Sum256([]byte(value))
+
+		return strings.ToLower(name) + ":" + hex.EncodeToString(sum[:8])
+	}
+}
+
+// Route keys by the pattern of mux matching the request, so that every
+// route has its own limit whatever its path values.
+func Route(mux *http.ServeMux) KeyFunc {
+	return func(r *http.Request) string {
+		_, pattern := mux.Handler(r)
+
+		return "route:" + pattern
+	}
+}
+
+// FirstKey keys by the first non-empty key, e.g. the API key and else the
+// client IP.
+func FirstKey(keys ...KeyFunc) KeyFunc {
+	return func(r *http.Request) string {
+		for _, key := range keys {
+			if k := key(r); k != "" {
+				return k
+			}
+		}
+
+		return ""
+	}
+}
+
+// JoinKeys keys by all the keys together, e.g. the route and the client IP
+// for a limit per client and route. A request is left out if one is empty.
+func JoinKeys(keys ...KeyFunc) KeyFunc {
+	return func(r *http.Request) string {
+		parts := make([]string, len(keys))
+		for i, key := range keys {
+			if parts[i] = key(r); parts[i] == "" {
+				return ""
+			}
+		}
+
+		return strings.Join(parts, "|")
+	}
+}
+
+// ---- rate limit ----
+
+type rateLimitOptions struct {
+	prefix     string
+	failClosed bool
+	reject     http.Handler
+	now        func() time.Time
+}
+
+// RateLimitOption configures the RateLimit middleware.
+type RateLimitOption func(*rateLimitOptions)
+
+// WithKeyPrefix sets the prefix of the keys in the store, "ratelimit:" by
+// default, to tell several limits sharing a store apart.
+func WithKeyPrefix(prefix string) RateLimitOption {
+	return func(o *rateLimitOptions) {
+		o.prefix = prefix
+	}
+}
+
+// WithFailClosed rejects the requests when the store fails, instead of
+// letting them through.
+func WithFailClosed() RateLimitOption {
+	return func(o *rateLimitOptions) {
+		o.failClosed = true
+	}
+}
+
+// WithRateLimitRejectHandler replaces the 429 "rate limit exceeded"
+// response. The headers are set before it is called.
+func WithRateLimitRejectHandler(h http.Handler) RateLimitOption {
+	return func(o *rateLimitOptions) {
+		o.reject = h
+	}
+}
+
+// RateLimit allows rate requests per key, answering the others with a 429
+// and a Retry-After header. Every response carries the RateLimit-Limit,
+// RateLimit-Remaining, RateLimit-Reset and RateLimit-Policy headers of the
+// IETF draft. A store failing is logged and lets the requests through,
+// see WithFailClosed.
+func RateLimit(store RateStore, rate Rate, key KeyFunc, opts ...RateLimitOption) Middleware {
+	o := rateLimitOptions{
+		prefix: "ratelimit:",
+		reject: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+		}),
+		now: time.Now,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	limit := strconv.Itoa(rate.Limit)
+	policy := limit + ";w=" + seconds(rate.Period)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			k := key(r)
+			if k == "" {
+				next.ServeHTTP(w, r)
+
+				return
+			}
+
+			result, err := store.Allow(r.Context(), o.prefix+k, rate, o.now())
+			if err != nil {
+				LoggerFromContext(r.Context()).Error("rate limit store failed", slog.Any("error", err))
+				if o.failClosed {
+					http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+
+					return
+				}
+				next.ServeHTTP(w, r)
+
+				return
+			}
+
+			h := w.Header()
+			h.Set("RateLimit-Limit", limit)
+			h.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+			h.Set("RateLimit-Reset", seconds(result.Reset))
+			h.Set("RateLimit-Policy", policy)
+			if !result.Allowed {
+				h.Set("Retry-After", seconds(result.RetryAfter))
+				o.reject.ServeHTTP(w, r)
+
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// seconds formats d in whole seconds, rounded up.
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
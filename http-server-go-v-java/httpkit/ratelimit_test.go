@@ -0,0 +1,225 @@
+package httpkit
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestGCRA(t *testing.T) {
+	rate := Rate{Limit: 3, Period: 3 * time.Second}
+	start := time.Unix(1000, 0)
+
+	tests := []struct {
+		name       string
+		after      time.Duration
+		allowed    bool
+		remaining  int
+		reset      time.Duration
+		retryAfter time.Duration
+	}{
+		{"first", 0, true, 2, time.Second, 0},
+		{"second", 0, true, 1, 2 * time.Second, 0},
+		{"third", 0, true, 0, 3 * time.Second, 0},
+		{"over the burst", 0, false, 0, 3 * time.Second, time.Second},
+		{"still over", 500 * time.Millisecond, false, 0, 2500 * time.Millisecond, 500 * time.Millisecond},
+		{"one token back", 500 * time.Millisecond, true, 0, 3 * time.Second, 0},
+		{"after a long pause", time.Minute, true, 2, time.Second, 0},
+	}
+
+	var tat time.Time
+	now := start
+	for _, tt := range tests {
+		now = now.Add(tt.after)
+		var got RateResult
+		tat, got = GCRA(rate, tat, now)
+
+		want := RateResult{Allowed: tt.allowed, Remaining: tt.remaining, Reset: tt.reset, RetryAfter: tt.retryAfter}
+		if got != want {
+			t.Errorf("%s: GCRA() = %+v, want %+v", tt.name, got, want)
+		}
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	s := NewMemoryStore()
+	rate := Rate{Limit: 1, Period: time.Second}
+	now := time.Unix(1000, 0)
+
+	// Keys are limited separately
+	for _, key := range []string{"a", "b"} {
+		if r, _ := s.Allow(context.Background(), key, rate, now); !r.Allowed {
+			t.Errorf("first request of %s not allowed", key)
+		}
+	}
+	if r, _ := s.Allow(context.Background(), "a", rate, now); r.Allowed {
+		t.Error("second request of a allowed")
+	}
+
+	// The full buckets are dropped
+	later := now.Add(time.Hour)
+	for range 1000 {
+		_, _ = s.Allow(context.Background(), "c", rate, later)
+		later = later.Add(time.Second)
+	}
+	if got := s.Len(); got != 1 {
+		t.Errorf("Len() = %d, want only c left", got)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	proxies := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("::1/128")}
+
+	tests := []struct {
+		name   string
+		remote string
+		xff    []string
+		want   string
+	}{
+		{"direct", "203.0.113.7:4242", nil, "ip:203.0.113.7"},
+		{"untrusted proxy", "203.0.113.7:4242", []string{"198.51.100.1"}, "ip:203.0.113.7"},
+		{"trusted proxy", "10.0.0.2:4242", []string{"198.51.100.1"}, "ip:198.51.100.1"},
+		{"spoofed left part", "10.0.0.2:4242", []string{"1.2.3.4, 198.51.100.1"}, "ip:198.51.100.1"},
+		{"proxy chain", "10.0.0.2:4242", []string{"198.51.100.1, 10.0.0.3"}, "ip:198.51.100.1"},
+		{"several headers", "10.0.0.2:4242", []string{"198.51.100.1", "10.0.0.3"}, "ip:198.51.100.1"},
+		{"only proxies", "10.0.0.2:4242", []string{"10.0.0.3"}, "ip:10.0.0.3"},
+		{"invalid hop", "10.0.0.2:4242", []string{"198.51.100.1, garbage"}, "ip:10.0.0.2"},
+		{"IPv6", "[::1]:4242", []string{"2001:db8::1"}, "ip:2001:db8::1"},
+		{"IPv4 in IPv6", "[::ffff:203.0.113.7]:4242", nil, "ip:203.0.113.7"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remote
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+
+			if got := ClientIP(proxies...)(r); got != tt.want {
+				t.Errorf("ClientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeys(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/items/{id}", func(http.ResponseWriter, *http.Request) {})
+
+	withKey := httptest.NewRequest(http.MethodGet, "/api/v1/items/7", nil)
+	withKey.RemoteAddr = "203.0.113.7:4242"
+	withKey.Header.Set("X-API-Key", "secret")
+	withoutKey := httptest.NewRequest(http.MethodGet, "/api/v1/items/8", nil)
+	withoutKey.RemoteAddr = "203.0.113.7:4242"
+
+	tests := []struct {
+		name string
+		key  KeyFunc
+		r    *http.Request
+		want string
+	}{
+		{"header", Header("X-API-Key"), withKey, "x-api-key:2bb80d537b1da3e3"},
+		{"no header", Header("X-API-Key"), withoutKey, ""},
+		{"route", Route(mux), withoutKey, "route:/api/v1/items/{id}"},
+		{"first key", FirstKey(Header("X-API-Key"), ClientIP()), withKey, "x-api-key:2bb80d537b1da3e3"},
+		{"first key fallback", FirstKey(Header("X-API-Key"), ClientIP()), withoutKey, "ip:203.0.113.7"},
+		{"joined", JoinKeys(Route(mux), ClientIP()), withoutKey, "route:/api/v1/items/{id}|ip:203.0.113.7"},
+		{"joined with an empty key", JoinKeys(Route(mux), Header("X-API-Key")), withoutKey, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.key(tt.r); got != tt.want {
+				t.Errorf("key = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// failingStore is a RateStore which is down.
+type failingStore struct{}
+
+func (failingStore) Allow(context.Context, string, Rate, time.Time) (RateResult, error) {
+	return RateResult{}, errors.New("connection refused")
+}
+
+func TestRateLimit(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	rate := Rate{Limit: 2, Period: time.Minute}
+	now := time.Unix(1000, 0)
+	clock := func(o *rateLimitOptions) {
+		o.now = func() time.Time { return now }
+	}
+	skipHealth := func(r *http.Request) string {
+		if r.URL.Path == "/health" {
+			return ""
+		}
+
+		return ClientIP()(r)
+	}
+	handler := RateLimit(NewMemoryStore(), rate, skipHealth, clock)(ok)
+
+	tests := []struct {
+		name       string
+		path       string
+		status     int
+		headers    map[string]string
+		retryAfter string
+	}{
+		{"first", "/", 200, map[string]string{"RateLimit-Limit": "2", "RateLimit-Remaining": "1", "RateLimit-Reset": "30", "RateLimit-Policy": "2;w=60"}, ""},
+		{"second", "/", 200, map[string]string{"RateLimit-Remaining": "0", "RateLimit-Reset": "60"}, ""},
+		{"limited", "/", 429, map[string]string{"RateLimit-Remaining": "0", "RateLimit-Reset": "60"}, "30"},
+		{"left out", "/health", 200, map[string]string{"RateLimit-Limit": ""}, ""},
+	}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+		if rec.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.name, rec.Code, tt.status)
+		}
+		for name, want := range tt.headers {
+			if got := rec.Header().Get(name); got != want {
+				t.Errorf("%s: %s = %q, want %q", tt.name, name, got, want)
+			}
+		}
+		if got := rec.Header().Get("Retry-After"); got != tt.retryAfter {
+			t.Errorf("%s: Retry-After = %q, want %q", tt.name, got, tt.retryAfter)
+		}
+	}
+}
+
+func TestRateLimitStoreFailure(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		name   string
+		opts   []RateLimitOption
+		status int
+	}{
+		{"fail open", nil, http.StatusOK},
+		{"fail closed", []RateLimitOption{WithFailClosed()}, http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			RateLimit(failingStore{}, Rate{Limit: 1, Period: time.Second}, ClientIP(), tt.opts...)(ok).
+				ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+// Package redisstore is an httpkit.RateStore in Redis, for rate limits
+// shared by several instances.
+package redisstore
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/flashlabs/kiss-samples/http-server-go-v-java/httpkit"
+)
+
+// gcra is httpkit.GCRA in Lua, run atomically by Redis. The times are in
+// milliseconds, which Lua numbers hold exactly. It returns whether the
+// request is allowed, the time until the bucket is full and the time until
+// the next request is allowed.
+var gcra = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local interval = tonumber(ARGV[2])
+local period = tonumber(ARGV[3])
+
+local tat = tonumber(redis.call("GET", KEYS[1])) or now
+if tat < now then
+	tat = now
+end
+local new_tat = tat + interval
+local allow_at = new_tat - period
+if now < allow_at then
+	return {0, tostring(tat - now), tostring(allow_at - now)}
+end
+
+redis.call("SET", KEYS[1], tostring(new_tat), "PX", math.ceil(new_tat - now))
+return {1, tostring(new_tat - now), "0"}
+`)
+
+// Store keeps the rate limits in Redis, expiring with the full buckets.
+type Store struct {
+	client redis.Scripter
+}
+
+// New creates a store on the client, a *redis.Client or any
+// redis.UniversalClient.
+func New(client redis.Scripter) *Store {
+	return &Store{client: client}
+}
+
+// Allow implements httpkit.RateStore. The time of the instances is used,
+// which must be in sync.
+func (s *Store) Allow(ctx context.Context, key string, rate httpkit.Rate, now time.Time) (httpkit.RateResult, error) {
+	values, err := gcra.Run(ctx, s.client, []string{key},
+		milliseconds(now.Sub(time.Unix(0, 0))),
+		milliseconds(rate.Interval()),
+		milliseconds(rate.Period),
+	).Slice()
+	if err != nil {
+		return httpkit.RateResult{}, fmt.Errorf("error running the rate limit script: %w", err)
+	}
+	if len(values) != 3 {
+		return httpkit.RateResult{}, fmt.Errorf("unexpected rate limit script result %v", values)
+	}
+
+	allowed, _ := values[0].(int64)
+	var ms [2]float64
+	for i, v := range values[1:] {
+		str, _ := v.(string)
+		if ms[i], err = strconv.ParseFloat(str, 64); err != nil {
+			return httpkit.RateResult{}, fmt.Errorf("unexpected rate limit script result %v: %w", values, err)
+		}
+	}
+	reset, retryAfter := ms[0], ms[1]
+
+	result := httpkit.RateResult{
+		Allowed:    allowed == 1,
+		Reset:      duration(reset),
+		RetryAfter: duration(retryAfter),
+	}
+	if result.Allowed {
+		interval := rate.Interval()
+		result.Remaining = rate.Limit - int((result.Reset+interval-1)/interval)
+	}
+
+	return result, nil
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func duration(ms float64) time.Duration {
+	return time.Duration(math.Round(ms * float64(time.Millisecond)))
+}
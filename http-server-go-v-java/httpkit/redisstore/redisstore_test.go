@@ -0,0 +1,80 @@
+package redisstore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+
+	"github.com/flashlabs/kiss-samples/http-server-go-v-java/httpkit"
+)
+
+func newStore(t *testing.T) (*Store, *miniredis.Miniredis) {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() {
+		if err := client.Close(); err != nil {
+			t.Log("Failed to close the Redis client", err)
+		}
+	})
+
+	return New(client), mr
+}
+
+func TestStore(t *testing.T) {
+	store, _ := newStore(t)
+	memory := httpkit.NewMemoryStore()
+	rate := httpkit.Rate{Limit: 3, Period: 3 * time.Second}
+
+	// The Redis store answers the same as the in-memory one
+	now := time.Unix(1_760_000_000, 123_000_000)
+	steps := []time.Duration{0, 0, 0, 0, 500 * time.Millisecond, 500 * time.Millisecond, 0, 1700 * time.Millisecond, time.Minute}
+	for i, step := range steps {
+		now = now.Add(step)
+		want, _ := memory.Allow(context.Background(), "client", rate, now)
+		got, err := store.Allow(context.Background(), "client", rate, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("request %d: Allow() = %+v, want %+v", i, got, want)
+		}
+	}
+}
+
+func TestStoreKeys(t *testing.T) {
+	store, mr := newStore(t)
+	rate := httpkit.Rate{Limit: 1, Period: time.Minute}
+	now := time.Now()
+
+	for _, key := range []string{"a", "b"} {
+		if r, err := store.Allow(context.Background(), key, rate, now); err != nil || !r.Allowed {
+			t.Errorf("first request of %s = %+v, %v, want allowed", key, r, err)
+		}
+	}
+	if r, _ := store.Allow(context.Background(), "a", rate, now); r.Allowed {
+		t.Error("second request of a allowed")
+	}
+
+	// The keys expire with the full buckets
+	if ttl := mr.TTL("a"); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("TTL = %s, want at most the period", ttl)
+	}
+	mr.FastForward(time.Minute)
+	if mr.Exists("a") || mr.Exists("b") {
+		t.Error("keys still there after the period")
+	}
+}
+
+func TestStoreError(t *testing.T) {
+	store, mr := newStore(t)
+	mr.Close()
+
+	if _, err := store.Allow(context.Background(), "a", httpkit.Rate{Limit: 1, Period: time.Second}, time.Now()); err == nil {
+		t.Error("Allow() with Redis down = nil, want an error")
+	}
+}
@@ -0,0 +1,204 @@
+package httpkit
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Server is an http.Server with production timeouts, which shuts down
+// gracefully on SIGINT or SIGTERM.
+type Server struct {
+	server          *http.Server
+	shutdownTimeout time.Duration
+	shutdownDelay   time.Duration
+	signals         []os.Signal
+	logger          *log.Logger
+	onShutdown      []func()
+	onDrained       []func(time.Duration)
+	clock           clock
+}
+
+// ServerOption configures a Server.
+type ServerOption func(*Server)
+
+// WithAddr sets the address to listen on, :8080 by default.
+func WithAddr(addr string) ServerOption {
+	return func(s *Server) {
+		s.server.Addr = addr
+	}
+}
+
+// WithTimeouts sets the time to read a request, to write a response and to
+// keep an idle connection, 5, 10 and 60 seconds by default.
+func WithTimeouts(read, write, idle time.Duration) ServerOption {
+	return func(s *Server) {
+		s.server.ReadTimeout = read
+		s.server.WriteTimeout = write
+		s.server.IdleTimeout = idle
+	}
+}
+
+// WithReadHeaderTimeout sets the time to read the request headers, 2
+// seconds by default, which cuts slowloris clients off early.
+func WithReadHeaderTimeout(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.server.ReadHeaderTimeout = d
+	}
+}
+
+// WithMaxHeaderBytes sets the largest request headers, 1 MiB by default.
+func WithMaxHeaderBytes(n int) ServerOption {
+	return func(s *Server) {
+		s.server.MaxHeaderBytes = n
+	}
+}
+
+// WithShutdownTimeout sets how long the in-flight requests get to finish
+// after the shutdown signal, 10 seconds by default.
+func WithShutdownTimeout(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.shutdownTimeout = d
+	}
+}
+
+// WithShutdownDelay keeps serving for d once the shutdown starts, before
+// draining, for the load balancers to see the readiness failing and stop
+// routing requests here. There's no delay on a handoff, the new process
+// keeping the sockets open.
+func WithShutdownDelay(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.shutdownDelay = d
+	}
+}
+
+// WithSignals replaces the signals that trigger the shutdown, SIGINT and
+// SIGTERM by default. Without signals only the context of Run does.
+func WithSignals(signals ...os.Signal) ServerOption {
+	return func(s *Server) {
+		s.signals = signals
+	}
+}
+
+// WithServerLogger sets the logger of the server and of http.Server errors,
+// the standard logger by default.
+func WithServerLogger(logger *log.Logger) ServerOption {
+	return func(s *Server) {
+		s.logger = logger
+		s.server.ErrorLog = logger
+	}
+}
+
+// WithOnShutdown calls f when the shutdown starts, before the server stops
+// accepting requests. Every call adds a function.
+func WithOnShutdown(f func()) ServerOption {
+	return func(s *Server) {
+		s.onShutdown = append(s.onShutdown, f)
+	}
+}
+
+// WithOnDrained calls f with the time the in-flight requests took to finish
+// once the shutdown is over, in time or not. Every call adds a function.
+func WithOnDrained(f func(drain time.Duration)) ServerOption {
+	return func(s *Server) {
+		s.onDrained = append(s.onDrained, f)
+	}
+}
+
+// NewServer creates a server for the handler.
+func NewServer(handler http.Handler, opts ...ServerOption) *Server {
+	s := &Server{
+		server: &http.Server{
+			Addr:              ":8080",
+			Handler:           handler,
+			ReadTimeout:       5 * time.Second,
+			ReadHeaderTimeout: 2 * time.Second,
+			WriteTimeout:      10 * time.Second,
+			IdleTimeout:       60 * time.Second,
+			MaxHeaderBytes:    1 << 20,
+		},
+		shutdownTimeout: 10 * time.Second,
+		signals:         []os.Signal{os.Interrupt, syscall.SIGTERM},
+		logger:          log.Default(),
+		clock:           realClock{},
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// HTTPServer returns the underlying server, to tune what the options don't
+// cover before Run.
+func (s *Server) HTTPServer() *http.Server {
+	return s.server
+}
+
+// Run listens on the address and serves until ctx is done or a shutdown
+// signal arrives, then shuts down gracefully. It returns nil after a clean
+// shutdown.
+func (s *Server) Run(ctx context.Context) error {
+	ln, err := net.Listen("tcp", s.server.Addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(ctx, ln)
+}
+
+// Serve is Run on an existing listener, which it closes.
+func (s *Server) Serve(ctx context.Context, ln net.Listener) error {
+	if len(s.signals) > 0 {
+		var stop context.CancelFunc
+		ctx, stop = signal.NotifyContext(ctx, s.signals...)
+		defer stop()
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		s.logger.Printf("HTTP server listening on %s", ln.Addr())
+		errs <- s.server.Serve(ln)
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	s.logger.Println("shutting down...")
+	for _, f := range s.onShutdown {
+		f()
+	}
+	if s.shutdownDelay > 0 && !errors.Is(context.Cause(ctx), ErrUpgraded) {
+		s.logger.Printf("draining in %s", s.shutdownDelay)
+		delay, stop := s.clock.NewTimer(s.shutdownDelay)
+		<-delay
+		stop()
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+	defer cancel()
+
+	start := time.Now()
+	err := s.server.Shutdown(shutdownCtx)
+	drain := time.Since(start)
+	for _, f := range s.onDrained {
+		f(drain)
+	}
+	if serveErr := <-errs; !errors.Is(serveErr, http.ErrServerClosed) {
+		err = errors.Join(err, serveErr)
+	}
+	if err != nil {
+		return err
+	}
+	s.logger.Println("server stopped")
+
+	return nil
+}
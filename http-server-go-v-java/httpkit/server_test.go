@@ -0,0 +1,170 @@
+package httpkit
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// startServer serves the handler on a free port and returns its URL and the
+// result of Serve.
+func startServer(t *testing.T, ctx context.Context, handler http.Handler, opts ...ServerOption) (string, <-chan error) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts = append([]ServerOption{WithServerLogger(log.New(io.Discard, "", 0))}, opts...)
+	s := NewServer(handler, opts...)
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.Serve(ctx, ln)
+	}()
+
+	return "http://" + ln.Addr().String(), errs
+}
+
+func TestNewServer(t *testing.T) {
+	s := NewServer(http.NotFoundHandler(),
+		WithAddr(":9090"),
+		WithTimeouts(time.Second, 2*time.Second, 3*time.Second),
+		WithReadHeaderTimeout(500*time.Millisecond),
+		WithMaxHeaderBytes(4096),
+	).HTTPServer()
+
+	if s.Addr != ":9090" || s.ReadTimeout != time.Second || s.WriteTimeout != 2*time.Second ||
+		s.IdleTimeout != 3*time.Second || s.ReadHeaderTimeout != 500*time.Millisecond || s.MaxHeaderBytes != 4096 {
+		t.Errorf("NewServer() = %+v, want the options applied", s)
+	}
+
+	d := NewServer(http.NotFoundHandler()).HTTPServer()
+	if d.Addr != ":8080" || d.ReadHeaderTimeout != 2*time.Second || d.MaxHeaderBytes != 1<<20 {
+		t.Errorf("NewServer() defaults = %+v", d)
+	}
+}
+
+func TestServerGracefulShutdown(t *testing.T) {
+	started := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		_, _ = io.WriteString(w, "done")
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	url, errs := startServer(t, ctx, handler, WithSignals())
+
+	// The request in flight when the shutdown starts completes
+	body := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer func() { _ = resp.Body.Close() }()
+		b, _ := io.ReadAll(resp.Body)
+		body <- string(b)
+	}()
+	<-started
+	cancel()
+
+	if got := <-body; got != "done" {
+		t.Errorf("in-flight response = %q, want done", got)
+	}
+	if err := <-errs; err != nil {
+		t.Errorf("Serve() = %v, want nil after a clean shutdown", err)
+	}
+	if _, err := http.Get(url); err == nil {
+		t.Error("request after the shutdown succeeded, want a connection error")
+	}
+}
+
+func TestServerShutdownTimeout(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	handler := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		close(started)
+		<-release
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	url, errs := startServer(t, ctx, handler, WithSignals(), WithShutdownTimeout(50*time.Millisecond))
+	go func() {
+		if resp, err := http.Get(url); err == nil {
+			_ = resp.Body.Close()
+		}
+	}()
+	<-started
+	cancel()
+
+	if err := <-errs; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Serve() = %v, want the shutdown deadline", err)
+	}
+}
+
+// withClock replaces the clock timing the shutdown delay.
+func withClock(c clock) ServerOption {
+	return func(s *Server) {
+		s.clock = c
+	}
+}
+
+func TestServerShutdownDelay(t *testing.T) {
+	tests := []struct {
+		name      string
+		cause     error
+		wantDelay bool
+	}{
+		{"shutdown", context.Canceled, true},
+		{"handoff", ErrUpgraded, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newFakeClock()
+			ctx, cancel := context.WithCancelCause(context.Background())
+			_, errs := startServer(t, ctx, http.NotFoundHandler(), WithSignals(), WithShutdownDelay(200*time.Millisecond), withClock(clock))
+
+			cancel(tt.cause)
+			if tt.wantDelay {
+				// Serving goes on until the whole delay has passed
+				<-clock.armed
+				clock.Advance(199 * time.Millisecond)
+				select {
+				case err := <-errs:
+					t.Fatalf("Serve() = %v before the end of the delay", err)
+				default:
+				}
+				clock.Advance(time.Millisecond)
+			}
+			if err := <-errs; err != nil {
+				t.Fatal(err)
+			}
+			if len(clock.armed) != 0 {
+				t.Error("a handoff waited for the shutdown delay")
+			}
+		})
+	}
+}
+
+func TestServerListenError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ln.Close() }()
+
+	s := NewServer(http.NotFoundHandler(), WithAddr(ln.Addr().String()), WithServerLogger(log.New(io.Discard, "", 0)))
+	if err := s.Run(context.Background()); err == nil {
+		t.Error("Run() on a used address = nil, want an error")
+	}
+}
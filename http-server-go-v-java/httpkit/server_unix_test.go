@@ -0,0 +1,41 @@
+//go:build unix
+
+package httpkit
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestServerSignal(t *testing.T) {
+	// Catching the signal in the test too keeps it from killing the process
+	// if it arrives before the server listens for it
+	caught := make(chan os.Signal, 1)
+	signal.Notify(caught, syscall.SIGUSR1)
+	defer signal.Stop(caught)
+
+	_, errs := startServer(t, context.Background(), http.NotFoundHandler(), WithSignals(syscall.SIGUSR1))
+
+	timeout := time.After(5 * time.Second)
+	for {
+		if err := syscall.Kill(syscall.Getpid(), syscall.SIGUSR1); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case err := <-errs:
+			if err != nil {
+				t.Errorf("Serve() = %v, want nil", err)
+			}
+
+			return
+		case <-time.After(20 * time.Millisecond):
+		case <-timeout:
+			t.Fatal("server didn't stop on the signal")
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package httpkit
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation scope of the spans.
+const tracerName = "github.com/flashlabs/kiss-samples/http-server-go-v-java/httpkit"
+
+type tracingOptions struct {
+	provider   trace.TracerProvider
+	propagator propagation.TextMapPropagator
+	mux        *http.ServeMux
+}
+
+// TracingOption configures the Tracing middleware.
+type TracingOption func(*tracingOptions)
+
+// WithTracerProvider sets the provider of the tracer, the global one of
+// otel by default.
+func WithTracerProvider(provider trace.TracerProvider) TracingOption {
+	return func(o *tracingOptions) {
+		o.provider = provider
+	}
+}
+
+// WithPropagator sets how the trace context is read from the requests, the
+// global propagator of otel by default.
+func WithPropagator(propagator propagation.TextMapPropagator) TracingOption {
+	return func(o *tracingOptions) {
+		o.propagator = propagator
+	}
+}
+
+// WithRoutes names the spans after the pattern of mux matching the request,
+// like "GET /api/v1/items/{id}", from the start. Without it the pattern is
+// only known if Tracing comes right before the mux.
+func WithRoutes(mux *http.ServeMux) TracingOption {
+	return func(o *tracingOptions) {
+		o.mux = mux
+	}
+}
+
+// Tracing starts an OpenTelemetry server span for every request, a child of
+// the trace context of the request if any, with the method, route, status
+// and client as attributes. A 5xx response marks the span as an error. The
+// handler gets the span in its context, to pass the trace on downstream.
+func Tracing(opts ...TracingOption) Middleware {
+	o := tracingOptions{
+		provider:   otel.GetTracerProvider(),
+		propagator: otel.GetTextMapPropagator(),
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	tracer := o.provider.Tracer(tracerName)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := o.propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+			route := ""
+			if o.mux != nil {
+				_, pattern := o.mux.Handler(r)
+				route = routePath(pattern)
+			}
+			ctx, span := tracer.Start(ctx, spanName(r.Method, route),
+				trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(requestAttributes(r)...),
+			)
+			defer span.End()
+
+			rw := &responseWriter{ResponseWriter: w}
+			r = r.WithContext(ctx)
+			next.ServeHTTP(rw, r)
+
+			if route == "" && r.Pattern != "" {
+				route = routePath(r.Pattern)
+				span.SetName(spanName(r.Method, route))
+			}
+			if route != "" {
+				span.SetAttributes(attribute.String("http.route", route))
+			}
+			status := rw.statusCode()
+			span.SetAttributes(attribute.Int("http.response.status_code", status))
+			if status >= http.StatusInternalServerError {
+				span.SetStatus(codes.Error, http.StatusText(status))
+			}
+		})
+	}
+}
+
+// routePath is the path template of a ServeMux pattern, without its
+// method.
+func routePath(pattern string) string {
+	if method, path, ok := strings.Cut(pattern, " "); ok && !strings.Contains(method, "/") {
+		return strings.TrimSpace(path)
+	}
+
+	return pattern
+}
+
+func spanName(method, route string) string {
+	if route == "" {
+		return method
+	}
+
+	return method + " " + route
+}
+
+// requestAttributes are the OpenTelemetry semantic conventions of a
+// request.
+func requestAttributes(r *http.Request) []attribute.KeyValue {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	attrs := []attribute.KeyValue{
+		attribute.String("http.request.method", r.Method),
+		attribute.String("url.scheme", scheme),
+		attribute.String("url.path", r.URL.Path),
+		attribute.String("network.protocol.version", fmt.Sprintf("%d.%d", r.ProtoMajor, r.ProtoMinor)),
+	}
+	if host, _, err := net.SplitHostPort(r.Host); err == nil {
+		attrs = append(attrs, attribute.String("server.address", host))
+	} else if r.Host != "" {
+		attrs = append(attrs, attribute.String("server.address", r.Host))
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		attrs = append(attrs, attribute.String("client.address", host))
+	}
+	if ua := r.UserAgent(); ua != "" {
+		attrs = append(attrs, attribute.String("user_agent.original", ua))
+	}
+
+	return attrs
+}
@@ -0,0 +1,142 @@
+package httpkit
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func newRecorder() (*tracetest.SpanRecorder, trace.TracerProvider) {
+	recorder := tracetest.NewSpanRecorder()
+
+	return recorder, sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+}
+
+func attributes(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	attrs := map[attribute.Key]attribute.Value{}
+	for _, kv := range span.Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+
+	return attrs
+}
+
+func TestTracing(t *testing.T) {
+	// The global propagator is the default, as main sets it
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/items/{id}", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/fail", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	})
+
+	const parent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	tests := []struct {
+		name        string
+		opts        []TracingOption
+		path        string
+		traceparent string
+		wantName    string
+		wantRoute   string
+		wantStatus  int64
+		wantError   bool
+	}{
+		{"route from the mux", []TracingOption{WithRoutes(mux)}, "/api/v1/items/7", "", "GET /api/v1/items/{id}", "/api/v1/items/{id}", 200, false},
+		{"route after the handler", nil, "/api/v1/items/7", "", "GET /api/v1/items/{id}", "/api/v1/items/{id}", 200, false},
+		{"not found", []TracingOption{WithRoutes(mux)}, "/nope", "", "GET", "", 404, false},
+		{"server error", nil, "/fail", "", "GET /fail", "/fail", 502, true},
+		{"inbound trace", nil, "/api/v1/items/7", parent, "GET /api/v1/items/{id}", "/api/v1/items/{id}", 200, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder, provider := newRecorder()
+			handler := Tracing(append(tt.opts, WithTracerProvider(provider))...)(mux)
+
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.traceparent != "" {
+				r.Header.Set("traceparent", tt.traceparent)
+				r.Header.Set("tracestate", "vendor=value")
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+
+			spans := recorder.Ended()
+			if len(spans) != 1 {
+				t.Fatalf("got %d spans, want 1", len(spans))
+			}
+			span := spans[0]
+			attrs := attributes(span)
+
+			if span.Name() != tt.wantName {
+				t.Errorf("name = %q, want %q", span.Name(), tt.wantName)
+			}
+			if span.SpanKind() != trace.SpanKindServer {
+				t.Errorf("kind = %v, want server", span.SpanKind())
+			}
+			if got := attrs["http.route"].AsString(); got != tt.wantRoute {
+				t.Errorf("http.route = %q, want %q", got, tt.wantRoute)
+			}
+			if got := attrs["http.response.status_code"].AsInt64(); got != tt.wantStatus {
+				t.Errorf("http.response.status_code = %d, want %d", got, tt.wantStatus)
+			}
+			if got := attrs["url.path"].AsString(); got != tt.path {
+				t.Errorf("url.path = %q, want %q", got, tt.path)
+			}
+			if got := span.Status().Code == codes.Error; got != tt.wantError {
+				t.Errorf("error status = %v, want %v", got, tt.wantError)
+			}
+			if !span.EndTime().After(span.StartTime()) && !span.EndTime().Equal(span.StartTime()) {
+				t.Error("span ended before it started")
+			}
+
+			parentSpan := span.Parent()
+			if tt.traceparent == "" {
+				if parentSpan.IsValid() {
+					t.Errorf("parent = %v, want a root span", parentSpan)
+				}
+
+				return
+			}
+			if got := parentSpan.TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+				t.Errorf("trace ID = %s, want the inbound one", got)
+			}
+			if got := parentSpan.SpanID().String(); got != "00f067aa0ba902b7" || !parentSpan.IsRemote() {
+				t.Errorf("parent span = %s, want the remote 00f067aa0ba902b7", got)
+			}
+			if got := span.SpanContext().TraceState().Get("vendor"); got != "value" {
+				t.Errorf("tracestate vendor = %q, want value", got)
+			}
+		})
+	}
+}
+
+func TestTracingLogging(t *testing.T) {
+	recorder, provider := newRecorder()
+	var buf bytes.Buffer
+	handler := NewChain(
+		Tracing(WithTracerProvider(provider)),
+		Logging(WithLogger(slog.New(slog.NewJSONHandler(&buf, nil)))),
+	).Then(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		LoggerFromContext(r.Context()).Info("inside")
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	span := recorder.Ended()[0].SpanContext()
+	for _, record := range decodeLogs(t, &buf) {
+		if record["trace_id"] != span.TraceID().String() || record["span_id"] != span.SpanID().String() {
+			t.Errorf("record %v, want trace %s and span %s", record, span.TraceID(), span.SpanID())
+		}
+	}
+}
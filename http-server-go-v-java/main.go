@@ -4,149 +4,250 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"flag"
 	"log"
-	"math/rand"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
-	"os/signal"
-	"strconv"
-	"syscall"
 	"time"
-)
 
-// ---- configuration ----
+	"github.com/redis/go-redis/v9"
 
-const (
-	addr            = ":8080"
-	maxInFlight     = 100
-	readTimeout     = 5 * time.Second
-	writeTimeout    = 10 * time.Second
-	idleTimeout     = 60 * time.Second
-	shutdownTimeout = 10 * time.Second
+	"github.com/flashlabs/kiss-samples/http-server-go-v-java/httpkit"
+	"github.com/flashlabs/kiss-samples/http-server-go-v-java/httpkit/downstream"
+	"github.com/flashlabs/kiss-samples/http-server-go-v-java/httpkit/redisstore"
 )
 
-// ---- middleware ----
-
-type middleware func(http.Handler) http.Handler
-
-func chain(h http.Handler, m ...middleware) http.Handler {
-	for i := len(m) - 1; i >= 0; i-- {
-		h = m[i](h)
-	}
-	return h
-}
+// ---- handlers ----
 
-// Request ID middleware
-func requestID(next http.Handler) http.Handler {
-	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		id := strconv.FormatInt(rng.Int63(), 16)
-		ctx := context.WithValue(r.Context(), "requestID", id)
-		w.Header().Set("X-Request-ID", id)
-		next.ServeHTTP(w, r.WithContext(ctx))
-	})
-}
+// probes are the health endpoints, /health being the former liveness one
+var probes = map[string]bool{"/livez": true, "/readyz": true, "/health": true}
 
-// Logging middleware
-func logging(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-		next.ServeHTTP(w, r)
-		log.Printf(
-			"method=%s path=%s duration=%s request_id=%v",
-			r.Method,
-			r.URL.Path,
-			time.Since(start),
-			r.Context().Value("requestID"),
-		)
-	})
+// item is an item of the items service.
+type item struct {
+	ID string `json:"id"`
 }
 
-// Backpressure middleware
-func limitConcurrency(max int) middleware {
-	sem := make(chan struct{}, max)
-
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			select {
-			case sem <- struct{}{}:
-				defer func() { <-sem }()
-				next.ServeHTTP(w, r)
-			default:
-				http.Error(w, "too many requests", http.StatusTooManyRequests)
+// itemHandler gets the item from the items service.
+func itemHandler(items *downstream.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		logger := httpkit.LoggerFromContext(r.Context()).With(slog.String("id", id))
+
+		resp, err := items.Get(r.Context(), "/items/"+url.PathEscape(id))
+		switch {
+		case errors.Is(err, context.Canceled):
+			logger.Warn("request cancelled")
+			http.Error(w, "request cancelled", http.StatusRequestTimeout)
+			return
+		case errors.Is(err, downstream.ErrCircuitOpen), errors.Is(err, downstream.ErrBulkheadFull):
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "items unavailable", http.StatusServiceUnavailable)
+			return
+		case errors.Is(err, context.DeadlineExceeded), errors.Is(err, downstream.ErrNoTime):
+			http.Error(w, "items timed out", http.StatusGatewayTimeout)
+			return
+		case err != nil:
+			logger.Error("items call failed", slog.String("error", err.Error()))
+			http.Error(w, "items failed", http.StatusBadGateway)
+			return
+		}
+		defer func() {
+			if e := resp.Body.Close(); e != nil {
+				logger.Warn("Failed to close the items response", slog.String("error", e.Error()))
 			}
-		})
+		}()
+
+		switch {
+		case resp.StatusCode == http.StatusNotFound:
+			http.NotFound(w, r)
+			return
+		case resp.StatusCode != http.StatusOK:
+			logger.Error("items call failed", slog.Int("status", resp.StatusCode))
+			http.Error(w, "items failed", http.StatusBadGateway)
+			return
+		}
+		var it item
+		if err := json.NewDecoder(resp.Body).Decode(&it); err != nil {
+			logger.Error("invalid item", slog.String("error", err.Error()))
+			http.Error(w, "items failed", http.StatusBadGateway)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(it)
 	}
 }
 
-// ---- handlers ----
-
-func healthHandler(w http.ResponseWriter, _ *http.Request) {
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("ok"))
-}
+// ---- main ----
 
-func itemHandler(w http.ResponseWriter, r *http.Request) {
-	id := r.PathValue("id")
+func main() {
+	cfg, printConfig, err := loadConfig(os.Args[1:], os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Printf("%v", err)
+		os.Exit(2)
+	}
+	if printConfig {
+		if err := cfg.print(os.Stdout); err != nil {
+			log.Fatalf("error printing config: %v", err)
+		}
 
-	// Simulate slow downstream respecting cancellation
-	select {
-	case <-time.After(100 * time.Millisecond):
-	case <-r.Context().Done():
-		http.Error(w, "request cancelled", http.StatusRequestTimeout)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"id": id,
-	})
-}
+	// JSON logs, the standard logger of the server included
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	slog.SetDefault(logger)
 
-// ---- main ----
+	shutdownTracing, err := setupTracing(context.Background(), cfg.OTelExporter)
+	if err != nil {
+		log.Fatalf("error setting up tracing: %v", err)
+	}
+	defer func() {
+		if e := shutdownTracing(context.Background()); e != nil {
+			log.Println("Failed to flush the spans", e)
+		}
+	}()
+
+	// Redis isn't checked: the rate limit does without it, and it being down
+	// would take every instance out at once
+	health := httpkit.NewHealth()
+	health.Register("disk", httpkit.DiskSpaceCheck(os.TempDir(), 100<<20), httpkit.WithCheckCache(10*time.Second))
+
+	// Without upstream_url the items service is simulated in the process
+	upstreamURL := cfg.UpstreamURL
+	if upstreamURL == "" {
+		var stop func()
+		if upstreamURL, stop, err = startSimulatedUpstream(); err != nil {
+			log.Fatalf("error starting the simulated upstream: %v", err)
+		}
+		defer stop()
+	}
+	items, err := downstream.New("items", upstreamURL,
+		downstream.WithTimeout(cfg.UpstreamTimeout),
+		downstream.WithBulkhead(cfg.UpstreamMaxInFlight, 0),
+	)
+	if err != nil {
+		log.Fatalf("error creating the items client: %v", err)
+	}
 
-func main() {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/health", healthHandler)
-	mux.HandleFunc("/api/v1/items/{id}", itemHandler)
-
-	handler := chain(
-		mux,
-		limitConcurrency(maxInFlight),
-		requestID,
-		logging,
+	mux.Handle("GET /livez", health.Livez())
+	mux.Handle("GET /readyz", health.Readyz())
+	mux.Handle("GET /health", health.Livez())
+	mux.Handle("/api/v1/items/{id}", itemHandler(items))
+
+	// Probes are never shed, so that an overloaded server isn't taken for a
+	// dead one
+	limiter := httpkit.NewAdaptiveLimiter(
+		httpkit.WithLimits(min(20, cfg.MaxInFlight), 1, cfg.MaxInFlight),
+		httpkit.WithQueue(cfg.QueueSize, cfg.QueueTimeout),
+		httpkit.WithPriority(func(r *http.Request) httpkit.Priority {
+			if probes[r.URL.Path] {
+				return httpkit.PriorityCritical
+			}
+
+			return httpkit.PriorityNormal
+		}),
 	)
 
-	server := &http.Server{
-		Addr:              addr,
-		Handler:           handler,
-		ReadTimeout:       readTimeout,
-		ReadHeaderTimeout: 2 * time.Second,
-		WriteTimeout:      writeTimeout,
-		IdleTimeout:       idleTimeout,
-		MaxHeaderBytes:    1 << 20,
+	// Every client, by API key or else IP, has its own rate limit, probes
+	// aside
+	proxies, _ := cfg.trustedProxies()
+	clientKey := httpkit.FirstKey(httpkit.Header("X-API-Key"), httpkit.ClientIP(proxies...))
+	var store httpkit.RateStore = httpkit.NewMemoryStore()
+	if cfg.RedisAddr != "" {
+		client := redis.NewClient(&redis.Options{Addr: cfg.RedisAddr})
+		defer func() {
+			if e := client.Close(); e != nil {
+				log.Println("Failed to close the Redis client", e)
+			}
+		}()
+		store = redisstore.New(client)
 	}
+	rateLimit := func(next http.Handler) http.Handler { return next }
+	if cfg.RateLimit > 0 {
+		rateLimit = httpkit.RateLimit(store, httpkit.Rate{Limit: cfg.RateLimit, Period: cfg.RateLimitPeriod}, func(r *http.Request) string {
+			if probes[r.URL.Path] {
+				return ""
+			}
 
-	go func() {
-		log.Printf("HTTP server listening on %s", addr)
-		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-			log.Fatalf("server error: %v", err)
-		}
-	}()
-
-	// Graceful shutdown
-	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+			return clientKey(r)
+		})
+	}
 
-	<-stop
-	log.Println("shutting down...")
+	metrics := httpkit.NewMetrics(httpkit.WithMetricsRoutes(mux))
+	metrics.ObserveLimiter(limiter)
+
+	// The deadline, past the write timeout, bounds the calls downstream.
+	// Tracing and metrics come first so that they cover the rejected
+	// requests too
+	handler := httpkit.NewChain(
+		httpkit.Deadline(cfg.WriteTimeout),
+		httpkit.Tracing(httpkit.WithRoutes(mux)),
+		metrics.Middleware(),
+		rateLimit,
+		limiter.Middleware(),
+		httpkit.RequestID(),
+		httpkit.Logging(httpkit.WithLogger(logger)),
+	).Then(mux)
+
+	server := httpkit.NewServer(handler,
+		httpkit.WithAddr(cfg.Addr),
+		httpkit.WithTimeouts(cfg.ReadTimeout, cfg.WriteTimeout, cfg.IdleTimeout),
+		httpkit.WithReadHeaderTimeout(cfg.ReadHeaderTimeout),
+		httpkit.WithMaxHeaderBytes(cfg.MaxHeaderBytes),
+		httpkit.WithShutdownTimeout(cfg.ShutdownTimeout),
+		httpkit.WithShutdownDelay(cfg.ShutdownDelay),
+		metrics.ObserveShutdown(),
+		health.ObserveShutdown(),
+	)
 
-	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
-	defer cancel()
+	// On an upgrade the sockets come from the previous process
+	handoff, err := httpkit.NewHandoff()
+	if err != nil {
+		log.Fatalf("error inheriting the listeners: %v", err)
+	}
+	ln, err := handoff.Listen("tcp", cfg.Addr)
+	if err != nil {
+		log.Fatalf("error listening on %s: %v", cfg.Addr, err)
+	}
 
-	if err := server.Shutdown(ctx); err != nil {
-		log.Printf("shutdown error: %v", err)
+	// The admin listener is kept off the public one, and outlives it to be
+	// scraped while the requests drain
+	adminCtx, stopAdmin := context.WithCancel(context.Background())
+	adminDone := make(chan struct{})
+	if cfg.AdminAddr != "" {
+		adminLn, err := handoff.Listen("tcp", cfg.AdminAddr)
+		if err != nil {
+			log.Fatalf("error listening on %s: %v", cfg.AdminAddr, err)
+		}
+		adminMux := http.NewServeMux()
+		adminMux.Handle("GET /metrics", metrics.Handler())
+		admin := httpkit.NewServer(adminMux, httpkit.WithAddr(cfg.AdminAddr), httpkit.WithSignals())
+		go func() {
+			defer close(adminDone)
+			if err := admin.Serve(adminCtx, adminLn); err != nil {
+				log.Printf("admin server error: %v", err)
+			}
+		}()
+	} else {
+		close(adminDone)
 	}
 
-	log.Println("server stopped")
+	// Graceful shutdown on SIGINT and SIGTERM. On Unix SIGHUP and SIGUSR2
+	// start the binary again, a new one if it was replaced, on the same
+	// sockets, and shut down once it serves
+	ctx := handoff.UpgradeOnSignal(context.Background(), upgradeSignals...)
+	handoff.Ready()
+	err = server.Serve(ctx, ln)
+	stopAdmin()
+	<-adminDone
+	if err != nil {
+		log.Fatalf("server error: %v", err)
+	}
 }
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// upgradeSignals is empty, the socket handoff needing Unix.
+var upgradeSignals []os.Signal
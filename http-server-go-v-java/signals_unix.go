@@ -0,0 +1,11 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// upgradeSignals hand the sockets over to a new process.
+var upgradeSignals = []os.Signal{syscall.SIGHUP, syscall.SIGUSR2}
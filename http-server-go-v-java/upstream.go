@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// startSimulatedUpstream serves the items service on a loopback port, taking
+// 100ms like a real one, for the server to call without upstream_url. stop
+// shuts it down.
+func startSimulatedUpstream() (url string, stop func(), err error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /items/{id}", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-r.Context().Done():
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(item{ID: r.PathValue("id")})
+	})
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: time.Second}
+	go func() {
+		if err := server.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("simulated upstream error: %v", err)
+		}
+	}()
+
+	return "http://" + ln.Addr().String(), func() {
+		if e := server.Shutdown(context.Background()); e != nil {
+			log.Println("Failed to stop the simulated upstream", e)
+		}
+	}, nil
+}
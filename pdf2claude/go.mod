@@ -2,8 +2,9 @@ module github.com/flashlabs/kiss-samples/pdf2claude
 
 go 1.23.0
 
+require github.com/anthropics/anthropic-sdk-go v0.2.0-alpha.4
+
 require (
-	github.com/anthropics/anthropic-sdk-go v0.2.0-alpha.4 // indirect
 	github.com/tidwall/gjson v1.18.0 // indirect
 	github.com/tidwall/match v1.1.1 // indirect
 	github.com/tidwall/pretty v1.2.1 // indirect
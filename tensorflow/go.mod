@@ -3,7 +3,8 @@ module github.com/flashlabs/kiss-samples/tensorflow
 go 1.24.1
 
 require (
-	github.com/nfnt/resize v0.0.0-20180221191011-83c6a9932646 // indirect
-	github.com/wamuir/graft v0.10.0 // indirect
-	google.golang.org/protobuf v1.36.6 // indirect
+	github.com/nfnt/resize v0.0.0-20180221191011-83c6a9932646
+	github.com/wamuir/graft v0.10.0
 )
+
+require google.golang.org/protobuf v1.36.6 // indirect
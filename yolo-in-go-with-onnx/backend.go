@@ -0,0 +1,290 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"runtime"
+	"sort"
+	"strings"
+
+	ort "github.com/yalue/onnxruntime_go"
+)
+
+const (
+	backendORT = "ort"
+	backendGo  = "go"
+)
+
+// InferenceBackend runs the network on a batch of prepared images. A backend
+// owns its buffers, so it must not be run concurrently.
+type InferenceBackend interface {
+	// Input is the [batch, 3, 640, 640] buffer to fill before Run.
+	Input() []float32
+	Run() error
+	// Outputs are the buffers of the last run, in the order of the model
+	// outputs.
+	Outputs() [][]float32
+	Destroy()
+}
+
+// newBackend creates the backend selected in the config for a batch of
+// images.
+func newBackend(cfg *sessionConfig, info *modelInfo, batch int) (InferenceBackend, error) {
+	switch cfg.backend {
+	case backendORT:
+		return newORTBackend(cfg, info, batch)
+	case backendGo:
+		return newGoBackend(info, batch, cfg.intraOpThreads)
+	default:
+		return nil, fmt.Errorf("unknown backend %q, use ort or go", cfg.backend)
+	}
+}
+
+// ortBackend runs the model with ONNX Runtime.
+type ortBackend struct {
+	session *ort.AdvancedSession
+	input   *ort.Tensor[float32]
+	outputs []*ort.Tensor[float32]
+}
+
+func newORTBackend(cfg *sessionConfig, info *modelInfo, batch int) (*ortBackend, error) {
+	inputShape := ort.NewShape(int64(batch), 3, modelInputSize, modelInputSize)
+
+	inputTensor, err := ort.NewEmptyTensor[float32](inputShape)
+	if err != nil {
+		return nil, fmt.Errorf("error creating input tensor: %w", err)
+	}
+
+	b := &ortBackend{input: inputTensor}
+
+	outputs := make([]ort.ArbitraryTensor, 0, len(info.outputShapes))
+	for _, shape := range info.outputShapes {
+		shape = shape.Clone()
+		shape[0] = int64(batch)
+		outputTensor, err := ort.NewEmptyTensor[float32](shape)
+		if err != nil {
+			b.Destroy()
+
+			return nil, fmt.Errorf("error creating output tensor: %w", err)
+		}
+		b.outputs = append(b.outputs, outputTensor)
+		outputs = append(outputs, outputTensor)
+	}
+
+	options, err := cfg.options()
+	if err != nil {
+		b.Destroy()
+
+		return nil, err
+	}
+	defer func(options *ort.SessionOptions) {
+		if e := options.Destroy(); e != nil {
+			fmt.Printf("error destroying ORT session options: %s\n", e)
+		}
+	}(options)
+
+	b.session, err = ort.NewAdvancedSession(cfg.model,
+		[]string{info.inputName}, info.outputNames,
+		[]ort.ArbitraryTensor{inputTensor},
+		outputs,
+		options)
+	if err != nil {
+		b.Destroy()
+
+		return nil, fmt.Errorf("error creating ORT session: %w", err)
+	}
+
+	return b, nil
+}
+
+func (b *ortBackend) Input() []float32 {
+	return b.input.GetData()
+}
+
+func (b *ortBackend) Run() error {
+	if err := b.session.Run(); err != nil {
+		return fmt.Errorf("error running ORT session: %w", err)
+	}
+
+	return nil
+}
+
+func (b *ortBackend) Outputs() [][]float32 {
+	outputs := make([][]float32, len(b.outputs))
+	for i, output := range b.outputs {
+		outputs[i] = output.GetData()
+	}
+
+	return outputs
+}
+
+func (b *ortBackend) Destroy() {
+	if b.session != nil {
+		if e := b.session.Destroy(); e != nil {
+			log.Printf("error destroying session: %s\n", e)
+		}
+	}
+
+	if e := b.input.Destroy(); e != nil {
+		log.Printf("error destroying input: %s\n", e)
+	}
+
+	for _, output := range b.outputs {
+		if e := output.Destroy(); e != nil {
+			log.Printf("error destroying output: %s\n", e)
+		}
+	}
+}
+
+// goBackend interprets the ONNX graph in Go. It is much slower than ONNX
+// Runtime but needs no native library, and covers the operators of the
+// Ultralytics YOLOv8 exports.
+type goBackend struct {
+	model   *onnxModel
+	input   *tensor
+	outputs [][]float32
+	ctx     execContext
+	// lastUse is the index of the last node reading a value, after which
+	// the value is released
+	lastUse map[string]int
+}
+
+// inspectONNX reads the same model description as inspectModel, without
+// ONNX Runtime.
+func inspectONNX(path string) (*modelInfo, error) {
+	model, err := loadONNX(path)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &model.graph
+	if len(g.inputs) != 1 {
+		return nil, fmt.Errorf("expected a single model input, got %d", len(g.inputs))
+	}
+
+	info := &modelInfo{
+		inputName:    g.inputs[0].name,
+		inputShape:   fixedInputShape(g.inputs[0].shape),
+		dynamicBatch: len(g.inputs[0].shape) > 0 && g.inputs[0].shape[0] <= 0,
+		metadata:     model.metadata,
+		graph:        model,
+	}
+	for _, o := range g.outputs {
+		info.outputNames = append(info.outputNames, o.name)
+		info.outputShapes = append(info.outputShapes, fixedOutputShape(o.shape, info.inputShape))
+	}
+
+	return info, nil
+}
+
+func newGoBackend(info *modelInfo, batch, threads int) (*goBackend, error) {
+	model := info.graph
+	if model == nil {
+		return nil, errors.New("model was not parsed for the go backend")
+	}
+
+	unsupported := map[string]bool{}
+	lastUse := map[string]int{}
+	for i, n := range model.graph.nodes {
+		if _, ok := operators[n.opType]; !ok {
+			unsupported[n.opType] = true
+		}
+		for _, name := range n.inputs {
+			lastUse[name] = i
+		}
+	}
+	if len(unsupported) > 0 {
+		ops := make([]string, 0, len(unsupported))
+		for op := range unsupported {
+			ops = append(ops, op)
+		}
+		sort.Strings(ops)
+
+		return nil, fmt.Errorf("the go backend doesn't support the operators %s", strings.Join(ops, ", "))
+	}
+	for _, o := range model.graph.outputs {
+		lastUse[o.name] = len(model.graph.nodes)
+	}
+
+	if threads <= 0 {
+		threads = runtime.NumCPU()
+	}
+
+	shape := []int{batch, 3, modelInputSize, modelInputSize}
+
+	return &goBackend{
+		model:   model,
+		input:   floatTensor(shape, make([]float32, shapeSize(shape))),
+		ctx:     execContext{opset: model.opset, threads: threads},
+		lastUse: lastUse,
+	}, nil
+}
+
+func (b *goBackend) Input() []float32 {
+	return b.input.floats
+}
+
+func (b *goBackend) Run() error {
+	g := &b.model.graph
+	values := map[string]*tensor{g.inputs[0].name: b.input}
+	lookup := func(name string) (*tensor, bool) {
+		if t, ok := values[name]; ok {
+			return t, true
+		}
+		t, ok := g.initializers[name]
+
+		return t, ok
+	}
+
+	for i := range g.nodes {
+		n := &g.nodes[i]
+
+		in := make([]*tensor, len(n.inputs))
+		for j, name := range n.inputs {
+			if name == "" {
+				continue
+			}
+			t, ok := lookup(name)
+			if !ok {
+				return fmt.Errorf("node %q (%s) reads the unknown value %q", n.name, n.opType, name)
+			}
+			in[j] = t
+		}
+
+		out, err := operators[n.opType](n, in, &b.ctx)
+		if err != nil {
+			return fmt.Errorf("error running node %q (%s): %w", n.name, n.opType, err)
+		}
+		for j, name := range n.outputs {
+			if name != "" && j < len(out) {
+				values[name] = out[j]
+			}
+		}
+
+		for _, name := range n.inputs {
+			if b.lastUse[name] == i {
+				delete(values, name)
+			}
+		}
+	}
+
+	b.outputs = make([][]float32, len(g.outputs))
+	for i, o := range g.outputs {
+		t, ok := lookup(o.name)
+		if !ok {
+			return fmt.Errorf("model output %q was not computed", o.name)
+		}
+		b.outputs[i] = t.asFloats()
+	}
+
+	return nil
+}
+
+func (b *goBackend) Outputs() [][]float32 {
+	return b.outputs
+}
+
+func (b *goBackend) Destroy() {
+	b.outputs = nil
+}
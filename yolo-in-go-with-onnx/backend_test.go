@@ -0,0 +1,416 @@
+package main
+
+import (
+	"image"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestOperators(t *testing.T) {
+	f := floatTensor
+	ints := func(v ...int64) *tensor { return intTensor([]int{len(v)}, v) }
+	node := func(opType string, attrs map[string]onnxAttr, outputs int) *onnxNode {
+		return &onnxNode{name: "test", opType: opType, attrs: attrs, outputs: make([]string, outputs)}
+	}
+	grid := f([]int{1, 1, 3, 3}, []float32{1, 2, 3, 4, 5, 6, 7, 8, 9})
+	ones := f([]int{1, 1, 3, 3}, []float32{1, 1, 1, 1, 1, 1, 1, 1, 1})
+
+	tests := []struct {
+		name string
+		node *onnxNode
+		in   []*tensor
+		want []*tensor
+	}{
+		{
+			name: "conv same padding with bias",
+			node: node("Conv", map[string]onnxAttr{"pads": {ints: []int64{1, 1, 1, 1}}}, 1),
+			in:   []*tensor{grid, ones, f([]int{1}, []float32{1})},
+			want: []*tensor{f([]int{1, 1, 3, 3}, []float32{13, 22, 17, 28, 46, 34, 25, 40, 29})},
+		},
+		{
+			name: "conv stride 2",
+			node: node("Conv", map[string]onnxAttr{"pads": {ints: []int64{1, 1, 1, 1}}, "strides": {ints: []int64{2, 2}}}, 1),
+			in:   []*tensor{grid, ones},
+			want: []*tensor{f([]int{1, 1, 2, 2}, []float32{12, 16, 24, 28})},
+		},
+		{
+			name: "grouped pointwise conv",
+			node: node("Conv", map[string]onnxAttr{"group": {i: 2}}, 1),
+			in:   []*tensor{f([]int{1, 2, 1, 2}, []float32{1, 2, 3, 4}), f([]int{2, 1, 1, 1}, []float32{2, 3})},
+			want: []*tensor{f([]int{1, 2, 1, 2}, []float32{2, 4, 9, 12})},
+		},
+		{
+			name: "max pool",
+			node: node("MaxPool", map[string]onnxAttr{"kernel_shape": {ints: []int64{2, 2}}, "strides": {ints: []int64{2, 2}}}, 1),
+			in:   []*tensor{f([]int{1, 1, 4, 4}, []float32{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15})},
+			want: []*tensor{f([]int{1, 1, 2, 2}, []float32{5, 7, 13, 15})},
+		},
+		{
+			name: "resize nearest",
+			node: node("Resize", nil, 1),
+			in:   []*tensor{f([]int{1, 1, 1, 2}, []float32{1, 2}), nil, f([]int{4}, []float32{1, 1, 2, 2})},
+			want: []*tensor{f([]int{1, 1, 2, 4}, []float32{1, 1, 2, 2, 1, 1, 2, 2})},
+		},
+		{
+			name: "broadcast add",
+			node: node("Add", nil, 1),
+			in:   []*tensor{f([]int{2, 1}, []float32{10, 20}), f([]int{3}, []float32{1, 2, 3})},
+			want: []*tensor{f([]int{2, 3}, []float32{11, 12, 13, 21, 22, 23})},
+		},
+		{
+			name: "integer mul",
+			node: node("Mul", nil, 1),
+			in:   []*tensor{ints(2, 3), ints(4)},
+			want: []*tensor{intTensor([]int{2}, []int64{8, 12})},
+		},
+		{
+			name: "concat",
+			node: node("Concat", map[string]onnxAttr{"axis": {i: 1}}, 1),
+			in:   []*tensor{f([]int{2, 1}, []float32{1, 2}), f([]int{2, 2}, []float32{3, 4, 5, 6})},
+			want: []*tensor{f([]int{2, 3}, []float32{1, 3, 4, 2, 5, 6})},
+		},
+		{
+			name: "split by sizes",
+			node: node("Split", map[string]onnxAttr{"axis": {i: 1}}, 2),
+			in:   []*tensor{f([]int{2, 3}, []float32{1, 2, 3, 4, 5, 6}), ints(1, 2)},
+			want: []*tensor{f([]int{2, 1}, []float32{1, 4}), f([]int{2, 2}, []float32{2, 3, 5, 6})},
+		},
+		{
+			name: "slice with steps",
+			node: node("Slice", nil, 1),
+			in:   []*tensor{f([]int{2, 4}, []float32{0, 1, 2, 3, 4, 5, 6, 7}), ints(1), ints(math.MaxInt64), ints(1), ints(2)},
+			want: []*tensor{f([]int{2, 2}, []float32{1, 3, 5, 7})},
+		},
+		{
+			name: "reshape",
+			node: node("Reshape", nil, 1),
+			in:   []*tensor{f([]int{2, 3}, []float32{1, 2, 3, 4, 5, 6}), ints(0, -1, 1)},
+			want: []*tensor{f([]int{2, 3, 1}, []float32{1, 2, 3, 4, 5, 6})},
+		},
+		{
+			name: "transpose",
+			node: node("Transpose", map[string]onnxAttr{"perm": {ints: []int64{1, 0}}}, 1),
+			in:   []*tensor{f([]int{2, 3}, []float32{1, 2, 3, 4, 5, 6})},
+			want: []*tensor{f([]int{3, 2}, []float32{1, 4, 2, 5, 3, 6})},
+		},
+		{
+			name: "gather",
+			node: node("Gather", nil, 1),
+			in:   []*tensor{f([]int{3, 2}, []float32{1, 2, 3, 4, 5, 6}), ints(2, 0)},
+			want: []*tensor{f([]int{2, 2}, []float32{5, 6, 1, 2})},
+		},
+		{
+			name: "softmax",
+			node: node("Softmax", nil, 1),
+			in:   []*tensor{f([]int{1, 2}, []float32{0, float32(math.Log(3))})},
+			want: []*tensor{f([]int{1, 2}, []float32{0.25, 0.75})},
+		},
+		{
+			name: "matmul",
+			node: node("MatMul", nil, 1),
+			in:   []*tensor{f([]int{2, 3}, []float32{1, 2, 3, 4, 5, 6}), f([]int{3, 2}, []float32{1, 0, 0, 1, 1, 1})},
+			want: []*tensor{f([]int{2, 2}, []float32{4, 5, 10, 11})},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := operators[tt.node.opType](tt.node, tt.in, &execContext{opset: 17, threads: 2})
+			if err != nil {
+				t.Fatalf("%s returned error: %s", tt.node.opType, err)
+			}
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("%s returned %d outputs, want %d", tt.node.opType, len(got), len(tt.want))
+			}
+			for i := range got {
+				assertTensor(t, got[i], tt.want[i])
+			}
+		})
+	}
+}
+
+func TestGoBackend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "model.onnx")
+	if err := os.WriteFile(path, tinyModel(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := inspectONNX(path)
+	if err != nil {
+		t.Fatalf("inspectONNX() returned error: %s", err)
+	}
+	if info.inputName != "images" || !reflect.DeepEqual(info.outputNames, []string{"output0"}) {
+		t.Errorf("inspectONNX() input %q, outputs %v, want images and [output0]", info.inputName, info.outputNames)
+	}
+	if !info.dynamicBatch {
+		t.Error("inspectONNX() didn't detect the dynamic batch dimension")
+	}
+	if info.metadata["task"] != "detect" {
+		t.Errorf("inspectONNX() metadata = %v, want task=detect", info.metadata)
+	}
+
+	b, err := newGoBackend(info, 1, 1)
+	if err != nil {
+		t.Fatalf("newGoBackend() returned error: %s", err)
+	}
+	defer b.Destroy()
+
+	// Pixel (x, y) of the three channels is set to 1, 2 and 3 times x/640
+	input := b.Input()
+	plane := modelInputSize * modelInputSize
+	for c := range 3 {
+		for i := range plane {
+			input[c*plane+i] = float32(c+1) * float32(i%modelInputSize) / modelInputSize
+		}
+	}
+
+	if err := b.Run(); err != nil {
+		t.Fatalf("Run() returned error: %s", err)
+	}
+
+	// The model computes y = x * sigmoid(x) with x = c0 + c1 + c2 - 1
+	out := b.Outputs()[0]
+	if len(out) != plane {
+		t.Fatalf("Run() output has %d values, want %d", len(out), plane)
+	}
+	for _, col := range []int{0, 1, 320, 639} {
+		x := 6*float64(col)/modelInputSize - 1
+		want := float32(x / (1 + math.Exp(-x)))
+		if got := out[5*modelInputSize+col]; math.Abs(float64(got-want)) > 1e-5 {
+			t.Errorf("output at column %d = %v, want %v", col, got, want)
+		}
+	}
+}
+
+func TestGoBackendUnsupported(t *testing.T) {
+	info := &modelInfo{graph: &onnxModel{graph: onnxGraph{nodes: []onnxNode{{opType: "LSTM"}, {opType: "Relu"}, {opType: "GRU"}}}}}
+
+	_, err := newGoBackend(info, 1, 1)
+	if err == nil || err.Error() != "the go backend doesn't support the operators GRU, LSTM" {
+		t.Errorf("newGoBackend() error = %v, want the sorted unsupported operators", err)
+	}
+}
+
+// requireFiles skips the test unless all the paths exist.
+func requireFiles(t *testing.T, paths ...string) {
+	t.Helper()
+	for _, path := range paths {
+		if _, err := os.Stat(path); err != nil {
+			t.Skipf("skipping, %s is not available", path)
+		}
+	}
+}
+
+func loadExample(t *testing.T) image.Image {
+	t.Helper()
+
+	file, err := os.Open("example.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	pic, _, err := image.Decode(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pic
+}
+
+func exampleSessionConfig(backend string) *sessionConfig {
+	return &sessionConfig{
+		model: modelPath, head: headAuto, confidence: defaultConfidenceThreshold, backend: backend, batch: 1,
+		optimization: "all", memArena: true, memPattern: true,
+	}
+}
+
+// TestGoBackendDetect runs the pure Go backend on the example image. It only
+// needs the model.
+func TestGoBackendDetect(t *testing.T) {
+	requireFiles(t, modelPath, "example.jpg")
+	pic := loadExample(t)
+
+	m, err := initSession(exampleSessionConfig(backendGo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Destroy()
+
+	boxes, err := m.Detect(pic)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The coffee cup on the right is the clearest object in the picture
+	cup := boundingBox{x1: 450, y1: 255, x2: 570, y2: 355}
+	found := false
+	for _, b := range boxes {
+		if !b.toRect().In(pic.Bounds()) || b.confidence < defaultConfidenceThreshold {
+			t.Errorf("box %v is outside the image or below the threshold", b)
+		}
+		if b.label == "cup" && b.classID == 41 && boxIoU(b, cup) >= 0.5 {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Detect() = %v, want a cup around %v", boxes, cup.toRect())
+	}
+}
+
+// TestBackendParity compares both backends on the example image. It needs
+// the model and the ONNX Runtime library, set ONNXRUNTIME_SHARED_LIBRARY_PATH
+// to point at it.
+func TestBackendParity(t *testing.T) {
+	lib := os.Getenv("ONNXRUNTIME_SHARED_LIBRARY_PATH")
+	if lib == "" {
+		lib = sharedLibPath
+	}
+	requireFiles(t, lib, modelPath, "example.jpg")
+	pic := loadExample(t)
+
+	var outputs [][][]float32
+	var boxes [][]boundingBox
+	for _, backend := range []string{backendORT, backendGo} {
+		m, err := initSession(exampleSessionConfig(backend))
+		if err != nil {
+			t.Fatalf("%s backend: %s", backend, err)
+		}
+		defer m.Destroy()
+
+		b, err := m.Detect(pic)
+		if err != nil {
+			t.Fatalf("%s backend: %s", backend, err)
+		}
+		outputs = append(outputs, m.Backend.Outputs())
+		boxes = append(boxes, b)
+	}
+
+	for i := range outputs[0] {
+		for j, want := range outputs[0][i] {
+			got := outputs[1][i][j]
+			if math.Abs(float64(got-want)) > 1e-3*max(1, math.Abs(float64(want))) {
+				t.Fatalf("output %d value %d = %v, ORT computed %v", i, j, got, want)
+			}
+		}
+	}
+
+	if len(boxes[0]) != len(boxes[1]) {
+		t.Fatalf("go backend found %d boxes, ORT %d", len(boxes[1]), len(boxes[0]))
+	}
+	for i := range boxes[0] {
+		if boxes[0][i].classID != boxes[1][i].classID || boxIoU(boxes[0][i], boxes[1][i]) < 0.99 {
+			t.Errorf("box %d = %v, ORT found %v", i, boxes[1][i], boxes[0][i])
+		}
+	}
+}
+
+func assertTensor(t *testing.T, got, want *tensor) {
+	t.Helper()
+
+	if !reflect.DeepEqual(got.shape, want.shape) || got.isInt != want.isInt {
+		t.Fatalf("got shape %v (int %t), want %v (int %t)", got.shape, got.isInt, want.shape, want.isInt)
+	}
+	if want.isInt {
+		if !reflect.DeepEqual(got.ints, want.ints) {
+			t.Errorf("got %v, want %v", got.ints, want.ints)
+		}
+
+		return
+	}
+	for i := range want.floats {
+		if math.Abs(float64(got.floats[i]-want.floats[i])) > 1e-5 {
+			t.Errorf("got %v, want %v", got.floats, want.floats)
+
+			return
+		}
+	}
+}
+
+// tinyModel encodes a model computing y = x * sigmoid(x) for x, a 1x1
+// convolution summing the three channels with a bias of -1.
+func tinyModel() []byte {
+	bytesField := func(b []byte, num protowire.Number, v []byte) []byte {
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+
+		return protowire.AppendBytes(b, v)
+	}
+	stringField := func(b []byte, num protowire.Number, s string) []byte {
+		return bytesField(b, num, []byte(s))
+	}
+	varintField := func(b []byte, num protowire.Number, v uint64) []byte {
+		b = protowire.AppendTag(b, num, protowire.VarintType)
+
+		return protowire.AppendVarint(b, v)
+	}
+	floatTensor := func(name string, dims []uint64, values []float32) []byte {
+		var b []byte
+		for _, d := range dims {
+			b = varintField(b, 1, d)
+		}
+		b = varintField(b, 2, onnxFloat)
+		var packed []byte
+		for _, v := range values {
+			packed = protowire.AppendFixed32(packed, math.Float32bits(v))
+		}
+		b = bytesField(b, 4, packed)
+
+		return stringField(b, 8, name)
+	}
+	// Negative dimensions are written as the dynamic batch parameter
+	valueInfo := func(name string, dims ...int) []byte {
+		var shape []byte
+		for _, d := range dims {
+			var dim []byte
+			if d < 0 {
+				dim = stringField(dim, 2, "batch")
+			} else {
+				dim = varintField(dim, 1, uint64(d))
+			}
+			shape = bytesField(shape, 1, dim)
+		}
+		var tensorType []byte
+		tensorType = varintField(tensorType, 1, onnxFloat)
+		tensorType = bytesField(tensorType, 2, shape)
+		var typ []byte
+		typ = bytesField(typ, 1, tensorType)
+
+		return bytesField(stringField(nil, 1, name), 2, typ)
+	}
+	node := func(opType string, inputs, outputs []string) []byte {
+		var b []byte
+		for _, in := range inputs {
+			b = stringField(b, 1, in)
+		}
+		for _, out := range outputs {
+			b = stringField(b, 2, out)
+		}
+		b = stringField(b, 3, opType+"_0")
+
+		return stringField(b, 4, opType)
+	}
+
+	size := modelInputSize
+	var graph []byte
+	graph = bytesField(graph, 1, node("Conv", []string{"images", "w", "b"}, []string{"x"}))
+	graph = bytesField(graph, 1, node("Sigmoid", []string{"x"}, []string{"s"}))
+	graph = bytesField(graph, 1, node("Mul", []string{"x", "s"}, []string{"output0"}))
+	graph = bytesField(graph, 5, floatTensor("w", []uint64{1, 3, 1, 1}, []float32{1, 1, 1}))
+	graph = bytesField(graph, 5, floatTensor("b", []uint64{1}, []float32{-1}))
+	graph = bytesField(graph, 11, valueInfo("images", -1, 3, size, size))
+	graph = bytesField(graph, 11, valueInfo("w", 1, 3, 1, 1))
+	graph = bytesField(graph, 12, valueInfo("output0", -1, 1, size, size))
+
+	var model []byte
+	model = varintField(model, 1, 8)
+	model = bytesField(model, 7, graph)
+	model = bytesField(model, 8, varintField(nil, 2, 17))
+	model = bytesField(model, 14, stringField(stringField(nil, 1, "task"), 2, "detect"))
+
+	return model
+}
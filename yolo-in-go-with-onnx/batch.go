@@ -0,0 +1,812 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"io/fs"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	formatJSONL = "jsonl"
+	formatCOCO  = "coco"
+	formatYOLO  = "yolo"
+	formatVOC   = "voc"
+)
+
+// imageJob is one image found while walking the input.
+type imageJob struct {
+	path string
+	rel  string
+	id   int
+}
+
+// imageResult is one line of the JSONL output.
+type imageResult struct {
+	Image      string      `json:"image"`
+	Width      int         `json:"width"`
+	Height     int         `json:"height"`
+	Detections []detection `json:"detections"`
+
+	id  int
+	rel string
+}
+
+// resultWriter stores results in one of the output formats. done reports
+// whether an earlier run already stored the image, so it can be skipped.
+type resultWriter interface {
+	done(job imageJob) bool
+	write(r imageResult) error
+	close() error
+}
+
+func runDetect(args []string) int {
+	fs := flag.NewFlagSet("detect", flag.ContinueOnError)
+	cfg := newSessionConfig(fs)
+	out := fs.String("out", "results.jsonl", "output file (jsonl, coco) or directory (yolo, voc)")
+	format := fs.String("format", formatJSONL, "output format: jsonl, coco, yolo or voc")
+	batch := fs.Int("batch", 1, "images per inference run, needs a dynamic-batch model when above 1")
+	workers := fs.Int("workers", runtime.NumCPU(), "goroutines decoding and resizing images")
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return 2
+	}
+	if len(positional) != 1 {
+		fmt.Println("usage: detect [flags] <image or directory>")
+
+		return 2
+	}
+	if *batch < 1 || *workers < 1 {
+		fmt.Println("-batch and -workers must be at least 1")
+
+		return 2
+	}
+
+	jobs, err := findImages(positional[0])
+	if err != nil {
+		fmt.Printf("error listing images: %s\n", err)
+
+		return 1
+	}
+
+	writer, err := newResultWriter(*format, *out)
+	if err != nil {
+		fmt.Printf("error opening output: %s\n", err)
+
+		return 1
+	}
+
+	todo := make([]imageJob, 0, len(jobs))
+	for _, job := range jobs {
+		if !writer.done(job) {
+			todo = append(todo, job)
+		}
+	}
+	if skipped := len(jobs) - len(todo); skipped > 0 {
+		fmt.Printf("Skipping %d images already in %s\n", skipped, *out)
+	}
+
+	cfg.batch = *batch
+	modelSession, err := initSession(cfg)
+	if err != nil {
+		fmt.Printf("error creating session and tensors: %s\n", err)
+
+		return 1
+	}
+	defer modelSession.Destroy()
+
+	// Stop feeding new images on Ctrl-C, but store what is already done so
+	// the next run can resume
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	stats, runErr := detectAll(ctx, modelSession, todo, *workers, writer)
+	if err := writer.close(); err != nil {
+		fmt.Printf("error writing output: %s\n", err)
+
+		return 1
+	}
+	if runErr != nil {
+		fmt.Printf("error running detection: %s\n", runErr)
+
+		return 1
+	}
+
+	stats.print()
+	if ctx.Err() != nil {
+		fmt.Println("Interrupted, run the same command again to resume")
+
+		return 1
+	}
+
+	return 0
+}
+
+// parseInterspersed parses flags that may appear before or after the
+// positional arguments, e.g. "detect ./dir --out results.jsonl".
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// findImages lists the image files under root in lexical order. COCO image
+// IDs are taken from numeric file names (000000397133.jpg) and fall back to
+// the 1-based position in that order.
+func findImages(root string) ([]imageJob, error) {
+	fi, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return []imageJob{{path: root, rel: filepath.Base(root), id: imageID(root, 1)}}, nil
+	}
+
+	var jobs []imageJob
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !isImageFile(path) {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		jobs = append(jobs, imageJob{path: path, rel: rel})
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range jobs {
+		jobs[i].id = imageID(jobs[i].path, i+1)
+	}
+
+	return jobs, nil
+}
+
+func imageID(path string, fallback int) int {
+	stem := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	if id, err := strconv.Atoi(stem); err == nil && id >= 0 {
+		return id
+	}
+
+	return fallback
+}
+
+// preparedImage is an image decoded and resized into a network input.
+type preparedImage struct {
+	job   imageJob
+	size  image.Point
+	input []float32
+	err   error
+}
+
+// batchStats collects what the summary reports.
+type batchStats struct {
+	processed int
+	failed    int
+	boxes     int
+	classes   map[string]int
+	started   time.Time
+}
+
+// detectAll decodes images on a pool of workers and runs them through the
+// session in batches. Failed images are reported and left out of the output,
+// so a later run retries them.
+func detectAll(ctx context.Context, m *ModelSession, todo []imageJob, workers int, w resultWriter) (*batchStats, error) {
+	stats := &batchStats{classes: map[string]int{}, started: time.Now()}
+
+	// Cancelled on a failed batch too, so the remaining images aren't
+	// decoded for nothing
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	jobs := make(chan imageJob)
+	prepared := make(chan preparedImage, m.Batch*2)
+
+	go func() {
+		defer close(jobs)
+		for _, job := range todo {
+			select {
+			case jobs <- job:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				select {
+				case prepared <- prepareJob(job):
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(prepared)
+	}()
+
+	progress := newProgress(len(todo))
+	defer progress.finish()
+
+	pending := make([]preparedImage, 0, m.Batch)
+	flush := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+
+		inputs := make([][]float32, len(pending))
+		sizes := make([]image.Point, len(pending))
+		for i, p := range pending {
+			inputs[i] = p.input
+			sizes[i] = p.size
+		}
+
+		results, err := m.DetectBatch(inputs, sizes)
+		if err != nil {
+			return err
+		}
+
+		for i, p := range pending {
+			r := imageResult{
+				Image:      p.job.path,
+				Width:      p.size.X,
+				Height:     p.size.Y,
+				Detections: toDetections(results[i]),
+				id:         p.job.id,
+				rel:        p.job.rel,
+			}
+			if err := w.write(r); err != nil {
+				return fmt.Errorf("error writing result for %s: %w", p.job.path, err)
+			}
+
+			stats.processed++
+			stats.boxes += len(r.Detections)
+			for _, d := range r.Detections {
+				stats.classes[d.Name]++
+			}
+		}
+		pending = pending[:0]
+
+		return nil
+	}
+
+	for p := range prepared {
+		progress.update(stats.processed+stats.failed+len(pending), stats.failed)
+
+		if p.err != nil {
+			stats.failed++
+			progress.warn(fmt.Sprintf("skipping %s: %s", p.job.path, p.err))
+
+			continue
+		}
+
+		pending = append(pending, p)
+		if len(pending) == m.Batch {
+			if err := flush(); err != nil {
+				// Stop the workers and wait for them before giving up
+				cancel()
+				for range prepared {
+				}
+
+				return stats, err
+			}
+		}
+	}
+
+	if err := flush(); err != nil {
+		return stats, err
+	}
+	progress.update(stats.processed+stats.failed, stats.failed)
+
+	return stats, nil
+}
+
+func prepareJob(job imageJob) preparedImage {
+	pic, err := loadImageFile(job.path)
+	if err != nil {
+		return preparedImage{job: job, err: err}
+	}
+
+	input := make([]float32, 3*modelInputSize*modelInputSize)
+	if err := prepareInput(pic, input); err != nil {
+		return preparedImage{job: job, err: err}
+	}
+
+	return preparedImage{job: job, size: pic.Bounds().Canon().Size(), input: input}
+}
+
+func (s *batchStats) print() {
+	elapsed := time.Since(s.started)
+	rate := 0.0
+	if elapsed > 0 {
+		rate = float64(s.processed) / elapsed.Seconds()
+	}
+
+	fmt.Printf("Processed %d images (%d failed) in %s, %.1f images/s, %d detections\n",
+		s.processed, s.failed, elapsed.Round(time.Millisecond), rate, s.boxes)
+
+	labels := make([]string, 0, len(s.classes))
+	for label := range s.classes {
+		labels = append(labels, label)
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		if s.classes[labels[i]] != s.classes[labels[j]] {
+			return s.classes[labels[i]] > s.classes[labels[j]]
+		}
+
+		return labels[i] < labels[j]
+	})
+	for _, label := range labels {
+		fmt.Printf("  %-16s %d\n", label, s.classes[label])
+	}
+}
+
+// progress redraws a single status line on stderr at most a few times a
+// second.
+type progress struct {
+	total int
+	start time.Time
+	last  time.Time
+}
+
+func newProgress(total int) *progress {
+	return &progress{total: total, start: time.Now()}
+}
+
+func (p *progress) update(done, failed int) {
+	now := time.Now()
+	if now.Sub(p.last) < 250*time.Millisecond && done < p.total {
+		return
+	}
+	p.last = now
+
+	rate := float64(done) / max(now.Sub(p.start).Seconds(), 1e-9)
+	fmt.Fprintf(os.Stderr, "\r[%d/%d] %.1f images/s, %d failed ", done, p.total, rate, failed)
+}
+
+func (p *progress) warn(msg string) {
+	fmt.Fprintf(os.Stderr, "\r%s\n", msg)
+}
+
+func (p *progress) finish() {
+	fmt.Fprintln(os.Stderr)
+}
+
+func newResultWriter(format, out string) (resultWriter, error) {
+	switch format {
+	case formatJSONL:
+		return newJSONLWriter(out)
+	case formatCOCO:
+		return newCOCOWriter(out)
+	case formatYOLO:
+		return &labelDirWriter{dir: out, ext: ".txt", encode: encodeYOLO}, nil
+	case formatVOC:
+		return &labelDirWriter{dir: out, ext: ".xml", encode: encodeVOC}, nil
+	}
+
+	return nil, fmt.Errorf("unknown output format %q", format)
+}
+
+// jsonlWriter appends one JSON object per image and resumes by skipping the
+// images already listed in the file.
+type jsonlWriter struct {
+	f    *os.File
+	w    *bufio.Writer
+	seen map[string]bool
+}
+
+func newJSONLWriter(path string) (*jsonlWriter, error) {
+	seen := map[string]bool{}
+
+	f, err := openAppendLog(path, func(line []byte) {
+		var r imageResult
+		if json.Unmarshal(line, &r) == nil {
+			seen[r.Image] = true
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &jsonlWriter{f: f, w: bufio.NewWriter(f), seen: seen}, nil
+}
+
+// openAppendLog passes every line of an existing file to load, then opens it
+// for appending. A line cut short by an interrupted run fails to parse in
+// load and is simply redone.
+func openAppendLog(path string, load func(line []byte)) (*os.File, error) {
+	if existing, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(existing)
+		scanner.Buffer(make([]byte, 0, 64*1024), 16<<20)
+		for scanner.Scan() {
+			load(scanner.Bytes())
+		}
+		scanErr := scanner.Err()
+		if e := existing.Close(); e != nil {
+			log.Printf("error closing %s: %s\n", path, e)
+		}
+		if scanErr != nil {
+			return nil, fmt.Errorf("error reading %s: %w", path, scanErr)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ensureNewline(f); err != nil {
+		_ = f.Close()
+
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// ensureNewline terminates a partial last line left by an interrupted run.
+func ensureNewline(f *os.File) error {
+	fi, err := f.Stat()
+	if err != nil || fi.Size() == 0 {
+		return err
+	}
+
+	last := make([]byte, 1)
+	if _, err := f.ReadAt(last, fi.Size()-1); err != nil {
+		return err
+	}
+	if last[0] != '\n' {
+		_, err = f.Write([]byte{'\n'})
+	}
+
+	return err
+}
+
+func (j *jsonlWriter) done(job imageJob) bool {
+	return j.seen[job.path]
+}
+
+func (j *jsonlWriter) write(r imageResult) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if _, err := j.w.Write(data); err != nil {
+		return err
+	}
+
+	// Flush every line so an interrupted run keeps everything it finished
+	return j.w.Flush()
+}
+
+func (j *jsonlWriter) close() error {
+	if err := j.w.Flush(); err != nil {
+		_ = j.f.Close()
+
+		return err
+	}
+
+	return j.f.Close()
+}
+
+// cocoResult is one entry of a COCO detection results file.
+type cocoResult struct {
+	ImageID    int        `json:"image_id"`
+	CategoryID int        `json:"category_id"`
+	BBox       [4]float64 `json:"bbox"`
+	Score      float64    `json:"score"`
+}
+
+// cocoWriter writes the COCO results array on close. Every processed image,
+// with or without detections, is first appended to a progress file next to
+// it, which survives a crash and tells a later run what to skip.
+type cocoWriter struct {
+	path     string
+	progress *os.File
+	w        *bufio.Writer
+	results  []cocoResult
+	seen     map[int]bool
+}
+
+// cocoProgress is one line of the progress file: the results of one image.
+type cocoProgress struct {
+	ImageID int          `json:"image_id"`
+	Results []cocoResult `json:"results"`
+}
+
+func cocoProgressPath(path string) string {
+	return path + ".progress.jsonl"
+}
+
+func newCOCOWriter(path string) (*cocoWriter, error) {
+	c := &cocoWriter{path: path, results: []cocoResult{}, seen: map[int]bool{}}
+
+	_, err := os.Stat(cocoProgressPath(path))
+	noProgress := errors.Is(err, os.ErrNotExist)
+
+	c.progress, err = openAppendLog(cocoProgressPath(path), func(line []byte) {
+		var p cocoProgress
+		if json.Unmarshal(line, &p) == nil {
+			c.seen[p.ImageID] = true
+			c.results = append(c.results, p.Results...)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.w = bufio.NewWriter(c.progress)
+
+	// Results written without a progress file only tell which images had
+	// detections, record those
+	if noProgress {
+		if err := c.importResults(); err != nil {
+			_ = c.progress.Close()
+
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+func (c *cocoWriter) importResults() error {
+	data, err := os.ReadFile(c.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var results []cocoResult
+	if err := json.Unmarshal(data, &results); err != nil {
+		return fmt.Errorf("error reading %s: %w", c.path, err)
+	}
+
+	var ids []int
+	byImage := map[int][]cocoResult{}
+	for _, r := range results {
+		if _, ok := byImage[r.ImageID]; !ok {
+			ids = append(ids, r.ImageID)
+		}
+		byImage[r.ImageID] = append(byImage[r.ImageID], r)
+	}
+	for _, id := range ids {
+		if err := c.record(id, byImage[id]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *cocoWriter) done(job imageJob) bool {
+	return c.seen[job.id]
+}
+
+func (c *cocoWriter) write(r imageResult) error {
+	results := make([]cocoResult, 0, len(r.Detections))
+	for _, d := range r.Detections {
+		results = append(results, cocoResult{
+			ImageID:    r.id,
+			CategoryID: cocoCategoryID(d.Class, d.Name),
+			BBox:       [4]float64{d.XMin, d.YMin, d.XMax - d.XMin, d.YMax - d.YMin},
+			Score:      d.Confidence,
+		})
+	}
+
+	return c.record(r.id, results)
+}
+
+// record appends the results of an image to the progress file.
+func (c *cocoWriter) record(imageID int, results []cocoResult) error {
+	data, err := json.Marshal(cocoProgress{ImageID: imageID, Results: results})
+	if err != nil {
+		return err
+	}
+	if _, err := c.w.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	c.seen[imageID] = true
+	c.results = append(c.results, results...)
+
+	return c.w.Flush()
+}
+
+func (c *cocoWriter) close() error {
+	if err := c.w.Flush(); err != nil {
+		_ = c.progress.Close()
+
+		return err
+	}
+	if err := c.progress.Close(); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(c.results)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so an interrupted write doesn't lose
+	// the results of earlier runs
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, c.path)
+}
+
+// cocoCategoryID maps the 80 contiguous YOLO classes to the sparse 91 COCO
+// category IDs. Custom models keep their class index.
+func cocoCategoryID(classID int, name string) int {
+	if classID >= 0 && classID < len(yoloClasses) && yoloClasses[classID] == name {
+		return coco80To91[classID]
+	}
+
+	return classID
+}
+
+var coco80To91 = []int{
+	1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 27, 28, 31, 32, 33, 34,
+	35, 36, 37, 38, 39, 40, 41, 42, 43, 44, 46, 47, 48, 49, 50, 51, 52, 53, 54, 55, 56, 57, 58, 59, 60, 61, 62, 63,
+	64, 65, 67, 70, 72, 73, 74, 75, 76, 77, 78, 79, 80, 81, 82, 84, 85, 86, 87, 88, 89, 90,
+}
+
+// labelDirWriter writes one label file per image, mirroring the input
+// directory layout. An existing label file means the image is done.
+type labelDirWriter struct {
+	dir    string
+	ext    string
+	encode func(r imageResult) ([]byte, error)
+}
+
+func (l *labelDirWriter) labelPath(rel string) string {
+	return filepath.Join(l.dir, strings.TrimSuffix(rel, filepath.Ext(rel))+l.ext)
+}
+
+func (l *labelDirWriter) done(job imageJob) bool {
+	_, err := os.Stat(l.labelPath(job.rel))
+
+	return err == nil
+}
+
+func (l *labelDirWriter) write(r imageResult) error {
+	data, err := l.encode(r)
+	if err != nil {
+		return err
+	}
+
+	path := l.labelPath(r.rel)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, data, 0o644)
+}
+
+func (l *labelDirWriter) close() error {
+	return nil
+}
+
+// encodeYOLO writes "class x_center y_center width height confidence" lines
+// normalized to the image size.
+func encodeYOLO(r imageResult) ([]byte, error) {
+	var b strings.Builder
+	for _, d := range r.Detections {
+		w, h := float64(r.Width), float64(r.Height)
+		fmt.Fprintf(&b, "%d %.6f %.6f %.6f %.6f %.6f\n", d.Class,
+			(d.XMin+d.XMax)/2/w, (d.YMin+d.YMax)/2/h, (d.XMax-d.XMin)/w, (d.YMax-d.YMin)/h, d.Confidence)
+	}
+
+	return []byte(b.String()), nil
+}
+
+type vocAnnotation struct {
+	XMLName  xml.Name    `xml:"annotation"`
+	Folder   string      `xml:"folder"`
+	Filename string      `xml:"filename"`
+	Path     string      `xml:"path"`
+	Size     vocSize     `xml:"size"`
+	Objects  []vocObject `xml:"object"`
+}
+
+type vocSize struct {
+	Width  int `xml:"width"`
+	Height int `xml:"height"`
+	Depth  int `xml:"depth"`
+}
+
+type vocObject struct {
+	Name      string    `xml:"name"`
+	Pose      string    `xml:"pose"`
+	Truncated int       `xml:"truncated"`
+	Difficult int       `xml:"difficult"`
+	Score     float64   `xml:"score"`
+	BndBox    vocBndBox `xml:"bndbox"`
+}
+
+type vocBndBox struct {
+	XMin int `xml:"xmin"`
+	YMin int `xml:"ymin"`
+	XMax int `xml:"xmax"`
+	YMax int `xml:"ymax"`
+}
+
+// encodeVOC writes a Pascal VOC annotation with 1-based pixel coordinates.
+func encodeVOC(r imageResult) ([]byte, error) {
+	a := vocAnnotation{
+		Folder:   filepath.Base(filepath.Dir(r.Image)),
+		Filename: filepath.Base(r.Image),
+		Path:     r.Image,
+		Size:     vocSize{Width: r.Width, Height: r.Height, Depth: 3},
+	}
+	for _, d := range r.Detections {
+		truncated := 0
+		if d.XMin <= 0 || d.YMin <= 0 || d.XMax >= float64(r.Width) || d.YMax >= float64(r.Height) {
+			truncated = 1
+		}
+		a.Objects = append(a.Objects, vocObject{
+			Name:      d.Name,
+			Pose:      "Unspecified",
+			Truncated: truncated,
+			Score:     d.Confidence,
+			BndBox: vocBndBox{
+				XMin: clampInt(int(d.XMin)+1, 1, r.Width),
+				YMin: clampInt(int(d.YMin)+1, 1, r.Height),
+				XMax: clampInt(int(d.XMax)+1, 1, r.Width),
+				YMax: clampInt(int(d.YMax)+1, 1, r.Height),
+			},
+		})
+	}
+
+	data, err := xml.MarshalIndent(a, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(xml.Header), append(data, '\n')...), nil
+}
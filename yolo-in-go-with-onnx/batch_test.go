@@ -0,0 +1,361 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func jobResult(job imageJob, detections ...detection) imageResult {
+	return imageResult{Image: job.path, Width: 640, Height: 480, Detections: detections, id: job.id, rel: job.rel}
+}
+
+var (
+	catJob   = imageJob{path: "images/1.jpg", rel: "1.jpg", id: 1}
+	emptyJob = imageJob{path: "images/sub/2.jpg", rel: "sub/2.jpg", id: 2}
+	newJob   = imageJob{path: "images/3.jpg", rel: "3.jpg", id: 3}
+	cat      = detection{XMin: 10, YMin: 20, XMax: 110, YMax: 220, Confidence: 0.9, Class: 15, Name: "cat"}
+)
+
+func TestResultWriterResume(t *testing.T) {
+	tests := []struct {
+		format string
+		out    string
+	}{
+		{formatJSONL, "results.jsonl"},
+		{formatCOCO, "results.json"},
+		{formatYOLO, "labels"},
+		{formatVOC, "annotations"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			out := filepath.Join(t.TempDir(), tt.out)
+			open := func() resultWriter {
+				w, err := newResultWriter(tt.format, out)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				return w
+			}
+			assertDone := func(w resultWriter, want map[imageJob]bool) {
+				t.Helper()
+				for job, wantDone := range want {
+					if got := w.done(job); got != wantDone {
+						t.Errorf("done(%s) = %v, want %v", job.rel, got, wantDone)
+					}
+				}
+			}
+
+			// The first run processes an image with a detection and an
+			// empty one
+			w := open()
+			assertDone(w, map[imageJob]bool{catJob: false, emptyJob: false})
+			for _, r := range []imageResult{jobResult(catJob, cat), jobResult(emptyJob)} {
+				if err := w.write(r); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// The second run only does the new image
+			w = open()
+			assertDone(w, map[imageJob]bool{catJob: true, emptyJob: true, newJob: false})
+			if err := w.write(jobResult(newJob, cat)); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.close(); err != nil {
+				t.Fatal(err)
+			}
+
+			w = open()
+			assertDone(w, map[imageJob]bool{catJob: true, emptyJob: true, newJob: true})
+			if err := w.close(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestResultWriterCrash(t *testing.T) {
+	for _, format := range []string{formatJSONL, formatCOCO} {
+		t.Run(format, func(t *testing.T) {
+			out := filepath.Join(t.TempDir(), "results")
+			w, err := newResultWriter(format, out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, r := range []imageResult{jobResult(catJob, cat), jobResult(emptyJob)} {
+				if err := w.write(r); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Killed before close, the next run still skips both images
+			resumed, err := newResultWriter(format, out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !resumed.done(catJob) || !resumed.done(emptyJob) || resumed.done(newJob) {
+				t.Errorf("done() after a crash = %v, %v, %v, want true, true, false",
+					resumed.done(catJob), resumed.done(emptyJob), resumed.done(newJob))
+			}
+			for _, w := range []resultWriter{w, resumed} {
+				if err := w.close(); err != nil {
+					t.Error(err)
+				}
+			}
+		})
+	}
+}
+
+func TestJSONLWriterPartialLine(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "results.jsonl")
+	line, err := json.Marshal(jobResult(catJob, cat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A complete line, then one cut short by an interrupted run
+	if err := os.WriteFile(out, append(append(line, '\n'), `{"image":"images/sub/2.jp`...), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := newJSONLWriter(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !w.done(catJob) || w.done(emptyJob) {
+		t.Errorf("done() = %v, %v, want true, false", w.done(catJob), w.done(emptyJob))
+	}
+	if err := w.write(jobResult(emptyJob)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("%d lines, want 3: %q", len(lines), data)
+	}
+	var r imageResult
+	if err := json.Unmarshal([]byte(lines[2]), &r); err != nil || r.Image != emptyJob.path {
+		t.Errorf("last line = %s, want the redone image", lines[2])
+	}
+}
+
+func TestEnsureNewline(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"empty", "", ""},
+		{"complete", "{}\n", "{}\n"},
+		{"partial", "{}\n{", "{}\n{\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "results.jsonl")
+			if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ensureNewline(f); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if got, _ := os.ReadFile(path); string(got) != tt.want {
+				t.Errorf("ensureNewline() left %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCOCOWriter(t *testing.T) {
+	want := []cocoResult{
+		{ImageID: 1, CategoryID: 17, BBox: [4]float64{10, 20, 100, 200}, Score: 0.9},
+		{ImageID: 3, CategoryID: 7, BBox: [4]float64{0, 0, 5, 5}, Score: 0.5},
+	}
+	custom := detection{XMax: 5, YMax: 5, Confidence: 0.5, Class: 7, Name: "widget"}
+
+	readResults := func(path string) []cocoResult {
+		t.Helper()
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var results []cocoResult
+		if err := json.Unmarshal(data, &results); err != nil {
+			t.Fatal(err)
+		}
+
+		return results
+	}
+
+	t.Run("results", func(t *testing.T) {
+		out := filepath.Join(t.TempDir(), "results.json")
+		w, err := newCOCOWriter(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range []imageResult{jobResult(catJob, cat), jobResult(emptyJob), jobResult(newJob, custom)} {
+			if err := w.write(r); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := readResults(out); !reflect.DeepEqual(got, want) {
+			t.Errorf("results = %+v, want %+v", got, want)
+		}
+	})
+
+	t.Run("no detections", func(t *testing.T) {
+		out := filepath.Join(t.TempDir(), "results.json")
+		w, err := newCOCOWriter(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.write(jobResult(emptyJob)); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if data, _ := os.ReadFile(out); string(data) != "[]" {
+			t.Errorf("results = %s, want an empty array", data)
+		}
+	})
+
+	t.Run("results without progress", func(t *testing.T) {
+		out := filepath.Join(t.TempDir(), "results.json")
+		data, err := json.Marshal(want[:1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(out, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		w, err := newCOCOWriter(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !w.done(catJob) || w.done(newJob) {
+			t.Errorf("done() = %v, %v, want true, false", w.done(catJob), w.done(newJob))
+		}
+		if err := w.write(jobResult(newJob, custom)); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := readResults(out); !reflect.DeepEqual(got, want) {
+			t.Errorf("results = %+v, want %+v", got, want)
+		}
+		if _, err := os.Stat(cocoProgressPath(out)); err != nil {
+			t.Errorf("progress file not written: %v", err)
+		}
+	})
+}
+
+func TestLabelDirWriter(t *testing.T) {
+	dir := t.TempDir()
+	w := &labelDirWriter{dir: dir, ext: ".txt", encode: encodeYOLO}
+	if err := w.write(jobResult(emptyJob)); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "sub", "2.txt")
+	if data, err := os.ReadFile(path); err != nil || len(data) != 0 {
+		t.Errorf("%s = %q, %v, want an empty label file", path, data, err)
+	}
+}
+
+func TestEncodeYOLO(t *testing.T) {
+	tests := []struct {
+		name       string
+		detections []detection
+		want       string
+	}{
+		{"no detections", nil, ""},
+		{"two boxes", []detection{cat, {XMin: 0, YMin: 0, XMax: 640, YMax: 480, Confidence: 0.25, Class: 0, Name: "person"}},
+			"15 0.093750 0.250000 0.156250 0.416667 0.900000\n0 0.500000 0.500000 1.000000 1.000000 0.250000\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := encodeYOLO(jobResult(catJob, tt.detections...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("encodeYOLO() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodeVOC(t *testing.T) {
+	tests := []struct {
+		name       string
+		detection  detection
+		want       vocBndBox
+		wantTrunc  int
+		wantObject string
+	}{
+		{"inside", cat, vocBndBox{XMin: 11, YMin: 21, XMax: 111, YMax: 221}, 0, "cat"},
+		{"touching the border", detection{XMin: -3, YMin: 5, XMax: 700, YMax: 480, Name: "dog"},
+			vocBndBox{XMin: 1, YMin: 6, XMax: 640, YMax: 480}, 1, "dog"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := encodeVOC(jobResult(emptyJob, tt.detection))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(string(data), xml.Header) {
+				t.Errorf("encodeVOC() has no XML header: %s", data)
+			}
+
+			var a vocAnnotation
+			if err := xml.Unmarshal(data, &a); err != nil {
+				t.Fatal(err)
+			}
+			if a.Folder != "sub" || a.Filename != "2.jpg" || a.Size != (vocSize{Width: 640, Height: 480, Depth: 3}) {
+				t.Errorf("annotation = %s/%s %+v, want sub/2.jpg 640x480x3", a.Folder, a.Filename, a.Size)
+			}
+			if len(a.Objects) != 1 {
+				t.Fatalf("%d objects, want 1", len(a.Objects))
+			}
+			o := a.Objects[0]
+			if o.Name != tt.wantObject || o.BndBox != tt.want || o.Truncated != tt.wantTrunc {
+				t.Errorf("object = %+v, want %s %+v truncated %d", o, tt.wantObject, tt.want, tt.wantTrunc)
+			}
+		})
+	}
+}
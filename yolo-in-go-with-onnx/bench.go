@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"image"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// benchResult summarizes one pool size.
+type benchResult struct {
+	pool        int
+	concurrency int
+	requests    int
+	errors      int
+	elapsed     time.Duration
+	latencies   []time.Duration
+}
+
+func (r *benchResult) throughput() float64 {
+	return float64(r.requests-r.errors) / r.elapsed.Seconds()
+}
+
+// percentile returns the nearest-rank percentile of the sorted latencies.
+func (r *benchResult) percentile(p float64) time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p/100*float64(len(r.latencies)))) - 1
+
+	return r.latencies[clampInt(rank, 0, len(r.latencies)-1)]
+}
+
+func runBench(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	cfg := newSessionConfig(fs)
+	input := fs.String("image", imagePath, "path to the benchmark image")
+	pools := fs.String("pools", "1,2,4", "comma separated session pool sizes to compare")
+	requests := fs.Int("requests", 100, "requests per pool size")
+	concurrency := fs.Int("concurrency", 0, "concurrent callers, 0 to match the pool size")
+	modelOnly := fs.Bool("model-only", false, "skip image resizing and measure the session run and decoding only")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	sizes, err := parseSizes(*pools)
+	if err != nil {
+		fmt.Printf("invalid -pools: %s\n", err)
+
+		return 2
+	}
+
+	pic, err := loadImageFile(*input)
+	if err != nil {
+		fmt.Printf("error loading input image: %s\n", err)
+
+		return 1
+	}
+
+	var prepared []float32
+	if *modelOnly {
+		prepared = make([]float32, 3*modelInputSize*modelInputSize)
+		if err := prepareInput(pic, prepared); err != nil {
+			fmt.Printf("error converting image to network input: %s\n", err)
+
+			return 1
+		}
+	}
+
+	results := make([]*benchResult, 0, len(sizes))
+	for _, size := range sizes {
+		callers := *concurrency
+		if callers <= 0 {
+			callers = size
+		}
+
+		fmt.Fprintf(os.Stderr, "benchmarking pool of %d with %d callers...\n", size, callers)
+
+		r, err := benchPool(cfg, size, callers, *requests, pic, prepared)
+		if err != nil {
+			fmt.Printf("error benchmarking pool of %d: %s\n", size, err)
+
+			return 1
+		}
+		results = append(results, r)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "pool\tcallers\trequests\terrors\timages/s\tp50\tp90\tp99\tmax\t\n")
+	for _, r := range results {
+		fmt.Fprintf(tw, "%d\t%d\t%d\t%d\t%.1f\t%s\t%s\t%s\t%s\t\n",
+			r.pool, r.concurrency, r.requests, r.errors, r.throughput(),
+			roundLatency(r.percentile(50)), roundLatency(r.percentile(90)),
+			roundLatency(r.percentile(99)), roundLatency(r.percentile(100)))
+	}
+	if err := tw.Flush(); err != nil {
+		fmt.Printf("error writing results: %s\n", err)
+
+		return 1
+	}
+
+	return 0
+}
+
+// benchPool warms up every session of a new pool, then spreads the requests
+// over the callers. Latencies include the wait for a free session.
+func benchPool(cfg *sessionConfig, size, callers, requests int, pic image.Image, prepared []float32) (*benchResult, error) {
+	pool, err := newSessionPool(cfg, size)
+	if err != nil {
+		return nil, err
+	}
+	defer pool.Destroy()
+
+	detect := func(m *ModelSession) error {
+		if prepared != nil {
+			_, err := m.DetectBatch([][]float32{prepared}, []image.Point{pic.Bounds().Size()})
+
+			return err
+		}
+		_, err := m.Detect(pic)
+
+		return err
+	}
+
+	// The first run of a session allocates its buffers, keep it out of the
+	// numbers
+	for _, m := range pool.all {
+		if err := detect(m); err != nil {
+			return nil, err
+		}
+	}
+
+	r := &benchResult{pool: size, concurrency: callers, requests: requests, latencies: make([]time.Duration, 0, requests)}
+
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		next = make(chan struct{}, requests)
+	)
+	for i := 0; i < requests; i++ {
+		next <- struct{}{}
+	}
+	close(next)
+
+	start := time.Now()
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range next {
+				t := time.Now()
+				m, err := pool.acquire(context.Background())
+				if err == nil {
+					err = detect(m)
+					pool.release(m)
+				}
+				latency := time.Since(t)
+
+				mu.Lock()
+				if err != nil {
+					r.errors++
+				} else {
+					r.latencies = append(r.latencies, latency)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	r.elapsed = time.Since(start)
+
+	sort.Slice(r.latencies, func(i, j int) bool { return r.latencies[i] < r.latencies[j] })
+
+	return r, nil
+}
+
+func parseSizes(s string) ([]int, error) {
+	var sizes []int
+	for _, field := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("%q is not a positive number", field)
+		}
+		sizes = append(sizes, n)
+	}
+
+	return sizes, nil
+}
+
+func roundLatency(d time.Duration) time.Duration {
+	return d.Round(10 * time.Microsecond)
+}
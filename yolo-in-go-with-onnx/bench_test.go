@@ -0,0 +1,69 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseSizes(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []int
+		wantErr bool
+	}{
+		{"1", []int{1}, false},
+		{"1,2,4", []int{1, 2, 4}, false},
+		{" 2 , 8 ", []int{2, 8}, false},
+		{"", nil, true},
+		{"1,,2", nil, true},
+		{"0", nil, true},
+		{"-1", nil, true},
+		{"two", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseSizes(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSizes() error = %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseSizes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	// 1ms to 10ms
+	var latencies []time.Duration
+	for i := 1; i <= 10; i++ {
+		latencies = append(latencies, time.Duration(i)*time.Millisecond)
+	}
+
+	tests := []struct {
+		name      string
+		latencies []time.Duration
+		p         float64
+		want      time.Duration
+	}{
+		{"no latencies", nil, 50, 0},
+		{"single", []time.Duration{time.Second}, 99, time.Second},
+		{"minimum", latencies, 0, time.Millisecond},
+		{"median", latencies, 50, 5 * time.Millisecond},
+		{"rounds up", latencies, 51, 6 * time.Millisecond},
+		{"p90", latencies, 90, 9 * time.Millisecond},
+		{"p99", latencies, 99, 10 * time.Millisecond},
+		{"maximum", latencies, 100, 10 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &benchResult{latencies: tt.latencies}
+			if got := r.percentile(tt.p); got != tt.want {
+				t.Errorf("percentile(%v) = %v, want %v", tt.p, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,670 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	ort "github.com/yalue/onnxruntime_go"
+)
+
+const (
+	headAuto       = "auto"
+	headYOLOv5     = "yolov5"
+	headYOLOv8     = "yolov8"
+	headYOLOv8Seg  = "yolov8-seg"
+	headYOLOv8Pose = "yolov8-pose"
+	headYOLOv10    = "yolov10"
+)
+
+const (
+	// defaultConfidenceThreshold is the minimum score of a decoded box. The
+	// eval mode lowers it, as mAP has to see the low-confidence tail of the
+	// predictions.
+	defaultConfidenceThreshold = 0.5
+	iouThreshold               = 0.7
+	maskThreshold              = 0.5
+	keypointThreshold          = 0.5
+)
+
+// outputDecoder turns the raw output tensors of a YOLO head into bounding
+// boxes scaled to the original image's dimensions.
+type outputDecoder interface {
+	decode(outputs [][]float32, originalWidth, originalHeight int) []boundingBox
+}
+
+// modelInfo describes the tensors and metadata of an exported ONNX model.
+type modelInfo struct {
+	inputName    string
+	inputShape   ort.Shape
+	dynamicBatch bool
+	outputNames  []string
+	outputShapes []ort.Shape
+	metadata     map[string]string
+	// graph is the parsed model, only loaded for the go backend
+	graph *onnxModel
+}
+
+// inspectModel reads the input/output layout and the custom metadata map of
+// the model. Ultralytics exports store e.g. "task", "names" and "kpt_shape"
+// there. The ORT environment must already be initialized.
+func inspectModel(path string) (*modelInfo, error) {
+	inputs, outputs, err := ort.GetInputOutputInfo(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading model inputs and outputs: %w", err)
+	}
+
+	if len(inputs) != 1 {
+		return nil, fmt.Errorf("expected a single model input, got %d", len(inputs))
+	}
+
+	info := &modelInfo{
+		inputName:    inputs[0].Name,
+		inputShape:   fixedInputShape(inputs[0].Dimensions),
+		dynamicBatch: len(inputs[0].Dimensions) > 0 && inputs[0].Dimensions[0] <= 0,
+		metadata:     map[string]string{},
+	}
+	for _, o := range outputs {
+		info.outputNames = append(info.outputNames, o.Name)
+		info.outputShapes = append(info.outputShapes, fixedOutputShape(o.Dimensions, info.inputShape))
+	}
+
+	meta, err := ort.GetModelMetadata(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading model metadata: %w", err)
+	}
+	defer func(meta *ort.ModelMetadata) {
+		if e := meta.Destroy(); e != nil {
+			fmt.Printf("error destroying model metadata: %s\n", e)
+		}
+	}(meta)
+
+	keys, err := meta.GetCustomMetadataMapKeys()
+	if err != nil {
+		return nil, fmt.Errorf("error reading model metadata keys: %w", err)
+	}
+	for _, k := range keys {
+		v, ok, err := meta.LookupCustomMetadataMap(k)
+		if err != nil {
+			return nil, fmt.Errorf("error reading model metadata %q: %w", k, err)
+		}
+		if ok {
+			info.metadata[k] = v
+		}
+	}
+
+	return info, nil
+}
+
+// protoStride is the downscaling of the segmentation prototype masks
+// relative to the model input.
+const protoStride = 4
+
+// fixedInputShape replaces the dynamic dimensions of the model input with
+// concrete ones: a batch of 1 and the default 640 pixels.
+func fixedInputShape(s ort.Shape) ort.Shape {
+	fixed := s.Clone()
+	for i, d := range fixed {
+		if d > 0 {
+			continue
+		}
+		if i == 0 {
+			fixed[i] = 1
+		} else {
+			fixed[i] = modelInputSize
+		}
+	}
+
+	return fixed
+}
+
+// fixedOutputShape replaces the dynamic dimensions of an output with the ones
+// the given input produces. Detection outputs hold one entry per anchor point
+// of the 8, 16 and 32 pixel grids (three per point for the YOLOv5 rows) and
+// the segmentation prototypes are a quarter of the input.
+func fixedOutputShape(s, input ort.Shape) ort.Shape {
+	height, width := int64(modelInputSize), int64(modelInputSize)
+	if len(input) == 4 {
+		height, width = input[2], input[3]
+	}
+	var points int64
+	for _, stride := range []int64{8, 16, 32} {
+		points += (height / stride) * (width / stride)
+	}
+
+	fixed := s.Clone()
+	for i, d := range fixed {
+		if d > 0 {
+			continue
+		}
+		switch {
+		case i == 0:
+			fixed[i] = 1
+		case len(s) == 3 && i == 1:
+			fixed[i] = 3 * points
+		case len(s) == 3 && i == 2:
+			fixed[i] = points
+		case len(s) == 4 && i == 2:
+			fixed[i] = height / protoStride
+		case len(s) == 4 && i == 3:
+			fixed[i] = width / protoStride
+		default:
+			fixed[i] = modelInputSize
+		}
+	}
+
+	return fixed
+}
+
+// detectHead guesses the output head from the model metadata, falling back to
+// the shape of the first output tensor.
+func detectHead(info *modelInfo) (string, error) {
+	if len(info.outputShapes) == 0 {
+		return "", fmt.Errorf("model has no outputs")
+	}
+	first := info.outputShapes[0]
+
+	switch info.metadata["task"] {
+	case "segment":
+		return headYOLOv8Seg, nil
+	case "pose":
+		return headYOLOv8Pose, nil
+	}
+	// Older exports have no task, but only pose models have keypoints
+	if _, ok := parseKeypointShape(info.metadata["kpt_shape"]); ok {
+		return headYOLOv8Pose, nil
+	}
+
+	if len(first) == 3 {
+		switch {
+		case first[2] == 6 && first[1] <= 1000:
+			// [1, 300, 6]: x1, y1, x2, y2, score, class after the built-in
+			// one-to-one assignment.
+			return headYOLOv10, nil
+		case first[1] > first[2]:
+			// [1, 25200, 85]: one row per anchor.
+			return headYOLOv5, nil
+		default:
+			// [1, 84, 8400]: one column per anchor point.
+			if len(info.outputShapes) > 1 {
+				return headYOLOv8Seg, nil
+			}
+
+			return headYOLOv8, nil
+		}
+	}
+
+	return "", fmt.Errorf("unrecognized output shape %s", first)
+}
+
+// newDecoder builds the decoder for the given head, resolving "auto" from the
+// model itself. Boxes scoring below confidence are dropped.
+func newDecoder(head string, info *modelInfo, confidence float32) (outputDecoder, error) {
+	if head == headAuto {
+		h, err := detectHead(info)
+		if err != nil {
+			return nil, err
+		}
+		head = h
+	}
+
+	names := yoloClasses
+	if n, ok := parseNames(info.metadata["names"]); ok {
+		names = n
+	}
+
+	switch head {
+	case headYOLOv5:
+		return &yolov5Decoder{names: names, shape: info.outputShapes[0], confidence: confidence}, nil
+	case headYOLOv8:
+		return &yolov8Decoder{names: names, shape: info.outputShapes[0], confidence: confidence}, nil
+	case headYOLOv8Seg:
+		if len(info.outputShapes) < 2 {
+			return nil, fmt.Errorf("%s needs a prototype mask output", head)
+		}
+
+		return &yolov8SegDecoder{
+			names:      names,
+			shape:      info.outputShapes[0],
+			protoShape: info.outputShapes[1],
+			confidence: confidence,
+		}, nil
+	case headYOLOv8Pose:
+		keypoints := 17
+		if k, ok := parseKeypointShape(info.metadata["kpt_shape"]); ok {
+			keypoints = k
+		}
+		if _, ok := info.metadata["names"]; !ok {
+			names = []string{"person"}
+		}
+
+		return &yolov8PoseDecoder{names: names, shape: info.outputShapes[0], keypoints: keypoints, confidence: confidence}, nil
+	case headYOLOv10:
+		return &yolov10Decoder{names: names, shape: info.outputShapes[0], confidence: confidence}, nil
+	}
+
+	return nil, fmt.Errorf("unknown output head %q", head)
+}
+
+// parseNames parses the Python dict literal Ultralytics stores under "names",
+// e.g. {0: 'person', 1: 'bicycle'}.
+func parseNames(s string) ([]string, bool) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "{") || !strings.HasSuffix(s, "}") {
+		return nil, false
+	}
+
+	names := map[int]string{}
+	maxID := -1
+	for _, entry := range splitDictEntries(s[1 : len(s)-1]) {
+		k, v, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, false
+		}
+		id, err := strconv.Atoi(strings.TrimSpace(k))
+		if err != nil {
+			return nil, false
+		}
+		names[id] = strings.Trim(strings.TrimSpace(v), `'"`)
+		maxID = max(maxID, id)
+	}
+	if maxID < 0 {
+		return nil, false
+	}
+
+	result := make([]string, maxID+1)
+	for id, name := range names {
+		result[id] = name
+	}
+
+	return result, true
+}
+
+// splitDictEntries splits on commas that are not inside a quoted string, so
+// names like 'hair drier, blue' survive.
+func splitDictEntries(s string) []string {
+	var (
+		entries []string
+		quote   rune
+		start   int
+	)
+	for i, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == ',':
+			entries = append(entries, s[start:i])
+			start = i + 1
+		}
+	}
+	if strings.TrimSpace(s[start:]) != "" {
+		entries = append(entries, s[start:])
+	}
+
+	return entries
+}
+
+// parseKeypointShape parses "[17, 3]" and returns the number of keypoints.
+func parseKeypointShape(s string) (int, bool) {
+	s = strings.Trim(strings.TrimSpace(s), "[]")
+	first, _, _ := strings.Cut(s, ",")
+	n, err := strconv.Atoi(strings.TrimSpace(first))
+	if err != nil || n <= 0 {
+		return 0, false
+	}
+
+	return n, true
+}
+
+func className(names []string, classID int) string {
+	if classID >= 0 && classID < len(names) && names[classID] != "" {
+		return names[classID]
+	}
+
+	return fmt.Sprintf("class %d", classID)
+}
+
+// scaleBox converts a center-size box in model input space to corner
+// coordinates in the original image.
+func scaleBox(xc, yc, w, h float32, originalWidth, originalHeight int) (x1, y1, x2, y2 float32) {
+	sx := float32(originalWidth) / modelInputSize
+	sy := float32(originalHeight) / modelInputSize
+
+	return (xc - w/2) * sx, (yc - h/2) * sy, (xc + w/2) * sx, (yc + h/2) * sy
+}
+
+// nonMaxSuppression keeps the most confident box out of every group of boxes
+// overlapping more than the IoU threshold. The result is sorted by descending
+// confidence. The index slice maps every kept box back to its position in the
+// input, so decoders can attach extra per-candidate data afterwards.
+func nonMaxSuppression(boxes []boundingBox, threshold float32) ([]boundingBox, []int) {
+	order := make([]int, len(boxes))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return boxes[order[i]].confidence > boxes[order[j]].confidence
+	})
+
+	kept := make([]boundingBox, 0, len(boxes))
+	indices := make([]int, 0, len(boxes))
+
+	for _, idx := range order {
+		candidateBox := boxes[idx]
+		overlapsExistingBox := false
+		for _, existingBox := range kept {
+			if (&candidateBox).iou(&existingBox) > threshold {
+				overlapsExistingBox = true
+				break
+			}
+		}
+		if !overlapsExistingBox {
+			kept = append(kept, candidateBox)
+			indices = append(indices, idx)
+		}
+	}
+
+	return kept, indices
+}
+
+// yolov8Decoder handles the anchor-free YOLOv8 detect head with the output
+// layout [1, 4+classes, anchors]: the box center and size, then one score per
+// class, stored column by column.
+type yolov8Decoder struct {
+	names      []string
+	shape      ort.Shape
+	confidence float32
+}
+
+func (d *yolov8Decoder) decode(output [][]float32, originalWidth, originalHeight int) []boundingBox {
+	boxes, _ := decodeAnchorFree(output[0], int(d.shape[2]), int(d.shape[1])-4, d.names, d.confidence, originalWidth, originalHeight)
+	boxes, _ = nonMaxSuppression(boxes, iouThreshold)
+
+	return boxes
+}
+
+// decodeAnchorFree reads the column-major YOLOv8 layout shared by the detect,
+// segmentation and pose heads. It returns the boxes above the confidence
+// threshold and, for each of them, the anchor column it was read from.
+func decodeAnchorFree(output []float32, anchors, classes int, names []string, confidence float32, originalWidth, originalHeight int) ([]boundingBox, []int) {
+	boxes := make([]boundingBox, 0, anchors)
+	columns := make([]int, 0, anchors)
+
+	for idx := 0; idx < anchors; idx++ {
+		classID, probability := 0, float32(-1e9)
+		for col := 0; col < classes; col++ {
+			currentProb := output[anchors*(col+4)+idx]
+			if currentProb > probability {
+				probability = currentProb
+				classID = col
+			}
+		}
+
+		if probability < confidence {
+			continue
+		}
+
+		xc, yc := output[idx], output[anchors+idx]
+		w, h := output[2*anchors+idx], output[3*anchors+idx]
+		x1, y1, x2, y2 := scaleBox(xc, yc, w, h, originalWidth, originalHeight)
+
+		boxes = append(boxes, boundingBox{
+			label:      className(names, classID),
+			classID:    classID,
+			confidence: probability,
+			x1:         x1,
+			y1:         y1,
+			x2:         x2,
+			y2:         y2,
+		})
+		columns = append(columns, idx)
+	}
+
+	return boxes, columns
+}
+
+// yolov5Decoder handles the YOLOv5 head with the output layout
+// [1, anchors, 5+classes]: the box center and size, the objectness score and
+// one score per class, stored row by row. The exported Detect layer already
+// applies the sigmoid and the anchor grid, so the 25200 rows (3 anchors for
+// each cell of the 80x80, 40x40 and 20x20 grids) are in input pixels.
+type yolov5Decoder struct {
+	names      []string
+	shape      ort.Shape
+	confidence float32
+}
+
+func (d *yolov5Decoder) decode(output [][]float32, originalWidth, originalHeight int) []boundingBox {
+	rows, stride := int(d.shape[1]), int(d.shape[2])
+	classes := stride - 5
+	data := output[0]
+
+	boxes := make([]boundingBox, 0, 256)
+
+	for row := 0; row < rows; row++ {
+		r := data[row*stride : (row+1)*stride]
+
+		objectness := r[4]
+		if objectness < d.confidence {
+			continue
+		}
+
+		classID, probability := 0, float32(-1e9)
+		for col := 0; col < classes; col++ {
+			if r[5+col] > probability {
+				probability = r[5+col]
+				classID = col
+			}
+		}
+
+		confidence := objectness * probability
+		if confidence < d.confidence {
+			continue
+		}
+
+		x1, y1, x2, y2 := scaleBox(r[0], r[1], r[2], r[3], originalWidth, originalHeight)
+
+		boxes = append(boxes, boundingBox{
+			label:      className(d.names, classID),
+			classID:    classID,
+			confidence: confidence,
+			x1:         x1,
+			y1:         y1,
+			x2:         x2,
+			y2:         y2,
+		})
+	}
+
+	boxes, _ = nonMaxSuppression(boxes, iouThreshold)
+
+	return boxes
+}
+
+// yolov10Decoder handles the NMS-free YOLOv10 head with the output layout
+// [1, detections, 6]: x1, y1, x2, y2, score and class, already de-duplicated
+// by the model.
+type yolov10Decoder struct {
+	names      []string
+	shape      ort.Shape
+	confidence float32
+}
+
+func (d *yolov10Decoder) decode(output [][]float32, originalWidth, originalHeight int) []boundingBox {
+	rows, stride := int(d.shape[1]), int(d.shape[2])
+	data := output[0]
+	sx := float32(originalWidth) / modelInputSize
+	sy := float32(originalHeight) / modelInputSize
+
+	boxes := make([]boundingBox, 0, rows)
+
+	for row := 0; row < rows; row++ {
+		r := data[row*stride : (row+1)*stride]
+		if r[4] < d.confidence {
+			continue
+		}
+
+		classID := int(r[5])
+		boxes = append(boxes, boundingBox{
+			label:      className(d.names, classID),
+			classID:    classID,
+			confidence: r[4],
+			x1:         r[0] * sx,
+			y1:         r[1] * sy,
+			x2:         r[2] * sx,
+			y2:         r[3] * sy,
+		})
+	}
+
+	sort.SliceStable(boxes, func(i, j int) bool {
+		return boxes[i].confidence > boxes[j].confidence
+	})
+
+	return boxes
+}
+
+// yolov8PoseDecoder handles the YOLOv8 pose head with the output layout
+// [1, 4+classes+keypoints*3, anchors]: the detect layout followed by x, y and
+// visibility for every keypoint.
+type yolov8PoseDecoder struct {
+	names      []string
+	shape      ort.Shape
+	keypoints  int
+	confidence float32
+}
+
+func (d *yolov8PoseDecoder) decode(output [][]float32, originalWidth, originalHeight int) []boundingBox {
+	anchors := int(d.shape[2])
+	classes := int(d.shape[1]) - 4 - d.keypoints*3
+	data := output[0]
+
+	boxes, columns := decodeAnchorFree(data, anchors, classes, d.names, d.confidence, originalWidth, originalHeight)
+	boxes, indices := nonMaxSuppression(boxes, iouThreshold)
+
+	sx := float32(originalWidth) / modelInputSize
+	sy := float32(originalHeight) / modelInputSize
+
+	for i := range boxes {
+		col := columns[indices[i]]
+		kps := make([]keypoint, d.keypoints)
+		for k := range kps {
+			base := 4 + classes + k*3
+			kps[k] = keypoint{
+				x:          data[anchors*base+col] * sx,
+				y:          data[anchors*(base+1)+col] * sy,
+				confidence: data[anchors*(base+2)+col],
+			}
+		}
+		boxes[i].keypoints = kps
+	}
+
+	return boxes
+}
+
+// yolov8SegDecoder handles the YOLOv8 segmentation head. The first output has
+// the layout [1, 4+classes+coefficients, anchors], the second holds the
+// prototype masks [1, coefficients, height, width]. An instance mask is the
+// sigmoid of the coefficient-weighted sum of the prototypes, cropped to the
+// box.
+type yolov8SegDecoder struct {
+	names      []string
+	shape      ort.Shape
+	protoShape ort.Shape
+	confidence float32
+}
+
+func (d *yolov8SegDecoder) decode(output [][]float32, originalWidth, originalHeight int) []boundingBox {
+	anchors := int(d.shape[2])
+	coefficients := int(d.protoShape[1])
+	classes := int(d.shape[1]) - 4 - coefficients
+	data := output[0]
+
+	boxes, columns := decodeAnchorFree(data, anchors, classes, d.names, d.confidence, originalWidth, originalHeight)
+	boxes, indices := nonMaxSuppression(boxes, iouThreshold)
+
+	coeffs := make([]float32, coefficients)
+	for i := range boxes {
+		col := columns[indices[i]]
+		for c := range coeffs {
+			coeffs[c] = data[anchors*(4+classes+c)+col]
+		}
+		boxes[i].mask = d.instanceMask(output[1], coeffs, &boxes[i], originalWidth, originalHeight)
+	}
+
+	return boxes
+}
+
+// instanceMask builds the binary mask of one instance in original image
+// coordinates, bounded by the instance's box.
+func (d *yolov8SegDecoder) instanceMask(protos, coeffs []float32, box *boundingBox, originalWidth, originalHeight int) *image.Alpha {
+	protoH, protoW := int(d.protoShape[2]), int(d.protoShape[3])
+	rect := box.toRect().Intersect(image.Rect(0, 0, originalWidth, originalHeight))
+	mask := image.NewAlpha(rect)
+	if rect.Empty() {
+		return mask
+	}
+
+	sx := float64(protoW) / float64(originalWidth)
+	sy := float64(protoH) / float64(originalHeight)
+
+	// Only the prototype cells under the box contribute, so evaluate the
+	// linear combination there and sample it bilinearly.
+	px0 := clampInt(int(math.Floor(float64(rect.Min.X)*sx))-1, 0, protoW-1)
+	py0 := clampInt(int(math.Floor(float64(rect.Min.Y)*sy))-1, 0, protoH-1)
+	px1 := clampInt(int(math.Ceil(float64(rect.Max.X)*sx))+1, 0, protoW-1)
+	py1 := clampInt(int(math.Ceil(float64(rect.Max.Y)*sy))+1, 0, protoH-1)
+	gw, gh := px1-px0+1, py1-py0+1
+
+	logits := make([]float32, gw*gh)
+	plane := protoW * protoH
+	for gy := 0; gy < gh; gy++ {
+		for gx := 0; gx < gw; gx++ {
+			offset := (py0+gy)*protoW + px0 + gx
+			var sum float32
+			for c, coeff := range coeffs {
+				sum += coeff * protos[c*plane+offset]
+			}
+			logits[gy*gw+gx] = sum
+		}
+	}
+
+	// sigmoid(x) > 0.5 exactly when x > 0, so no sigmoid is needed for the
+	// default threshold.
+	limit := float32(math.Log(maskThreshold / (1 - maskThreshold)))
+
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		fy := (float64(y)+0.5)*sy - 0.5 - float64(py0)
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			fx := (float64(x)+0.5)*sx - 0.5 - float64(px0)
+			if bilinear(logits, gw, gh, fx, fy) > limit {
+				mask.SetAlpha(x, y, color.Alpha{A: 0xff})
+			}
+		}
+	}
+
+	return mask
+}
+
+func bilinear(grid []float32, w, h int, fx, fy float64) float32 {
+	fx = math.Max(0, math.Min(fx, float64(w-1)))
+	fy = math.Max(0, math.Min(fy, float64(h-1)))
+	x0, y0 := int(fx), int(fy)
+	x1, y1 := min(x0+1, w-1), min(y0+1, h-1)
+	dx, dy := float32(fx-float64(x0)), float32(fy-float64(y0))
+
+	top := grid[y0*w+x0]*(1-dx) + grid[y0*w+x1]*dx
+	bottom := grid[y1*w+x0]*(1-dx) + grid[y1*w+x1]*dx
+
+	return top*(1-dy) + bottom*dy
+}
+
+func clampInt(v, lo, hi int) int {
+	return max(lo, min(v, hi))
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	ort "github.com/yalue/onnxruntime_go"
+)
+
+func TestDetectHead(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata map[string]string
+		shapes   []ort.Shape
+		want     string
+		wantErr  bool
+	}{
+		{"yolov8", nil, []ort.Shape{{1, 84, 8400}}, headYOLOv8, false},
+		{"yolov8 segmentation by shape", nil, []ort.Shape{{1, 116, 8400}, {1, 32, 160, 160}}, headYOLOv8Seg, false},
+		{"segmentation task", map[string]string{"task": "segment"}, []ort.Shape{{1, 116, 8400}}, headYOLOv8Seg, false},
+		{"pose task", map[string]string{"task": "pose"}, []ort.Shape{{1, 56, 8400}}, headYOLOv8Pose, false},
+		{"pose without a task", map[string]string{"kpt_shape": "[17, 3]"}, []ort.Shape{{1, 56, 8400}}, headYOLOv8Pose, false},
+		{"yolov5", nil, []ort.Shape{{1, 25200, 85}}, headYOLOv5, false},
+		{"yolov10", nil, []ort.Shape{{1, 300, 6}}, headYOLOv10, false},
+		{"unknown shape", nil, []ort.Shape{{1, 1000}}, "", true},
+		{"no outputs", nil, nil, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := detectHead(&modelInfo{metadata: tt.metadata, outputShapes: tt.shapes})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("detectHead() error = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("detectHead() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewDecoderPoseWithoutTask(t *testing.T) {
+	info := &modelInfo{
+		metadata:     map[string]string{"kpt_shape": "[5, 3]"},
+		outputShapes: []ort.Shape{{1, 4 + 1 + 5*3, 8400}},
+	}
+
+	decoder, err := newDecoder(headAuto, info, defaultConfidenceThreshold)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pose, ok := decoder.(*yolov8PoseDecoder)
+	if !ok {
+		t.Fatalf("newDecoder() = %T, want a pose decoder", decoder)
+	}
+	if pose.keypoints != 5 || !reflect.DeepEqual(pose.names, []string{"person"}) {
+		t.Errorf("pose decoder has %d keypoints and names %v, want 5 and [person]", pose.keypoints, pose.names)
+	}
+}
+
+func TestFixedOutputShape(t *testing.T) {
+	tests := []struct {
+		name         string
+		shape, input ort.Shape
+		want         ort.Shape
+	}{
+		{"fixed", ort.Shape{1, 300, 6}, ort.Shape{1, 3, 640, 640}, ort.Shape{1, 300, 6}},
+		{"anchor columns", ort.Shape{-1, 84, -1}, ort.Shape{1, 3, 640, 640}, ort.Shape{1, 84, 8400}},
+		{"anchor rows", ort.Shape{-1, -1, 85}, ort.Shape{1, 3, 640, 640}, ort.Shape{1, 25200, 85}},
+		{"prototypes", ort.Shape{-1, 32, -1, -1}, ort.Shape{1, 3, 640, 640}, ort.Shape{1, 32, 160, 160}},
+		{"prototypes of a smaller input", ort.Shape{-1, 32, -1, -1}, ort.Shape{1, 3, 320, 480}, ort.Shape{1, 32, 80, 120}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := fixedOutputShape(tt.shape, tt.input); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("fixedOutputShape() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseNames(t *testing.T) {
+	tests := []struct {
+		in     string
+		want   []string
+		wantOK bool
+	}{
+		{"{0: 'person', 1: 'bicycle'}", []string{"person", "bicycle"}, true},
+		{`{0: 'hair drier, blue', 2: "cat"}`, []string{"hair drier, blue", "", "cat"}, true},
+		{"{}", nil, false},
+		{"", nil, false},
+		{"['person']", nil, false},
+		{"{person: 0}", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, ok := parseNames(tt.in)
+			if ok != tt.wantOK || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseNames() = %q, %v, want %q, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestParseKeypointShape(t *testing.T) {
+	tests := []struct {
+		in     string
+		want   int
+		wantOK bool
+	}{
+		{"[17, 3]", 17, true},
+		{"[5,2]", 5, true},
+		{"[0, 3]", 0, false},
+		{"", 0, false},
+		{"keypoints", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			if got, ok := parseKeypointShape(tt.in); got != tt.want || ok != tt.wantOK {
+				t.Errorf("parseKeypointShape() = %d, %v, want %d, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+// columns lays out one row of values per anchor in the column-major YOLOv8
+// layout.
+func columns(anchors [][]float32) []float32 {
+	n := len(anchors)
+	out := make([]float32, n*len(anchors[0]))
+	for a, values := range anchors {
+		for c, v := range values {
+			out[c*n+a] = v
+		}
+	}
+
+	return out
+}
+
+// stripped drops the masks and keypoints, checked separately.
+func stripped(boxes []boundingBox) []boundingBox {
+	out := make([]boundingBox, len(boxes))
+	for i, b := range boxes {
+		out[i] = boundingBox{label: b.label, classID: b.classID, confidence: b.confidence, x1: b.x1, y1: b.y1, x2: b.x2, y2: b.y2}
+	}
+
+	return out
+}
+
+func TestDecoders(t *testing.T) {
+	names := []string{"cat", "dog", "bird"}
+
+	// The original image is 1280x640, twice as wide as the model input
+	tests := []struct {
+		name    string
+		decoder outputDecoder
+		output  []float32
+		want    []boundingBox
+	}{
+		{
+			name:    "yolov8",
+			decoder: &yolov8Decoder{names: names, shape: ort.Shape{1, 4 + 3, 3}, confidence: 0.5},
+			output: columns([][]float32{
+				{100, 100, 40, 20, 0.1, 0.9, 0},
+				// Overlaps the first box with a lower score
+				{102, 100, 40, 20, 0.1, 0.6, 0},
+				// Below the confidence threshold
+				{300, 300, 20, 20, 0.3, 0, 0.2},
+			}),
+			want: []boundingBox{{label: "dog", classID: 1, confidence: 0.9, x1: 160, y1: 90, x2: 240, y2: 110}},
+		},
+		{
+			name:    "yolov5",
+			decoder: &yolov5Decoder{names: names, shape: ort.Shape{1, 3, 5 + 3}, confidence: 0.5},
+			output: []float32{
+				100, 100, 40, 20, 0.8, 0.1, 0.1, 1,
+				// Low objectness
+				300, 300, 20, 20, 0.4, 1, 0, 0,
+				// Objectness times the class score is below the threshold
+				500, 300, 20, 20, 0.9, 0.5, 0, 0,
+			},
+			want: []boundingBox{{label: "bird", classID: 2, confidence: 0.8, x1: 160, y1: 90, x2: 240, y2: 110}},
+		},
+		{
+			name:    "yolov10",
+			decoder: &yolov10Decoder{names: names, shape: ort.Shape{1, 3, 6}, confidence: 0.5},
+			output: []float32{
+				10, 10, 20, 20, 0.6, 2,
+				30, 30, 40, 40, 0.8, 0,
+				0, 0, 1, 1, 0.1, 1,
+			},
+			want: []boundingBox{
+				{label: "cat", classID: 0, confidence: 0.8, x1: 60, y1: 30, x2: 80, y2: 40},
+				{label: "bird", classID: 2, confidence: 0.6, x1: 20, y1: 10, x2: 40, y2: 20},
+			},
+		},
+		{
+			name:    "lower confidence threshold",
+			decoder: &yolov10Decoder{names: names, shape: ort.Shape{1, 2, 6}, confidence: 0.05},
+			output: []float32{
+				10, 10, 20, 20, 0.1, 1,
+				0, 0, 1, 1, 0.01, 1,
+			},
+			want: []boundingBox{{label: "dog", classID: 1, confidence: 0.1, x1: 20, y1: 10, x2: 40, y2: 20}},
+		},
+		{
+			name:    "unknown class id",
+			decoder: &yolov10Decoder{names: names, shape: ort.Shape{1, 1, 6}, confidence: 0.5},
+			output:  []float32{10, 10, 20, 20, 0.6, 7},
+			want:    []boundingBox{{label: "class 7", classID: 7, confidence: 0.6, x1: 20, y1: 10, x2: 40, y2: 20}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.decoder.decode([][]float32{tt.output}, 1280, 640)
+			if !reflect.DeepEqual(stripped(got), tt.want) {
+				t.Errorf("decode() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPoseDecoder(t *testing.T) {
+	d := &yolov8PoseDecoder{names: []string{"person"}, shape: ort.Shape{1, 4 + 1 + 2*3, 2}, keypoints: 2, confidence: 0.5}
+	output := columns([][]float32{
+		{100, 100, 40, 20, 0.9, 90, 95, 0.8, 110, 105, 0.3},
+		{300, 300, 40, 20, 0.2, 290, 295, 0.8, 310, 305, 0.8},
+	})
+
+	boxes := d.decode([][]float32{output}, 1280, 640)
+	if len(boxes) != 1 {
+		t.Fatalf("decode() = %v, want a single person", boxes)
+	}
+	want := []keypoint{{x: 180, y: 95, confidence: 0.8}, {x: 220, y: 105, confidence: 0.3}}
+	if !reflect.DeepEqual(boxes[0].keypoints, want) {
+		t.Errorf("keypoints = %v, want %v", boxes[0].keypoints, want)
+	}
+}
+
+func TestSegDecoder(t *testing.T) {
+	d := &yolov8SegDecoder{names: []string{"cat"}, shape: ort.Shape{1, 4 + 1 + 1, 1}, protoShape: ort.Shape{1, 1, 4, 4}, confidence: 0.5}
+	// The left half of an 8x8 image, its single prototype positive in the
+	// top half only
+	output := columns([][]float32{{160, 320, 320, 640, 0.9, 1}})
+	protos := []float32{
+		1, 1, 1, 1,
+		1, 1, 1, 1,
+		-1, -1, -1, -1,
+		-1, -1, -1, -1,
+	}
+
+	boxes := d.decode([][]float32{output, protos}, 8, 8)
+	if len(boxes) != 1 {
+		t.Fatalf("decode() = %v, want a single cat", boxes)
+	}
+	mask := boxes[0].mask
+	if mask.Bounds() != boxes[0].toRect() {
+		t.Errorf("mask bounds = %v, want the box %v", mask.Bounds(), boxes[0].toRect())
+	}
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 4; x++ {
+			if got, want := mask.AlphaAt(x, y).A == 0xff, y < 4; got != want {
+				t.Errorf("mask at (%d, %d) = %v, want %v", x, y, got, want)
+			}
+		}
+	}
+}
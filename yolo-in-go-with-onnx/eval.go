@@ -0,0 +1,543 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+const (
+	evalMaxDetections    = 100
+	evalRecallPoints     = 101
+	evalConfusionIoU     = 0.5
+	evalConfusionMinConf = 0.25
+)
+
+// evalIoUThresholds are the COCO thresholds 0.50:0.05:0.95.
+var evalIoUThresholds = []float64{0.5, 0.55, 0.6, 0.65, 0.7, 0.75, 0.8, 0.85, 0.9, 0.95}
+
+// cocoDataset is the subset of a COCO annotations file the evaluation needs.
+type cocoDataset struct {
+	Images      []cocoImage      `json:"images"`
+	Annotations []cocoAnnotation `json:"annotations"`
+	Categories  []cocoCategory   `json:"categories"`
+}
+
+type cocoImage struct {
+	ID       int    `json:"id"`
+	FileName string `json:"file_name"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+}
+
+type cocoAnnotation struct {
+	ImageID    int        `json:"image_id"`
+	CategoryID int        `json:"category_id"`
+	BBox       [4]float64 `json:"bbox"`
+	IsCrowd    int        `json:"iscrowd"`
+}
+
+type cocoCategory struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// evalBox is a ground-truth or predicted box in [x, y, w, h] pixels.
+type evalBox struct {
+	ImageID    int
+	CategoryID int
+	BBox       [4]float64
+	Score      float64
+	Crowd      bool
+}
+
+// classReport holds the metrics of one category. Precision and recall are
+// taken at the confidence with the best F1 score for IoU 0.5.
+type classReport struct {
+	CategoryID  int       `json:"category_id"`
+	Name        string    `json:"name"`
+	GroundTruth int       `json:"ground_truth"`
+	AP50        float64   `json:"ap50"`
+	AP50To95    float64   `json:"ap50_95"`
+	Precision   float64   `json:"precision"`
+	Recall      float64   `json:"recall"`
+	PRCurve     []float64 `json:"pr_curve"`
+}
+
+// evalReport is written as the JSON output of the eval mode. PR curves hold
+// the interpolated precision at the recall points 0.00, 0.01, ..., 1.00 for
+// IoU 0.5. Confusion rows are ground-truth classes and columns predicted
+// classes, with a trailing background row and column.
+type evalReport struct {
+	MAP50     float64       `json:"map50"`
+	MAP50To95 float64       `json:"map50_95"`
+	Classes   []classReport `json:"classes"`
+	Labels    []string      `json:"confusion_labels"`
+	Confusion [][]int       `json:"confusion_matrix"`
+}
+
+// evaluate computes COCO-style AP for every category with ground truth, the
+// same way pycocotools does for the "all" area range and at most 100
+// detections per image and category.
+func evaluate(dataset *cocoDataset, predictions []evalBox) *evalReport {
+	gts := map[[2]int][]evalBox{}
+	for _, a := range dataset.Annotations {
+		gts[[2]int{a.ImageID, a.CategoryID}] = append(gts[[2]int{a.ImageID, a.CategoryID}], evalBox{
+			ImageID:    a.ImageID,
+			CategoryID: a.CategoryID,
+			BBox:       a.BBox,
+			Crowd:      a.IsCrowd != 0,
+		})
+	}
+
+	dts := map[[2]int][]evalBox{}
+	for _, p := range predictions {
+		dts[[2]int{p.ImageID, p.CategoryID}] = append(dts[[2]int{p.ImageID, p.CategoryID}], p)
+	}
+	// pycocotools applies maxDets to every image and category, not to the
+	// image as a whole
+	for key, ds := range dts {
+		sort.SliceStable(ds, func(i, j int) bool { return ds[i].Score > ds[j].Score })
+		dts[key] = ds[:min(len(ds), evalMaxDetections)]
+	}
+
+	report := &evalReport{}
+	var sum50, sum5095 float64
+
+	for _, cat := range dataset.Categories {
+		// Per threshold: scores, true positive flags and the ignored flags
+		// of all detections of the category, across images
+		type matched struct {
+			score   float64
+			tp      []bool
+			ignored []bool
+		}
+		var (
+			all      []matched
+			positive int
+		)
+
+		for _, img := range dataset.Images {
+			key := [2]int{img.ID, cat.ID}
+			g, d := gts[key], dts[key]
+			for _, gt := range g {
+				if !gt.Crowd {
+					positive++
+				}
+			}
+
+			tp, ignored := matchImage(g, d)
+			for i, det := range d {
+				m := matched{score: det.Score, tp: make([]bool, len(evalIoUThresholds)), ignored: make([]bool, len(evalIoUThresholds))}
+				for t := range evalIoUThresholds {
+					m.tp[t] = tp[t][i]
+					m.ignored[t] = ignored[t][i]
+				}
+				all = append(all, m)
+			}
+		}
+
+		if positive == 0 {
+			continue
+		}
+
+		sort.SliceStable(all, func(i, j int) bool { return all[i].score > all[j].score })
+
+		cr := classReport{CategoryID: cat.ID, Name: cat.Name, GroundTruth: positive}
+		var apSum float64
+		for t := range evalIoUThresholds {
+			var tps, fps int
+			precision := make([]float64, 0, len(all))
+			recall := make([]float64, 0, len(all))
+			for _, m := range all {
+				if m.ignored[t] {
+					continue
+				}
+				if m.tp[t] {
+					tps++
+				} else {
+					fps++
+				}
+				precision = append(precision, float64(tps)/float64(tps+fps))
+				recall = append(recall, float64(tps)/float64(positive))
+			}
+
+			curve := interpolatedPrecision(precision, recall)
+			ap := mean(curve)
+			apSum += ap
+
+			if t == 0 {
+				cr.AP50 = ap
+				cr.PRCurve = curve
+				cr.Precision, cr.Recall = bestF1(precision, recall)
+			}
+		}
+		cr.AP50To95 = apSum / float64(len(evalIoUThresholds))
+
+		sum50 += cr.AP50
+		sum5095 += cr.AP50To95
+		report.Classes = append(report.Classes, cr)
+	}
+
+	if n := len(report.Classes); n > 0 {
+		report.MAP50 = sum50 / float64(n)
+		report.MAP50To95 = sum5095 / float64(n)
+	}
+
+	report.Labels, report.Confusion = confusionMatrix(dataset, predictions)
+
+	return report
+}
+
+// matchImage greedily matches the detections of one image and category, in
+// descending score order, to the ground truth with the highest IoU at every
+// threshold. Detections matched to crowd regions are ignored rather than
+// counted as false positives. The result is indexed [threshold][detection].
+func matchImage(gts, dts []evalBox) ([][]bool, [][]bool) {
+	// Non-crowd ground truth goes first, so a crowd match is only a fallback
+	sort.SliceStable(gts, func(i, j int) bool { return !gts[i].Crowd && gts[j].Crowd })
+	sort.SliceStable(dts, func(i, j int) bool { return dts[i].Score > dts[j].Score })
+
+	tp := make([][]bool, len(evalIoUThresholds))
+	ignored := make([][]bool, len(evalIoUThresholds))
+
+	for t, threshold := range evalIoUThresholds {
+		tp[t] = make([]bool, len(dts))
+		ignored[t] = make([]bool, len(dts))
+		taken := make([]bool, len(gts))
+
+		for d, dt := range dts {
+			best, bestIoU := -1, math.Min(threshold, 1-1e-10)
+			for g, gt := range gts {
+				if taken[g] && !gt.Crowd {
+					continue
+				}
+				// Once matched to regular ground truth, stop at the crowd
+				if best > -1 && !gts[best].Crowd && gt.Crowd {
+					break
+				}
+				iou := cocoIoU(dt.BBox, gt.BBox, gt.Crowd)
+				if iou < bestIoU {
+					continue
+				}
+				best, bestIoU = g, iou
+			}
+			if best == -1 {
+				continue
+			}
+
+			taken[best] = true
+			if gts[best].Crowd {
+				ignored[t][d] = true
+			} else {
+				tp[t][d] = true
+			}
+		}
+	}
+
+	return tp, ignored
+}
+
+// cocoIoU computes the IoU of two [x, y, w, h] boxes. For crowd regions the
+// overlap is relative to the detection only.
+func cocoIoU(dt, gt [4]float64, crowd bool) float64 {
+	iw := math.Min(dt[0]+dt[2], gt[0]+gt[2]) - math.Max(dt[0], gt[0])
+	ih := math.Min(dt[1]+dt[3], gt[1]+gt[3]) - math.Max(dt[1], gt[1])
+	if iw <= 0 || ih <= 0 {
+		return 0
+	}
+
+	inter := iw * ih
+	union := dt[2]*dt[3] + gt[2]*gt[3] - inter
+	if crowd {
+		union = dt[2] * dt[3]
+	}
+	if union <= 0 {
+		return 0
+	}
+
+	return inter / union
+}
+
+// interpolatedPrecision samples the precision envelope at the 101 COCO recall
+// points. Recall values that are never reached get a precision of 0.
+func interpolatedPrecision(precision, recall []float64) []float64 {
+	envelope := make([]float64, len(precision))
+	copy(envelope, precision)
+	for i := len(envelope) - 1; i > 0; i-- {
+		envelope[i-1] = math.Max(envelope[i-1], envelope[i])
+	}
+
+	curve := make([]float64, evalRecallPoints)
+	for r := range curve {
+		threshold := float64(r) / float64(evalRecallPoints-1)
+		i := sort.SearchFloat64s(recall, threshold)
+		if i < len(envelope) {
+			curve[r] = envelope[i]
+		}
+	}
+
+	return curve
+}
+
+// bestF1 returns the precision and recall at the confidence cut-off with the
+// highest F1 score.
+func bestF1(precision, recall []float64) (float64, float64) {
+	var bestP, bestR, best float64
+	for i := range precision {
+		if precision[i]+recall[i] == 0 {
+			continue
+		}
+		if f1 := 2 * precision[i] * recall[i] / (precision[i] + recall[i]); f1 > best {
+			best, bestP, bestR = f1, precision[i], recall[i]
+		}
+	}
+
+	return bestP, bestR
+}
+
+func mean(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+
+	return sum / float64(len(values))
+}
+
+// confusionMatrix matches predictions above evalConfusionMinConf to ground
+// truth of any class at IoU 0.5, pairing the highest overlaps first.
+func confusionMatrix(dataset *cocoDataset, predictions []evalBox) ([]string, [][]int) {
+	index := map[int]int{}
+	labels := make([]string, 0, len(dataset.Categories)+1)
+	for i, c := range dataset.Categories {
+		index[c.ID] = i
+		labels = append(labels, c.Name)
+	}
+	background := len(labels)
+	labels = append(labels, "background")
+
+	matrix := make([][]int, len(labels))
+	for i := range matrix {
+		matrix[i] = make([]int, len(labels))
+	}
+
+	gtByImage := map[int][]cocoAnnotation{}
+	for _, a := range dataset.Annotations {
+		if a.IsCrowd == 0 {
+			gtByImage[a.ImageID] = append(gtByImage[a.ImageID], a)
+		}
+	}
+	dtByImage := map[int][]evalBox{}
+	for _, p := range predictions {
+		if p.Score >= evalConfusionMinConf {
+			dtByImage[p.ImageID] = append(dtByImage[p.ImageID], p)
+		}
+	}
+
+	for _, img := range dataset.Images {
+		gts, dts := gtByImage[img.ID], dtByImage[img.ID]
+
+		type pair struct {
+			g, d int
+			iou  float64
+		}
+		var pairs []pair
+		for g, gt := range gts {
+			for d, dt := range dts {
+				if iou := cocoIoU(dt.BBox, gt.BBox, false); iou >= evalConfusionIoU {
+					pairs = append(pairs, pair{g, d, iou})
+				}
+			}
+		}
+		sort.SliceStable(pairs, func(i, j int) bool { return pairs[i].iou > pairs[j].iou })
+
+		gtUsed := make([]bool, len(gts))
+		dtUsed := make([]bool, len(dts))
+		for _, p := range pairs {
+			if gtUsed[p.g] || dtUsed[p.d] {
+				continue
+			}
+			gtUsed[p.g], dtUsed[p.d] = true, true
+			matrix[categoryIndex(index, gts[p.g].CategoryID, background)][categoryIndex(index, dts[p.d].CategoryID, background)]++
+		}
+		for g, used := range gtUsed {
+			if !used {
+				matrix[categoryIndex(index, gts[g].CategoryID, background)][background]++
+			}
+		}
+		for d, used := range dtUsed {
+			if !used {
+				matrix[background][categoryIndex(index, dts[d].CategoryID, background)]++
+			}
+		}
+	}
+
+	return labels, matrix
+}
+
+func categoryIndex(index map[int]int, categoryID, background int) int {
+	if i, ok := index[categoryID]; ok {
+		return i
+	}
+
+	return background
+}
+
+// writeTable prints the summary and per-class metrics as aligned text.
+func (r *evalReport) writeTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "class\tgt\tprecision\trecall\tAP50\tAP50-95\t\n")
+	for _, c := range r.Classes {
+		fmt.Fprintf(tw, "%s\t%d\t%.3f\t%.3f\t%.3f\t%.3f\t\n", c.Name, c.GroundTruth, c.Precision, c.Recall, c.AP50, c.AP50To95)
+	}
+	fmt.Fprintf(tw, "all\t\t\t\t%.3f\t%.3f\t\n", r.MAP50, r.MAP50To95)
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	// Only print the classes that show up in the matrix
+	var used []int
+	for i := range r.Labels {
+		var total int
+		for j := range r.Labels {
+			total += r.Confusion[i][j] + r.Confusion[j][i]
+		}
+		if total > 0 {
+			used = append(used, i)
+		}
+	}
+	if len(used) == 0 {
+		return nil
+	}
+
+	fmt.Fprintf(w, "\nconfusion matrix (rows: ground truth, columns: predicted)\n")
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	header := []string{""}
+	for _, i := range used {
+		header = append(header, r.Labels[i])
+	}
+	fmt.Fprintf(tw, "%s\t\n", strings.Join(header, "\t"))
+	for _, i := range used {
+		row := []string{r.Labels[i]}
+		for _, j := range used {
+			row = append(row, fmt.Sprint(r.Confusion[i][j]))
+		}
+		fmt.Fprintf(tw, "%s\t\n", strings.Join(row, "\t"))
+	}
+
+	return tw.Flush()
+}
+
+func runEval(args []string) int {
+	fs := flag.NewFlagSet("eval", flag.ContinueOnError)
+	annotations := fs.String("annotations", "", "COCO annotations JSON with the ground truth")
+	images := fs.String("images", "", "directory with the annotated images")
+	cfg := newSessionConfig(fs)
+	out := fs.String("out", "eval.json", "path to the JSON report")
+	conf := fs.Float64("conf", 0.001, "minimum confidence of the evaluated predictions")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *annotations == "" || *images == "" {
+		fmt.Println("missing -annotations or -images")
+
+		return 2
+	}
+
+	data, err := os.ReadFile(*annotations)
+	if err != nil {
+		fmt.Printf("error reading annotations: %s\n", err)
+
+		return 1
+	}
+	var dataset cocoDataset
+	if err := json.Unmarshal(data, &dataset); err != nil {
+		fmt.Printf("error parsing annotations: %s\n", err)
+
+		return 1
+	}
+
+	cfg.confidence = float32(*conf)
+
+	modelSession, err := initSession(cfg)
+	if err != nil {
+		fmt.Printf("error creating session and tensors: %s\n", err)
+
+		return 1
+	}
+	defer modelSession.Destroy()
+
+	// Predictions are matched to categories by name, so custom datasets work
+	// as long as the model was trained with the same class names
+	categories := map[string]int{}
+	for _, c := range dataset.Categories {
+		categories[c.Name] = c.ID
+	}
+
+	var predictions []evalBox
+	for i, img := range dataset.Images {
+		fmt.Fprintf(os.Stderr, "\r[%d/%d] %s", i+1, len(dataset.Images), img.FileName)
+
+		pic, err := loadImageFile(filepath.Join(*images, img.FileName))
+		if err != nil {
+			fmt.Printf("\nerror loading image: %s\n", err)
+
+			return 1
+		}
+
+		boxes, err := modelSession.Detect(pic)
+		if err != nil {
+			fmt.Printf("\nerror running detection: %s\n", err)
+
+			return 1
+		}
+
+		for _, b := range boxes {
+			id, ok := categories[b.label]
+			if !ok {
+				continue
+			}
+			predictions = append(predictions, evalBox{
+				ImageID:    img.ID,
+				CategoryID: id,
+				BBox:       [4]float64{float64(b.x1), float64(b.y1), float64(b.x2 - b.x1), float64(b.y2 - b.y1)},
+				Score:      float64(b.confidence),
+			})
+		}
+	}
+	fmt.Fprintln(os.Stderr)
+
+	report := evaluate(&dataset, predictions)
+
+	data, err = json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		fmt.Printf("error encoding report: %s\n", err)
+
+		return 1
+	}
+	if err := os.WriteFile(*out, data, 0o644); err != nil {
+		fmt.Printf("error writing report: %s\n", err)
+
+		return 1
+	}
+
+	if err := report.writeTable(os.Stdout); err != nil {
+		fmt.Printf("error writing table: %s\n", err)
+
+		return 1
+	}
+
+	return 0
+}
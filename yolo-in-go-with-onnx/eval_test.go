@@ -0,0 +1,160 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestEvaluate(t *testing.T) {
+	categories := []cocoCategory{{ID: 1, Name: "cat"}, {ID: 2, Name: "dog"}}
+	images := []cocoImage{{ID: 1, FileName: "1.jpg"}, {ID: 2, FileName: "2.jpg"}}
+
+	gt := func(image, category int, x, y, w, h float64) cocoAnnotation {
+		return cocoAnnotation{ImageID: image, CategoryID: category, BBox: [4]float64{x, y, w, h}}
+	}
+	dt := func(image, category int, score, x, y, w, h float64) evalBox {
+		return evalBox{ImageID: image, CategoryID: category, Score: score, BBox: [4]float64{x, y, w, h}}
+	}
+
+	// A hundred confident dogs that match nothing, all on image 1
+	var dogs []evalBox
+	for i := range evalMaxDetections {
+		dogs = append(dogs, dt(1, 2, 0.9, float64(100+20*i), 100, 10, 10))
+	}
+
+	tests := []struct {
+		name        string
+		annotations []cocoAnnotation
+		predictions []evalBox
+		wantMAP50   float64
+		wantMAP5095 float64
+	}{
+		{
+			name:        "perfect",
+			annotations: []cocoAnnotation{gt(1, 1, 0, 0, 10, 10), gt(2, 1, 20, 20, 10, 10)},
+			predictions: []evalBox{dt(1, 1, 0.9, 0, 0, 10, 10), dt(2, 1, 0.8, 20, 20, 10, 10)},
+			wantMAP50:   1,
+			wantMAP5095: 1,
+		},
+		{
+			name:        "false positive ranked first",
+			annotations: []cocoAnnotation{gt(1, 1, 0, 0, 10, 10)},
+			predictions: []evalBox{dt(1, 1, 0.9, 50, 50, 10, 10), dt(1, 1, 0.8, 0, 0, 10, 10)},
+			wantMAP50:   0.5,
+			wantMAP5095: 0.5,
+		},
+		{
+			// Recall reaches 0.5 at precision 1 and 1.0 at precision 2/3:
+			// 51 recall points at 1 and 50 at 2/3.
+			name:        "false positive between true positives",
+			annotations: []cocoAnnotation{gt(1, 1, 0, 0, 10, 10), gt(2, 1, 0, 0, 10, 10)},
+			predictions: []evalBox{dt(1, 1, 0.9, 0, 0, 10, 10), dt(1, 1, 0.8, 50, 50, 10, 10), dt(2, 1, 0.7, 0, 0, 10, 10)},
+			wantMAP50:   (51 + 50*2.0/3) / 101,
+			wantMAP5095: (51 + 50*2.0/3) / 101,
+		},
+		{
+			name:        "missed ground truth",
+			annotations: []cocoAnnotation{gt(1, 1, 0, 0, 10, 10), gt(2, 1, 0, 0, 10, 10)},
+			predictions: []evalBox{dt(1, 1, 0.9, 0, 0, 10, 10)},
+			wantMAP50:   51.0 / 101,
+			wantMAP5095: 51.0 / 101,
+		},
+		{
+			// IoU 0.62 passes the thresholds 0.50, 0.55 and 0.60 only
+			name:        "loose box",
+			annotations: []cocoAnnotation{gt(1, 1, 0, 0, 10, 10)},
+			predictions: []evalBox{dt(1, 1, 0.9, 0, 0, 10, 6.2)},
+			wantMAP50:   1,
+			wantMAP5095: 0.3,
+		},
+		{
+			name:        "duplicate detection",
+			annotations: []cocoAnnotation{gt(1, 1, 0, 0, 10, 10)},
+			predictions: []evalBox{dt(1, 1, 0.9, 0, 0, 10, 10), dt(1, 1, 0.8, 0, 0, 10, 10)},
+			wantMAP50:   1,
+			wantMAP5095: 1,
+		},
+		{
+			name: "detection on crowd region is ignored",
+			annotations: []cocoAnnotation{
+				gt(1, 1, 0, 0, 10, 10),
+				{ImageID: 1, CategoryID: 1, BBox: [4]float64{100, 100, 50, 50}, IsCrowd: 1},
+			},
+			predictions: []evalBox{dt(1, 1, 0.95, 110, 110, 10, 10), dt(1, 1, 0.9, 0, 0, 10, 10)},
+			wantMAP50:   1,
+			wantMAP5095: 1,
+		},
+		{
+			// Capped per image instead, the dogs would crowd out the cat
+			name:        "detections are capped per image and category",
+			annotations: []cocoAnnotation{gt(1, 1, 0, 0, 10, 10), gt(2, 2, 0, 0, 10, 10)},
+			predictions: append([]evalBox{dt(1, 1, 0.5, 0, 0, 10, 10), dt(2, 2, 0.95, 0, 0, 10, 10)}, dogs...),
+			wantMAP50:   1,
+			wantMAP5095: 1,
+		},
+		{
+			name:        "classes are averaged",
+			annotations: []cocoAnnotation{gt(1, 1, 0, 0, 10, 10), gt(1, 2, 50, 50, 10, 10)},
+			predictions: []evalBox{dt(1, 1, 0.9, 0, 0, 10, 10)},
+			wantMAP50:   0.5,
+			wantMAP5095: 0.5,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dataset := &cocoDataset{Images: images, Annotations: tt.annotations, Categories: categories}
+
+			got := evaluate(dataset, tt.predictions)
+
+			if !almostEqual(got.MAP50, tt.wantMAP50) {
+				t.Errorf("evaluate() mAP@0.5 = %v, want %v", got.MAP50, tt.wantMAP50)
+			}
+			if !almostEqual(got.MAP50To95, tt.wantMAP5095) {
+				t.Errorf("evaluate() mAP@0.5:0.95 = %v, want %v", got.MAP50To95, tt.wantMAP5095)
+			}
+		})
+	}
+}
+
+func TestConfusionMatrix(t *testing.T) {
+	dataset := &cocoDataset{
+		Images:     []cocoImage{{ID: 1}},
+		Categories: []cocoCategory{{ID: 1, Name: "cat"}, {ID: 2, Name: "dog"}},
+		Annotations: []cocoAnnotation{
+			{ImageID: 1, CategoryID: 1, BBox: [4]float64{0, 0, 10, 10}},
+			{ImageID: 1, CategoryID: 2, BBox: [4]float64{50, 50, 10, 10}},
+			{ImageID: 1, CategoryID: 2, BBox: [4]float64{100, 100, 10, 10}},
+		},
+	}
+	predictions := []evalBox{
+		// Correct cat
+		{ImageID: 1, CategoryID: 1, Score: 0.9, BBox: [4]float64{0, 0, 10, 10}},
+		// Dog predicted as cat
+		{ImageID: 1, CategoryID: 1, Score: 0.8, BBox: [4]float64{50, 50, 10, 10}},
+		// Background predicted as dog
+		{ImageID: 1, CategoryID: 2, Score: 0.7, BBox: [4]float64{200, 200, 10, 10}},
+		// Below the confidence cut-off, so the last dog counts as missed
+		{ImageID: 1, CategoryID: 2, Score: 0.1, BBox: [4]float64{100, 100, 10, 10}},
+	}
+
+	labels, matrix := confusionMatrix(dataset, predictions)
+
+	wantLabels := []string{"cat", "dog", "background"}
+	wantMatrix := [][]int{
+		{1, 0, 0},
+		{1, 0, 1},
+		{0, 1, 0},
+	}
+	if !reflect.DeepEqual(labels, wantLabels) {
+		t.Errorf("confusionMatrix() labels = %v, want %v", labels, wantLabels)
+	}
+	if !reflect.DeepEqual(matrix, wantMatrix) {
+		t.Errorf("confusionMatrix() matrix = %v, want %v", matrix, wantMatrix)
+	}
+}
+
+func almostEqual(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
@@ -1,19 +1,14 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"image"
-	_ "image/color"
 	_ "image/draw"
-	"image/jpeg"
-	"log"
+	_ "image/jpeg"
 	"os"
-	"sort"
 
 	"github.com/nfnt/resize"
-	ort "github.com/yalue/onnxruntime_go"
-
-	"github.com/fogleman/gg"
 )
 
 const (
@@ -22,33 +17,80 @@ const (
 	outputImagePath = "./output.jpg"
 	sharedLibPath   = "./onnxruntime_arm64.dylib"
 	fontPath        = "/Library/Fonts/Arial Unicode.ttf"
+	modelInputSize  = 640
 )
 
-type ModelSession struct {
-	Session *ort.AdvancedSession
-	Input   *ort.Tensor[float32]
-	Output  *ort.Tensor[float32]
-}
-
 func main() {
 	fmt.Println("YoloV8 with ONNX by KISS-SAMPLES (blog.skopow.ski):")
 
-	os.Exit(run())
+	os.Exit(run(os.Args[1:]))
+}
+
+// Dispatches to a sub-command, defaulting to detection on a single image.
+func run(args []string) int {
+	if len(args) > 0 {
+		switch args[0] {
+		case "serve":
+			return runServe(args[1:])
+		case "track":
+			return runTrack(args[1:])
+		case "detect":
+			return runDetect(args[1:])
+		case "eval":
+			return runEval(args[1:])
+		case "bench":
+			return runBench(args[1:])
+		}
+	}
+
+	return runImage(args)
 }
 
-func run() int {
+func runImage(args []string) int {
+	fs := flag.NewFlagSet("yolo", flag.ContinueOnError)
+	cfg := newSessionConfig(fs)
+	input := fs.String("image", imagePath, "path to the input image")
+	output := fs.String("output", outputImagePath, "path to the annotated output image")
+	zonesPath := fs.String("zones", "", "JSON file with zones to count detections in")
+	render := newRenderOptions(fs)
+	slicing := newSliceConfig(fs)
+	fs.IntVar(&cfg.batch, "batch", 1, "tiles run at once, above 1 needs a model with a dynamic batch dimension")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	// Flags after a stray argument would be silently ignored
+	if fs.NArg() > 0 {
+		fmt.Printf("unexpected argument %q, the modes are serve, track, detect, eval and bench\n", fs.Arg(0))
+		fs.Usage()
+
+		return 2
+	}
+	if err := slicing.validate(); err != nil {
+		fmt.Printf("invalid tiling flags: %s\n", err)
+
+		return 2
+	}
+
+	var zones *zoneMonitor
+	if *zonesPath != "" {
+		zoneCfg, e := loadZones(*zonesPath)
+		if e != nil {
+			fmt.Printf("error loading zones: %s\n", e)
+
+			return 1
+		}
+		zones = newZoneMonitor(zoneCfg)
+	}
+
 	// Read the input image into an image.Image object
-	pic, e := loadImageFile(imagePath)
+	pic, e := loadImageFile(*input)
 	if e != nil {
 		fmt.Printf("error loading input image: %s\n", e)
 
 		return 1
 	}
 
-	originalWidth := pic.Bounds().Canon().Dx()
-	originalHeight := pic.Bounds().Canon().Dy()
-
-	modelSession, e := initSession()
+	modelSession, e := initSession(cfg)
 	if e != nil {
 		fmt.Printf("error creating session and tensors: %s\n", e)
 
@@ -56,29 +98,39 @@ func run() int {
 	}
 	defer modelSession.Destroy()
 
-	e = prepareInput(pic, modelSession.Input)
+	var boxes []boundingBox
+	if slicing.enabled() {
+		boxes, e = detectSliced(modelSession, pic, slicing)
+	} else {
+		boxes, e = modelSession.Detect(pic)
+	}
 	if e != nil {
-		fmt.Printf("error converting image to network input: %s\n", e)
+		fmt.Printf("error running detection: %s\n", e)
 
 		return 1
 	}
 
-	e = modelSession.Session.Run()
-	if e != nil {
-		fmt.Printf("error running ORT session: %s\n", e)
-
-		return 1
+	var events []zoneEvent
+	if zones != nil {
+		boxes, events = zones.observe(0, boxes)
 	}
 
 	// Print the results
-	boxes := processOutput(modelSession.Output.GetData(), originalWidth, originalHeight)
 	for i, box := range boxes {
 		fmt.Printf("Box %d: %s\n", i, &box)
 	}
 
-	fmt.Printf("Creating an ouput image with bounding boxes: %s\n", outputImagePath)
-	err := drawBoxes(imagePath, outputImagePath, boxes)
-	if err != nil {
+	canvas := pic
+	if zones != nil {
+		zones.printCounts()
+		for _, event := range events {
+			fmt.Println(event)
+		}
+		canvas = zones.render(pic)
+	}
+
+	fmt.Printf("Creating an ouput image with bounding boxes: %s\n", *output)
+	if err := drawBoxes(canvas, *output, boxes, render); err != nil {
 		fmt.Printf("error drawing boxes: %s\n", err)
 
 		return 1
@@ -108,9 +160,9 @@ func loadImageFile(filePath string) (image.Image, error) {
 	return pic, nil
 }
 
-// Populates a YOLOv8n input tensor with the contents of the given image.
-func prepareInput(pic image.Image, dst *ort.Tensor[float32]) error {
-	data := dst.GetData()
+// Populates a YOLOv8n input tensor (or one image of a batch) with the
+// contents of the given image.
+func prepareInput(pic image.Image, data []float32) error {
 	channelSize := 640 * 640
 	if len(data) < (channelSize * 3) {
 		return fmt.Errorf("destination tensor only holds %d floats, needs %d (make sure it's the right shape!)", len(data), channelSize*3)
@@ -135,92 +187,20 @@ func prepareInput(pic image.Image, dst *ort.Tensor[float32]) error {
 	return nil
 }
 
-func initSession() (*ModelSession, error) {
-	ort.SetSharedLibraryPath(sharedLibPath)
-
-	err := ort.InitializeEnvironment()
-	if err != nil {
-		return nil, fmt.Errorf("error initializing ORT environment: %w", err)
-	}
-
-	inputShape := ort.NewShape(1, 3, 640, 640)
-
-	inputTensor, err := ort.NewEmptyTensor[float32](inputShape)
-	if err != nil {
-		return nil, fmt.Errorf("error creating input tensor: %w", err)
-	}
-
-	outputShape := ort.NewShape(1, 84, 8400)
-
-	outputTensor, err := ort.NewEmptyTensor[float32](outputShape)
-	if err != nil {
-		if e := inputTensor.Destroy(); e != nil {
-			return nil, fmt.Errorf("inputTensor.Destroy: %w", e)
-		}
-
-		return nil, fmt.Errorf("error creating output tensor: %w", err)
-	}
-
-	options, err := ort.NewSessionOptions()
-	if err != nil {
-		if e := inputTensor.Destroy(); e != nil {
-			return nil, fmt.Errorf("inputTensor.Destroy: %w", e)
-		}
-
-		if e := outputTensor.Destroy(); e != nil {
-			return nil, fmt.Errorf("outputTensor.Destroy: %w", e)
-		}
-
-		return nil, fmt.Errorf("error creating ORT session options: %w", err)
-	}
-	defer func(options *ort.SessionOptions) {
-		if e := options.Destroy(); e != nil {
-			fmt.Printf("error destroying ORT session options: %s\n", err)
-		}
-	}(options)
-
-	session, err := ort.NewAdvancedSession(modelPath,
-		[]string{"images"}, []string{"output0"},
-		[]ort.ArbitraryTensor{inputTensor},
-		[]ort.ArbitraryTensor{outputTensor},
-		options)
-	if err != nil {
-		if e := inputTensor.Destroy(); e != nil {
-			return nil, fmt.Errorf("inputTensor.Destroy: %w", e)
-		}
-
-		if e := outputTensor.Destroy(); e != nil {
-			return nil, fmt.Errorf("outputTensor.Destroy: %w", e)
-		}
-
-		return nil, fmt.Errorf("error creating ORT session: %w", err)
-	}
-
-	return &ModelSession{
-		Session: session,
-		Input:   inputTensor,
-		Output:  outputTensor,
-	}, nil
-}
-
-func (m *ModelSession) Destroy() {
-	if e := m.Session.Destroy(); e != nil {
-		log.Printf("error destroying session: %s\n", e)
-	}
-
-	if e := m.Input.Destroy(); e != nil {
-		log.Printf("error destroying input: %s\n", e)
-	}
-
-	if e := m.Output.Destroy(); e != nil {
-		log.Printf("error destroying output: %s\n", e)
-	}
-}
-
 type boundingBox struct {
 	label          string
+	classID        int
 	confidence     float32
 	x1, y1, x2, y2 float32
+	// mask is the binary instance mask in original image coordinates,
+	// bounded by the box. Only segmentation heads set it.
+	mask *image.Alpha
+	// keypoints are in original image coordinates. Only pose heads set them.
+	keypoints []keypoint
+}
+
+type keypoint struct {
+	x, y, confidence float32
 }
 
 func (b *boundingBox) String() string {
@@ -261,127 +241,6 @@ func (b *boundingBox) iou(other *boundingBox) float32 {
 	return b.intersection(other) / b.union(other)
 }
 
-func processOutput(output []float32, originalWidth, originalHeight int) []boundingBox {
-	boundingBoxes := make([]boundingBox, 0, 8400)
-
-	var classID int
-	var probability float32
-
-	// Iterate through the output array, considering 8400 indices
-	for idx := 0; idx < 8400; idx++ {
-		// Iterate through 80 classes and find the class with the highest probability
-		probability = -1e9
-		for col := 0; col < 80; col++ {
-			currentProb := output[8400*(col+4)+idx]
-			if currentProb > probability {
-				probability = currentProb
-				classID = col
-			}
-		}
-
-		// If the probability is less than 0.5, continue to the next index
-		if probability < 0.5 {
-			continue
-		}
-
-		// Extract the coordinates and dimensions of the bounding box
-		xc, yc := output[idx], output[8400+idx]
-		w, h := output[2*8400+idx], output[3*8400+idx]
-		x1 := (xc - w/2) / 640 * float32(originalWidth)
-		y1 := (yc - h/2) / 640 * float32(originalHeight)
-		x2 := (xc + w/2) / 640 * float32(originalWidth)
-		y2 := (yc + h/2) / 640 * float32(originalHeight)
-
-		// Append the bounding box to the result
-		boundingBoxes = append(boundingBoxes, boundingBox{
-			label:      yoloClasses[classID],
-			confidence: probability,
-			x1:         x1,
-			y1:         y1,
-			x2:         x2,
-			y2:         y2,
-		})
-	}
-
-	// Sort the bounding boxes by probability
-	sort.Slice(boundingBoxes, func(i, j int) bool {
-		return boundingBoxes[i].confidence < boundingBoxes[j].confidence
-	})
-
-	// Define a slice to hold the final result
-	mergedResults := make([]boundingBox, 0, len(boundingBoxes))
-
-	// Iterate through sorted bounding boxes, removing overlaps
-	for _, candidateBox := range boundingBoxes {
-		overlapsExistingBox := false
-		for _, existingBox := range mergedResults {
-			if (&candidateBox).iou(&existingBox) > 0.7 {
-				overlapsExistingBox = true
-				break
-			}
-		}
-		if !overlapsExistingBox {
-			mergedResults = append(mergedResults, candidateBox)
-		}
-	}
-
-	// This will still be in sorted order by confidence
-	return mergedResults
-}
-
-// Draws bounding boxes with labels onto the image and saves the result
-func drawBoxes(inputPath string, outputPath string, boxes []boundingBox) error {
-	// Open and decode the image
-	f, err := os.Open(inputPath)
-	if err != nil {
-		return fmt.Errorf("error opening input image: %w", err)
-	}
-	defer func(f *os.File) {
-		if e := f.Close(); e != nil {
-			fmt.Printf("error closing input image: %v", e)
-		}
-	}(f)
-
-	img, _, err := image.Decode(f)
-	if err != nil {
-		return fmt.Errorf("error decoding image: %w", err)
-	}
-
-	dc := gg.NewContextForImage(img)
-	dc.SetLineWidth(1)
-	fontLoaded := false
-	if err := dc.LoadFontFace(fontPath, 14); err == nil {
-		fontLoaded = true
-	}
-
-	for _, box := range boxes {
-		// Draw rectangle
-		dc.SetRGB(1, 0, 0) // red
-		dc.DrawRectangle(float64(box.x1), float64(box.y1), float64(box.x2-box.x1), float64(box.y2-box.y1))
-		dc.Stroke()
-
-		// Draw label
-		if fontLoaded {
-			label := fmt.Sprintf("%s (%.2f)", box.label, box.confidence)
-			dc.SetRGB(0, 0, 1)
-			dc.DrawStringAnchored(label, float64(box.x1)+4, float64(box.y1)-4, 0, 1)
-		}
-	}
-
-	// Save the result
-	out, err := os.Create(outputPath)
-	if err != nil {
-		return fmt.Errorf("error creating output file: %w", err)
-	}
-	defer func(out *os.File) {
-		if e := out.Close(); e != nil {
-			fmt.Printf("error closing output file: %v", e)
-		}
-	}(out)
-
-	return jpeg.Encode(out, dc.Image(), &jpeg.Options{Quality: 90})
-}
-
 // Array of YOLOv8 class labels
 var yoloClasses = []string{
 	"person", "bicycle", "car", "motorcycle", "airplane", "bus", "train", "truck", "boat",
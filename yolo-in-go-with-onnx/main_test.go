@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestRunImageUsage(t *testing.T) {
+	// Usage errors are caught before any model is loaded
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"unknown palette", []string{"-palette", "neon"}},
+		{"stray argument", []string{"image", "-backend", "go"}},
+		{"argument after the flags", []string{"-backend", "go", "example.jpg"}},
+		{"invalid tiling", []string{"-overlap", "1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := run(tt.args); got != 2 {
+				t.Errorf("run(%q) = %d, want 2", tt.args, got)
+			}
+		})
+	}
+}
+
+func TestRunTrackUsage(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"missing source", []string{"track"}},
+		{"low above high", []string{"track", "-source", "traffic.y4m", "-low-thresh", "0.7"}},
+		{"zero low", []string{"track", "-source", "traffic.y4m", "-low-thresh", "0"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := run(tt.args); got != 2 {
+				t.Errorf("run(%q) = %d, want 2", tt.args, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"sync"
+)
+
+// parallelFor splits [0, n) into one chunk per thread.
+func parallelFor(n, threads int, fn func(lo, hi int)) {
+	threads = min(max(threads, 1), n)
+	if threads <= 1 {
+		fn(0, n)
+
+		return
+	}
+
+	var wg sync.WaitGroup
+	chunk := (n + threads - 1) / threads
+	for lo := 0; lo < n; lo += chunk {
+		wg.Add(1)
+		go func(lo, hi int) {
+			defer wg.Done()
+			fn(lo, hi)
+		}(lo, min(lo+chunk, n))
+	}
+	wg.Wait()
+}
+
+// pads2D reads the [top, left, bottom, right] padding of a 2D window,
+// resolving auto_pad for the given input size.
+func pads2D(n *onnxNode, h, w, kh, kw, sh, sw, dh, dw int) [4]int {
+	var pads [4]int
+	switch n.attrString("auto_pad", "NOTSET") {
+	case "SAME_UPPER", "SAME_LOWER":
+		for i, d := range [][4]int{{h, kh, sh, dh}, {w, kw, sw, dw}} {
+			size, k, s, dil := d[0], d[1], d[2], d[3]
+			out := (size + s - 1) / s
+			total := max(0, (out-1)*s+(k-1)*dil+1-size)
+			small, large := total/2, total-total/2
+			if n.attrString("auto_pad", "") == "SAME_LOWER" {
+				small, large = large, small
+			}
+			pads[i], pads[i+2] = small, large
+		}
+	case "VALID":
+	default:
+		for i, p := range n.attrInts("pads", nil) {
+			if i < 4 {
+				pads[i] = int(p)
+			}
+		}
+	}
+
+	return pads
+}
+
+func pair(v []int64, def int) (int, int) {
+	if len(v) < 2 {
+		return def, def
+	}
+
+	return int(v[0]), int(v[1])
+}
+
+// opConv implements 2D convolution as im2col followed by a matrix product,
+// parallel over the output channels.
+func opConv(n *onnxNode, in []*tensor, ctx *execContext) ([]*tensor, error) {
+	x, w, b := in[0], in[1], input(in, 2)
+	if len(x.shape) != 4 || len(w.shape) != 4 {
+		return nil, fmt.Errorf("conv %q only supports 2D inputs, got %v", n.name, x.shape)
+	}
+
+	batch, channels, h, wd := x.shape[0], x.shape[1], x.shape[2], x.shape[3]
+	filters, kh, kw := w.shape[0], w.shape[2], w.shape[3]
+	group := int(n.attrInt("group", 1))
+	sh, sw := pair(n.attrInts("strides", nil), 1)
+	dh, dw := pair(n.attrInts("dilations", nil), 1)
+	pads := pads2D(n, h, wd, kh, kw, sh, sw, dh, dw)
+
+	oh := (h+pads[0]+pads[2]-(dh*(kh-1)+1))/sh + 1
+	ow := (wd+pads[1]+pads[3]-(dw*(kw-1)+1))/sw + 1
+	if group < 1 || channels%group != 0 || filters%group != 0 || w.shape[1] != channels/group {
+		return nil, fmt.Errorf("conv %q has mismatched channels: input %v, weights %v, group %d", n.name, x.shape, w.shape, group)
+	}
+
+	cg, fg := channels/group, filters/group
+	k := cg * kh * kw
+	plane := oh * ow
+	pointwise := kh == 1 && kw == 1 && sh == 1 && sw == 1 && pads == [4]int{}
+
+	src, weights := x.asFloats(), w.asFloats()
+	var bias []float32
+	if b != nil {
+		bias = b.asFloats()
+	}
+
+	out := make([]float32, batch*filters*plane)
+	var col []float32
+	if !pointwise {
+		col = make([]float32, k*plane)
+	}
+
+	for bi := 0; bi < batch; bi++ {
+		for g := 0; g < group; g++ {
+			input := src[(bi*channels+g*cg)*h*wd : (bi*channels+(g+1)*cg)*h*wd]
+
+			// Each row of col holds one kernel tap over all output pixels
+			cols := input
+			if !pointwise {
+				parallelFor(k, ctx.threads, func(lo, hi int) {
+					for r := lo; r < hi; r++ {
+						c, ky, kx := r/(kh*kw), r/kw%kh, r%kw
+						row := col[r*plane : (r+1)*plane]
+						for oy := 0; oy < oh; oy++ {
+							iy := oy*sh - pads[0] + ky*dh
+							dst := row[oy*ow : (oy+1)*ow]
+							if iy < 0 || iy >= h {
+								clear(dst)
+								continue
+							}
+							line := input[(c*h+iy)*wd : (c*h+iy+1)*wd]
+							for ox := range dst {
+								ix := ox*sw - pads[1] + kx*dw
+								if ix < 0 || ix >= wd {
+									dst[ox] = 0
+								} else {
+									dst[ox] = line[ix]
+								}
+							}
+						}
+					}
+				})
+				cols = col
+			}
+
+			parallelFor(fg, ctx.threads, func(lo, hi int) {
+				for f := lo; f < hi; f++ {
+					filter := g*fg + f
+					dst := out[(bi*filters+filter)*plane : (bi*filters+filter+1)*plane]
+					if bias != nil {
+						for i := range dst {
+							dst[i] = bias[filter]
+						}
+					}
+					for r, wv := range weights[filter*k : (filter+1)*k] {
+						if wv == 0 {
+							continue
+						}
+						row := cols[r*plane : (r+1)*plane]
+						row = row[:len(dst)]
+						for i, v := range row {
+							dst[i] += wv * v
+						}
+					}
+				}
+			})
+		}
+	}
+
+	return []*tensor{floatTensor([]int{batch, filters, oh, ow}, out)}, nil
+}
+
+func opMaxPool(n *onnxNode, in []*tensor, ctx *execContext) ([]*tensor, error) {
+	x := in[0]
+	if len(x.shape) != 4 {
+		return nil, fmt.Errorf("max pool %q only supports 2D inputs, got %v", n.name, x.shape)
+	}
+	if len(n.outputs) > 1 && n.outputs[1] != "" {
+		return nil, fmt.Errorf("max pool %q: indices output is not supported", n.name)
+	}
+
+	batch, channels, h, w := x.shape[0], x.shape[1], x.shape[2], x.shape[3]
+	kh, kw := pair(n.attrInts("kernel_shape", nil), 1)
+	sh, sw := pair(n.attrInts("strides", nil), 1)
+	dh, dw := pair(n.attrInts("dilations", nil), 1)
+	pads := pads2D(n, h, w, kh, kw, sh, sw, dh, dw)
+
+	size := func(length, pad, k, s, d int) int {
+		span := length + pad - (d*(k-1) + 1)
+		if n.attrInt("ceil_mode", 0) == 1 {
+			return (span+s-1)/s + 1
+		}
+
+		return span/s + 1
+	}
+	oh, ow := size(h, pads[0]+pads[2], kh, sh, dh), size(w, pads[1]+pads[3], kw, sw, dw)
+
+	src := x.asFloats()
+	out := make([]float32, batch*channels*oh*ow)
+	parallelFor(batch*channels, ctx.threads, func(lo, hi int) {
+		for p := lo; p < hi; p++ {
+			plane := src[p*h*w : (p+1)*h*w]
+			dst := out[p*oh*ow : (p+1)*oh*ow]
+			for oy := 0; oy < oh; oy++ {
+				for ox := 0; ox < ow; ox++ {
+					best := float32(math.Inf(-1))
+					for ky := 0; ky < kh; ky++ {
+						iy := oy*sh - pads[0] + ky*dh
+						if iy < 0 || iy >= h {
+							continue
+						}
+						for kx := 0; kx < kw; kx++ {
+							ix := ox*sw - pads[1] + kx*dw
+							if ix >= 0 && ix < w {
+								best = max(best, plane[iy*w+ix])
+							}
+						}
+					}
+					dst[oy*ow+ox] = best
+				}
+			}
+		}
+	})
+
+	return []*tensor{floatTensor([]int{batch, channels, oh, ow}, out)}, nil
+}
+
+// opResize implements nearest neighbour Resize and the older Upsample.
+func opResize(n *onnxNode, in []*tensor, _ *execContext) ([]*tensor, error) {
+	x := in[0]
+	if mode := n.attrString("mode", "nearest"); mode != "nearest" {
+		return nil, fmt.Errorf("resize %q: mode %q is not supported", n.name, mode)
+	}
+
+	// Upsample and opset 10 Resize take (X, scales), later Resize takes
+	// (X, roi, scales, sizes)
+	var scales []float32
+	var sizes []int64
+	transform, rounding := "half_pixel", "round_prefer_floor"
+	if n.opType == "Upsample" || len(in) == 2 {
+		scales = in[1].asFloats()
+		transform, rounding = "asymmetric", "floor"
+	} else {
+		if t := input(in, 2); t != nil && t.size() > 0 {
+			scales = t.asFloats()
+		}
+		if t := input(in, 3); t != nil && t.size() > 0 {
+			sizes = t.asInts()
+		}
+	}
+	transform = n.attrString("coordinate_transformation_mode", transform)
+	rounding = n.attrString("nearest_mode", rounding)
+
+	rank := len(x.shape)
+	shape := make([]int, rank)
+	scale := make([]float64, rank)
+	for d := range shape {
+		switch {
+		case len(sizes) == rank:
+			shape[d] = int(sizes[d])
+			scale[d] = float64(shape[d]) / float64(x.shape[d])
+		case len(scales) == rank:
+			scale[d] = float64(scales[d])
+			shape[d] = int(math.Floor(float64(x.shape[d]) * scale[d]))
+		default:
+			return nil, fmt.Errorf("resize %q needs scales or sizes for all %d dimensions", n.name, rank)
+		}
+	}
+
+	// Source index along every dimension for every output position
+	lookup := make([][]int, rank)
+	for d := range lookup {
+		lookup[d] = make([]int, shape[d])
+		for o := range lookup[d] {
+			var c float64
+			switch transform {
+			case "asymmetric":
+				c = float64(o) / scale[d]
+			case "align_corners":
+				if shape[d] > 1 {
+					c = float64(o) * float64(x.shape[d]-1) / float64(shape[d]-1)
+				}
+			case "pytorch_half_pixel":
+				if shape[d] > 1 {
+					c = (float64(o)+0.5)/scale[d] - 0.5
+				}
+			case "half_pixel":
+				c = (float64(o)+0.5)/scale[d] - 0.5
+			default:
+				return nil, fmt.Errorf("resize %q: coordinate mode %q is not supported", n.name, transform)
+			}
+
+			var i float64
+			switch rounding {
+			case "floor":
+				i = math.Floor(c)
+			case "ceil":
+				i = math.Ceil(c)
+			case "round_prefer_ceil":
+				i = math.Floor(c + 0.5)
+			default:
+				i = math.Ceil(c - 0.5)
+			}
+			lookup[d][o] = clampInt(int(i), 0, x.shape[d]-1)
+		}
+	}
+
+	src := strides(x.shape)
+	idx := make([]int, 0, shapeSize(shape))
+	pos := make([]int, rank)
+	for range shapeSize(shape) {
+		off := 0
+		for d, p := range pos {
+			off += lookup[d][p] * src[d]
+		}
+		idx = append(idx, off)
+		for d := rank - 1; d >= 0; d-- {
+			if pos[d]++; pos[d] < shape[d] {
+				break
+			}
+			pos[d] = 0
+		}
+	}
+
+	return []*tensor{x.take(shape, idx)}, nil
+}
+
+func opSoftmax(n *onnxNode, in []*tensor, ctx *execContext) ([]*tensor, error) {
+	x := in[0]
+	rank := len(x.shape)
+
+	// Before opset 13 the input was flattened to 2D at axis
+	def := int64(-1)
+	if ctx.opset < 13 {
+		def = 1
+	}
+	ax, err := axis(n.attrInt("axis", def), rank)
+	if err != nil {
+		return nil, err
+	}
+
+	outer := shapeSize(x.shape[:ax])
+	dim, inner := x.shape[ax], shapeSize(x.shape[ax+1:])
+	if ctx.opset < 13 {
+		dim, inner = shapeSize(x.shape[ax:]), 1
+	}
+
+	src := x.asFloats()
+	out := make([]float32, len(src))
+	for o := 0; o < outer; o++ {
+		for i := 0; i < inner; i++ {
+			base := o*dim*inner + i
+			peak := float32(math.Inf(-1))
+			for j := 0; j < dim; j++ {
+				peak = max(peak, src[base+j*inner])
+			}
+			var sum float64
+			for j := 0; j < dim; j++ {
+				e := math.Exp(float64(src[base+j*inner] - peak))
+				out[base+j*inner] = float32(e)
+				sum += e
+			}
+			for j := 0; j < dim; j++ {
+				out[base+j*inner] = float32(float64(out[base+j*inner]) / sum)
+			}
+		}
+	}
+
+	return []*tensor{floatTensor(slices.Clone(x.shape), out)}, nil
+}
+
+// opMatMul multiplies the last two dimensions, broadcasting the rest.
+func opMatMul(n *onnxNode, in []*tensor, ctx *execContext) ([]*tensor, error) {
+	a, b := in[0], in[1]
+	as, bs := slices.Clone(a.shape), slices.Clone(b.shape)
+
+	// 1D operands are promoted to matrices and the extra dimension dropped
+	// from the result
+	if len(as) == 1 {
+		as = []int{1, as[0]}
+	}
+	if len(bs) == 1 {
+		bs = []int{bs[0], 1}
+	}
+	rows, inner, cols := as[len(as)-2], as[len(as)-1], bs[len(bs)-1]
+	if bs[len(bs)-2] != inner {
+		return nil, fmt.Errorf("matmul %q of %v and %v", n.name, a.shape, b.shape)
+	}
+
+	batch, err := broadcastShape(as[:len(as)-2], bs[:len(bs)-2])
+	if err != nil {
+		return nil, err
+	}
+	aOffs := gatherIndex(batch, broadcastStrides(as[:len(as)-2], batch), 0)
+	bOffs := gatherIndex(batch, broadcastStrides(bs[:len(bs)-2], batch), 0)
+
+	x, y := a.asFloats(), b.asFloats()
+	out := make([]float32, len(aOffs)*rows*cols)
+	for i := range aOffs {
+		am := x[aOffs[i]*rows*inner : (aOffs[i]+1)*rows*inner]
+		bm := y[bOffs[i]*inner*cols : (bOffs[i]+1)*inner*cols]
+		om := out[i*rows*cols : (i+1)*rows*cols]
+		parallelFor(rows, ctx.threads, func(lo, hi int) {
+			for r := lo; r < hi; r++ {
+				dst := om[r*cols : (r+1)*cols]
+				for k, av := range am[r*inner : (r+1)*inner] {
+					for c, bv := range bm[k*cols : (k+1)*cols] {
+						dst[c] += av * bv
+					}
+				}
+			}
+		})
+	}
+
+	shape := slices.Concat(batch, []int{rows, cols})
+	if len(a.shape) == 1 {
+		shape = slices.Delete(shape, len(shape)-2, len(shape)-1)
+	}
+	if len(b.shape) == 1 {
+		shape = shape[:len(shape)-1]
+	}
+
+	return []*tensor{floatTensor(shape, out)}, nil
+}
@@ -0,0 +1,529 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// ONNX tensor element types, see TensorProto.DataType in onnx.proto
+const (
+	onnxFloat   = 1
+	onnxUint8   = 2
+	onnxInt8    = 3
+	onnxInt32   = 6
+	onnxInt64   = 7
+	onnxBool    = 9
+	onnxFloat16 = 10
+	onnxDouble  = 11
+)
+
+// onnxModel is the part of an ONNX ModelProto the go backend needs.
+type onnxModel struct {
+	opset    int64
+	graph    onnxGraph
+	metadata map[string]string
+}
+
+type onnxGraph struct {
+	nodes        []onnxNode
+	initializers map[string]*tensor
+	inputs       []onnxValueInfo
+	outputs      []onnxValueInfo
+}
+
+type onnxNode struct {
+	name    string
+	opType  string
+	inputs  []string
+	outputs []string
+	attrs   map[string]onnxAttr
+}
+
+type onnxAttr struct {
+	f      float32
+	i      int64
+	s      string
+	t      *tensor
+	floats []float32
+	ints   []int64
+}
+
+// onnxValueInfo is a graph input or output. Dynamic dimensions are -1.
+type onnxValueInfo struct {
+	name  string
+	shape []int64
+}
+
+// loadONNX reads and parses an ONNX model file.
+func loadONNX(path string) (*onnxModel, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading model: %w", err)
+	}
+
+	m, err := parseModel(data)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", path, err)
+	}
+
+	return m, nil
+}
+
+func parseModel(b []byte) (*onnxModel, error) {
+	m := &onnxModel{metadata: map[string]string{}}
+	err := walkFields(b, func(num protowire.Number, _ protowire.Type, _ uint64, data []byte) error {
+		switch num {
+		case 7: // graph
+			g, err := parseGraph(data)
+			if err != nil {
+				return err
+			}
+			m.graph = *g
+		case 8: // opset_import
+			var domain string
+			var version int64
+			err := walkFields(data, func(num protowire.Number, _ protowire.Type, v uint64, data []byte) error {
+				switch num {
+				case 1:
+					domain = string(data)
+				case 2:
+					version = int64(v)
+				}
+
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if domain == "" || domain == "ai.onnx" {
+				m.opset = version
+			}
+		case 14: // metadata_props
+			var key, value string
+			err := walkFields(data, func(num protowire.Number, _ protowire.Type, _ uint64, data []byte) error {
+				switch num {
+				case 1:
+					key = string(data)
+				case 2:
+					value = string(data)
+				}
+
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			m.metadata[key] = value
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(m.graph.nodes) == 0 {
+		return nil, errors.New("model has no graph")
+	}
+
+	return m, nil
+}
+
+func parseGraph(b []byte) (*onnxGraph, error) {
+	g := &onnxGraph{initializers: map[string]*tensor{}}
+	var inputs []onnxValueInfo
+	err := walkFields(b, func(num protowire.Number, _ protowire.Type, _ uint64, data []byte) error {
+		switch num {
+		case 1: // node
+			n, err := parseNode(data)
+			if err != nil {
+				return err
+			}
+			g.nodes = append(g.nodes, *n)
+		case 5: // initializer
+			name, t, err := parseTensor(data)
+			if err != nil {
+				return fmt.Errorf("initializer %q: %w", name, err)
+			}
+			g.initializers[name] = t
+		case 11: // input
+			vi, err := parseValueInfo(data)
+			if err != nil {
+				return err
+			}
+			inputs = append(inputs, vi)
+		case 12: // output
+			vi, err := parseValueInfo(data)
+			if err != nil {
+				return err
+			}
+			g.outputs = append(g.outputs, vi)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Older exports also list the initializers as graph inputs
+	for _, in := range inputs {
+		if _, ok := g.initializers[in.name]; !ok {
+			g.inputs = append(g.inputs, in)
+		}
+	}
+
+	return g, nil
+}
+
+func parseNode(b []byte) (*onnxNode, error) {
+	n := &onnxNode{attrs: map[string]onnxAttr{}}
+	err := walkFields(b, func(num protowire.Number, _ protowire.Type, _ uint64, data []byte) error {
+		switch num {
+		case 1:
+			n.inputs = append(n.inputs, string(data))
+		case 2:
+			n.outputs = append(n.outputs, string(data))
+		case 3:
+			n.name = string(data)
+		case 4:
+			n.opType = string(data)
+		case 5:
+			name, a, err := parseAttr(data)
+			if err != nil {
+				return err
+			}
+			n.attrs[name] = a
+		case 7:
+			if domain := string(data); domain != "" && domain != "ai.onnx" {
+				return fmt.Errorf("node %q uses the unsupported operator domain %q", n.name, domain)
+			}
+		}
+
+		return nil
+	})
+
+	return n, err
+}
+
+func parseAttr(b []byte) (string, onnxAttr, error) {
+	var name string
+	a := onnxAttr{}
+	err := walkFields(b, func(num protowire.Number, typ protowire.Type, v uint64, data []byte) error {
+		switch num {
+		case 1:
+			name = string(data)
+		case 2:
+			a.f = math.Float32frombits(uint32(v))
+		case 3:
+			a.i = int64(v)
+		case 4:
+			a.s = string(data)
+		case 5:
+			_, t, err := parseTensor(data)
+			if err != nil {
+				return err
+			}
+			a.t = t
+		case 7:
+			a.floats = appendFloats(a.floats, typ, v, data)
+		case 8:
+			ints, err := appendInts(a.ints, typ, v, data)
+			if err != nil {
+				return err
+			}
+			a.ints = ints
+		}
+
+		return nil
+	})
+
+	return name, a, err
+}
+
+func parseValueInfo(b []byte) (onnxValueInfo, error) {
+	vi := onnxValueInfo{}
+	err := walkFields(b, func(num protowire.Number, _ protowire.Type, _ uint64, data []byte) error {
+		switch num {
+		case 1:
+			vi.name = string(data)
+		case 2: // type.tensor_type.shape.dim
+			return walkFields(data, func(num protowire.Number, _ protowire.Type, _ uint64, data []byte) error {
+				if num != 1 {
+					return nil
+				}
+
+				return walkFields(data, func(num protowire.Number, _ protowire.Type, _ uint64, data []byte) error {
+					if num != 2 {
+						return nil
+					}
+					vi.shape = []int64{}
+
+					return walkFields(data, func(num protowire.Number, _ protowire.Type, _ uint64, data []byte) error {
+						if num != 1 {
+							return nil
+						}
+
+						dim := int64(-1)
+						err := walkFields(data, func(num protowire.Number, _ protowire.Type, v uint64, _ []byte) error {
+							if num == 1 {
+								dim = int64(v)
+							}
+
+							return nil
+						})
+						vi.shape = append(vi.shape, dim)
+
+						return err
+					})
+				})
+			})
+		}
+
+		return nil
+	})
+
+	return vi, err
+}
+
+// parseTensor decodes a TensorProto. Floating point types become float
+// tensors, integer and boolean types int tensors.
+func parseTensor(b []byte) (string, *tensor, error) {
+	var (
+		name     string
+		dims     []int64
+		dataType int64
+		raw      []byte
+		floats   []float32
+		ints     []int64
+		doubles  []float64
+		external bool
+		err      error
+	)
+	err = walkFields(b, func(num protowire.Number, typ protowire.Type, v uint64, data []byte) error {
+		switch num {
+		case 1:
+			dims, err = appendInts(dims, typ, v, data)
+		case 2:
+			dataType = int64(v)
+		case 4:
+			floats = appendFloats(floats, typ, v, data)
+		case 5, 7:
+			ints, err = appendInts(ints, typ, v, data)
+		case 8:
+			name = string(data)
+		case 9:
+			raw = data
+		case 10:
+			doubles = appendDoubles(doubles, typ, v, data)
+		case 14:
+			external = v == 1
+		}
+
+		return err
+	})
+	if err != nil {
+		return name, nil, err
+	}
+	if external {
+		return name, nil, errors.New("tensors with external data are not supported")
+	}
+
+	shape := make([]int, len(dims))
+	for i, d := range dims {
+		shape[i] = int(d)
+	}
+	n := shapeSize(shape)
+
+	switch dataType {
+	case onnxFloat:
+		if raw != nil {
+			floats = make([]float32, len(raw)/4)
+			for i := range floats {
+				floats[i] = math.Float32frombits(binary.LittleEndian.Uint32(raw[4*i:]))
+			}
+		}
+	case onnxDouble:
+		if raw != nil {
+			doubles = make([]float64, len(raw)/8)
+			for i := range doubles {
+				doubles[i] = math.Float64frombits(binary.LittleEndian.Uint64(raw[8*i:]))
+			}
+		}
+		floats = make([]float32, len(doubles))
+		for i, d := range doubles {
+			floats[i] = float32(d)
+		}
+	case onnxFloat16:
+		// Stored as uint16 bit patterns, raw or widened into int32_data
+		if raw != nil {
+			ints = make([]int64, len(raw)/2)
+			for i := range ints {
+				ints[i] = int64(binary.LittleEndian.Uint16(raw[2*i:]))
+			}
+		}
+		floats = make([]float32, len(ints))
+		for i, h := range ints {
+			floats[i] = float16ToFloat32(uint16(h))
+		}
+	case onnxInt64:
+		if raw != nil {
+			ints = make([]int64, len(raw)/8)
+			for i := range ints {
+				ints[i] = int64(binary.LittleEndian.Uint64(raw[8*i:]))
+			}
+		}
+	case onnxInt32:
+		if raw != nil {
+			ints = make([]int64, len(raw)/4)
+			for i := range ints {
+				ints[i] = int64(int32(binary.LittleEndian.Uint32(raw[4*i:])))
+			}
+		}
+	case onnxUint8, onnxBool:
+		if raw != nil {
+			ints = make([]int64, len(raw))
+			for i, c := range raw {
+				ints[i] = int64(c)
+			}
+		}
+	case onnxInt8:
+		if raw != nil {
+			ints = make([]int64, len(raw))
+			for i, c := range raw {
+				ints[i] = int64(int8(c))
+			}
+		}
+	default:
+		return name, nil, fmt.Errorf("unsupported tensor data type %d", dataType)
+	}
+
+	var t *tensor
+	switch dataType {
+	case onnxFloat, onnxDouble, onnxFloat16:
+		t = floatTensor(shape, floats)
+		if len(floats) != n {
+			return name, nil, fmt.Errorf("tensor holds %d values, shape %v needs %d", len(floats), shape, n)
+		}
+	default:
+		t = intTensor(shape, ints)
+		if len(ints) != n {
+			return name, nil, fmt.Errorf("tensor holds %d values, shape %v needs %d", len(ints), shape, n)
+		}
+	}
+
+	return name, t, nil
+}
+
+// walkFields calls fn for every field of a protobuf message with the decoded
+// varint or fixed value in v, or the payload of length-delimited fields in
+// data.
+func walkFields(b []byte, fn func(num protowire.Number, typ protowire.Type, v uint64, data []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		var (
+			v    uint64
+			data []byte
+		)
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed32Type:
+			var x uint32
+			x, n = protowire.ConsumeFixed32(b)
+			v = uint64(x)
+		case protowire.Fixed64Type:
+			v, n = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			data, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if err := fn(num, typ, v, data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// appendInts adds a repeated varint field, packed or not.
+func appendInts(dst []int64, typ protowire.Type, v uint64, data []byte) ([]int64, error) {
+	if typ != protowire.BytesType {
+		return append(dst, int64(v)), nil
+	}
+
+	for len(data) > 0 {
+		x, n := protowire.ConsumeVarint(data)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		dst = append(dst, int64(x))
+		data = data[n:]
+	}
+
+	return dst, nil
+}
+
+// appendFloats adds a repeated float field, packed or not.
+func appendFloats(dst []float32, typ protowire.Type, v uint64, data []byte) []float32 {
+	if typ != protowire.BytesType {
+		return append(dst, math.Float32frombits(uint32(v)))
+	}
+
+	for i := 0; i+4 <= len(data); i += 4 {
+		dst = append(dst, math.Float32frombits(binary.LittleEndian.Uint32(data[i:])))
+	}
+
+	return dst
+}
+
+func appendDoubles(dst []float64, typ protowire.Type, v uint64, data []byte) []float64 {
+	if typ != protowire.BytesType {
+		return append(dst, math.Float64frombits(v))
+	}
+
+	for i := 0; i+8 <= len(data); i += 8 {
+		dst = append(dst, math.Float64frombits(binary.LittleEndian.Uint64(data[i:])))
+	}
+
+	return dst
+}
+
+// float16ToFloat32 widens an IEEE 754 half precision value.
+func float16ToFloat32(h uint16) float32 {
+	sign := uint32(h>>15) << 31
+	exp := int32(h>>10) & 0x1f
+	frac := uint32(h) & 0x3ff
+
+	switch {
+	case exp == 0 && frac == 0:
+		return math.Float32frombits(sign)
+	case exp == 0:
+		// Subnormal, normalize it
+		exp = 1
+		for frac&0x400 == 0 {
+			frac <<= 1
+			exp--
+		}
+		frac &= 0x3ff
+	case exp == 0x1f:
+		return math.Float32frombits(sign | 0xff<<23 | frac<<13)
+	}
+
+	return math.Float32frombits(sign | uint32(exp+127-15)<<23 | frac<<13)
+}
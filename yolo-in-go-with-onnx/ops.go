@@ -0,0 +1,905 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+)
+
+// tensor is a dense row-major value of the go backend. Floating point data
+// lives in floats, integer and boolean data in ints.
+type tensor struct {
+	shape  []int
+	floats []float32
+	ints   []int64
+	isInt  bool
+}
+
+func floatTensor(shape []int, data []float32) *tensor {
+	return &tensor{shape: shape, floats: data}
+}
+
+func intTensor(shape []int, data []int64) *tensor {
+	return &tensor{shape: shape, ints: data, isInt: true}
+}
+
+func shapeSize(shape []int) int {
+	n := 1
+	for _, d := range shape {
+		n *= d
+	}
+
+	return n
+}
+
+func strides(shape []int) []int {
+	s := make([]int, len(shape))
+	step := 1
+	for i := len(shape) - 1; i >= 0; i-- {
+		s[i] = step
+		step *= shape[i]
+	}
+
+	return s
+}
+
+func (t *tensor) size() int {
+	return shapeSize(t.shape)
+}
+
+func (t *tensor) asFloats() []float32 {
+	if !t.isInt {
+		return t.floats
+	}
+
+	f := make([]float32, len(t.ints))
+	for i, v := range t.ints {
+		f[i] = float32(v)
+	}
+
+	return f
+}
+
+func (t *tensor) asInts() []int64 {
+	if t.isInt {
+		return t.ints
+	}
+
+	v := make([]int64, len(t.floats))
+	for i, f := range t.floats {
+		v[i] = int64(f)
+	}
+
+	return v
+}
+
+// take builds a tensor of the given shape from the elements at idx.
+func (t *tensor) take(shape []int, idx []int) *tensor {
+	if t.isInt {
+		out := make([]int64, len(idx))
+		for i, j := range idx {
+			out[i] = t.ints[j]
+		}
+
+		return intTensor(shape, out)
+	}
+
+	out := make([]float32, len(idx))
+	for i, j := range idx {
+		out[i] = t.floats[j]
+	}
+
+	return floatTensor(shape, out)
+}
+
+// reshaped shares the data under a new shape.
+func (t *tensor) reshaped(shape []int) *tensor {
+	c := *t
+	c.shape = shape
+
+	return &c
+}
+
+// forEachIndex walks shape in row-major order. Every source k starts at
+// offs[k] and moves by strides[k][d] along dimension d; fn gets the current
+// offsets.
+func forEachIndex(shape []int, strides [][]int, offs []int, fn func(offs []int)) {
+	n := shapeSize(shape)
+	idx := make([]int, len(shape))
+	for range n {
+		fn(offs)
+		for d := len(shape) - 1; d >= 0; d-- {
+			idx[d]++
+			for k := range offs {
+				offs[k] += strides[k][d]
+			}
+			if idx[d] < shape[d] {
+				break
+			}
+			for k := range offs {
+				offs[k] -= strides[k][d] * shape[d]
+			}
+			idx[d] = 0
+		}
+	}
+}
+
+// gatherIndex lists the source offsets visited by forEachIndex for a single
+// source.
+func gatherIndex(shape, stride []int, base int) []int {
+	idx := make([]int, 0, shapeSize(shape))
+	forEachIndex(shape, [][]int{stride}, []int{base}, func(offs []int) {
+		idx = append(idx, offs[0])
+	})
+
+	return idx
+}
+
+// broadcastShape applies the numpy broadcasting rules.
+func broadcastShape(shapes ...[]int) ([]int, error) {
+	rank := 0
+	for _, s := range shapes {
+		rank = max(rank, len(s))
+	}
+
+	out := make([]int, rank)
+	for i := range out {
+		out[i] = 1
+	}
+	for _, s := range shapes {
+		for i, d := range s {
+			j := rank - len(s) + i
+			switch {
+			case d == out[j] || d == 1:
+			case out[j] == 1:
+				out[j] = d
+			default:
+				return nil, fmt.Errorf("shapes %v can't be broadcast", shapes)
+			}
+		}
+	}
+
+	return out, nil
+}
+
+// broadcastStrides returns the strides of shape aligned to out, 0 along
+// broadcast dimensions.
+func broadcastStrides(shape, out []int) []int {
+	s := strides(shape)
+	b := make([]int, len(out))
+	for i, d := range shape {
+		if d != 1 {
+			b[len(out)-len(shape)+i] = s[i]
+		}
+	}
+
+	return b
+}
+
+// operator runs one node on its inputs. Optional inputs that are not given
+// are nil.
+type operator func(n *onnxNode, in []*tensor, ctx *execContext) ([]*tensor, error)
+
+type execContext struct {
+	opset   int64
+	threads int
+}
+
+var operators = map[string]operator{
+	"Identity":        opIdentity,
+	"Constant":        opConstant,
+	"ConstantOfShape": opConstantOfShape,
+	"Cast":            opCast,
+	"Shape":           opShape,
+	"Sigmoid":         unary(func(x float64) float64 { return 1 / (1 + math.Exp(-x)) }),
+	"Relu":            unary(func(x float64) float64 { return math.Max(x, 0) }),
+	"Exp":             unary(math.Exp),
+	"Log":             unary(math.Log),
+	"Sqrt":            unary(math.Sqrt),
+	"Tanh":            unary(math.Tanh),
+	"Abs":             unary(math.Abs),
+	"Neg":             unary(func(x float64) float64 { return -x }),
+	"Floor":           unary(math.Floor),
+	"Ceil":            unary(math.Ceil),
+	"Erf":             unary(math.Erf),
+	"HardSwish":       unary(func(x float64) float64 { return x * math.Max(0, math.Min(1, x/6+0.5)) }),
+	"LeakyRelu":       opLeakyRelu,
+	"HardSigmoid":     opHardSigmoid,
+	"Clip":            opClip,
+	"Add":             elementwise(func(a, b float32) float32 { return a + b }, func(a, b int64) int64 { return a + b }),
+	"Sub":             elementwise(func(a, b float32) float32 { return a - b }, func(a, b int64) int64 { return a - b }),
+	"Mul":             elementwise(func(a, b float32) float32 { return a * b }, func(a, b int64) int64 { return a * b }),
+	"Div":             elementwise(func(a, b float32) float32 { return a / b }, func(a, b int64) int64 { return a / b }),
+	"Pow":             elementwise(func(a, b float32) float32 { return float32(math.Pow(float64(a), float64(b))) }, nil),
+	"Max":             variadic(func(a, b float32) float32 { return max(a, b) }, func(a, b int64) int64 { return max(a, b) }),
+	"Min":             variadic(func(a, b float32) float32 { return min(a, b) }, func(a, b int64) int64 { return min(a, b) }),
+	"Sum":             variadic(func(a, b float32) float32 { return a + b }, func(a, b int64) int64 { return a + b }),
+	"Equal":           compare(func(a, b float64) bool { return a == b }),
+	"Less":            compare(func(a, b float64) bool { return a < b }),
+	"Greater":         compare(func(a, b float64) bool { return a > b }),
+	"Where":           opWhere,
+	"Concat":          opConcat,
+	"Split":           opSplit,
+	"Slice":           opSlice,
+	"Reshape":         opReshape,
+	"Flatten":         opFlatten,
+	"Squeeze":         opSqueeze,
+	"Unsqueeze":       opUnsqueeze,
+	"Transpose":       opTranspose,
+	"Gather":          opGather,
+	"Expand":          opExpand,
+	"Range":           opRange,
+	"Conv":            opConv,
+	"MaxPool":         opMaxPool,
+	"Resize":          opResize,
+	"Upsample":        opResize,
+	"Softmax":         opSoftmax,
+	"MatMul":          opMatMul,
+}
+
+func (n *onnxNode) attrInt(name string, def int64) int64 {
+	if a, ok := n.attrs[name]; ok {
+		return a.i
+	}
+
+	return def
+}
+
+func (n *onnxNode) attrInts(name string, def []int64) []int64 {
+	if a, ok := n.attrs[name]; ok {
+		return a.ints
+	}
+
+	return def
+}
+
+func (n *onnxNode) attrFloat(name string, def float32) float32 {
+	if a, ok := n.attrs[name]; ok {
+		return a.f
+	}
+
+	return def
+}
+
+func (n *onnxNode) attrString(name, def string) string {
+	if a, ok := n.attrs[name]; ok {
+		return a.s
+	}
+
+	return def
+}
+
+// axis resolves a possibly negative axis against the rank.
+func axis(a int64, rank int) (int, error) {
+	if a < 0 {
+		a += int64(rank)
+	}
+	if a < 0 || int(a) >= max(rank, 1) {
+		return 0, fmt.Errorf("axis %d out of range for rank %d", a, rank)
+	}
+
+	return int(a), nil
+}
+
+// input returns the i-th input or nil when it wasn't given.
+func input(in []*tensor, i int) *tensor {
+	if i < len(in) {
+		return in[i]
+	}
+
+	return nil
+}
+
+func opIdentity(_ *onnxNode, in []*tensor, _ *execContext) ([]*tensor, error) {
+	return []*tensor{in[0]}, nil
+}
+
+func opConstant(n *onnxNode, _ []*tensor, _ *execContext) ([]*tensor, error) {
+	if a, ok := n.attrs["value"]; ok && a.t != nil {
+		return []*tensor{a.t}, nil
+	}
+	if a, ok := n.attrs["value_float"]; ok {
+		return []*tensor{floatTensor([]int{}, []float32{a.f})}, nil
+	}
+	if a, ok := n.attrs["value_floats"]; ok {
+		return []*tensor{floatTensor([]int{len(a.floats)}, a.floats)}, nil
+	}
+	if a, ok := n.attrs["value_int"]; ok {
+		return []*tensor{intTensor([]int{}, []int64{a.i})}, nil
+	}
+	if a, ok := n.attrs["value_ints"]; ok {
+		return []*tensor{intTensor([]int{len(a.ints)}, a.ints)}, nil
+	}
+
+	return nil, fmt.Errorf("constant %q has no supported value", n.name)
+}
+
+func opConstantOfShape(n *onnxNode, in []*tensor, _ *execContext) ([]*tensor, error) {
+	shape := toShape(in[0].asInts())
+	size := shapeSize(shape)
+
+	if a, ok := n.attrs["value"]; ok && a.t != nil && a.t.isInt {
+		data := make([]int64, size)
+		for i := range data {
+			data[i] = a.t.ints[0]
+		}
+
+		return []*tensor{intTensor(shape, data)}, nil
+	}
+
+	var v float32
+	if a, ok := n.attrs["value"]; ok && a.t != nil {
+		v = a.t.floats[0]
+	}
+	data := make([]float32, size)
+	for i := range data {
+		data[i] = v
+	}
+
+	return []*tensor{floatTensor(shape, data)}, nil
+}
+
+func opCast(n *onnxNode, in []*tensor, _ *execContext) ([]*tensor, error) {
+	x := in[0]
+	switch n.attrInt("to", onnxFloat) {
+	case onnxFloat, onnxDouble, onnxFloat16:
+		return []*tensor{floatTensor(x.shape, x.asFloats())}, nil
+	case onnxBool:
+		v := x.asInts()
+		out := make([]int64, len(v))
+		for i := range v {
+			if x.isInt && v[i] != 0 || !x.isInt && x.floats[i] != 0 {
+				out[i] = 1
+			}
+		}
+
+		return []*tensor{intTensor(x.shape, out)}, nil
+	default:
+		return []*tensor{intTensor(x.shape, x.asInts())}, nil
+	}
+}
+
+func opShape(n *onnxNode, in []*tensor, _ *execContext) ([]*tensor, error) {
+	rank := len(in[0].shape)
+	start, end := int(n.attrInt("start", 0)), int(n.attrInt("end", int64(rank)))
+	if start < 0 {
+		start += rank
+	}
+	if end < 0 {
+		end += rank
+	}
+	start, end = clampInt(start, 0, rank), clampInt(end, 0, rank)
+
+	dims := make([]int64, 0, rank)
+	for _, d := range in[0].shape[start:max(start, end)] {
+		dims = append(dims, int64(d))
+	}
+
+	return []*tensor{intTensor([]int{len(dims)}, dims)}, nil
+}
+
+func unary(f func(float64) float64) operator {
+	return func(_ *onnxNode, in []*tensor, _ *execContext) ([]*tensor, error) {
+		x := in[0].asFloats()
+		out := make([]float32, len(x))
+		for i, v := range x {
+			out[i] = float32(f(float64(v)))
+		}
+
+		return []*tensor{floatTensor(in[0].shape, out)}, nil
+	}
+}
+
+func opLeakyRelu(n *onnxNode, in []*tensor, ctx *execContext) ([]*tensor, error) {
+	alpha := float64(n.attrFloat("alpha", 0.01))
+
+	return unary(func(x float64) float64 {
+		if x < 0 {
+			return alpha * x
+		}
+
+		return x
+	})(n, in, ctx)
+}
+
+func opHardSigmoid(n *onnxNode, in []*tensor, ctx *execContext) ([]*tensor, error) {
+	alpha, beta := float64(n.attrFloat("alpha", 0.2)), float64(n.attrFloat("beta", 0.5))
+
+	return unary(func(x float64) float64 { return math.Max(0, math.Min(1, alpha*x+beta)) })(n, in, ctx)
+}
+
+func opClip(n *onnxNode, in []*tensor, ctx *execContext) ([]*tensor, error) {
+	lo, hi := math.Inf(-1), math.Inf(1)
+	// Opset 11 moved the bounds from attributes to inputs
+	if a, ok := n.attrs["min"]; ok {
+		lo = float64(a.f)
+	}
+	if a, ok := n.attrs["max"]; ok {
+		hi = float64(a.f)
+	}
+	if t := input(in, 1); t != nil {
+		lo = float64(t.asFloats()[0])
+	}
+	if t := input(in, 2); t != nil {
+		hi = float64(t.asFloats()[0])
+	}
+
+	return unary(func(x float64) float64 { return math.Max(lo, math.Min(hi, x)) })(n, in, ctx)
+}
+
+// elementwise builds a broadcasting element-wise operator. Integer inputs stay
+// integers when fi is given.
+func elementwise(ff func(a, b float32) float32, fi func(a, b int64) int64) operator {
+	return func(_ *onnxNode, in []*tensor, _ *execContext) ([]*tensor, error) {
+		out, err := applyBinary(in[0], in[1], ff, fi)
+		if err != nil {
+			return nil, err
+		}
+
+		return []*tensor{out}, nil
+	}
+}
+
+func variadic(ff func(a, b float32) float32, fi func(a, b int64) int64) operator {
+	return func(_ *onnxNode, in []*tensor, _ *execContext) ([]*tensor, error) {
+		acc := in[0]
+		for _, t := range in[1:] {
+			var err error
+			if acc, err = applyBinary(acc, t, ff, fi); err != nil {
+				return nil, err
+			}
+		}
+
+		return []*tensor{acc}, nil
+	}
+}
+
+func applyBinary(a, b *tensor, ff func(a, b float32) float32, fi func(a, b int64) int64) (*tensor, error) {
+	shape, err := broadcastShape(a.shape, b.shape)
+	if err != nil {
+		return nil, err
+	}
+
+	if a.isInt && b.isInt && fi != nil {
+		x, y := a.ints, b.ints
+		out := make([]int64, shapeSize(shape))
+		i := 0
+		forEachIndex(shape, [][]int{broadcastStrides(a.shape, shape), broadcastStrides(b.shape, shape)}, []int{0, 0}, func(offs []int) {
+			out[i] = fi(x[offs[0]], y[offs[1]])
+			i++
+		})
+
+		return intTensor(shape, out), nil
+	}
+
+	x, y := a.asFloats(), b.asFloats()
+	out := make([]float32, shapeSize(shape))
+	switch {
+	case slices.Equal(a.shape, b.shape):
+		for i := range out {
+			out[i] = ff(x[i], y[i])
+		}
+	case len(y) == 1:
+		for i := range out {
+			out[i] = ff(x[i], y[0])
+		}
+	case len(x) == 1:
+		for i := range out {
+			out[i] = ff(x[0], y[i])
+		}
+	default:
+		i := 0
+		forEachIndex(shape, [][]int{broadcastStrides(a.shape, shape), broadcastStrides(b.shape, shape)}, []int{0, 0}, func(offs []int) {
+			out[i] = ff(x[offs[0]], y[offs[1]])
+			i++
+		})
+	}
+
+	return floatTensor(shape, out), nil
+}
+
+// compare builds a broadcasting comparison returning a boolean tensor.
+func compare(f func(a, b float64) bool) operator {
+	return func(_ *onnxNode, in []*tensor, _ *execContext) ([]*tensor, error) {
+		a, b := in[0], in[1]
+		shape, err := broadcastShape(a.shape, b.shape)
+		if err != nil {
+			return nil, err
+		}
+
+		x, y := a.asFloats(), b.asFloats()
+		out := make([]int64, shapeSize(shape))
+		i := 0
+		forEachIndex(shape, [][]int{broadcastStrides(a.shape, shape), broadcastStrides(b.shape, shape)}, []int{0, 0}, func(offs []int) {
+			if f(float64(x[offs[0]]), float64(y[offs[1]])) {
+				out[i] = 1
+			}
+			i++
+		})
+
+		return []*tensor{intTensor(shape, out)}, nil
+	}
+}
+
+func opWhere(_ *onnxNode, in []*tensor, _ *execContext) ([]*tensor, error) {
+	cond, x, y := in[0], in[1], in[2]
+	shape, err := broadcastShape(cond.shape, x.shape, y.shape)
+	if err != nil {
+		return nil, err
+	}
+
+	c := cond.asInts()
+	all := [][]int{broadcastStrides(cond.shape, shape), broadcastStrides(x.shape, shape), broadcastStrides(y.shape, shape)}
+	i := 0
+	if x.isInt && y.isInt {
+		out := make([]int64, shapeSize(shape))
+		forEachIndex(shape, all, []int{0, 0, 0}, func(offs []int) {
+			out[i] = y.ints[offs[2]]
+			if c[offs[0]] != 0 {
+				out[i] = x.ints[offs[1]]
+			}
+			i++
+		})
+
+		return []*tensor{intTensor(shape, out)}, nil
+	}
+
+	xf, yf := x.asFloats(), y.asFloats()
+	out := make([]float32, shapeSize(shape))
+	forEachIndex(shape, all, []int{0, 0, 0}, func(offs []int) {
+		out[i] = yf[offs[2]]
+		if c[offs[0]] != 0 {
+			out[i] = xf[offs[1]]
+		}
+		i++
+	})
+
+	return []*tensor{floatTensor(shape, out)}, nil
+}
+
+func opConcat(n *onnxNode, in []*tensor, _ *execContext) ([]*tensor, error) {
+	ax, err := axis(n.attrInt("axis", 0), len(in[0].shape))
+	if err != nil {
+		return nil, err
+	}
+
+	shape := slices.Clone(in[0].shape)
+	shape[ax] = 0
+	isInt := true
+	for _, t := range in {
+		if len(t.shape) != len(shape) {
+			return nil, fmt.Errorf("concat of ranks %d and %d", len(shape), len(t.shape))
+		}
+		shape[ax] += t.shape[ax]
+		isInt = isInt && t.isInt
+	}
+
+	outer := shapeSize(shape[:ax])
+	if isInt {
+		parts := make([][]int64, len(in))
+		for i, t := range in {
+			parts[i] = t.ints
+		}
+
+		return []*tensor{intTensor(shape, concatBlocks(parts, outer, shapeSize(shape)))}, nil
+	}
+
+	parts := make([][]float32, len(in))
+	for i, t := range in {
+		parts[i] = t.asFloats()
+	}
+
+	return []*tensor{floatTensor(shape, concatBlocks(parts, outer, shapeSize(shape)))}, nil
+}
+
+// concatBlocks interleaves the parts: for each of the outer positions, the
+// next block of every part in turn.
+func concatBlocks[T float32 | int64](parts [][]T, outer, size int) []T {
+	out := make([]T, 0, size)
+	for o := 0; o < outer; o++ {
+		for _, p := range parts {
+			block := len(p) / outer
+			out = append(out, p[o*block:(o+1)*block]...)
+		}
+	}
+
+	return out
+}
+
+func opSplit(n *onnxNode, in []*tensor, ctx *execContext) ([]*tensor, error) {
+	x := in[0]
+	ax, err := axis(n.attrInt("axis", 0), len(x.shape))
+	if err != nil {
+		return nil, err
+	}
+
+	// Split sizes come from an input since opset 13, an attribute before,
+	// or are equal parts
+	var sizes []int64
+	if t := input(in, 1); t != nil {
+		sizes = t.asInts()
+	} else {
+		sizes = n.attrInts("split", nil)
+	}
+	if sizes == nil {
+		parts := int(n.attrInt("num_outputs", int64(len(n.outputs))))
+		chunk := (x.shape[ax] + parts - 1) / parts
+		for left := x.shape[ax]; left > 0; left -= chunk {
+			sizes = append(sizes, int64(min(chunk, left)))
+		}
+	}
+
+	outs := make([]*tensor, 0, len(sizes))
+	start := 0
+	for _, size := range sizes {
+		shape := slices.Clone(x.shape)
+		shape[ax] = int(size)
+		base := start * strides(x.shape)[ax]
+		outs = append(outs, x.take(shape, gatherIndex(shape, strides(x.shape), base)))
+		start += int(size)
+	}
+
+	return outs, nil
+}
+
+func opSlice(n *onnxNode, in []*tensor, ctx *execContext) ([]*tensor, error) {
+	x := in[0]
+	rank := len(x.shape)
+
+	var starts, ends, axes, steps []int64
+	if ctx.opset < 10 {
+		starts, ends, axes = n.attrInts("starts", nil), n.attrInts("ends", nil), n.attrInts("axes", nil)
+	} else {
+		starts, ends = in[1].asInts(), in[2].asInts()
+		if t := input(in, 3); t != nil {
+			axes = t.asInts()
+		}
+		if t := input(in, 4); t != nil {
+			steps = t.asInts()
+		}
+	}
+	if axes == nil {
+		for i := range starts {
+			axes = append(axes, int64(i))
+		}
+	}
+
+	shape := slices.Clone(x.shape)
+	src := strides(x.shape)
+	stride := slices.Clone(src)
+	base := 0
+	for i, a := range axes {
+		ax, err := axis(a, rank)
+		if err != nil {
+			return nil, err
+		}
+		dim := int64(x.shape[ax])
+		step := int64(1)
+		if steps != nil {
+			step = steps[i]
+		}
+		if step == 0 {
+			return nil, fmt.Errorf("slice %q has a zero step", n.name)
+		}
+
+		start, end := starts[i], ends[i]
+		if start < 0 {
+			start += dim
+		}
+		if end < 0 {
+			end += dim
+		}
+		var count int64
+		if step > 0 {
+			start, end = min(max(start, 0), dim), min(max(end, 0), dim)
+			count = max(0, (end-start+step-1)/step)
+		} else {
+			start, end = min(max(start, 0), dim-1), min(max(end, -1), dim-1)
+			count = max(0, (start-end-step-1)/-step)
+		}
+
+		shape[ax] = int(count)
+		stride[ax] = src[ax] * int(step)
+		base += int(start) * src[ax]
+	}
+
+	return []*tensor{x.take(shape, gatherIndex(shape, stride, base))}, nil
+}
+
+func opReshape(n *onnxNode, in []*tensor, _ *execContext) ([]*tensor, error) {
+	x := in[0]
+	target := in[1].asInts()
+	allowZero := n.attrInt("allowzero", 0) == 1
+
+	shape := make([]int, len(target))
+	infer := -1
+	known := 1
+	for i, d := range target {
+		switch {
+		case d == -1:
+			infer = i
+			continue
+		case d == 0 && !allowZero:
+			shape[i] = x.shape[i]
+		default:
+			shape[i] = int(d)
+		}
+		known *= shape[i]
+	}
+	if infer >= 0 {
+		if known == 0 {
+			return nil, fmt.Errorf("reshape %q can't infer a dimension next to a zero", n.name)
+		}
+		shape[infer] = x.size() / known
+	}
+	if shapeSize(shape) != x.size() {
+		return nil, fmt.Errorf("reshape %q from %v to %v", n.name, x.shape, target)
+	}
+
+	return []*tensor{x.reshaped(shape)}, nil
+}
+
+func opFlatten(n *onnxNode, in []*tensor, _ *execContext) ([]*tensor, error) {
+	x := in[0]
+	a := n.attrInt("axis", 1)
+	if a < 0 {
+		a += int64(len(x.shape))
+	}
+	outer := shapeSize(x.shape[:a])
+
+	return []*tensor{x.reshaped([]int{outer, x.size() / max(outer, 1)})}, nil
+}
+
+// axesOf reads the axes from the input (opset 13) or the attribute.
+func axesOf(n *onnxNode, in []*tensor, rank int) ([]int, error) {
+	raw := n.attrInts("axes", nil)
+	if t := input(in, 1); t != nil {
+		raw = t.asInts()
+	}
+
+	axes := make([]int, 0, len(raw))
+	for _, a := range raw {
+		ax, err := axis(a, rank)
+		if err != nil {
+			return nil, err
+		}
+		axes = append(axes, ax)
+	}
+
+	return axes, nil
+}
+
+func opSqueeze(n *onnxNode, in []*tensor, _ *execContext) ([]*tensor, error) {
+	x := in[0]
+	axes, err := axesOf(n, in, len(x.shape))
+	if err != nil {
+		return nil, err
+	}
+
+	shape := make([]int, 0, len(x.shape))
+	for i, d := range x.shape {
+		if slices.Contains(axes, i) || len(axes) == 0 && d == 1 {
+			continue
+		}
+		shape = append(shape, d)
+	}
+
+	return []*tensor{x.reshaped(shape)}, nil
+}
+
+func opUnsqueeze(n *onnxNode, in []*tensor, _ *execContext) ([]*tensor, error) {
+	x := in[0]
+	rank := len(x.shape) + len(n.attrInts("axes", nil))
+	if t := input(in, 1); t != nil {
+		rank = len(x.shape) + t.size()
+	}
+	axes, err := axesOf(n, in, rank)
+	if err != nil {
+		return nil, err
+	}
+
+	shape := make([]int, 0, rank)
+	rest := x.shape
+	for i := 0; i < rank; i++ {
+		if slices.Contains(axes, i) {
+			shape = append(shape, 1)
+			continue
+		}
+		shape = append(shape, rest[0])
+		rest = rest[1:]
+	}
+
+	return []*tensor{x.reshaped(shape)}, nil
+}
+
+func opTranspose(n *onnxNode, in []*tensor, _ *execContext) ([]*tensor, error) {
+	x := in[0]
+	rank := len(x.shape)
+	perm := n.attrInts("perm", nil)
+	if perm == nil {
+		for i := rank - 1; i >= 0; i-- {
+			perm = append(perm, int64(i))
+		}
+	}
+
+	src := strides(x.shape)
+	shape := make([]int, rank)
+	stride := make([]int, rank)
+	for i, p := range perm {
+		shape[i] = x.shape[p]
+		stride[i] = src[p]
+	}
+
+	return []*tensor{x.take(shape, gatherIndex(shape, stride, 0))}, nil
+}
+
+func opGather(n *onnxNode, in []*tensor, _ *execContext) ([]*tensor, error) {
+	x, indices := in[0], in[1]
+	ax, err := axis(n.attrInt("axis", 0), len(x.shape))
+	if err != nil {
+		return nil, err
+	}
+
+	shape := slices.Concat(x.shape[:ax], indices.shape, x.shape[ax+1:])
+	outer, inner := shapeSize(x.shape[:ax]), shapeSize(x.shape[ax+1:])
+	dim := x.shape[ax]
+
+	idx := make([]int, 0, shapeSize(shape))
+	for o := 0; o < outer; o++ {
+		for _, j := range indices.asInts() {
+			if j < 0 {
+				j += int64(dim)
+			}
+			if j < 0 || int(j) >= dim {
+				return nil, fmt.Errorf("gather %q index %d out of range %d", n.name, j, dim)
+			}
+			base := (o*dim + int(j)) * inner
+			for k := 0; k < inner; k++ {
+				idx = append(idx, base+k)
+			}
+		}
+	}
+
+	return []*tensor{x.take(shape, idx)}, nil
+}
+
+func opExpand(_ *onnxNode, in []*tensor, _ *execContext) ([]*tensor, error) {
+	x := in[0]
+	shape, err := broadcastShape(x.shape, toShape(in[1].asInts()))
+	if err != nil {
+		return nil, err
+	}
+
+	return []*tensor{x.take(shape, gatherIndex(shape, broadcastStrides(x.shape, shape), 0))}, nil
+}
+
+func opRange(_ *onnxNode, in []*tensor, _ *execContext) ([]*tensor, error) {
+	start, limit, delta := in[0], in[1], in[2]
+	if start.isInt && limit.isInt && delta.isInt {
+		s, l, d := start.ints[0], limit.ints[0], delta.ints[0]
+		var out []int64
+		for v := s; d > 0 && v < l || d < 0 && v > l; v += d {
+			out = append(out, v)
+		}
+
+		return []*tensor{intTensor([]int{len(out)}, out)}, nil
+	}
+
+	s, l, d := start.asFloats()[0], limit.asFloats()[0], delta.asFloats()[0]
+	count := max(0, int(math.Ceil(float64((l-s)/d))))
+	out := make([]float32, count)
+	for i := range out {
+		out[i] = s + float32(i)*d
+	}
+
+	return []*tensor{floatTensor([]int{count}, out)}, nil
+}
+
+func toShape(dims []int64) []int {
+	shape := make([]int, len(dims))
+	for i, d := range dims {
+		shape[i] = int(d)
+	}
+
+	return shape
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/fogleman/gg"
+)
+
+// Colour palettes boxes are drawn with, picked by class ID
+var palettes = map[string][]color.NRGBA{
+	"ultralytics": hexPalette("FF3838", "FF9D97", "FF701F", "FFB21D", "CFD231", "48F90A", "92CC17", "3DDB86",
+		"1A9334", "00D4BB", "2C99A8", "00C2FF", "344593", "6473FF", "0018EC", "8438FF", "520085", "CB38FF",
+		"FF95C8", "FF37C7"),
+	"tableau": hexPalette("4E79A7", "F28E2B", "E15759", "76B7B2", "59A14F", "EDC948", "B07AA1", "FF9DA7",
+		"9C755F", "BAB0AC"),
+	"red": hexPalette("FF0000"),
+}
+
+func hexPalette(codes ...string) []color.NRGBA {
+	colors := make([]color.NRGBA, 0, len(codes))
+	for _, code := range codes {
+		var r, g, b uint8
+		if _, err := fmt.Sscanf(code, "%02x%02x%02x", &r, &g, &b); err != nil {
+			panic(fmt.Sprintf("invalid palette colour %q", code))
+		}
+		colors = append(colors, color.NRGBA{R: r, G: g, B: b, A: 255})
+	}
+
+	return colors
+}
+
+// renderOptions controls how detections are drawn.
+type renderOptions struct {
+	palette   string
+	labels    bool
+	masks     bool
+	keypoints bool
+	// blur lists the classes whose boxes are blurred before drawing. With a
+	// pose model only the head of a person is blurred.
+	blur []string
+}
+
+// newRenderOptions registers the drawing flags on fs.
+func newRenderOptions(fs *flag.FlagSet) *renderOptions {
+	opts := &renderOptions{palette: "ultralytics", labels: true, masks: true, keypoints: true}
+	if fs == nil {
+		return opts
+	}
+
+	fs.Func("palette", "box colours: ultralytics (default), tableau or red", func(s string) error {
+		if _, ok := palettes[s]; !ok {
+			return fmt.Errorf("unknown palette %q", s)
+		}
+		opts.palette = s
+
+		return nil
+	})
+	fs.BoolVar(&opts.labels, "labels", opts.labels, "draw class labels and confidences")
+	fs.BoolVar(&opts.masks, "masks", opts.masks, "draw segmentation masks")
+	fs.BoolVar(&opts.keypoints, "keypoints", opts.keypoints, "draw pose keypoints")
+	fs.Func("blur", "comma separated classes to blur for privacy, e.g. person", func(s string) error {
+		opts.blur = nil
+		for _, class := range strings.Split(s, ",") {
+			if class = strings.TrimSpace(class); class != "" {
+				opts.blur = append(opts.blur, class)
+			}
+		}
+
+		return nil
+	})
+
+	return opts
+}
+
+func (o *renderOptions) color(classID int) color.NRGBA {
+	p, ok := palettes[o.palette]
+	if !ok {
+		p = palettes["ultralytics"]
+	}
+	if classID < 0 {
+		classID = -classID
+	}
+
+	return p[classID%len(p)]
+}
+
+// Draws bounding boxes with labels onto the decoded image and saves the
+// result as PNG or JPEG, depending on the extension of outputPath
+func drawBoxes(img image.Image, outputPath string, boxes []boundingBox, opts *renderOptions) error {
+	return saveImage(outputPath, renderBoxes(img, boxes, opts))
+}
+
+// Returns a copy of the image with the bounding boxes and labels drawn on it
+func renderBoxes(img image.Image, boxes []boundingBox, opts *renderOptions) image.Image {
+	if opts == nil {
+		opts = newRenderOptions(nil)
+	}
+
+	// Blur first, so boxes and labels stay readable on top of it
+	dst := image.NewRGBA(img.Bounds())
+	draw.Draw(dst, dst.Bounds(), img, img.Bounds().Min, draw.Src)
+	for _, box := range boxes {
+		if slices.Contains(opts.blur, box.label) {
+			blurRegion(dst, privacyRegion(&box), 0)
+		}
+	}
+
+	dc := gg.NewContextForRGBA(dst)
+	lineWidth := scaledLineWidth(img.Bounds().Size())
+	// gg keeps its built-in bitmap face when the font isn't installed
+	_ = dc.LoadFontFace(fontPath, math.Max(12, 5*lineWidth))
+
+	for _, box := range boxes {
+		c := opts.color(box.classID)
+
+		// Draw the instance mask and the pose, if any
+		if opts.masks && box.mask != nil {
+			drawMask(dc, box.mask, color.NRGBA{R: c.R, G: c.G, B: c.B, A: 96})
+		}
+		if opts.keypoints && len(box.keypoints) > 0 {
+			drawKeypoints(dc, box.keypoints, lineWidth)
+		}
+
+		// Draw rectangle
+		dc.SetColor(c)
+		dc.SetLineWidth(lineWidth)
+		dc.DrawRectangle(float64(box.x1), float64(box.y1), float64(box.x2-box.x1), float64(box.y2-box.y1))
+		dc.Stroke()
+
+		if opts.labels {
+			drawLabel(dc, fmt.Sprintf("%s %.2f", box.label, box.confidence), &box, c, lineWidth)
+		}
+	}
+
+	return dc.Image()
+}
+
+// Lines grow with the image, 0.3% of its mean side and 2 pixels at least
+func scaledLineWidth(size image.Point) float64 {
+	return math.Max(2, math.Round(float64(size.X+size.Y)/2*0.003))
+}
+
+// Draws the label on a filled background above the box, or inside it when
+// there is no room above, and keeps it within the image
+func drawLabel(dc *gg.Context, label string, box *boundingBox, c color.NRGBA, lineWidth float64) {
+	tw, th := dc.MeasureString(label)
+	pad := lineWidth
+	w, h := tw+2*pad, th+2*pad
+	x, y := labelOrigin(box, w, h, lineWidth, dc.Width(), dc.Height())
+
+	dc.SetColor(c)
+	dc.DrawRectangle(x, y, w, h)
+	dc.Fill()
+
+	// Dark text on light colours, white text on dark ones
+	if 0.299*float64(c.R)+0.587*float64(c.G)+0.114*float64(c.B) > 150 {
+		dc.SetRGB(0, 0, 0)
+	} else {
+		dc.SetRGB(1, 1, 1)
+	}
+	dc.DrawStringAnchored(label, x+pad, y+pad, 0, 1)
+}
+
+// Returns the top left corner of a w x h label for the box in an image of the
+// given size
+func labelOrigin(box *boundingBox, w, h, lineWidth float64, width, height int) (float64, float64) {
+	x := float64(box.x1) - lineWidth/2
+	y := float64(box.y1) - lineWidth/2 - h
+	if y < 0 {
+		y = float64(box.y1) + lineWidth/2
+	}
+
+	return math.Max(0, math.Min(x, float64(width)-w)), math.Max(0, math.Min(y, float64(height)-h))
+}
+
+// Blends a solid colour into the image wherever the mask is set
+func drawMask(dc *gg.Context, mask *image.Alpha, c color.NRGBA) {
+	dst, ok := dc.Image().(*image.RGBA)
+	if !ok {
+		return
+	}
+
+	r := mask.Bounds().Intersect(dst.Bounds())
+	a := uint32(c.A)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if mask.AlphaAt(x, y).A == 0 {
+				continue
+			}
+			i := dst.PixOffset(x, y)
+			p := dst.Pix[i : i+3 : i+3]
+			p[0] = uint8((uint32(p[0])*(255-a) + uint32(c.R)*a) / 255)
+			p[1] = uint8((uint32(p[1])*(255-a) + uint32(c.G)*a) / 255)
+			p[2] = uint8((uint32(p[2])*(255-a) + uint32(c.B)*a) / 255)
+		}
+	}
+}
+
+// Draws the COCO skeleton and the visible keypoints of a pose
+func drawKeypoints(dc *gg.Context, kps []keypoint, lineWidth float64) {
+	visible := func(i int) bool {
+		return i < len(kps) && kps[i].confidence >= keypointThreshold
+	}
+
+	dc.SetRGB(0, 1, 0)
+	dc.SetLineWidth(lineWidth)
+	for _, limb := range cocoSkeleton {
+		a, b := limb[0], limb[1]
+		if visible(a) && visible(b) {
+			dc.DrawLine(float64(kps[a].x), float64(kps[a].y), float64(kps[b].x), float64(kps[b].y))
+			dc.Stroke()
+		}
+	}
+
+	dc.SetRGB(1, 1, 0)
+	for i, kp := range kps {
+		if visible(i) {
+			dc.DrawCircle(float64(kp.x), float64(kp.y), 1.5*lineWidth)
+			dc.Fill()
+		}
+	}
+}
+
+// Pairs of COCO keypoint indices connected in the pose skeleton
+var cocoSkeleton = [][2]int{
+	{15, 13}, {13, 11}, {16, 14}, {14, 12}, {11, 12}, {5, 11}, {6, 12}, {5, 6}, {5, 7},
+	{6, 8}, {7, 9}, {8, 10}, {1, 2}, {0, 1}, {0, 2}, {1, 3}, {2, 4}, {3, 5}, {4, 6},
+}
+
+// The first five COCO keypoints are the nose, eyes and ears
+const faceKeypoints = 5
+
+// privacyRegion is the part of a box to blur: the head when the face
+// keypoints are known, the whole box otherwise.
+func privacyRegion(b *boundingBox) image.Rectangle {
+	box := b.toRect()
+
+	var face image.Rectangle
+	for i := 0; i < faceKeypoints && i < len(b.keypoints); i++ {
+		kp := b.keypoints[i]
+		if kp.confidence < keypointThreshold {
+			continue
+		}
+		face = face.Union(image.Rect(int(kp.x), int(kp.y), int(kp.x)+1, int(kp.y)+1))
+	}
+	if face.Empty() {
+		return box
+	}
+
+	// Keypoints only span the eyes and ears, grow the region to the head
+	pad := max(face.Dx(), box.Dx()/6)
+
+	return image.Rect(face.Min.X-pad/2, face.Min.Y-pad, face.Max.X+pad/2, face.Max.Y+pad).Intersect(box)
+}
+
+// blurRegion applies three box blur passes to r, approximating a gaussian.
+// A radius of 0 picks one proportional to the region.
+func blurRegion(img *image.RGBA, r image.Rectangle, radius int) {
+	r = r.Intersect(img.Bounds())
+	if r.Empty() {
+		return
+	}
+	if radius <= 0 {
+		radius = max(4, max(r.Dx(), r.Dy())/10)
+	}
+
+	w, h := r.Dx(), r.Dy()
+	buf := make([][4]int, max(w, h))
+	line := make([][4]int, max(w, h))
+
+	pass := func(n int, at func(i int) int) {
+		for i := 0; i < n; i++ {
+			o := at(i)
+			line[i] = [4]int{int(img.Pix[o]), int(img.Pix[o+1]), int(img.Pix[o+2]), int(img.Pix[o+3])}
+		}
+		// Running sum over a window clamped at the region edges
+		var sum [4]int
+		for i := -radius; i <= radius; i++ {
+			v := line[clampInt(i, 0, n-1)]
+			for c := range sum {
+				sum[c] += v[c]
+			}
+		}
+		size := 2*radius + 1
+		for i := 0; i < n; i++ {
+			for c := range sum {
+				buf[i][c] = sum[c] / size
+			}
+			out, in := line[clampInt(i-radius, 0, n-1)], line[clampInt(i+radius+1, 0, n-1)]
+			for c := range sum {
+				sum[c] += in[c] - out[c]
+			}
+		}
+		for i := 0; i < n; i++ {
+			o := at(i)
+			img.Pix[o], img.Pix[o+1], img.Pix[o+2], img.Pix[o+3] = uint8(buf[i][0]), uint8(buf[i][1]), uint8(buf[i][2]), uint8(buf[i][3])
+		}
+	}
+
+	for range 3 {
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			pass(w, func(i int) int { return img.PixOffset(r.Min.X+i, y) })
+		}
+		for x := r.Min.X; x < r.Max.X; x++ {
+			pass(h, func(i int) int { return img.PixOffset(x, r.Min.Y+i) })
+		}
+	}
+}
+
+// saveImage writes a PNG for .png paths and a JPEG otherwise.
+func saveImage(path string, img image.Image) error {
+	out, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("error creating %s: %w", path, err)
+	}
+	defer func(out *os.File) {
+		if e := out.Close(); e != nil {
+			fmt.Printf("error closing %s: %v\n", path, e)
+		}
+	}(out)
+
+	return encodeImage(out, filepath.Ext(path), img)
+}
+
+func encodeImage(w io.Writer, ext string, img image.Image) error {
+	if strings.EqualFold(ext, ".png") {
+		return png.Encode(w, img)
+	}
+
+	return jpeg.Encode(w, img, &jpeg.Options{Quality: 90})
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"flag"
+	"image"
+	"image/color"
+	"io"
+	"testing"
+)
+
+func TestPaletteFlag(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		want    string
+		wantErr bool
+	}{
+		{"default", nil, "ultralytics", false},
+		{"tableau", []string{"-palette", "tableau"}, "tableau", false},
+		{"red", []string{"-palette", "red"}, "red", false},
+		{"unknown", []string{"-palette", "neon"}, "", true},
+		{"empty", []string{"-palette", ""}, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.SetOutput(io.Discard)
+			opts := newRenderOptions(fs)
+
+			err := fs.Parse(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Parse(%q) error = %v, want error %v", tt.args, err, tt.wantErr)
+			}
+			if err == nil && opts.palette != tt.want {
+				t.Errorf("palette = %q, want %q", opts.palette, tt.want)
+			}
+		})
+	}
+
+}
+
+func TestScaledLineWidth(t *testing.T) {
+	tests := []struct {
+		size image.Point
+		want float64
+	}{
+		{image.Pt(32, 32), 2},
+		{image.Pt(640, 480), 2},
+		{image.Pt(2000, 2000), 6},
+		{image.Pt(3000, 5000), 12},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.size.String(), func(t *testing.T) {
+			if got := scaledLineWidth(tt.size); got != tt.want {
+				t.Errorf("scaledLineWidth(%v) = %v, want %v", tt.size, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLabelOrigin(t *testing.T) {
+	// A 30x10 label drawn with 2 pixel lines
+	tests := []struct {
+		name          string
+		box           boundingBox
+		width, height int
+		wantX, wantY  float64
+	}{
+		{"above the box", boundingBox{x1: 20, y1: 40, x2: 60, y2: 80}, 100, 100, 19, 29},
+		{"no room above", boundingBox{x1: 20, y1: 5, x2: 60, y2: 80}, 100, 100, 19, 6},
+		{"left edge", boundingBox{x1: 0, y1: 40, x2: 60, y2: 80}, 100, 100, 0, 29},
+		{"right edge", boundingBox{x1: 90, y1: 40, x2: 100, y2: 80}, 100, 100, 70, 29},
+		{"bottom edge", boundingBox{x1: 20, y1: 8, x2: 60, y2: 15}, 100, 15, 19, 5},
+		{"wider than the image", boundingBox{x1: 5, y1: 40, x2: 15, y2: 50}, 20, 100, 0, 29},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			x, y := labelOrigin(&tt.box, 30, 10, 2, tt.width, tt.height)
+			if x != tt.wantX || y != tt.wantY {
+				t.Errorf("labelOrigin() = (%v, %v), want (%v, %v)", x, y, tt.wantX, tt.wantY)
+			}
+		})
+	}
+}
+
+func TestPrivacyRegion(t *testing.T) {
+	face := []keypoint{
+		{x: 60, y: 30, confidence: 0.9},
+		{x: 55, y: 25, confidence: 0.9},
+		{x: 65, y: 25, confidence: 0.9},
+		{x: 50, y: 28, confidence: 0.9},
+		{x: 70, y: 28, confidence: 0.9},
+		// A wrist, not part of the head
+		{x: 110, y: 200, confidence: 0.9},
+	}
+	hidden := make([]keypoint, len(face))
+	for i, kp := range face {
+		hidden[i] = keypoint{x: kp.x, y: kp.y, confidence: 0.1}
+	}
+
+	tests := []struct {
+		name      string
+		keypoints []keypoint
+		want      image.Rectangle
+	}{
+		{"no keypoints", nil, image.Rect(0, 0, 120, 300)},
+		{"face keypoints", face, image.Rect(40, 4, 81, 52)},
+		{"hidden face", hidden, image.Rect(0, 0, 120, 300)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := boundingBox{label: "person", x2: 120, y2: 300, keypoints: tt.keypoints}
+			if got := privacyRegion(&b); got != tt.want {
+				t.Errorf("privacyRegion() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBlurRegion(t *testing.T) {
+	// Black on the left, white on the right
+	stripes := func() *image.RGBA {
+		img := image.NewRGBA(image.Rect(0, 0, 40, 20))
+		for y := 0; y < 20; y++ {
+			for x := 20; x < 40; x++ {
+				img.Set(x, y, color.White)
+			}
+		}
+
+		return img
+	}
+
+	tests := []struct {
+		name   string
+		region image.Rectangle
+	}{
+		{"across the edge", image.Rect(10, 5, 30, 15)},
+		{"partly outside", image.Rect(30, -10, 60, 10)},
+		{"outside", image.Rect(50, 50, 60, 60)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img, orig := stripes(), stripes()
+			blurRegion(img, tt.region, 0)
+
+			inside := tt.region.Intersect(img.Bounds())
+			for y := 0; y < 20; y++ {
+				for x := 0; x < 40; x++ {
+					if !image.Pt(x, y).In(inside) && img.RGBAAt(x, y) != orig.RGBAAt(x, y) {
+						t.Fatalf("pixel (%d, %d) outside the region changed", x, y)
+					}
+				}
+			}
+		})
+	}
+
+	img := stripes()
+	blurRegion(img, image.Rect(10, 5, 30, 15), 0)
+	// The hard edge becomes a ramp, the white beyond the region stays white
+	left, right := img.RGBAAt(19, 10).R, img.RGBAAt(20, 10).R
+	if left < 50 || right > 205 || left > right {
+		t.Errorf("edge pixels = %d, %d, want a grey ramp", left, right)
+	}
+	if got := img.RGBAAt(38, 10).R; got != 255 {
+		t.Errorf("pixel outside the region = %d, want 255", got)
+	}
+}
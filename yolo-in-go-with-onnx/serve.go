@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const (
+	serveAddr            = ":8000"
+	maxUploadBytes       = 20 << 20
+	maxImagePixels       = 40_000_000
+	defaultMaxInFlight   = 8
+	defaultQueueTimeout  = 5 * time.Second
+	serveReadTimeout     = 30 * time.Second
+	serveWriteTimeout    = 60 * time.Second
+	serveShutdownTimeout = 15 * time.Second
+	// statusClientClosedRequest is the nginx status of a request whose
+	// client left before the answer
+	statusClientClosedRequest = 499
+)
+
+// detection is one record of the pandas xyxy frame returned by the Python
+// /detect endpoint, so both services share a contract.
+type detection struct {
+	XMin       float64 `json:"xmin"`
+	YMin       float64 `json:"ymin"`
+	XMax       float64 `json:"xmax"`
+	YMax       float64 `json:"ymax"`
+	Confidence float64 `json:"confidence"`
+	Class      int     `json:"class"`
+	Name       string  `json:"name"`
+}
+
+func toDetections(boxes []boundingBox) []detection {
+	detections := make([]detection, 0, len(boxes))
+	for _, b := range boxes {
+		detections = append(detections, detection{
+			XMin:       float64(b.x1),
+			YMin:       float64(b.y1),
+			XMax:       float64(b.x2),
+			YMax:       float64(b.y2),
+			Confidence: float64(b.confidence),
+			Class:      b.classID,
+			Name:       b.label,
+		})
+	}
+
+	return detections
+}
+
+// detector runs inference on decoded images and is safe for concurrent use.
+// It gives up waiting for the model once ctx is done.
+type detector interface {
+	Detect(ctx context.Context, pic image.Image) ([]boundingBox, error)
+}
+
+// detectServer implements the /detect endpoint. At most maxInFlight requests
+// are admitted at once, the rest wait up to queueTimeout for a slot.
+type detectServer struct {
+	detector     detector
+	slots        chan struct{}
+	queueTimeout time.Duration
+	render       *renderOptions
+}
+
+func newDetectServer(d detector, maxInFlight int, queueTimeout time.Duration, render *renderOptions) *detectServer {
+	return &detectServer{
+		detector:     d,
+		slots:        make(chan struct{}, maxInFlight),
+		queueTimeout: queueTimeout,
+		render:       render,
+	}
+}
+
+func (s *detectServer) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /detect", s.handleDetect)
+	mux.HandleFunc("GET /health", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		if _, err := w.Write([]byte("ok")); err != nil {
+			log.Println("error writing health response:", err)
+		}
+	})
+
+	return mux
+}
+
+// annotatedTypes are the content types of the ?annotate=1 output, picked
+// with ?format=
+var annotatedTypes = map[string]string{"": "image/jpeg", "jpeg": "image/jpeg", "png": "image/png"}
+
+func (s *detectServer) handleDetect(w http.ResponseWriter, r *http.Request) {
+	annotate := r.URL.Query().Get("annotate") == "1"
+	format := r.URL.Query().Get("format")
+	contentType, ok := annotatedTypes[format]
+	if annotate && !ok {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("unsupported format %q, use jpeg or png", format))
+
+		return
+	}
+
+	pic, status, err := readUpload(w, r)
+	if err != nil {
+		writeError(w, status, err.Error())
+
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.queueTimeout)
+	defer cancel()
+
+	select {
+	case s.slots <- struct{}{}:
+		defer func() { <-s.slots }()
+	case <-ctx.Done():
+		writeUnavailable(w, r)
+
+		return
+	}
+
+	// With fewer sessions than slots, the wait for one shares the queue timeout
+	boxes, err := s.detector.Detect(ctx, pic)
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		writeUnavailable(w, r)
+
+		return
+	}
+	if err != nil {
+		log.Printf("detection failed: %s", err)
+		writeError(w, http.StatusInternalServerError, "detection failed")
+
+		return
+	}
+
+	if annotate {
+		w.Header().Set("Content-Type", contentType)
+		if err := encodeImage(w, "."+format, renderBoxes(pic, boxes, s.render)); err != nil {
+			log.Println("error writing annotated image:", err)
+		}
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(toDetections(boxes)); err != nil {
+		log.Println("error writing detections:", err)
+	}
+}
+
+// readUpload extracts and decodes the multipart "file" field. The image size
+// is checked from its header before the pixels are decoded.
+func readUpload(w http.ResponseWriter, r *http.Request) (image.Image, int, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes)
+
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, http.StatusRequestEntityTooLarge, fmt.Errorf("upload exceeds %d bytes", maxUploadBytes)
+		}
+
+		return nil, http.StatusUnprocessableEntity, errors.New("field required: file")
+	}
+	defer func() {
+		if e := file.Close(); e != nil {
+			log.Println("error closing upload:", e)
+		}
+	}()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, http.StatusBadRequest, errors.New("error reading upload")
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, http.StatusBadRequest, errors.New("unsupported or corrupt image")
+	}
+	if cfg.Width*cfg.Height > maxImagePixels {
+		return nil, http.StatusRequestEntityTooLarge, fmt.Errorf("image exceeds %d pixels", maxImagePixels)
+	}
+
+	pic, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, http.StatusBadRequest, errors.New("unsupported or corrupt image")
+	}
+
+	return pic, 0, nil
+}
+
+// writeUnavailable answers a request that got no slot or session before its
+// queue timeout, or whose client left while it waited.
+func writeUnavailable(w http.ResponseWriter, r *http.Request) {
+	if r.Context().Err() != nil {
+		// Nobody reads the answer, the status is for the access logs
+		w.WriteHeader(statusClientClosedRequest)
+
+		return
+	}
+	w.Header().Set("Retry-After", "1")
+	writeError(w, http.StatusServiceUnavailable, "detector busy, try again later")
+}
+
+// writeError mirrors the {"detail": ...} body FastAPI uses for errors.
+func writeError(w http.ResponseWriter, status int, detail string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(map[string]string{"detail": detail}); err != nil {
+		log.Println("error writing error response:", err)
+	}
+}
+
+func runServe(args []string) int {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	addr := fs.String("addr", serveAddr, "listen address")
+	cfg := newSessionConfig(fs)
+	poolSize := fs.Int("pool", 1, "number of sessions running requests in parallel")
+	maxInFlight := fs.Int("max-inflight", defaultMaxInFlight, "maximum number of requests admitted at once")
+	queueTimeout := fs.Duration("queue-timeout", defaultQueueTimeout, "how long a request waits for a free slot")
+	render := newRenderOptions(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	// Create the sessions up front so the first requests don't pay for it
+	pool, err := newSessionPool(cfg, *poolSize)
+	if err != nil {
+		fmt.Printf("error creating session pool: %s\n", err)
+
+		return 1
+	}
+	defer pool.Destroy()
+
+	srv := newDetectServer(pool, *maxInFlight, *queueTimeout, render)
+
+	server := &http.Server{
+		Addr:              *addr,
+		Handler:           srv.routes(),
+		ReadTimeout:       serveReadTimeout,
+		ReadHeaderTimeout: 5 * time.Second,
+		WriteTimeout:      serveWriteTimeout,
+		IdleTimeout:       60 * time.Second,
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		log.Printf("detection server listening on %s", *addr)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			errCh <- err
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+	select {
+	case err := <-errCh:
+		fmt.Printf("server error: %s\n", err)
+
+		return 1
+	case <-stop:
+	}
+
+	log.Println("shutting down...")
+
+	ctx, cancel := context.WithTimeout(context.Background(), serveShutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("shutdown error: %v", err)
+	}
+
+	return 0
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type fakeDetector struct {
+	boxes []boundingBox
+	err   error
+}
+
+func (d fakeDetector) Detect(context.Context, image.Image) ([]boundingBox, error) {
+	return d.boxes, d.err
+}
+
+// multipartBody puts data in the given form field.
+func multipartBody(t *testing.T, field string, data []byte) (*bytes.Buffer, string) {
+	t.Helper()
+
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	part, err := mw.CreateFormFile(field, "upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := part.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return body, mw.FormDataContentType()
+}
+
+func encodedJPEG(t *testing.T, w, h int) []byte {
+	t.Helper()
+
+	buf := &bytes.Buffer{}
+	if err := jpeg.Encode(buf, image.NewRGBA(image.Rect(0, 0, w, h)), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+// hugePNG is a PNG header claiming w x h pixels, enough for DecodeConfig.
+func hugePNG(t *testing.T, w, h uint32) []byte {
+	t.Helper()
+
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	// The IHDR chunk follows the 8 byte signature: length, type, width,
+	// height, 5 more bytes and the CRC of the type and data
+	binary.BigEndian.PutUint32(data[16:20], w)
+	binary.BigEndian.PutUint32(data[20:24], h)
+	binary.BigEndian.PutUint32(data[29:33], crc32.ChecksumIEEE(data[12:29]))
+
+	return data
+}
+
+func TestDetectHandler(t *testing.T) {
+	boxes := []boundingBox{{label: "cat", classID: 15, confidence: 0.5, x1: 1, y1: 2, x2: 3, y2: 4}}
+	small := encodedJPEG(t, 32, 16)
+
+	tests := []struct {
+		name        string
+		query       string
+		field       string
+		data        []byte
+		detector    fakeDetector
+		wantStatus  int
+		wantType    string
+		wantDetail  string
+		wantBoxes   []detection
+		wantDecoder func([]byte) (image.Image, error)
+	}{
+		{
+			name: "detections", field: "file", data: small, detector: fakeDetector{boxes: boxes},
+			wantStatus: http.StatusOK, wantType: "application/json",
+			wantBoxes: []detection{{XMin: 1, YMin: 2, XMax: 3, YMax: 4, Confidence: 0.5, Class: 15, Name: "cat"}},
+		},
+		{
+			name: "no detections", field: "file", data: small,
+			wantStatus: http.StatusOK, wantType: "application/json", wantBoxes: []detection{},
+		},
+		{
+			name: "missing file field", field: "image", data: small,
+			wantStatus: http.StatusUnprocessableEntity, wantDetail: "field required: file",
+		},
+		{
+			name: "corrupt image", field: "file", data: []byte("not an image"),
+			wantStatus: http.StatusBadRequest, wantDetail: "unsupported or corrupt image",
+		},
+		{
+			name: "too many pixels", field: "file", data: hugePNG(t, 8000, 6000),
+			wantStatus: http.StatusRequestEntityTooLarge, wantDetail: "image exceeds 40000000 pixels",
+		},
+		{
+			name: "too many bytes", field: "file", data: make([]byte, maxUploadBytes+1),
+			wantStatus: http.StatusRequestEntityTooLarge, wantDetail: "upload exceeds 20971520 bytes",
+		},
+		{
+			name: "detection error", field: "file", data: small, detector: fakeDetector{err: errors.New("boom")},
+			wantStatus: http.StatusInternalServerError, wantDetail: "detection failed",
+		},
+		{
+			name: "annotated", query: "?annotate=1", field: "file", data: small, detector: fakeDetector{boxes: boxes},
+			wantStatus: http.StatusOK, wantType: "image/jpeg",
+			wantDecoder: func(b []byte) (image.Image, error) { return jpeg.Decode(bytes.NewReader(b)) },
+		},
+		{
+			name: "annotated png", query: "?annotate=1&format=png", field: "file", data: small, detector: fakeDetector{boxes: boxes},
+			wantStatus: http.StatusOK, wantType: "image/png",
+			wantDecoder: func(b []byte) (image.Image, error) { return png.Decode(bytes.NewReader(b)) },
+		},
+		{
+			name: "annotated in an unknown format", query: "?annotate=1&format=gif", field: "file", data: small,
+			wantStatus: http.StatusBadRequest, wantDetail: `unsupported format "gif", use jpeg or png`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newDetectServer(tt.detector, 1, time.Second, nil)
+			body, contentType := multipartBody(t, tt.field, tt.data)
+			req := httptest.NewRequest(http.MethodPost, "/detect"+tt.query, body)
+			req.Header.Set("Content-Type", contentType)
+			rec := httptest.NewRecorder()
+
+			srv.routes().ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantDetail != "" {
+				tt.wantType = "application/json"
+				var got map[string]string
+				if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil || got["detail"] != tt.wantDetail {
+					t.Errorf("body = %s, want detail %q", rec.Body, tt.wantDetail)
+				}
+			}
+			if got := rec.Header().Get("Content-Type"); got != tt.wantType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.wantType)
+			}
+			if tt.wantBoxes != nil {
+				var got []detection
+				if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got, tt.wantBoxes) {
+					t.Errorf("detections = %+v, want %+v", got, tt.wantBoxes)
+				}
+			}
+			if tt.wantDecoder != nil {
+				pic, err := tt.wantDecoder(rec.Body.Bytes())
+				if err != nil {
+					t.Fatalf("annotated image: %v", err)
+				}
+				if pic.Bounds() != image.Rect(0, 0, 32, 16) {
+					t.Errorf("annotated image bounds = %v, want the upload's", pic.Bounds())
+				}
+			}
+		})
+	}
+}
+
+func TestDetectHandlerBusy(t *testing.T) {
+	srv := newDetectServer(fakeDetector{}, 1, 10*time.Millisecond, nil)
+	// The only slot is taken
+	srv.slots <- struct{}{}
+
+	body, contentType := multipartBody(t, "file", encodedJPEG(t, 8, 8))
+	req := httptest.NewRequest(http.MethodPost, "/detect", body)
+	req.Header.Set("Content-Type", contentType)
+	rec := httptest.NewRecorder()
+	srv.routes().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "1" {
+		t.Errorf("status = %d with Retry-After %q, want 503 with 1", rec.Code, rec.Header().Get("Retry-After"))
+	}
+}
+
+func TestDetectHandlerNoSession(t *testing.T) {
+	tests := []struct {
+		name         string
+		queueTimeout time.Duration
+		cancelAfter  time.Duration
+		wantStatus   int
+	}{
+		{"queue timeout", 10 * time.Millisecond, 0, http.StatusServiceUnavailable},
+		{"client gone", time.Minute, 10 * time.Millisecond, statusClientClosedRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// A free slot but the only session is checked out
+			pool := fakePool(&fakeBackend{})
+			if _, err := pool.acquire(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			srv := newDetectServer(pool, 2, tt.queueTimeout, nil)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancelAfter > 0 {
+				time.AfterFunc(tt.cancelAfter, cancel)
+			}
+			body, contentType := multipartBody(t, "file", encodedJPEG(t, 8, 8))
+			req := httptest.NewRequestWithContext(ctx, http.MethodPost, "/detect", body)
+			req.Header.Set("Content-Type", contentType)
+			rec := httptest.NewRecorder()
+			srv.routes().ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if len(srv.slots) != 0 {
+				t.Errorf("%d slots still taken, want none", len(srv.slots))
+			}
+		})
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"image"
+	"log"
+	"os"
+	"sync"
+
+	ort "github.com/yalue/onnxruntime_go"
+)
+
+// sessionConfig selects the model and tunes the ONNX Runtime sessions.
+type sessionConfig struct {
+	model          string
+	head           string
+	confidence     float32
+	backend        string
+	batch          int
+	intraOpThreads int
+	interOpThreads int
+	optimization   string
+	memArena       bool
+	memPattern     bool
+	parallel       bool
+}
+
+// newSessionConfig registers the flags shared by every mode that runs the
+// model.
+func newSessionConfig(fs *flag.FlagSet) *sessionConfig {
+	cfg := &sessionConfig{batch: 1, confidence: defaultConfidenceThreshold}
+	fs.StringVar(&cfg.model, "model", modelPath, "path to the ONNX model")
+	fs.StringVar(&cfg.head, "head", headAuto, "output head: auto, yolov5, yolov8, yolov8-seg, yolov8-pose or yolov10")
+	fs.StringVar(&cfg.backend, "backend", backendORT, "inference backend: ort (ONNX Runtime) or go (pure Go, no native library)")
+	fs.IntVar(&cfg.intraOpThreads, "intra-threads", 0, "threads used inside a graph node, 0 for the default (all cores for the go backend)")
+	fs.IntVar(&cfg.interOpThreads, "inter-threads", 0, "threads used across graph nodes, 0 for the ORT default")
+	fs.StringVar(&cfg.optimization, "graph-opt", "all", "graph optimization level: disable, basic, extended or all")
+	fs.BoolVar(&cfg.memArena, "mem-arena", true, "use the CPU memory arena")
+	fs.BoolVar(&cfg.memPattern, "mem-pattern", true, "pre-plan memory allocations for fixed shapes")
+	fs.BoolVar(&cfg.parallel, "parallel", false, "run independent graph nodes in parallel (uses the inter-op threads)")
+
+	return cfg
+}
+
+// options builds the ORT session options for the config. The caller must
+// destroy them.
+func (c *sessionConfig) options() (*ort.SessionOptions, error) {
+	levels := map[string]ort.GraphOptimizationLevel{
+		"disable":  ort.GraphOptimizationLevelDisableAll,
+		"basic":    ort.GraphOptimizationLevelEnableBasic,
+		"extended": ort.GraphOptimizationLevelEnableExtended,
+		"all":      ort.GraphOptimizationLevelEnableAll,
+	}
+	level, ok := levels[c.optimization]
+	if !ok {
+		return nil, fmt.Errorf("unknown graph optimization level %q", c.optimization)
+	}
+
+	options, err := ort.NewSessionOptions()
+	if err != nil {
+		return nil, fmt.Errorf("error creating ORT session options: %w", err)
+	}
+
+	mode := ort.ExecutionMode(ort.ExecutionModeSequential)
+	if c.parallel {
+		mode = ort.ExecutionModeParallel
+	}
+
+	for _, set := range []func() error{
+		func() error { return options.SetIntraOpNumThreads(c.intraOpThreads) },
+		func() error { return options.SetInterOpNumThreads(c.interOpThreads) },
+		func() error { return options.SetGraphOptimizationLevel(level) },
+		func() error { return options.SetCpuMemArena(c.memArena) },
+		func() error { return options.SetMemPattern(c.memPattern) },
+		func() error { return options.SetExecutionMode(mode) },
+	} {
+		if err := set(); err != nil {
+			if e := options.Destroy(); e != nil {
+				log.Printf("error destroying ORT session options: %s\n", e)
+			}
+
+			return nil, fmt.Errorf("error configuring ORT session options: %w", err)
+		}
+	}
+
+	return options, nil
+}
+
+var (
+	environmentOnce sync.Once
+	environmentErr  error
+)
+
+// initEnvironment loads the shared library and creates the process-wide ORT
+// environment the first time it is called. ONNXRUNTIME_SHARED_LIBRARY_PATH
+// overrides the library location.
+func initEnvironment() error {
+	environmentOnce.Do(func() {
+		path := sharedLibPath
+		if p := os.Getenv("ONNXRUNTIME_SHARED_LIBRARY_PATH"); p != "" {
+			path = p
+		}
+		ort.SetSharedLibraryPath(path)
+		if err := ort.InitializeEnvironment(); err != nil {
+			environmentErr = fmt.Errorf("error initializing ORT environment: %w", err)
+		}
+	})
+
+	return environmentErr
+}
+
+// loadModel inspects the model and picks its output decoder. The result can
+// be shared by any number of sessions.
+func loadModel(cfg *sessionConfig) (*modelInfo, outputDecoder, error) {
+	var (
+		info *modelInfo
+		err  error
+	)
+	switch cfg.backend {
+	case backendORT:
+		if err := initEnvironment(); err != nil {
+			return nil, nil, err
+		}
+		info, err = inspectModel(cfg.model)
+	case backendGo:
+		info, err = inspectONNX(cfg.model)
+	default:
+		err = fmt.Errorf("unknown backend %q, use ort or go", cfg.backend)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	decoder, err := newDecoder(cfg.head, info, cfg.confidence)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error choosing output decoder: %w", err)
+	}
+
+	if cfg.batch > 1 && !info.dynamicBatch {
+		return nil, nil, fmt.Errorf("model has a fixed batch size of 1, export it with dynamic=True to use a batch of %d", cfg.batch)
+	}
+
+	return info, decoder, nil
+}
+
+type ModelSession struct {
+	Backend InferenceBackend
+	Decoder outputDecoder
+	Batch   int
+}
+
+// Creates a session running cfg.batch images at once. Batches larger than
+// one need a model exported with a dynamic batch dimension.
+func initSession(cfg *sessionConfig) (*ModelSession, error) {
+	info, decoder, err := loadModel(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return newModelSession(cfg, info, decoder)
+}
+
+// Creates a session with its own input and output buffers.
+func newModelSession(cfg *sessionConfig, info *modelInfo, decoder outputDecoder) (*ModelSession, error) {
+	backend, err := newBackend(cfg, info, cfg.batch)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ModelSession{
+		Backend: backend,
+		Decoder: decoder,
+		Batch:   cfg.batch,
+	}, nil
+}
+
+// Runs the model on a single image and returns the decoded boxes. A session
+// owns one set of tensors, so callers must not call Detect concurrently.
+func (m *ModelSession) Detect(pic image.Image) ([]boundingBox, error) {
+	if err := prepareInput(pic, m.Backend.Input()); err != nil {
+		return nil, fmt.Errorf("error converting image to network input: %w", err)
+	}
+
+	if err := m.Backend.Run(); err != nil {
+		return nil, err
+	}
+
+	return processOutput(m, 0, pic.Bounds().Canon().Dx(), pic.Bounds().Canon().Dy()), nil
+}
+
+// Runs the model on up to Batch preprocessed inputs (see prepareInput) and
+// returns the decoded boxes for each, scaled to the given original sizes.
+func (m *ModelSession) DetectBatch(inputs [][]float32, sizes []image.Point) ([][]boundingBox, error) {
+	if len(inputs) > m.Batch {
+		return nil, fmt.Errorf("got %d inputs for a batch of %d", len(inputs), m.Batch)
+	}
+
+	data := m.Backend.Input()
+	slot := len(data) / m.Batch
+	for i, input := range inputs {
+		copy(data[i*slot:(i+1)*slot], input)
+	}
+	// Unused slots of a partial batch are run on zeros and ignored
+	clear(data[len(inputs)*slot:])
+
+	if err := m.Backend.Run(); err != nil {
+		return nil, err
+	}
+
+	results := make([][]boundingBox, len(inputs))
+	for i, size := range sizes {
+		results[i] = processOutput(m, i, size.X, size.Y)
+	}
+
+	return results, nil
+}
+
+func (m *ModelSession) Destroy() {
+	m.Backend.Destroy()
+}
+
+// Decodes the output tensors of the last run for the given image of the batch
+// into bounding boxes scaled to the original image, sorted by descending
+// confidence.
+func processOutput(m *ModelSession, index, originalWidth, originalHeight int) []boundingBox {
+	all := m.Backend.Outputs()
+	outputs := make([][]float32, len(all))
+	for i, data := range all {
+		size := len(data) / m.Batch
+		outputs[i] = data[index*size : (index+1)*size]
+	}
+
+	return m.Decoder.decode(outputs, originalWidth, originalHeight)
+}
+
+// sessionPool hands out a fixed set of sessions, each with its own tensors,
+// so that up to size images run through the model concurrently.
+type sessionPool struct {
+	sessions chan *ModelSession
+	all      []*ModelSession
+}
+
+func newSessionPool(cfg *sessionConfig, size int) (*sessionPool, error) {
+	if size < 1 {
+		return nil, fmt.Errorf("session pool size must be at least 1, got %d", size)
+	}
+
+	info, decoder, err := loadModel(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &sessionPool{sessions: make(chan *ModelSession, size)}
+	for i := 0; i < size; i++ {
+		m, err := newModelSession(cfg, info, decoder)
+		if err != nil {
+			p.Destroy()
+
+			return nil, err
+		}
+		p.all = append(p.all, m)
+		p.sessions <- m
+	}
+
+	return p, nil
+}
+
+// acquire checks out a session, waiting until one is free or ctx is done.
+func (p *sessionPool) acquire(ctx context.Context) (*ModelSession, error) {
+	select {
+	case m := <-p.sessions:
+		return m, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (p *sessionPool) release(m *ModelSession) {
+	p.sessions <- m
+}
+
+// Detect runs one image on the next free session, waiting for one until ctx
+// is done.
+func (p *sessionPool) Detect(ctx context.Context, pic image.Image) ([]boundingBox, error) {
+	m, err := p.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer p.release(m)
+
+	return m.Detect(pic)
+}
+
+func (p *sessionPool) size() int {
+	return len(p.all)
+}
+
+// Destroy frees every session. Sessions must not be checked out any more.
+func (p *sessionPool) Destroy() {
+	for _, m := range p.all {
+		m.Destroy()
+	}
+}
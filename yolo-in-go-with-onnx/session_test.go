@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"image"
+	"testing"
+	"time"
+
+	ort "github.com/yalue/onnxruntime_go"
+)
+
+// fakeBackend runs nothing and returns a fixed output.
+type fakeBackend struct {
+	input     []float32
+	output    []float32
+	err       error
+	destroyed int
+}
+
+func (b *fakeBackend) Input() []float32 {
+	return b.input
+}
+
+func (b *fakeBackend) Run() error {
+	return b.err
+}
+
+func (b *fakeBackend) Outputs() [][]float32 {
+	return [][]float32{b.output}
+}
+
+func (b *fakeBackend) Destroy() {
+	b.destroyed++
+}
+
+// fakePool builds a pool of sessions on fake backends, bypassing the model.
+func fakePool(backends ...*fakeBackend) *sessionPool {
+	p := &sessionPool{sessions: make(chan *ModelSession, len(backends))}
+	for _, b := range backends {
+		m := &ModelSession{
+			Backend: b,
+			Decoder: &yolov10Decoder{names: []string{"cat"}, shape: ort.Shape{1, 1, 6}, confidence: defaultConfidenceThreshold},
+			Batch:   1,
+		}
+		p.all = append(p.all, m)
+		p.sessions <- m
+	}
+
+	return p
+}
+
+func TestSessionPoolAcquire(t *testing.T) {
+	backends := []*fakeBackend{{}, {}}
+	p := fakePool(backends...)
+	if p.size() != 2 {
+		t.Fatalf("size() = %d, want 2", p.size())
+	}
+
+	first, err := p.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := p.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Fatal("acquire() handed out the same session twice")
+	}
+
+	// Both are checked out, so the next caller waits until its deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if m, err := p.acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("acquire() on an empty pool = %v, %v, want a deadline error", m, err)
+	}
+
+	// A waiting caller gets the released session
+	got := make(chan *ModelSession)
+	go func() {
+		m, err := p.acquire(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+		got <- m
+	}()
+	p.release(second)
+	if m := <-got; m != second {
+		t.Errorf("acquire() after release = %p, want the released session %p", m, second)
+	}
+
+	p.release(first)
+	p.release(second)
+	p.Destroy()
+	for i, b := range backends {
+		if b.destroyed != 1 {
+			t.Errorf("backend %d destroyed %d times, want once", i, b.destroyed)
+		}
+	}
+}
+
+func TestSessionPoolDetect(t *testing.T) {
+	pic := image.NewRGBA(image.Rect(0, 0, 64, 32))
+	input := make([]float32, 3*640*640)
+
+	tests := []struct {
+		name      string
+		backend   *fakeBackend
+		wantBoxes int
+		wantErr   bool
+	}{
+		{"detection", &fakeBackend{input: input, output: []float32{10, 10, 20, 20, 0.9, 0}}, 1, false},
+		{"below the threshold", &fakeBackend{input: input, output: []float32{10, 10, 20, 20, 0.1, 0}}, 0, false},
+		{"run error", &fakeBackend{input: input, err: errors.New("boom")}, 0, true},
+		{"input too small", &fakeBackend{input: make([]float32, 10)}, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := fakePool(tt.backend)
+
+			boxes, err := p.Detect(context.Background(), pic)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Detect() error = %v, want error %v", err, tt.wantErr)
+			}
+			if len(boxes) != tt.wantBoxes {
+				t.Errorf("Detect() = %v, want %d boxes", boxes, tt.wantBoxes)
+			}
+
+			// The session goes back to the pool, even after an error
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			if _, err := p.acquire(ctx); err != nil {
+				t.Errorf("session not released after Detect(): %v", err)
+			}
+		})
+	}
+}
+
+func TestNewSessionPoolSize(t *testing.T) {
+	if _, err := newSessionPool(&sessionConfig{batch: 1}, 0); err == nil {
+		t.Error("newSessionPool() with size 0 succeeded, want an error")
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"image/draw"
+	"sort"
+)
+
+const (
+	mergeNMS = "nms"
+	mergeWBF = "wbf"
+
+	matchIoU = "iou"
+	matchIoS = "ios"
+)
+
+// sliceConfig controls SAHI-style sliced inference: the image is cut into
+// overlapping tiles that are each run at the model resolution, so small
+// objects keep enough pixels.
+type sliceConfig struct {
+	tile      int
+	overlap   float64
+	merge     string
+	metric    string
+	threshold float64
+	fullImage bool
+}
+
+// newSliceConfig registers the tiling flags on fs.
+func newSliceConfig(fs *flag.FlagSet) *sliceConfig {
+	cfg := &sliceConfig{}
+	fs.IntVar(&cfg.tile, "tile", 0, "tile size in pixels for sliced inference, 0 to run on the whole image")
+	fs.Float64Var(&cfg.overlap, "overlap", 0.2, "overlap between neighbouring tiles, as a fraction of the tile size")
+	fs.StringVar(&cfg.merge, "merge", mergeNMS, "how boxes from overlapping tiles are merged: nms or wbf")
+	fs.StringVar(&cfg.metric, "merge-metric", matchIoS, "overlap measure used for merging: iou or ios (intersection over the smaller box)")
+	fs.Float64Var(&cfg.threshold, "merge-thresh", 0.5, "overlap above which boxes of the same class are merged")
+	fs.BoolVar(&cfg.fullImage, "full-image", false, "also run on the whole image to catch objects larger than a tile")
+
+	return cfg
+}
+
+func (c *sliceConfig) enabled() bool {
+	return c.tile > 0
+}
+
+func (c *sliceConfig) validate() error {
+	if c.overlap < 0 || c.overlap >= 1 {
+		return fmt.Errorf("overlap must be in [0, 1), got %v", c.overlap)
+	}
+	if c.merge != mergeNMS && c.merge != mergeWBF {
+		return fmt.Errorf("unknown merge %q, use nms or wbf", c.merge)
+	}
+	if c.metric != matchIoU && c.metric != matchIoS {
+		return fmt.Errorf("unknown merge metric %q, use iou or ios", c.metric)
+	}
+
+	return nil
+}
+
+// tiles covers a w x h image with tiles of the given size. The last tile of
+// a row or column is shifted back to end at the image border, so all tiles
+// have the same size unless the image is smaller than one tile.
+func tiles(w, h, size int, overlap float64) []image.Rectangle {
+	step := max(1, int(float64(size)*(1-overlap)))
+
+	starts := func(length int) []int {
+		if length <= size {
+			return []int{0}
+		}
+
+		var s []int
+		for p := 0; ; p += step {
+			if p+size >= length {
+				s = append(s, length-size)
+
+				return s
+			}
+			s = append(s, p)
+		}
+	}
+
+	var rects []image.Rectangle
+	for _, y := range starts(h) {
+		for _, x := range starts(w) {
+			rects = append(rects, image.Rect(x, y, min(x+size, w), min(y+size, h)))
+		}
+	}
+
+	return rects
+}
+
+// detectSliced runs the model on every tile, batching as many tiles per run
+// as the session allows, maps the boxes back to image coordinates and merges
+// the duplicates found by neighbouring tiles.
+func detectSliced(m *ModelSession, pic image.Image, cfg *sliceConfig) ([]boundingBox, error) {
+	bounds := pic.Bounds()
+	regions := tiles(bounds.Dx(), bounds.Dy(), cfg.tile, cfg.overlap)
+	if cfg.fullImage {
+		regions = append(regions, image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	}
+
+	var boxes []boundingBox
+	for start := 0; start < len(regions); start += m.Batch {
+		batch := regions[start:min(start+m.Batch, len(regions))]
+
+		inputs := make([][]float32, len(batch))
+		sizes := make([]image.Point, len(batch))
+		for i, r := range batch {
+			inputs[i] = make([]float32, 3*modelInputSize*modelInputSize)
+			if err := prepareInput(crop(pic, r.Add(bounds.Min)), inputs[i]); err != nil {
+				return nil, fmt.Errorf("error converting tile to network input: %w", err)
+			}
+			sizes[i] = r.Size()
+		}
+
+		results, err := m.DetectBatch(inputs, sizes)
+		if err != nil {
+			return nil, err
+		}
+		for i, found := range results {
+			for _, b := range found {
+				boxes = append(boxes, offsetBox(b, batch[i].Min))
+			}
+		}
+	}
+
+	return mergeBoxes(boxes, cfg), nil
+}
+
+// crop returns the part of the image inside r, sharing pixels when the image
+// type supports it.
+func crop(pic image.Image, r image.Rectangle) image.Image {
+	if sub, ok := pic.(interface {
+		SubImage(image.Rectangle) image.Image
+	}); ok {
+		return sub.SubImage(r)
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(dst, dst.Bounds(), pic, r.Min, draw.Src)
+
+	return dst
+}
+
+// offsetBox moves a box found in a tile, with its mask and keypoints, by the
+// tile origin.
+func offsetBox(b boundingBox, offset image.Point) boundingBox {
+	dx, dy := float32(offset.X), float32(offset.Y)
+	b.x1, b.y1, b.x2, b.y2 = b.x1+dx, b.y1+dy, b.x2+dx, b.y2+dy
+
+	if b.mask != nil {
+		mask := *b.mask
+		mask.Rect = mask.Rect.Add(offset)
+		b.mask = &mask
+	}
+	if len(b.keypoints) > 0 {
+		kps := make([]keypoint, len(b.keypoints))
+		for i, kp := range b.keypoints {
+			kps[i] = keypoint{x: kp.x + dx, y: kp.y + dy, confidence: kp.confidence}
+		}
+		b.keypoints = kps
+	}
+
+	return b
+}
+
+// overlapOf measures two boxes with the configured metric. Intersection over
+// the smaller box also matches a box cut at a tile border with the full box
+// found by the neighbouring tile.
+func (c *sliceConfig) overlapOf(a, b *boundingBox) float64 {
+	inter := float64(boxIntersection(a, b))
+	if inter == 0 {
+		return 0
+	}
+
+	areaA, areaB := float64((a.x2-a.x1)*(a.y2-a.y1)), float64((b.x2-b.x1)*(b.y2-b.y1))
+	if c.metric == matchIoS {
+		return inter / min(areaA, areaB)
+	}
+
+	return inter / (areaA + areaB - inter)
+}
+
+func boxIntersection(a, b *boundingBox) float32 {
+	w := min(a.x2, b.x2) - max(a.x1, b.x1)
+	h := min(a.y2, b.y2) - max(a.y1, b.y1)
+	if w <= 0 || h <= 0 {
+		return 0
+	}
+
+	return w * h
+}
+
+// mergeBoxes clusters boxes of the same class around the most confident one.
+// NMS keeps that box, weighted box fusion replaces the cluster by the
+// confidence weighted average of its boxes with the highest confidence.
+func mergeBoxes(boxes []boundingBox, cfg *sliceConfig) []boundingBox {
+	sort.SliceStable(boxes, func(i, j int) bool { return boxes[i].confidence > boxes[j].confidence })
+
+	used := make([]bool, len(boxes))
+	merged := make([]boundingBox, 0, len(boxes))
+	for i := range boxes {
+		if used[i] {
+			continue
+		}
+		used[i] = true
+
+		cluster := []boundingBox{boxes[i]}
+		for j := i + 1; j < len(boxes); j++ {
+			if used[j] || boxes[j].classID != boxes[i].classID {
+				continue
+			}
+			if cfg.overlapOf(&boxes[i], &boxes[j]) > cfg.threshold {
+				used[j] = true
+				cluster = append(cluster, boxes[j])
+			}
+		}
+
+		if cfg.merge == mergeWBF {
+			merged = append(merged, fuseBoxes(cluster))
+		} else {
+			merged = append(merged, cluster[0])
+		}
+	}
+
+	return merged
+}
+
+// fuseBoxes averages the corners weighted by confidence. The mask and
+// keypoints of the most confident box are kept.
+func fuseBoxes(cluster []boundingBox) boundingBox {
+	fused := cluster[0]
+	if len(cluster) == 1 {
+		return fused
+	}
+
+	var x1, y1, x2, y2, total float32
+	for _, b := range cluster {
+		x1 += b.x1 * b.confidence
+		y1 += b.y1 * b.confidence
+		x2 += b.x2 * b.confidence
+		y2 += b.y2 * b.confidence
+		total += b.confidence
+	}
+	fused.x1, fused.y1, fused.x2, fused.y2 = x1/total, y1/total, x2/total, y2/total
+
+	return fused
+}
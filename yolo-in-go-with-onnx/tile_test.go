@@ -0,0 +1,138 @@
+package main
+
+import (
+	"image"
+	"reflect"
+	"testing"
+)
+
+func TestTiles(t *testing.T) {
+	tests := []struct {
+		name          string
+		w, h, size    int
+		overlap       float64
+		want          []image.Rectangle
+		wantTileCount int
+	}{
+		{
+			name: "smaller than a tile",
+			w:    500, h: 300, size: 640, overlap: 0.2,
+			want: []image.Rectangle{image.Rect(0, 0, 500, 300)},
+		},
+		{
+			// Step 512, the second column is shifted back to end at 1000
+			name: "last tile shifted to the border",
+			w:    1000, h: 640, size: 640, overlap: 0.2,
+			want: []image.Rectangle{image.Rect(0, 0, 640, 640), image.Rect(360, 0, 1000, 640)},
+		},
+		{
+			name: "exact fit without overlap",
+			w:    1280, h: 640, size: 640, overlap: 0,
+			want: []image.Rectangle{image.Rect(0, 0, 640, 640), image.Rect(640, 0, 1280, 640)},
+		},
+		{
+			// 6000 wide: starts 0, 512, ..., 5120 and a shifted 5360 (12
+			// columns), 4000 high: 0, 512, ..., 3072 and 3360 (8 rows)
+			name: "drone image",
+			w:    6000, h: 4000, size: 640, overlap: 0.2,
+			wantTileCount: 12 * 8,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tiles(tt.w, tt.h, tt.size, tt.overlap)
+
+			if tt.want != nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("tiles() = %v, want %v", got, tt.want)
+			}
+			if tt.wantTileCount != 0 && len(got) != tt.wantTileCount {
+				t.Errorf("tiles() returned %d tiles, want %d", len(got), tt.wantTileCount)
+			}
+
+			// Every pixel must be covered
+			covered := image.Rectangle{}
+			for _, r := range got {
+				covered = covered.Union(r)
+			}
+			if covered != image.Rect(0, 0, tt.w, tt.h) {
+				t.Errorf("tiles() cover %v, want the whole image", covered)
+			}
+		})
+	}
+}
+
+func TestMergeBoxes(t *testing.T) {
+	box := func(classID int, confidence, x1, y1, x2, y2 float32) boundingBox {
+		return boundingBox{classID: classID, confidence: confidence, x1: x1, y1: y1, x2: x2, y2: y2}
+	}
+
+	// A car cut by the tile border at x=100 and the full car from the
+	// neighbouring tile
+	full := box(2, 0.9, 80, 0, 140, 40)
+	cut := box(2, 0.6, 80, 0, 100, 40)
+	other := box(0, 0.8, 85, 5, 95, 35)
+
+	tests := []struct {
+		name  string
+		cfg   sliceConfig
+		boxes []boundingBox
+		want  []boundingBox
+	}{
+		{
+			name:  "ios merges the cut box",
+			cfg:   sliceConfig{merge: mergeNMS, metric: matchIoS, threshold: 0.5},
+			boxes: []boundingBox{cut, full},
+			want:  []boundingBox{full},
+		},
+		{
+			// The cut box has an IoU of 1/3 with the full one
+			name:  "iou keeps the cut box",
+			cfg:   sliceConfig{merge: mergeNMS, metric: matchIoU, threshold: 0.5},
+			boxes: []boundingBox{cut, full},
+			want:  []boundingBox{full, cut},
+		},
+		{
+			name:  "other classes are not merged",
+			cfg:   sliceConfig{merge: mergeNMS, metric: matchIoS, threshold: 0.5},
+			boxes: []boundingBox{full, other},
+			want:  []boundingBox{full, other},
+		},
+		{
+			name:  "wbf averages by confidence",
+			cfg:   sliceConfig{merge: mergeWBF, metric: matchIoU, threshold: 0.5},
+			boxes: []boundingBox{box(2, 0.25, 10, 10, 50, 50), box(2, 0.75, 14, 10, 54, 50)},
+			want:  []boundingBox{box(2, 0.75, 13, 10, 53, 50)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := mergeBoxes(tt.boxes, &tt.cfg)
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mergeBoxes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOffsetBox(t *testing.T) {
+	mask := image.NewAlpha(image.Rect(10, 10, 20, 20))
+	b := boundingBox{x1: 10, y1: 10, x2: 20, y2: 20, mask: mask, keypoints: []keypoint{{x: 15, y: 12, confidence: 1}}}
+
+	got := offsetBox(b, image.Pt(100, 200))
+
+	if got.x1 != 110 || got.y1 != 210 || got.x2 != 120 || got.y2 != 220 {
+		t.Errorf("offsetBox() box = (%v, %v, %v, %v), want (110, 210, 120, 220)", got.x1, got.y1, got.x2, got.y2)
+	}
+	if got.mask.Bounds() != image.Rect(110, 210, 120, 220) {
+		t.Errorf("offsetBox() mask bounds = %v, want (110,210)-(120,220)", got.mask.Bounds())
+	}
+	if got.keypoints[0] != (keypoint{x: 115, y: 212, confidence: 1}) {
+		t.Errorf("offsetBox() keypoint = %v, want {115 212 1}", got.keypoints[0])
+	}
+	if mask.Bounds() != image.Rect(10, 10, 20, 20) {
+		t.Errorf("offsetBox() changed the original mask bounds to %v", mask.Bounds())
+	}
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+const (
+	defaultTrackMaxAge  = 30
+	defaultTrackMinHits = 3
+	trackIoUThreshold   = 0.3
+	// Detections at or above this confidence are matched first and may start
+	// new tracks; the weaker ones only get a chance to extend tracks left over
+	// from the first pass, as in ByteTrack.
+	defaultTrackHighThreshold = 0.6
+	// defaultTrackLowThreshold is the decoder cut in track mode, well below
+	// the usual one so that the second pass has weak detections to match.
+	defaultTrackLowThreshold = 0.1
+)
+
+// track is a single object followed across frames.
+type track struct {
+	id        int
+	box       boundingBox
+	kf        *kalmanBox
+	hits      int
+	sinceSeen int
+}
+
+// confirmed reports whether the track has been matched often enough to be
+// reported, or was matched in the first frames of the sequence.
+func (t *track) confirmed(minHits, frame int) bool {
+	return t.hits >= minHits || frame <= minHits
+}
+
+// tracker links detections across frames with a constant velocity Kalman
+// filter per object and IoU-based Hungarian matching, in the spirit of SORT.
+type tracker struct {
+	maxAge        int
+	minHits       int
+	highThreshold float32
+	nextID        int
+	frame         int
+	tracks        []*track
+	// dropped holds the IDs of the tracks the last update gave up on
+	dropped []int
+}
+
+func newTracker(maxAge, minHits int, highThreshold float32) *tracker {
+	return &tracker{maxAge: maxAge, minHits: minHits, highThreshold: highThreshold, nextID: 1}
+}
+
+// trackedBox is a detection annotated with its track ID.
+type trackedBox struct {
+	boundingBox
+	trackID int
+}
+
+// update advances all tracks by one frame, matches them against the frame's
+// detections and returns the confirmed tracks that were seen in this frame.
+func (t *tracker) update(detections []boundingBox) []trackedBox {
+	t.frame++
+
+	predicted := make([]boundingBox, len(t.tracks))
+	for i, tr := range t.tracks {
+		tr.sinceSeen++
+		predicted[i] = tr.kf.predict()
+	}
+
+	var high, low []int
+	for i, d := range detections {
+		if d.confidence >= t.highThreshold {
+			high = append(high, i)
+		} else {
+			low = append(low, i)
+		}
+	}
+
+	allTracks := make([]int, len(t.tracks))
+	for i := range allTracks {
+		allTracks[i] = i
+	}
+
+	matches, unmatchedTracks, unmatchedHigh := associate(predicted, allTracks, detections, high)
+	lowMatches, _, _ := associate(predicted, unmatchedTracks, detections, low)
+	matches = append(matches, lowMatches...)
+
+	for _, m := range matches {
+		tr, d := t.tracks[m[0]], detections[m[1]]
+		tr.kf.update(d)
+		tr.box = d
+		tr.hits++
+		tr.sinceSeen = 0
+	}
+
+	// Only confident detections start new tracks
+	for _, i := range unmatchedHigh {
+		d := detections[i]
+		t.tracks = append(t.tracks, &track{
+			id:   t.nextID,
+			box:  d,
+			kf:   newKalmanBox(d),
+			hits: 1,
+		})
+		t.nextID++
+	}
+
+	var (
+		alive  []*track
+		result []trackedBox
+	)
+	t.dropped = t.dropped[:0]
+	for _, tr := range t.tracks {
+		if tr.sinceSeen > t.maxAge {
+			t.dropped = append(t.dropped, tr.id)
+
+			continue
+		}
+		alive = append(alive, tr)
+
+		if tr.sinceSeen == 0 && tr.confirmed(t.minHits, t.frame) {
+			result = append(result, trackedBox{boundingBox: tr.box, trackID: tr.id})
+		}
+	}
+	t.tracks = alive
+
+	sort.Slice(result, func(i, j int) bool { return result[i].trackID < result[j].trackID })
+
+	return result
+}
+
+// associate matches the given tracks and detections by maximum total IoU,
+// rejecting pairs below trackIoUThreshold. It returns [track, detection]
+// index pairs plus the track and detection indices left unmatched.
+func associate(predicted []boundingBox, tracks []int, detections []boundingBox, dets []int) ([][2]int, []int, []int) {
+	if len(tracks) == 0 || len(dets) == 0 {
+		return nil, tracks, dets
+	}
+
+	cost := make([][]float64, len(tracks))
+	for i, ti := range tracks {
+		cost[i] = make([]float64, len(dets))
+		for j, di := range dets {
+			cost[i][j] = 1 - float64(boxIoU(predicted[ti], detections[di]))
+		}
+	}
+
+	assignment := hungarian(cost)
+
+	var (
+		matches       [][2]int
+		matchedTracks = make([]bool, len(tracks))
+		matchedDets   = make([]bool, len(dets))
+	)
+	for i, j := range assignment {
+		if j < 0 || 1-cost[i][j] < trackIoUThreshold {
+			continue
+		}
+		matches = append(matches, [2]int{tracks[i], dets[j]})
+		matchedTracks[i] = true
+		matchedDets[j] = true
+	}
+
+	var unmatchedTracks, unmatchedDets []int
+	for i, ok := range matchedTracks {
+		if !ok {
+			unmatchedTracks = append(unmatchedTracks, tracks[i])
+		}
+	}
+	for j, ok := range matchedDets {
+		if !ok {
+			unmatchedDets = append(unmatchedDets, dets[j])
+		}
+	}
+
+	return matches, unmatchedTracks, unmatchedDets
+}
+
+// boxIoU computes the IoU of two boxes in floating point coordinates.
+func boxIoU(a, b boundingBox) float32 {
+	iw := min(a.x2, b.x2) - max(a.x1, b.x1)
+	ih := min(a.y2, b.y2) - max(a.y1, b.y1)
+	if iw <= 0 || ih <= 0 {
+		return 0
+	}
+
+	inter := iw * ih
+	union := (a.x2-a.x1)*(a.y2-a.y1) + (b.x2-b.x1)*(b.y2-b.y1) - inter
+	if union <= 0 {
+		return 0
+	}
+
+	return inter / union
+}
+
+// hungarian solves the rectangular assignment problem minimizing the total
+// cost. It returns, for every row, the assigned column or -1.
+func hungarian(cost [][]float64) []int {
+	rows := len(cost)
+	if rows == 0 {
+		return nil
+	}
+	cols := len(cost[0])
+
+	// The potentials method below needs rows <= columns, so solve the
+	// transposed problem otherwise.
+	if rows > cols {
+		transposed := make([][]float64, cols)
+		for j := range transposed {
+			transposed[j] = make([]float64, rows)
+			for i := range cost {
+				transposed[j][i] = cost[i][j]
+			}
+		}
+
+		result := make([]int, rows)
+		for i := range result {
+			result[i] = -1
+		}
+		for j, i := range hungarian(transposed) {
+			if i >= 0 {
+				result[i] = j
+			}
+		}
+
+		return result
+	}
+
+	// 1-indexed potentials u, v, matching p and back-links way.
+	u := make([]float64, rows+1)
+	v := make([]float64, cols+1)
+	p := make([]int, cols+1)
+	way := make([]int, cols+1)
+
+	for i := 1; i <= rows; i++ {
+		p[0] = i
+		j0 := 0
+		minv := make([]float64, cols+1)
+		used := make([]bool, cols+1)
+		for j := range minv {
+			minv[j] = math.Inf(1)
+		}
+
+		for {
+			used[j0] = true
+			i0, delta, j1 := p[j0], math.Inf(1), 0
+			for j := 1; j <= cols; j++ {
+				if used[j] {
+					continue
+				}
+				cur := cost[i0-1][j-1] - u[i0] - v[j]
+				if cur < minv[j] {
+					minv[j] = cur
+					way[j] = j0
+				}
+				if minv[j] < delta {
+					delta = minv[j]
+					j1 = j
+				}
+			}
+			for j := 0; j <= cols; j++ {
+				if used[j] {
+					u[p[j]] += delta
+					v[j] -= delta
+				} else {
+					minv[j] -= delta
+				}
+			}
+			j0 = j1
+			if p[j0] == 0 {
+				break
+			}
+		}
+
+		for j0 != 0 {
+			j1 := way[j0]
+			p[j0] = p[j1]
+			j0 = j1
+		}
+	}
+
+	result := make([]int, rows)
+	for i := range result {
+		result[i] = -1
+	}
+	for j := 1; j <= cols; j++ {
+		if p[j] > 0 {
+			result[p[j]-1] = j - 1
+		}
+	}
+
+	return result
+}
+
+// kalmanBox is the SORT constant velocity model of a box. The state is
+// [cx, cy, area, aspect, vcx, vcy, varea]; only the first four are measured.
+type kalmanBox struct {
+	x [7]float64
+	p [7][7]float64
+}
+
+func newKalmanBox(b boundingBox) *kalmanBox {
+	k := &kalmanBox{}
+	z := measurement(b)
+	copy(k.x[:4], z[:])
+
+	for i := 0; i < 7; i++ {
+		k.p[i][i] = 10
+	}
+	// The velocities are unobserved, so start with a high uncertainty
+	for i := 4; i < 7; i++ {
+		k.p[i][i] = 10000
+	}
+
+	return k
+}
+
+func measurement(b boundingBox) [4]float64 {
+	w, h := float64(b.x2-b.x1), float64(b.y2-b.y1)
+	r := 0.0
+	if h > 0 {
+		r = w / h
+	}
+
+	return [4]float64{float64(b.x1) + w/2, float64(b.y1) + h/2, w * h, r}
+}
+
+func (k *kalmanBox) box() boundingBox {
+	s, r := math.Max(k.x[2], 0), math.Max(k.x[3], 0)
+	w := math.Sqrt(s * r)
+	h := 0.0
+	if w > 0 {
+		h = s / w
+	}
+
+	return boundingBox{
+		x1: float32(k.x[0] - w/2),
+		y1: float32(k.x[1] - h/2),
+		x2: float32(k.x[0] + w/2),
+		y2: float32(k.x[1] + h/2),
+	}
+}
+
+// predict advances the state by one frame and returns the predicted box.
+func (k *kalmanBox) predict() boundingBox {
+	// Keep the area from going negative
+	if k.x[2]+k.x[6] <= 0 {
+		k.x[6] = 0
+	}
+
+	// x = F x with F the identity plus the position += velocity terms
+	for i := 0; i < 3; i++ {
+		k.x[i] += k.x[i+4]
+	}
+
+	// P = F P F' + Q
+	var fp [7][7]float64
+	for i := 0; i < 7; i++ {
+		for j := 0; j < 7; j++ {
+			fp[i][j] = k.p[i][j]
+			if i < 3 {
+				fp[i][j] += k.p[i+4][j]
+			}
+		}
+	}
+	for i := 0; i < 7; i++ {
+		for j := 0; j < 7; j++ {
+			k.p[i][j] = fp[i][j]
+			if j < 3 {
+				k.p[i][j] += fp[i][j+4]
+			}
+		}
+	}
+	for i := 0; i < 7; i++ {
+		k.p[i][i] += processNoise[i]
+	}
+
+	return k.box()
+}
+
+// update corrects the state with a measured box.
+func (k *kalmanBox) update(b boundingBox) {
+	z := measurement(b)
+
+	// H picks the first four state components, so H P H' + R and P H' are
+	// plain sub-blocks of P.
+	var s [4][4]float64
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 4; j++ {
+			s[i][j] = k.p[i][j]
+		}
+		s[i][i] += measurementNoise[i]
+	}
+
+	sInv, ok := invert4(s)
+	if !ok {
+		return
+	}
+
+	// K = P H' S^-1
+	var gain [7][4]float64
+	for i := 0; i < 7; i++ {
+		for j := 0; j < 4; j++ {
+			for l := 0; l < 4; l++ {
+				gain[i][j] += k.p[i][l] * sInv[l][j]
+			}
+		}
+	}
+
+	var y [4]float64
+	for i := 0; i < 4; i++ {
+		y[i] = z[i] - k.x[i]
+	}
+	for i := 0; i < 7; i++ {
+		for j := 0; j < 4; j++ {
+			k.x[i] += gain[i][j] * y[j]
+		}
+	}
+
+	// P = (I - K H) P
+	var p [7][7]float64
+	for i := 0; i < 7; i++ {
+		for j := 0; j < 7; j++ {
+			p[i][j] = k.p[i][j]
+			for l := 0; l < 4; l++ {
+				p[i][j] -= gain[i][l] * k.p[l][j]
+			}
+		}
+	}
+	k.p = p
+}
+
+// Diagonal process and measurement noise, as tuned in the SORT paper's
+// reference implementation.
+var (
+	processNoise     = [7]float64{1, 1, 1, 1, 0.01, 0.01, 0.0001}
+	measurementNoise = [4]float64{1, 1, 10, 10}
+)
+
+// invert4 inverts a 4x4 matrix with Gauss-Jordan elimination.
+func invert4(m [4][4]float64) ([4][4]float64, bool) {
+	var inv [4][4]float64
+	for i := range inv {
+		inv[i][i] = 1
+	}
+
+	for col := 0; col < 4; col++ {
+		pivot := col
+		for r := col + 1; r < 4; r++ {
+			if math.Abs(m[r][col]) > math.Abs(m[pivot][col]) {
+				pivot = r
+			}
+		}
+		if math.Abs(m[pivot][col]) < 1e-12 {
+			return inv, false
+		}
+		m[col], m[pivot] = m[pivot], m[col]
+		inv[col], inv[pivot] = inv[pivot], inv[col]
+
+		d := m[col][col]
+		for j := 0; j < 4; j++ {
+			m[col][j] /= d
+			inv[col][j] /= d
+		}
+		for r := 0; r < 4; r++ {
+			if r == col {
+				continue
+			}
+			f := m[r][col]
+			for j := 0; j < 4; j++ {
+				m[r][j] -= f * m[col][j]
+				inv[r][j] -= f * inv[col][j]
+			}
+		}
+	}
+
+	return inv, true
+}
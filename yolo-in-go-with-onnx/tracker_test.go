@@ -0,0 +1,252 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestHungarian(t *testing.T) {
+	tests := []struct {
+		name string
+		cost [][]float64
+		want []int
+	}{
+		{"empty", nil, nil},
+		{"single", [][]float64{{3}}, []int{0}},
+		{"greedy is wrong", [][]float64{{1, 2}, {2, 100}}, []int{1, 0}},
+		{"square", [][]float64{{4, 1, 3}, {2, 0, 5}, {3, 2, 2}}, []int{1, 0, 2}},
+		{"more columns", [][]float64{{5, 1, 9}, {5, 2, 9}}, []int{1, 0}},
+		{"more rows", [][]float64{{5, 5}, {1, 2}, {9, 9}}, []int{1, 0, -1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hungarian(tt.cost); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("hungarian() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// bruteForceAssignment tries every assignment of the smaller side and returns
+// the lowest total cost.
+func bruteForceAssignment(cost [][]float64) float64 {
+	rows, cols := len(cost), len(cost[0])
+	best := math.Inf(1)
+	used := make([]bool, cols)
+
+	var try func(row, assigned int, total float64)
+	try = func(row, assigned int, total float64) {
+		if assigned == min(rows, cols) {
+			best = math.Min(best, total)
+
+			return
+		}
+		if row == rows || rows-row < min(rows, cols)-assigned {
+			return
+		}
+		// Leave the row out, when there are more rows than columns
+		if rows > cols {
+			try(row+1, assigned, total)
+		}
+		for j := range cols {
+			if !used[j] {
+				used[j] = true
+				try(row+1, assigned+1, total+cost[row][j])
+				used[j] = false
+			}
+		}
+	}
+	try(0, 0, 0)
+
+	return best
+}
+
+func TestHungarianBruteForce(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+
+	for i := range 500 {
+		rows, cols := 1+random.Intn(6), 1+random.Intn(6)
+		cost := make([][]float64, rows)
+		for r := range cost {
+			cost[r] = make([]float64, cols)
+			for c := range cost[r] {
+				// Ties are common with IoU costs of 1
+				if random.Intn(4) == 0 {
+					cost[r][c] = 1
+				} else {
+					cost[r][c] = random.Float64()
+				}
+			}
+		}
+
+		assignment := hungarian(cost)
+		if len(assignment) != rows {
+			t.Fatalf("case %d: %d assignments for %d rows", i, len(assignment), rows)
+		}
+		seen := map[int]bool{}
+		total, assigned := 0.0, 0
+		for r, c := range assignment {
+			if c < 0 {
+				continue
+			}
+			if c >= cols || seen[c] {
+				t.Fatalf("case %d: invalid assignment %v", i, assignment)
+			}
+			seen[c] = true
+			total += cost[r][c]
+			assigned++
+		}
+
+		if assigned != min(rows, cols) {
+			t.Errorf("case %d: %d pairs assigned for a %dx%d matrix", i, assigned, rows, cols)
+		}
+		if want := bruteForceAssignment(cost); math.Abs(total-want) > 1e-9 {
+			t.Errorf("case %d: hungarian(%v) = %v costing %v, want %v", i, cost, assignment, total, want)
+		}
+	}
+}
+
+func TestInvert4(t *testing.T) {
+	tests := []struct {
+		name   string
+		m      [4][4]float64
+		wantOK bool
+	}{
+		{"identity", [4][4]float64{{1, 0, 0, 0}, {0, 1, 0, 0}, {0, 0, 1, 0}, {0, 0, 0, 1}}, true},
+		{"needs pivoting", [4][4]float64{{0, 2, 0, 0}, {3, 0, 0, 0}, {0, 0, 0, 4}, {0, 0, 5, 1}}, true},
+		{"dense", [4][4]float64{{4, 7, 2, 3}, {0, 5, 1, 8}, {6, 2, 9, 1}, {3, 3, 3, 7}}, true},
+		{"singular", [4][4]float64{{1, 2, 3, 4}, {2, 4, 6, 8}, {0, 1, 0, 1}, {1, 0, 1, 0}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inv, ok := invert4(tt.m)
+			if ok != tt.wantOK {
+				t.Fatalf("invert4() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			for i := range 4 {
+				for j := range 4 {
+					var sum float64
+					for k := range 4 {
+						sum += tt.m[i][k] * inv[k][j]
+					}
+					if want := map[bool]float64{true: 1, false: 0}[i == j]; math.Abs(sum-want) > 1e-9 {
+						t.Errorf("m * invert4(m) at (%d, %d) = %v, want %v", i, j, sum, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func box(x1, y1, x2, y2 float32) boundingBox {
+	return boundingBox{x1: x1, y1: y1, x2: x2, y2: y2, confidence: 0.9}
+}
+
+func TestKalmanBox(t *testing.T) {
+	tests := []struct {
+		name   string
+		dx, dy float32
+		grow   float32
+	}{
+		{"still", 0, 0, 0},
+		{"moving right", 10, 0, 0},
+		{"moving diagonally", -4, 6, 0},
+		{"approaching", 0, 0, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			at := func(frame int) boundingBox {
+				f, g := float32(frame), tt.grow*float32(frame)
+				return box(100+tt.dx*f-g, 100+tt.dy*f-g, 150+tt.dx*f+g, 200+tt.dy*f+g)
+			}
+
+			k := newKalmanBox(at(0))
+			if got := k.box(); math.Abs(float64(got.x1-100)) > 1e-3 || math.Abs(float64(got.y2-200)) > 1e-3 {
+				t.Fatalf("initial box = %v, want the measured one", got)
+			}
+
+			for frame := 1; frame <= 30; frame++ {
+				k.predict()
+				k.update(at(frame))
+			}
+
+			// Having learnt the motion, the prediction is the next position
+			got, want := k.predict(), at(31)
+			if iou := boxIoU(got, want); iou < 0.95 {
+				t.Errorf("predict() = %v, want about %v (IoU %v)", got, want, iou)
+			}
+		})
+	}
+}
+
+func TestKalmanBoxCoast(t *testing.T) {
+	k := newKalmanBox(box(0, 0, 10, 10))
+	// Shrinking fast, then no more measurements
+	for frame := 1; frame <= 5; frame++ {
+		k.predict()
+		k.update(box(float32(frame), float32(frame), 10-float32(frame), 10-float32(frame)))
+	}
+	for range 20 {
+		b := k.predict()
+		if b.x2 < b.x1 || b.y2 < b.y1 || math.IsNaN(float64(b.x1)) {
+			t.Fatalf("predict() = %v, want a valid box", b)
+		}
+	}
+}
+
+func TestTracker(t *testing.T) {
+	tr := newTracker(2, 2, 0.6)
+
+	ids := func(boxes []trackedBox) []int {
+		var result []int
+		for _, b := range boxes {
+			result = append(result, b.trackID)
+		}
+
+		return result
+	}
+
+	steps := []struct {
+		name       string
+		detections []boundingBox
+		want       []int
+	}{
+		{"two objects", []boundingBox{box(0, 0, 10, 10), box(100, 0, 110, 10)}, []int{1, 2}},
+		{"both move", []boundingBox{box(102, 0, 112, 10), box(2, 0, 12, 10)}, []int{1, 2}},
+		{"a new object is not confirmed yet", []boundingBox{box(4, 0, 14, 10), box(104, 0, 114, 10), box(50, 50, 60, 60)}, []int{1, 2}},
+		{"the new object is confirmed", []boundingBox{box(6, 0, 16, 10), box(106, 0, 116, 10), box(50, 50, 60, 60)}, []int{1, 2, 3}},
+		{"a low confidence detection extends a track", []boundingBox{box(8, 0, 18, 10), {x1: 108, x2: 118, y2: 10, confidence: 0.3}}, []int{1, 2}},
+		{"a low confidence detection doesn't start one", []boundingBox{{x1: 300, x2: 310, y2: 10, confidence: 0.3}}, nil},
+	}
+
+	for _, step := range steps {
+		if got := ids(tr.update(step.detections)); !reflect.DeepEqual(got, step.want) {
+			t.Errorf("%s: tracks %v, want %v", step.name, got, step.want)
+		}
+	}
+
+	// Track 3 was last seen 3 frames ago, more than the maximum age
+	tr.update(nil)
+	for _, track := range tr.tracks {
+		if track.id == 3 {
+			t.Errorf("track 3 still alive after %d frames unseen", track.sinceSeen)
+		}
+	}
+	if !reflect.DeepEqual(tr.dropped, []int{3}) {
+		t.Errorf("dropped = %v, want [3]", tr.dropped)
+	}
+
+	// Tracks 1 and 2 were seen a frame later, so they go next
+	tr.update(nil)
+	if !reflect.DeepEqual(tr.dropped, []int{1, 2}) {
+		t.Errorf("dropped = %v, want [1 2]", tr.dropped)
+	}
+}
@@ -0,0 +1,651 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// frameSource yields the frames of a video or image sequence in order. Next
+// returns io.EOF after the last frame.
+type frameSource interface {
+	Next() (image.Image, error)
+	Close() error
+}
+
+// openFrameSource picks the reader from the source: an http(s) URL is an
+// MJPEG stream, a directory holds sequential frames, and files are read as
+// Y4M or concatenated JPEGs depending on their extension.
+func openFrameSource(source string) (frameSource, error) {
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		return openMJPEGStream(source)
+	}
+
+	fi, err := os.Stat(source)
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s: %w", source, err)
+	}
+	if fi.IsDir() {
+		return openFrameDir(source)
+	}
+
+	f, err := os.Open(source)
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s: %w", source, err)
+	}
+
+	switch strings.ToLower(filepath.Ext(source)) {
+	case ".y4m":
+		return newY4MReader(f)
+	case ".mjpeg", ".mjpg":
+		return &mjpegReader{r: bufio.NewReader(f), c: f}, nil
+	}
+
+	if e := f.Close(); e != nil {
+		log.Printf("error closing %s: %s\n", source, e)
+	}
+
+	return nil, fmt.Errorf("unsupported frame source %s", source)
+}
+
+// frameDir reads image files from a directory in lexical order, so frames
+// should be named with zero-padded sequence numbers.
+type frameDir struct {
+	paths []string
+	next  int
+}
+
+func openFrameDir(dir string) (*frameDir, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", dir, err)
+	}
+
+	d := &frameDir{}
+	for _, e := range entries {
+		if !e.IsDir() && isImageFile(e.Name()) {
+			d.paths = append(d.paths, filepath.Join(dir, e.Name()))
+		}
+	}
+	sort.Strings(d.paths)
+
+	return d, nil
+}
+
+func isImageFile(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".jpg", ".jpeg", ".png":
+		return true
+	}
+
+	return false
+}
+
+func (d *frameDir) Next() (image.Image, error) {
+	if d.next >= len(d.paths) {
+		return nil, io.EOF
+	}
+	path := d.paths[d.next]
+	d.next++
+
+	return loadImageFile(path)
+}
+
+func (d *frameDir) Close() error {
+	return nil
+}
+
+// mjpegReader splits a stream of concatenated JPEG images. It walks the
+// marker segments instead of searching for the end-of-image bytes, which can
+// also appear inside embedded thumbnails.
+type mjpegReader struct {
+	r *bufio.Reader
+	c io.Closer
+}
+
+func (m *mjpegReader) Next() (image.Image, error) {
+	frame, err := readJPEGFrame(m.r)
+	if err != nil {
+		return nil, err
+	}
+
+	pic, err := jpeg.Decode(bytes.NewReader(frame))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding MJPEG frame: %w", err)
+	}
+
+	return pic, nil
+}
+
+func (m *mjpegReader) Close() error {
+	return m.c.Close()
+}
+
+// readJPEGFrame returns the bytes of the next JPEG image, skipping anything
+// before its start-of-image marker.
+func readJPEGFrame(r *bufio.Reader) ([]byte, error) {
+	var frame bytes.Buffer
+
+	// Find SOI
+	prev := byte(0)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if prev == 0xff && b == 0xd8 {
+			break
+		}
+		prev = b
+	}
+	frame.Write([]byte{0xff, 0xd8})
+
+	for {
+		marker, err := nextMarker(r, &frame)
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+
+		switch {
+		case marker == 0xd9:
+			return frame.Bytes(), nil
+		case marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7):
+			// Markers without a length
+			continue
+		}
+
+		var length [2]byte
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		frame.Write(length[:])
+		n := int(length[0])<<8 | int(length[1])
+		if n < 2 {
+			return nil, errors.New("invalid JPEG segment length")
+		}
+		if _, err := io.CopyN(&frame, r, int64(n-2)); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+
+		if marker == 0xda {
+			// Entropy coded data follows the scan header; copy it up to
+			// the next marker that isn't a stuffed 0xff00 or a restart.
+			if err := copyScan(r, &frame); err != nil {
+				return nil, unexpectedEOF(err)
+			}
+		}
+	}
+}
+
+// nextMarker reads a 0xff marker prefix, any fill bytes, and the marker code.
+func nextMarker(r *bufio.Reader, frame *bytes.Buffer) (byte, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if b != 0xff {
+		return 0, errors.New("missing JPEG marker")
+	}
+	for b == 0xff {
+		if b, err = r.ReadByte(); err != nil {
+			return 0, err
+		}
+	}
+	frame.Write([]byte{0xff, b})
+
+	return b, nil
+}
+
+func copyScan(r *bufio.Reader, frame *bytes.Buffer) error {
+	for {
+		next, err := r.Peek(2)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case next[0] != 0xff:
+			frame.WriteByte(next[0])
+			_, _ = r.Discard(1)
+		case next[1] == 0x00 || (next[1] >= 0xd0 && next[1] <= 0xd7):
+			frame.Write(next)
+			_, _ = r.Discard(2)
+		default:
+			// A real marker: leave it for nextMarker
+			return nil
+		}
+	}
+}
+
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
+
+// streamTimeout bounds connecting to a camera and waiting for its response
+// headers.
+const streamTimeout = 10 * time.Second
+
+// streamClient times out cameras that don't answer, but not the endless body
+// of a stream, which http.Client.Timeout would cut off.
+var streamClient = newStreamClient(streamTimeout)
+
+func newStreamClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           (&net.Dialer{Timeout: timeout}).DialContext,
+			TLSHandshakeTimeout:   timeout,
+			ResponseHeaderTimeout: timeout,
+		},
+	}
+}
+
+// mjpegStream reads a multipart/x-mixed-replace HTTP stream, as served by IP
+// cameras, one JPEG per part.
+type mjpegStream struct {
+	body   io.ReadCloser
+	mr     *multipart.Reader
+	cancel context.CancelFunc
+}
+
+func openMJPEGStream(url string) (*mjpegStream, error) {
+	// Cancelled by Close, which aborts a read blocked on a stalled camera
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		cancel()
+
+		return nil, fmt.Errorf("error opening stream: %w", err)
+	}
+
+	resp, err := streamClient.Do(req)
+	if err != nil {
+		cancel()
+
+		return nil, fmt.Errorf("error opening stream: %w", err)
+	}
+	fail := func(err error) (*mjpegStream, error) {
+		if e := resp.Body.Close(); e != nil {
+			log.Printf("error closing stream: %s\n", e)
+		}
+		cancel()
+
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fail(fmt.Errorf("error opening stream: %s", resp.Status))
+	}
+
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") || params["boundary"] == "" {
+		return fail(fmt.Errorf("%s is not a multipart MJPEG stream", url))
+	}
+
+	// Some cameras put the leading dashes into the boundary parameter
+	boundary := strings.TrimPrefix(params["boundary"], "--")
+
+	return &mjpegStream{body: resp.Body, mr: multipart.NewReader(resp.Body, boundary), cancel: cancel}, nil
+}
+
+func (s *mjpegStream) Next() (image.Image, error) {
+	part, err := s.mr.NextPart()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if e := part.Close(); e != nil {
+			log.Printf("error closing MJPEG part: %s\n", e)
+		}
+	}()
+
+	pic, err := jpeg.Decode(part)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding MJPEG frame: %w", err)
+	}
+
+	return pic, nil
+}
+
+func (s *mjpegStream) Close() error {
+	defer s.cancel()
+
+	return s.body.Close()
+}
+
+// y4mReader reads uncompressed YUV4MPEG2 video with 4:2:0, 4:2:2, 4:4:4 or
+// monochrome 8-bit frames.
+type y4mReader struct {
+	r             *bufio.Reader
+	c             io.Closer
+	width, height int
+	ratio         image.YCbCrSubsampleRatio
+	mono          bool
+}
+
+func newY4MReader(f *os.File) (*y4mReader, error) {
+	y := &y4mReader{r: bufio.NewReader(f), c: f, ratio: image.YCbCrSubsampleRatio420}
+
+	header, err := y.r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(header, "YUV4MPEG2 ") {
+		_ = f.Close()
+
+		return nil, errors.New("missing YUV4MPEG2 header")
+	}
+
+	for _, field := range strings.Fields(header)[1:] {
+		value := field[1:]
+		switch field[0] {
+		case 'W':
+			y.width, err = strconv.Atoi(value)
+		case 'H':
+			y.height, err = strconv.Atoi(value)
+		case 'C':
+			switch {
+			case strings.HasPrefix(value, "420"):
+				y.ratio = image.YCbCrSubsampleRatio420
+			case strings.HasPrefix(value, "422"):
+				y.ratio = image.YCbCrSubsampleRatio422
+			case strings.HasPrefix(value, "444") && !strings.HasPrefix(value, "444alpha"):
+				y.ratio = image.YCbCrSubsampleRatio444
+			case strings.HasPrefix(value, "mono"):
+				y.mono = true
+			default:
+				err = fmt.Errorf("unsupported colour space %s", value)
+			}
+		}
+		if err != nil {
+			_ = f.Close()
+
+			return nil, fmt.Errorf("invalid Y4M header field %s: %w", field, err)
+		}
+	}
+
+	if y.width <= 0 || y.height <= 0 {
+		_ = f.Close()
+
+		return nil, errors.New("missing Y4M frame size")
+	}
+
+	return y, nil
+}
+
+func (y *y4mReader) Next() (image.Image, error) {
+	line, err := y.r.ReadString('\n')
+	if err != nil {
+		if errors.Is(err, io.EOF) && line == "" {
+			return nil, io.EOF
+		}
+
+		return nil, unexpectedEOF(err)
+	}
+	if !strings.HasPrefix(line, "FRAME") {
+		return nil, errors.New("missing Y4M FRAME header")
+	}
+
+	rect := image.Rect(0, 0, y.width, y.height)
+	if y.mono {
+		pic := image.NewGray(rect)
+		if _, err := io.ReadFull(y.r, pic.Pix); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+
+		return pic, nil
+	}
+
+	pic := image.NewYCbCr(rect, y.ratio)
+	for _, plane := range [][]byte{pic.Y, pic.Cb, pic.Cr} {
+		if _, err := io.ReadFull(y.r, plane); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+	}
+
+	return pic, nil
+}
+
+func (y *y4mReader) Close() error {
+	return y.c.Close()
+}
+
+// trackRecord is one line of the NDJSON track log.
+type trackRecord struct {
+	Frame   int `json:"frame"`
+	TrackID int `json:"track_id"`
+	detection
+}
+
+func runTrack(args []string) int {
+	fs := flag.NewFlagSet("track", flag.ContinueOnError)
+	source := fs.String("source", "", "MJPEG URL or file, directory of frames, or .y4m file")
+	cfg := newSessionConfig(fs)
+	outDir := fs.String("out", "./frames", "directory for annotated frames, empty to skip them")
+	logPath := fs.String("log", "./tracks.ndjson", "path to the NDJSON track log")
+	maxAge := fs.Int("max-age", defaultTrackMaxAge, "frames a track survives without a matching detection")
+	minHits := fs.Int("min-hits", defaultTrackMinHits, "matches needed before a track is reported")
+	highThreshold := fs.Float64("high-thresh", defaultTrackHighThreshold, "confidence needed to start a track")
+	lowThreshold := fs.Float64("low-thresh", defaultTrackLowThreshold, "confidence needed to extend a track")
+	zonesPath := fs.String("zones", "", "JSON file with zones and counting lines")
+	render := newRenderOptions(fs)
+	eventsPath := fs.String("events", "", "path to the NDJSON zone event log, empty to only print events")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *source == "" {
+		fmt.Println("missing -source")
+
+		return 2
+	}
+	if *lowThreshold <= 0 || *lowThreshold > *highThreshold {
+		fmt.Printf("-low-thresh must be above 0 and at most -high-thresh %g, got %g\n", *highThreshold, *lowThreshold)
+
+		return 2
+	}
+	// The tracker sorts the detections into its two passes itself
+	cfg.confidence = float32(*lowThreshold)
+
+	var zones *zoneMonitor
+	if *zonesPath != "" {
+		zoneCfg, err := loadZones(*zonesPath)
+		if err != nil {
+			fmt.Printf("error loading zones: %s\n", err)
+
+			return 1
+		}
+		zones = newZoneMonitor(zoneCfg)
+		zones.minConfidence = defaultConfidenceThreshold
+	}
+
+	var events *json.Encoder
+	if *eventsPath != "" {
+		eventFile, err := os.Create(*eventsPath)
+		if err != nil {
+			fmt.Printf("error creating event log: %s\n", err)
+
+			return 1
+		}
+		defer func() {
+			if e := eventFile.Close(); e != nil {
+				log.Printf("error closing event log: %s\n", e)
+			}
+		}()
+		events = json.NewEncoder(eventFile)
+	}
+	report := func(evs []zoneEvent) error {
+		for _, ev := range evs {
+			log.Printf("frame %d: %s", ev.Frame, ev)
+			if events != nil {
+				if err := events.Encode(ev); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	}
+
+	frames, err := openFrameSource(*source)
+	if err != nil {
+		fmt.Printf("error opening frame source: %s\n", err)
+
+		return 1
+	}
+	defer func() {
+		if e := frames.Close(); e != nil {
+			log.Printf("error closing frame source: %s\n", e)
+		}
+	}()
+
+	if *outDir != "" {
+		if err := os.MkdirAll(*outDir, 0o755); err != nil {
+			fmt.Printf("error creating output directory: %s\n", err)
+
+			return 1
+		}
+	}
+
+	logFile, err := os.Create(*logPath)
+	if err != nil {
+		fmt.Printf("error creating track log: %s\n", err)
+
+		return 1
+	}
+	defer func() {
+		if e := logFile.Close(); e != nil {
+			log.Printf("error closing track log: %s\n", e)
+		}
+	}()
+	logWriter := bufio.NewWriter(logFile)
+	enc := json.NewEncoder(logWriter)
+
+	modelSession, err := initSession(cfg)
+	if err != nil {
+		fmt.Printf("error creating session and tensors: %s\n", err)
+
+		return 1
+	}
+	defer modelSession.Destroy()
+
+	t := newTracker(*maxAge, *minHits, float32(*highThreshold))
+	firstClass := map[int]string{}
+
+	frame := 0
+	for {
+		pic, err := frames.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			fmt.Printf("error reading frame %d: %s\n", frame+1, err)
+
+			return 1
+		}
+		frame++
+
+		boxes, err := modelSession.Detect(pic)
+		if err != nil {
+			fmt.Printf("error running detection on frame %d: %s\n", frame, err)
+
+			return 1
+		}
+
+		if zones != nil {
+			var alerts []zoneEvent
+			boxes, alerts = zones.observe(frame, boxes)
+			if err := report(alerts); err != nil {
+				fmt.Printf("error writing event log: %s\n", err)
+
+				return 1
+			}
+		}
+
+		tracked := t.update(boxes)
+		if zones != nil {
+			if err := report(zones.cross(frame, tracked)); err != nil {
+				fmt.Printf("error writing event log: %s\n", err)
+
+				return 1
+			}
+			zones.forget(t.dropped)
+		}
+
+		labelled := make([]boundingBox, 0, len(tracked))
+		for _, tb := range tracked {
+			if _, ok := firstClass[tb.trackID]; !ok {
+				firstClass[tb.trackID] = tb.label
+			}
+
+			d := toDetections([]boundingBox{tb.boundingBox})[0]
+			if err := enc.Encode(trackRecord{Frame: frame, TrackID: tb.trackID, detection: d}); err != nil {
+				fmt.Printf("error writing track log: %s\n", err)
+
+				return 1
+			}
+
+			b := tb.boundingBox
+			b.label = fmt.Sprintf("#%d %s", tb.trackID, b.label)
+			labelled = append(labelled, b)
+		}
+
+		if *outDir != "" {
+			path := filepath.Join(*outDir, fmt.Sprintf("frame_%06d.jpg", frame))
+			canvas := pic
+			if zones != nil {
+				canvas = zones.render(pic)
+			}
+			if err := drawBoxes(canvas, path, labelled, render); err != nil {
+				fmt.Printf("error writing annotated frame: %s\n", err)
+
+				return 1
+			}
+		}
+	}
+
+	if err := logWriter.Flush(); err != nil {
+		fmt.Printf("error writing track log: %s\n", err)
+
+		return 1
+	}
+
+	// Every track is counted once, under the class it was first reported as
+	counts := map[string]int{}
+	for _, label := range firstClass {
+		counts[label]++
+	}
+	labels := make([]string, 0, len(counts))
+	for label := range counts {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	fmt.Printf("Processed %d frames, %d tracks\n", frame, len(firstClass))
+	for _, label := range labels {
+		fmt.Printf("  %s: %d\n", label, counts[label])
+	}
+	if zones != nil {
+		zones.printCounts()
+	}
+
+	return 0
+}
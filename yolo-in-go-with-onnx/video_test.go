@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestReadJPEGFrame(t *testing.T) {
+	first, second := encodedJPEG(t, 16, 8), encodedJPEG(t, 8, 16)
+	// An APP1 segment holding a thumbnail, with its own end-of-image marker
+	thumbnail := encodedJPEG(t, 2, 2)
+	n := len(thumbnail) + 2
+	withThumbnail := concat(first[:2], []byte{0xff, 0xe1, byte(n >> 8), byte(n)}, thumbnail, first[2:])
+	// A scan with stuffed bytes, a restart marker and fill bytes
+	scan := []byte{0xff, 0xd8, 0xff, 0xda, 0x00, 0x02, 0x12, 0xff, 0x00, 0x34, 0xff, 0xd3, 0x56, 0xff, 0xff, 0xd9}
+
+	tests := []struct {
+		name    string
+		stream  []byte
+		want    [][]byte
+		wantErr error
+	}{
+		{"empty", nil, nil, io.EOF},
+		{"concatenated frames", concat(first, second), [][]byte{first, second}, io.EOF},
+		{"garbage before a frame", concat([]byte("--boundary\r\n\r\n"), first), [][]byte{first}, io.EOF},
+		{"embedded thumbnail", withThumbnail, [][]byte{withThumbnail}, io.EOF},
+		{"scan data", scan, [][]byte{concat(scan[:len(scan)-3], []byte{0xff, 0xd9})}, io.EOF},
+		{"truncated in a scan", first[:len(first)-10], nil, io.ErrUnexpectedEOF},
+		{"truncated in a segment", first[:8], nil, io.ErrUnexpectedEOF},
+		{"truncated after the start", first[:2], nil, io.ErrUnexpectedEOF},
+		{"missing marker", []byte{0xff, 0xd8, 0x00, 0x01}, nil, errors.New("missing JPEG marker")},
+		{"invalid segment length", []byte{0xff, 0xd8, 0xff, 0xe0, 0x00, 0x01}, nil, errors.New("invalid JPEG segment length")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(bytes.NewReader(tt.stream))
+			for i, want := range tt.want {
+				got, err := readJPEGFrame(r)
+				if err != nil {
+					t.Fatalf("frame %d: %v", i, err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Fatalf("frame %d = % x, want % x", i, got, want)
+				}
+			}
+
+			_, err := readJPEGFrame(r)
+			if err == nil || err.Error() != tt.wantErr.Error() {
+				t.Errorf("readJPEGFrame() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCopyScan(t *testing.T) {
+	tests := []struct {
+		name     string
+		in       []byte
+		want     []byte
+		wantRest []byte
+		wantErr  bool
+	}{
+		{"up to a marker", []byte{0x12, 0xff, 0x00, 0xff, 0xd3, 0x34, 0xff, 0xd9}, []byte{0x12, 0xff, 0x00, 0xff, 0xd3, 0x34}, []byte{0xff, 0xd9}, false},
+		{"marker first", []byte{0xff, 0xc4, 0x00}, nil, []byte{0xff, 0xc4, 0x00}, false},
+		{"no marker", []byte{0x12, 0x34}, []byte{0x12}, []byte{0x34}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(bytes.NewReader(tt.in))
+			var frame bytes.Buffer
+
+			err := copyScan(r, &frame)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("copyScan() error = %v, want error %v", err, tt.wantErr)
+			}
+			if !bytes.Equal(frame.Bytes(), tt.want) {
+				t.Errorf("copied % x, want % x", frame.Bytes(), tt.want)
+			}
+			if rest, _ := io.ReadAll(r); !bytes.Equal(rest, tt.wantRest) {
+				t.Errorf("left % x, want % x", rest, tt.wantRest)
+			}
+		})
+	}
+}
+
+// writeTemp writes data to a file in a temporary directory and opens it.
+func writeTemp(t *testing.T, name string, data []byte) *os.File {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return f
+}
+
+func TestY4MReader(t *testing.T) {
+	// 4x2 frames: 8 luma bytes, then the chroma planes
+	frame := func(chroma int) string {
+		return "FRAME\n" + strings.Repeat("Y", 8) + strings.Repeat("U", chroma) + strings.Repeat("V", chroma)
+	}
+
+	tests := []struct {
+		name       string
+		data       string
+		wantFrames int
+		wantType   string
+		wantErr    string
+	}{
+		{"420", "YUV4MPEG2 W4 H2 F25:1 Ip C420jpeg\n" + frame(2) + frame(2), 2, "*image.YCbCr YCbCrSubsampleRatio420", "EOF"},
+		{"default 420", "YUV4MPEG2 W4 H2\n" + frame(2), 1, "*image.YCbCr YCbCrSubsampleRatio420", "EOF"},
+		{"422", "YUV4MPEG2 W4 H2 C422\n" + frame(4), 1, "*image.YCbCr YCbCrSubsampleRatio422", "EOF"},
+		{"444", "YUV4MPEG2 W4 H2 C444\n" + frame(8), 1, "*image.YCbCr YCbCrSubsampleRatio444", "EOF"},
+		{"mono", "YUV4MPEG2 W4 H2 Cmono\nFRAME\n" + strings.Repeat("Y", 8), 1, "*image.Gray", "EOF"},
+		{"frame parameters", "YUV4MPEG2 W4 H2\nFRAME Ixyz" + frame(2)[5:], 1, "*image.YCbCr YCbCrSubsampleRatio420", "EOF"},
+		{"truncated frame", "YUV4MPEG2 W4 H2\n" + frame(2)[:10], 0, "", "unexpected EOF"},
+		{"truncated frame header", "YUV4MPEG2 W4 H2\nFRA", 0, "", "unexpected EOF"},
+		{"missing frame header", "YUV4MPEG2 W4 H2\nJUNK\n", 0, "", "missing Y4M FRAME header"},
+		{"missing header", "RIFF", 0, "", "missing YUV4MPEG2 header"},
+		{"missing size", "YUV4MPEG2 W4\n", 0, "", "missing Y4M frame size"},
+		{"invalid size", "YUV4MPEG2 Wfour H2\n", 0, "", `invalid Y4M header field Wfour: strconv.Atoi: parsing "four": invalid syntax`},
+		{"unsupported colour space", "YUV4MPEG2 W4 H2 C411\n", 0, "", "invalid Y4M header field C411: unsupported colour space 411"},
+		{"alpha", "YUV4MPEG2 W4 H2 C444alpha\n", 0, "", "invalid Y4M header field C444alpha: unsupported colour space 444alpha"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			y, err := newY4MReader(writeTemp(t, "video.y4m", []byte(tt.data)))
+			if err != nil {
+				if err.Error() != tt.wantErr {
+					t.Errorf("newY4MReader() error = %v, want %s", err, tt.wantErr)
+				}
+
+				return
+			}
+			defer func() {
+				if e := y.Close(); e != nil {
+					t.Error(e)
+				}
+			}()
+
+			for i := 0; i < tt.wantFrames; i++ {
+				pic, err := y.Next()
+				if err != nil {
+					t.Fatalf("frame %d: %v", i, err)
+				}
+				got := fmt.Sprintf("%T", pic)
+				if ycbcr, ok := pic.(*image.YCbCr); ok {
+					got += " " + ycbcr.SubsampleRatio.String()
+					if ycbcr.Y[0] != 'Y' || ycbcr.Cb[0] != 'U' || ycbcr.Cr[len(ycbcr.Cr)-1] != 'V' {
+						t.Errorf("frame %d planes misread", i)
+					}
+				}
+				if got != tt.wantType || pic.Bounds() != image.Rect(0, 0, 4, 2) {
+					t.Errorf("frame %d = %s %v, want %s 4x2", i, got, pic.Bounds(), tt.wantType)
+				}
+			}
+
+			if _, err := y.Next(); err == nil || err.Error() != tt.wantErr {
+				t.Errorf("Next() error = %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMJPEGStream(t *testing.T) {
+	frame := encodedJPEG(t, 16, 8)
+	block := make(chan struct{})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stream", func(w http.ResponseWriter, _ *http.Request) {
+		mw := multipart.NewWriter(w)
+		// The leading dashes some cameras add to the parameter
+		w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary=--"+mw.Boundary())
+		for range 2 {
+			part, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"image/jpeg"}})
+			if err != nil {
+				return
+			}
+			_, _ = part.Write(frame)
+		}
+		_ = mw.Close()
+	})
+	mux.HandleFunc("/page", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("<html></html>"))
+	})
+	mux.HandleFunc("/stalled", func(http.ResponseWriter, *http.Request) {
+		<-block
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	// Unblock the stalled handler before the server waits for it
+	defer close(block)
+
+	defer func(c *http.Client) { streamClient = c }(streamClient)
+	streamClient = newStreamClient(50 * time.Millisecond)
+
+	tests := []struct {
+		path       string
+		wantFrames int
+		wantErr    string
+	}{
+		{"/stream", 2, ""},
+		{"/missing", 0, "error opening stream: 404 Not Found"},
+		{"/page", 0, "is not a multipart MJPEG stream"},
+		{"/stalled", 0, "timeout awaiting response headers"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			s, err := openMJPEGStream(server.URL + tt.path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("openMJPEGStream() error = %v, want %s", err, tt.wantErr)
+				}
+
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				if e := s.Close(); e != nil {
+					t.Error(e)
+				}
+			}()
+
+			for i := 0; i < tt.wantFrames; i++ {
+				pic, err := s.Next()
+				if err != nil {
+					t.Fatalf("frame %d: %v", i, err)
+				}
+				if pic.Bounds() != image.Rect(0, 0, 16, 8) {
+					t.Errorf("frame %d bounds = %v, want 16x8", i, pic.Bounds())
+				}
+			}
+			if _, err := s.Next(); !errors.Is(err, io.EOF) {
+				t.Errorf("Next() after the last frame = %v, want EOF", err)
+			}
+		})
+	}
+}
+
+func TestMJPEGReader(t *testing.T) {
+	frame := encodedJPEG(t, 16, 8)
+	data := concat(frame, frame)
+	m := &mjpegReader{r: bufio.NewReader(bytes.NewReader(data)), c: io.NopCloser(nil)}
+
+	for i := range 2 {
+		pic, err := m.Next()
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if _, ok := pic.(*image.YCbCr); !ok {
+			t.Errorf("frame %d = %T, want a decoded JPEG", i, pic)
+		}
+	}
+	if _, err := m.Next(); !errors.Is(err, io.EOF) {
+		t.Errorf("Next() after the last frame = %v, want EOF", err)
+	}
+
+	// A frame whose markers are fine but whose content isn't a JPEG
+	m = &mjpegReader{r: bufio.NewReader(bytes.NewReader([]byte{0xff, 0xd8, 0xff, 0xd9})), c: io.NopCloser(nil)}
+	if _, err := m.Next(); err == nil || errors.Is(err, io.EOF) {
+		t.Errorf("Next() on an empty frame = %v, want a decoding error", err)
+	}
+}
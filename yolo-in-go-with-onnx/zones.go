@@ -0,0 +1,383 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/fogleman/gg"
+)
+
+const (
+	anchorBottom = "bottom"
+	anchorCenter = "center"
+)
+
+// zoneConfig is the zones file: polygons to count detections in and lines to
+// count tracks crossing.
+type zoneConfig struct {
+	// Anchor is the point of a box tested against zones and lines, the
+	// bottom center (feet on the floor) by default
+	Anchor string `json:"anchor,omitempty"`
+	// Filter drops detections outside every zone
+	Filter bool        `json:"filter,omitempty"`
+	Zones  []zone      `json:"zones"`
+	Lines  []countLine `json:"lines"`
+}
+
+type zone struct {
+	Name    string       `json:"name"`
+	Polygon [][2]float64 `json:"polygon"`
+	// Classes limits the zone to these labels, all classes when empty
+	Classes []string   `json:"classes,omitempty"`
+	Alert   *zoneAlert `json:"alert,omitempty"`
+}
+
+// zoneAlert fires when at least MinCount detections of the given classes are
+// inside the zone.
+type zoneAlert struct {
+	Classes  []string `json:"classes"`
+	MinCount int      `json:"min_count,omitempty"`
+}
+
+type countLine struct {
+	Name    string     `json:"name"`
+	From    [2]float64 `json:"from"`
+	To      [2]float64 `json:"to"`
+	Classes []string   `json:"classes,omitempty"`
+}
+
+func loadZones(path string) (*zoneConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading zones: %w", err)
+	}
+
+	cfg := &zoneConfig{}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("error parsing zones: %w", err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid zones in %s: %w", path, err)
+	}
+
+	return cfg, nil
+}
+
+func (c *zoneConfig) validate() error {
+	switch c.Anchor {
+	case "":
+		c.Anchor = anchorBottom
+	case anchorBottom, anchorCenter:
+	default:
+		return fmt.Errorf("unknown anchor %q, use bottom or center", c.Anchor)
+	}
+
+	names := map[string]bool{}
+	for i := range c.Zones {
+		z := &c.Zones[i]
+		if z.Name == "" || names[z.Name] {
+			return fmt.Errorf("zone %d needs a unique name", i)
+		}
+		names[z.Name] = true
+		if len(z.Polygon) < 3 {
+			return fmt.Errorf("zone %q needs at least 3 points", z.Name)
+		}
+		if z.Alert != nil && z.Alert.MinCount < 1 {
+			z.Alert.MinCount = 1
+		}
+	}
+	for i, l := range c.Lines {
+		if l.Name == "" || names[l.Name] {
+			return fmt.Errorf("line %d needs a unique name", i)
+		}
+		names[l.Name] = true
+		if l.From == l.To {
+			return fmt.Errorf("line %q has the same start and end", l.Name)
+		}
+	}
+	if len(c.Zones) == 0 && len(c.Lines) == 0 {
+		return errors.New("no zones or lines defined")
+	}
+
+	return nil
+}
+
+func (c *zoneConfig) anchor(b *boundingBox) [2]float64 {
+	x := float64(b.x1+b.x2) / 2
+	if c.Anchor == anchorCenter {
+		return [2]float64{x, float64(b.y1+b.y2) / 2}
+	}
+
+	return [2]float64{x, float64(b.y2)}
+}
+
+// matchesClass reports whether label passes a class list, an empty list
+// matches everything.
+func matchesClass(classes []string, label string) bool {
+	return len(classes) == 0 || slices.Contains(classes, label)
+}
+
+// contains tests the point against the polygon with the even-odd rule.
+func (z *zone) contains(p [2]float64) bool {
+	inside := false
+	n := len(z.Polygon)
+	for i, j := 0, n-1; i < n; j, i = i, i+1 {
+		a, b := z.Polygon[i], z.Polygon[j]
+		if (a[1] > p[1]) != (b[1] > p[1]) &&
+			p[0] < (b[0]-a[0])*(p[1]-a[1])/(b[1]-a[1])+a[0] {
+			inside = !inside
+		}
+	}
+
+	return inside
+}
+
+// side returns the sign of the point relative to the line: positive on the
+// right when looking from From to To (image y axis points down).
+func (l *countLine) side(p [2]float64) float64 {
+	return (l.To[0]-l.From[0])*(p[1]-l.From[1]) - (l.To[1]-l.From[1])*(p[0]-l.From[0])
+}
+
+// crossed reports whether the move from a to b crosses the line segment and
+// in which direction. A point on the line counts as being on its right.
+func (l *countLine) crossed(a, b [2]float64) (string, bool) {
+	sa, sb := l.side(a), l.side(b)
+	if (sa >= 0) == (sb >= 0) {
+		return "", false
+	}
+
+	// The move must also separate the line's end points, otherwise it passes
+	// beside the segment
+	move := countLine{From: a, To: b}
+	if sf, st := move.side(l.From), move.side(l.To); sf != 0 && st != 0 && (sf > 0) == (st > 0) {
+		return "", false
+	}
+
+	if sa < 0 {
+		return "in", true
+	}
+
+	return "out", true
+}
+
+// zoneEvent is a line crossing or an alert change, logged as one NDJSON line.
+type zoneEvent struct {
+	Frame     int    `json:"frame,omitempty"`
+	Type      string `json:"type"`
+	Name      string `json:"name"`
+	TrackID   int    `json:"track_id,omitempty"`
+	Class     string `json:"class,omitempty"`
+	Direction string `json:"direction,omitempty"`
+	Count     int    `json:"count,omitempty"`
+}
+
+func (e zoneEvent) String() string {
+	switch e.Type {
+	case "crossing":
+		return fmt.Sprintf("#%d %s crossed %q (%s)", e.TrackID, e.Class, e.Name, e.Direction)
+	case "alert":
+		return fmt.Sprintf("ALERT: %d in %q", e.Count, e.Name)
+	default:
+		return fmt.Sprintf("cleared: %q", e.Name)
+	}
+}
+
+// zoneMonitor keeps the per-zone counts of the last frame, the line totals
+// and the positions tracks were last seen at.
+type zoneMonitor struct {
+	cfg      *zoneConfig
+	counts   []map[string]int
+	alerting []bool
+	crossing []map[string]map[string]int
+	last     map[int][2]float64
+	// minConfidence is the confidence a box needs to be counted, for the
+	// weak detections the tracker gets
+	minConfidence float32
+}
+
+func newZoneMonitor(cfg *zoneConfig) *zoneMonitor {
+	m := &zoneMonitor{
+		cfg:      cfg,
+		counts:   make([]map[string]int, len(cfg.Zones)),
+		alerting: make([]bool, len(cfg.Zones)),
+		crossing: make([]map[string]map[string]int, len(cfg.Lines)),
+		last:     map[int][2]float64{},
+	}
+	for i := range m.crossing {
+		m.crossing[i] = map[string]map[string]int{"in": {}, "out": {}}
+	}
+
+	return m
+}
+
+// observe counts the boxes per zone and class and returns the alerts that
+// started or cleared. With filtering on, only the boxes inside a zone are
+// kept, the ones below minConfidence included.
+func (m *zoneMonitor) observe(frame int, boxes []boundingBox) ([]boundingBox, []zoneEvent) {
+	kept := make([]boundingBox, 0, len(boxes))
+	for i := range m.counts {
+		m.counts[i] = map[string]int{}
+	}
+
+	for _, b := range boxes {
+		p := m.cfg.anchor(&b)
+		inside := false
+		for i, z := range m.cfg.Zones {
+			if matchesClass(z.Classes, b.label) && z.contains(p) {
+				if b.confidence >= m.minConfidence {
+					m.counts[i][b.label]++
+				}
+				inside = true
+			}
+		}
+		if inside || !m.cfg.Filter {
+			kept = append(kept, b)
+		}
+	}
+
+	var events []zoneEvent
+	for i, z := range m.cfg.Zones {
+		if z.Alert == nil {
+			continue
+		}
+
+		n := 0
+		for label, count := range m.counts[i] {
+			if matchesClass(z.Alert.Classes, label) {
+				n += count
+			}
+		}
+
+		active := n >= z.Alert.MinCount
+		if active != m.alerting[i] {
+			m.alerting[i] = active
+			e := zoneEvent{Frame: frame, Type: "cleared", Name: z.Name}
+			if active {
+				e.Type, e.Count = "alert", n
+			}
+			events = append(events, e)
+		}
+	}
+
+	return kept, events
+}
+
+// cross moves the tracks to their new anchors and reports the lines they
+// crossed on the way.
+func (m *zoneMonitor) cross(frame int, tracked []trackedBox) []zoneEvent {
+	var events []zoneEvent
+	for _, tb := range tracked {
+		p := m.cfg.anchor(&tb.boundingBox)
+		prev, ok := m.last[tb.trackID]
+		m.last[tb.trackID] = p
+		if !ok {
+			continue
+		}
+
+		for i, l := range m.cfg.Lines {
+			if !matchesClass(l.Classes, tb.label) {
+				continue
+			}
+			if dir, ok := l.crossed(prev, p); ok {
+				m.crossing[i][dir][tb.label]++
+				events = append(events, zoneEvent{
+					Frame: frame, Type: "crossing", Name: l.Name, TrackID: tb.trackID, Class: tb.label, Direction: dir,
+				})
+			}
+		}
+	}
+
+	return events
+}
+
+// forget drops the positions of tracks that ended, so that a long video
+// doesn't keep every track it ever saw.
+func (m *zoneMonitor) forget(trackIDs []int) {
+	for _, id := range trackIDs {
+		delete(m.last, id)
+	}
+}
+
+// printCounts writes the per-class counts of every zone and line.
+func (m *zoneMonitor) printCounts() {
+	for i, z := range m.cfg.Zones {
+		fmt.Printf("Zone %q: %s\n", z.Name, formatCounts(m.counts[i]))
+	}
+	for i, l := range m.cfg.Lines {
+		fmt.Printf("Line %q: in %s, out %s\n", l.Name, formatCounts(m.crossing[i]["in"]), formatCounts(m.crossing[i]["out"]))
+	}
+}
+
+func formatCounts(counts map[string]int) string {
+	if len(counts) == 0 {
+		return "0"
+	}
+
+	labels := make([]string, 0, len(counts))
+	for label := range counts {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	parts := make([]string, 0, len(labels))
+	for _, label := range labels {
+		parts = append(parts, fmt.Sprintf("%d %s", counts[label], label))
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+func sumCounts(counts map[string]int) int {
+	n := 0
+	for _, c := range counts {
+		n += c
+	}
+
+	return n
+}
+
+// render draws the zones, tinted red while alerting, and the counting lines
+// with their totals.
+func (m *zoneMonitor) render(img image.Image) image.Image {
+	dc := gg.NewContextForImage(img)
+	dc.SetLineWidth(2)
+	// gg keeps its built-in bitmap face when the font isn't installed
+	_ = dc.LoadFontFace(fontPath, 14)
+
+	for i, z := range m.cfg.Zones {
+		c := color.NRGBA{G: 200, B: 255, A: 255}
+		if m.alerting[i] {
+			c = color.NRGBA{R: 255, A: 255}
+		}
+
+		for _, p := range z.Polygon {
+			dc.LineTo(p[0], p[1])
+		}
+		dc.ClosePath()
+		dc.SetColor(color.NRGBA{R: c.R, G: c.G, B: c.B, A: 48})
+		dc.FillPreserve()
+		dc.SetColor(c)
+		dc.Stroke()
+
+		label := fmt.Sprintf("%s: %d", z.Name, sumCounts(m.counts[i]))
+		dc.DrawStringAnchored(label, z.Polygon[0][0]+4, z.Polygon[0][1]+4, 0, 1)
+	}
+
+	dc.SetColor(color.NRGBA{R: 255, G: 200, A: 255})
+	for i, l := range m.cfg.Lines {
+		dc.DrawLine(l.From[0], l.From[1], l.To[0], l.To[1])
+		dc.Stroke()
+
+		label := fmt.Sprintf("%s: in %d, out %d", l.Name, sumCounts(m.crossing[i]["in"]), sumCounts(m.crossing[i]["out"]))
+		dc.DrawStringAnchored(label, l.From[0]+4, l.From[1]-4, 0, 0)
+	}
+
+	return dc.Image()
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestZoneContains(t *testing.T) {
+	// An L shape, so the notch at (15, 5) is outside
+	z := zone{Polygon: [][2]float64{{0, 0}, {10, 0}, {10, 10}, {20, 10}, {20, 20}, {0, 20}}}
+
+	tests := []struct {
+		name  string
+		point [2]float64
+		want  bool
+	}{
+		{name: "inside", point: [2]float64{5, 5}, want: true},
+		{name: "inside the foot", point: [2]float64{15, 15}, want: true},
+		{name: "notch", point: [2]float64{15, 5}, want: false},
+		{name: "left of the polygon", point: [2]float64{-1, 5}, want: false},
+		{name: "below the polygon", point: [2]float64{5, 25}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := z.contains(tt.point); got != tt.want {
+				t.Errorf("contains(%v) = %v, want %v", tt.point, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCountLineCrossed(t *testing.T) {
+	// Horizontal line pointing right, its right side is below it
+	l := countLine{From: [2]float64{0, 100}, To: [2]float64{100, 100}}
+
+	tests := []struct {
+		name    string
+		a, b    [2]float64
+		wantDir string
+		wantOK  bool
+	}{
+		{name: "downwards", a: [2]float64{50, 90}, b: [2]float64{50, 110}, wantDir: "in", wantOK: true},
+		{name: "upwards", a: [2]float64{50, 110}, b: [2]float64{50, 90}, wantDir: "out", wantOK: true},
+		{name: "onto the line", a: [2]float64{50, 90}, b: [2]float64{50, 100}, wantDir: "in", wantOK: true},
+		{name: "away from the line", a: [2]float64{50, 100}, b: [2]float64{50, 110}},
+		{name: "same side", a: [2]float64{50, 80}, b: [2]float64{60, 90}},
+		{name: "beside the segment", a: [2]float64{150, 90}, b: [2]float64{150, 110}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, ok := l.crossed(tt.a, tt.b)
+			if dir != tt.wantDir || ok != tt.wantOK {
+				t.Errorf("crossed(%v, %v) = %q, %v, want %q, %v", tt.a, tt.b, dir, ok, tt.wantDir, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestZoneMonitor(t *testing.T) {
+	cfg := &zoneConfig{
+		Filter: true,
+		Zones: []zone{{
+			Name:    "forklift area",
+			Polygon: [][2]float64{{0, 0}, {100, 0}, {100, 100}, {0, 100}},
+			Alert:   &zoneAlert{Classes: []string{"person"}},
+		}},
+		Lines: []countLine{{Name: "door", From: [2]float64{200, 0}, To: [2]float64{200, 100}}},
+	}
+	if err := cfg.validate(); err != nil {
+		t.Fatalf("validate() error = %v", err)
+	}
+	m := newZoneMonitor(cfg)
+
+	person := boundingBox{label: "person", x1: 40, y1: 40, x2: 60, y2: 80}
+	outside := boundingBox{label: "person", x1: 140, y1: 40, x2: 160, y2: 80}
+
+	kept, events := m.observe(1, []boundingBox{person, outside})
+	if !reflect.DeepEqual(kept, []boundingBox{person}) {
+		t.Errorf("observe() kept = %v, want only the box inside the zone", kept)
+	}
+	wantEvents := []zoneEvent{{Frame: 1, Type: "alert", Name: "forklift area", Count: 1}}
+	if !reflect.DeepEqual(events, wantEvents) {
+		t.Errorf("observe() events = %v, want %v", events, wantEvents)
+	}
+
+	// Still alerting, nothing new to report
+	if _, events := m.observe(2, []boundingBox{person}); len(events) != 0 {
+		t.Errorf("observe() events = %v, want none", events)
+	}
+
+	_, events = m.observe(3, nil)
+	wantEvents = []zoneEvent{{Frame: 3, Type: "cleared", Name: "forklift area"}}
+	if !reflect.DeepEqual(events, wantEvents) {
+		t.Errorf("observe() events = %v, want %v", events, wantEvents)
+	}
+
+	// The door line points down, so moving right crosses it from its right
+	// side to its left
+	m.cross(4, []trackedBox{{boundingBox: outside, trackID: 7}})
+	moved := outside
+	moved.x1, moved.x2 = 240, 260
+	events = m.cross(5, []trackedBox{{boundingBox: moved, trackID: 7}})
+	wantEvents = []zoneEvent{{Frame: 5, Type: "crossing", Name: "door", TrackID: 7, Class: "person", Direction: "out"}}
+	if !reflect.DeepEqual(events, wantEvents) {
+		t.Errorf("cross() events = %v, want %v", events, wantEvents)
+	}
+
+	// Once the tracker drops the track its position goes, and a reused ID
+	// starts afresh rather than crossing back
+	m.forget([]int{7})
+	if _, ok := m.last[7]; ok {
+		t.Errorf("forget() kept the position of track 7")
+	}
+	if events := m.cross(6, []trackedBox{{boundingBox: outside, trackID: 7}}); len(events) != 0 {
+		t.Errorf("cross() events = %v after forget(), want none", events)
+	}
+}
+
+func TestZoneMonitorMinConfidence(t *testing.T) {
+	cfg := &zoneConfig{
+		Filter: true,
+		Zones: []zone{{
+			Name:    "forklift area",
+			Polygon: [][2]float64{{0, 0}, {100, 0}, {100, 100}, {0, 100}},
+			Alert:   &zoneAlert{Classes: []string{"person"}},
+		}},
+	}
+	if err := cfg.validate(); err != nil {
+		t.Fatalf("validate() error = %v", err)
+	}
+	m := newZoneMonitor(cfg)
+	m.minConfidence = 0.5
+
+	// A weak box goes on to the tracker but raises no alert
+	weak := boundingBox{label: "person", confidence: 0.2, x1: 40, y1: 40, x2: 60, y2: 80}
+	kept, events := m.observe(1, []boundingBox{weak})
+	if !reflect.DeepEqual(kept, []boundingBox{weak}) || len(events) != 0 {
+		t.Errorf("observe() = %v, %v, want the weak box kept and no events", kept, events)
+	}
+
+	strong := weak
+	strong.confidence = 0.8
+	if _, events := m.observe(2, []boundingBox{weak, strong}); len(events) != 1 || events[0].Count != 1 {
+		t.Errorf("observe() events = %v, want an alert counting the strong box only", events)
+	}
+}
@@ -0,0 +1,540 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/flashlabs/kiss-samples/yolo-in-go-with-python/detect"
+)
+
+// imageExtensions are the files picked up from directories
+var imageExtensions = map[string]bool{".jpg": true, ".jpeg": true, ".png": true, ".webp": true, ".bmp": true}
+
+type bulkConfig struct {
+	concurrency int
+	output      string
+	format      string
+	checkpoint  string
+	retryPasses int
+	retryDelay  time.Duration
+	progress    time.Duration
+}
+
+// runBulk runs the detection on every image of the given directories and
+// glob patterns and writes the detections to a JSONL or CSV file.
+func runBulk(args []string) int {
+	fs := flag.NewFlagSet("bulk", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: go run . bulk [flags] <directory|glob>...")
+		fs.PrintDefaults()
+	}
+	detectorCfg := newDetectorConfig(fs)
+	cfg := &bulkConfig{}
+	fs.IntVar(&cfg.concurrency, "concurrency", 4, "images uploaded at once")
+	fs.StringVar(&cfg.output, "output", "detections.jsonl", "results file, JSONL or CSV")
+	fs.StringVar(&cfg.format, "format", "", "jsonl or csv, by default from the output extension")
+	fs.StringVar(&cfg.checkpoint, "checkpoint", "", "checkpoint file to resume from, by default the output with .checkpoint")
+	fs.IntVar(&cfg.retryPasses, "retry-passes", 1, "passes over the failed images after the first one")
+	fs.DurationVar(&cfg.retryDelay, "retry-delay", 10*time.Second, "wait before each retry pass")
+	fs.DurationVar(&cfg.progress, "progress", 10*time.Second, "interval of the progress log, 0 disables it")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if err := cfg.validate(); err != nil {
+		log.Println("Invalid flags:", err)
+
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+
+		return 2
+	}
+
+	paths, err := listImages(fs.Args())
+	if err != nil {
+		log.Println("Error listing images:", err)
+
+		return 1
+	}
+
+	detector, err := detectorCfg.newDetector()
+	if err != nil {
+		log.Println("Error creating detector:", err)
+
+		return 2
+	}
+	defer func() {
+		if e := detector.Close(); e != nil {
+			log.Println("Failed to close detector", e)
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	summary, err := runBulkJob(ctx, detector, cfg, paths)
+	if err != nil {
+		log.Println("Error:", err)
+
+		return 1
+	}
+	summary.print(os.Stdout)
+
+	switch {
+	case ctx.Err() != nil:
+		log.Printf("Interrupted, run the same command again to resume from %s", cfg.checkpoint)
+
+		return 130
+	case len(summary.failures) > 0:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func (c *bulkConfig) validate() error {
+	if c.concurrency < 1 {
+		return errors.New("-concurrency must be at least 1")
+	}
+	if c.format == "" {
+		c.format = "jsonl"
+		if strings.EqualFold(filepath.Ext(c.output), ".csv") {
+			c.format = "csv"
+		}
+	}
+	if c.format != "jsonl" && c.format != "csv" {
+		return fmt.Errorf("unknown format %q, use jsonl or csv", c.format)
+	}
+	if c.checkpoint == "" {
+		c.checkpoint = c.output + ".checkpoint"
+	}
+
+	return nil
+}
+
+// listImages expands directories (recursively) and glob patterns into a
+// sorted list of image files.
+func listImages(patterns []string) ([]string, error) {
+	seen := map[string]bool{}
+	var paths []string
+	add := func(path string) {
+		if path = filepath.Clean(path); !seen[path] {
+			seen[path] = true
+			paths = append(paths, path)
+		}
+	}
+
+	for _, pattern := range patterns {
+		if info, err := os.Stat(pattern); err == nil && info.IsDir() {
+			err := filepath.WalkDir(pattern, func(path string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if !d.IsDir() && imageExtensions[strings.ToLower(filepath.Ext(path))] {
+					add(path)
+				}
+
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("%q matches no file", pattern)
+		}
+		for _, m := range matches {
+			if info, err := os.Stat(m); err == nil && !info.IsDir() {
+				add(m)
+			}
+		}
+	}
+	slices.Sort(paths)
+
+	return paths, nil
+}
+
+// checkpointRecord is a line of the checkpoint file, written after the
+// results of an image. Offset is the size of the output file with them, so
+// a resumed run drops anything written after the last record.
+type checkpointRecord struct {
+	Path   string         `json:"path"`
+	Offset int64          `json:"offset"`
+	Counts map[string]int `json:"counts,omitempty"`
+}
+
+// loadCheckpoint reads the images already done, the output offset and the
+// size of the valid records. A missing file is an empty checkpoint, a torn
+// last line from a crash is ignored.
+func loadCheckpoint(path string) (map[string]checkpointRecord, int64, int64, error) {
+	done := map[string]checkpointRecord{}
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return done, 0, 0, nil
+	}
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer func() {
+		if e := file.Close(); e != nil {
+			log.Println("Failed to close checkpoint", e)
+		}
+	}()
+
+	var offset, size int64
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return done, offset, size, nil
+		}
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		var rec checkpointRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return done, offset, size, nil
+		}
+		done[rec.Path] = rec
+		offset = rec.Offset
+		size += int64(len(line))
+	}
+}
+
+type bulkFailure struct {
+	path string
+	err  error
+}
+
+type classCount struct {
+	name       string
+	images     int
+	detections int
+}
+
+type bulkSummary struct {
+	total     int
+	resumed   int
+	succeeded int
+	counts    map[string]*classCount
+	failures  []bulkFailure
+	elapsed   time.Duration
+}
+
+func (s *bulkSummary) count(perClass map[string]int) {
+	for name, n := range perClass {
+		c, ok := s.counts[name]
+		if !ok {
+			c = &classCount{name: name}
+			s.counts[name] = c
+		}
+		c.images++
+		c.detections += n
+	}
+}
+
+// bulkJob processes the images and writes the output and the checkpoint,
+// from a single goroutine.
+type bulkJob struct {
+	detector detect.Detector
+	cfg      *bulkConfig
+	output   *os.File
+	offset   int64
+	csv      bool
+	ckpt     *os.File
+	summary  *bulkSummary
+}
+
+// runBulkJob processes the images not in the checkpoint, then retries the
+// failed ones. Cancelling the context stops it, the checkpoint allows to
+// resume.
+func runBulkJob(ctx context.Context, d detect.Detector, cfg *bulkConfig, paths []string) (*bulkSummary, error) {
+	start := time.Now()
+	done, offset, size, err := loadCheckpoint(cfg.checkpoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint: %w", err)
+	}
+
+	// Results written after the last checkpoint record are dropped, they
+	// are processed again
+	output, err := os.OpenFile(cfg.output, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open output: %w", err)
+	}
+	defer func() {
+		if e := output.Close(); e != nil {
+			log.Println("Failed to close output", e)
+		}
+	}()
+	if err := output.Truncate(offset); err != nil {
+		return nil, fmt.Errorf("failed to truncate output: %w", err)
+	}
+	if _, err := output.Seek(offset, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to seek output: %w", err)
+	}
+
+	ckpt, err := os.OpenFile(cfg.checkpoint, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open checkpoint: %w", err)
+	}
+	defer func() {
+		if e := ckpt.Close(); e != nil {
+			log.Println("Failed to close checkpoint", e)
+		}
+	}()
+	if err := ckpt.Truncate(size); err != nil {
+		return nil, fmt.Errorf("failed to truncate checkpoint: %w", err)
+	}
+
+	job := &bulkJob{
+		detector: d,
+		cfg:      cfg,
+		output:   output,
+		offset:   offset,
+		csv:      cfg.format == "csv",
+		ckpt:     ckpt,
+		summary:  &bulkSummary{total: len(paths), counts: map[string]*classCount{}},
+	}
+
+	var pending []string
+	for _, path := range paths {
+		if rec, ok := done[path]; ok {
+			job.summary.resumed++
+			job.summary.count(rec.Counts)
+		} else {
+			pending = append(pending, path)
+		}
+	}
+	if job.summary.resumed > 0 {
+		log.Printf("Resuming from %s: %d of %d images already done", cfg.checkpoint, job.summary.resumed, len(paths))
+	}
+
+	for pass := 0; len(pending) > 0 && ctx.Err() == nil; pass++ {
+		if pass > 0 {
+			log.Printf("Retrying %d failed images in %s", len(pending), cfg.retryDelay)
+			select {
+			case <-ctx.Done():
+				continue
+			case <-time.After(cfg.retryDelay):
+			}
+		}
+
+		failures, err := job.pass(ctx, pending)
+		if err != nil {
+			return nil, err
+		}
+		job.summary.failures = failures
+		if pass >= cfg.retryPasses {
+			break
+		}
+		pending = pending[:0]
+		for _, f := range failures {
+			pending = append(pending, f.path)
+		}
+	}
+	job.summary.elapsed = time.Since(start)
+
+	return job.summary, nil
+}
+
+// pass sends the images with bounded concurrency and returns the failed ones.
+// Images cancelled by the context are neither done nor failed.
+func (j *bulkJob) pass(ctx context.Context, paths []string) ([]bulkFailure, error) {
+	type result struct {
+		path       string
+		detections []detect.Detection
+		err        error
+	}
+
+	jobs := make(chan string)
+	results := make(chan result)
+	var wg sync.WaitGroup
+	for range j.cfg.concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range jobs {
+				detections, err := j.detect(ctx, path)
+				results <- result{path, detections, err}
+			}
+		}()
+	}
+	go func() {
+		// Once cancelled, only the images in flight are waited for
+		defer close(jobs)
+		for _, path := range paths {
+			select {
+			case <-ctx.Done():
+				return
+			case jobs <- path:
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var ticker <-chan time.Time
+	if j.cfg.progress > 0 {
+		t := time.NewTicker(j.cfg.progress)
+		defer t.Stop()
+		ticker = t.C
+	}
+
+	var failures []bulkFailure
+	var writeErr error
+	for {
+		select {
+		case <-ticker:
+			log.Printf("Processed %d/%d images, %d failed", j.summary.resumed+j.summary.succeeded, j.summary.total, len(failures))
+		case res, ok := <-results:
+			if !ok {
+				return failures, writeErr
+			}
+			switch {
+			case writeErr != nil:
+				// Drain the workers after a write error
+			case res.err != nil && ctx.Err() != nil:
+				// Interrupted, not a failure
+			case res.err != nil:
+				log.Printf("Failed %s: %s", res.path, res.err)
+				failures = append(failures, bulkFailure{res.path, res.err})
+			default:
+				writeErr = j.write(res.path, res.detections)
+			}
+		}
+	}
+}
+
+func (j *bulkJob) detect(ctx context.Context, path string) ([]detect.Detection, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if e := file.Close(); e != nil {
+			log.Println("Failed to close file", e)
+		}
+	}()
+
+	return j.detector.Detect(ctx, file, filepath.Base(path))
+}
+
+// write appends the results of an image to the output, then records it in
+// the checkpoint.
+func (j *bulkJob) write(path string, detections []detect.Detection) error {
+	var buf bytes.Buffer
+	if j.csv {
+		w := csv.NewWriter(&buf)
+		if j.offset == 0 {
+			_ = w.Write([]string{"path", "class", "name", "confidence", "xmin", "ymin", "xmax", "ymax"})
+		}
+		for _, d := range detections {
+			_ = w.Write([]string{path, strconv.Itoa(d.Class), d.Name, formatFloat(d.Confidence),
+				formatFloat(d.XMin), formatFloat(d.YMin), formatFloat(d.XMax), formatFloat(d.YMax)})
+		}
+		w.Flush()
+	} else {
+		if detections == nil {
+			detections = []detect.Detection{}
+		}
+		line, err := json.Marshal(struct {
+			Path       string             `json:"path"`
+			Detections []detect.Detection `json:"detections"`
+		}{path, detections})
+		if err != nil {
+			return err
+		}
+		buf.Write(append(line, '\n'))
+	}
+
+	n, err := j.output.Write(buf.Bytes())
+	j.offset += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write output: %w", err)
+	}
+
+	counts := map[string]int{}
+	for _, d := range detections {
+		counts[d.Name]++
+	}
+	rec, err := json.Marshal(checkpointRecord{Path: path, Offset: j.offset, Counts: counts})
+	if err != nil {
+		return err
+	}
+	if _, err := j.ckpt.Write(append(rec, '\n')); err != nil {
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+
+	j.summary.succeeded++
+	j.summary.count(counts)
+
+	return nil
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// print writes the class counts and the failed images.
+func (s *bulkSummary) print(out io.Writer) {
+	fmt.Fprintf(out, "%d images: %d done now, %d in earlier runs, %d failed, in %s\n",
+		s.total, s.succeeded, s.resumed, len(s.failures), s.elapsed.Round(time.Second))
+
+	counts := make([]*classCount, 0, len(s.counts))
+	for _, c := range s.counts {
+		counts = append(counts, c)
+	}
+	slices.SortFunc(counts, func(a, b *classCount) int {
+		return cmp.Or(b.detections-a.detections, strings.Compare(a.name, b.name))
+	})
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CLASS\tIMAGES\tDETECTIONS")
+	for _, c := range counts {
+		fmt.Fprintf(w, "%s\t%d\t%d\n", c.name, c.images, c.detections)
+	}
+	if err := w.Flush(); err != nil {
+		log.Println("Failed to print summary", err)
+	}
+
+	if len(s.failures) > 0 {
+		fmt.Fprintln(out, "Failed images:")
+		for _, f := range s.failures {
+			fmt.Fprintf(out, "  %s: %s\n", f.path, f.err)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/flashlabs/kiss-samples/yolo-in-go-with-python/yoloclient"
+)
+
+// stubDetector answers with a cup per image, failing the images of fail
+// the given number of times.
+type stubDetector struct {
+	mu       sync.Mutex
+	fail     map[string]int
+	calls    map[string]int
+	inFlight atomic.Int32
+	maxSeen  atomic.Int32
+	delay    time.Duration
+	onDetect func(filename string)
+}
+
+func (s *stubDetector) Detect(ctx context.Context, r io.Reader, filename string) ([]yoloclient.Detection, error) {
+	n := s.inFlight.Add(1)
+	defer s.inFlight.Add(-1)
+	for {
+		m := s.maxSeen.Load()
+		if n <= m || s.maxSeen.CompareAndSwap(m, n) {
+			break
+		}
+	}
+	if s.onDetect != nil {
+		s.onDetect(filename)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if _, err := io.ReadAll(r); err != nil {
+		return nil, err
+	}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(s.delay):
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.calls == nil {
+		s.calls = map[string]int{}
+	}
+	s.calls[filename]++
+	if s.fail[filename] >= s.calls[filename] {
+		return nil, yoloclient.ErrServer
+	}
+
+	return []yoloclient.Detection{
+		{XMin: 1, YMin: 2, XMax: 3, YMax: 4, Confidence: 0.9, Class: 41, Name: "cup"},
+		{XMin: 5, YMin: 6, XMax: 7, YMax: 8, Confidence: 0.5, Class: 0, Name: filename},
+	}, nil
+}
+
+func writeImages(t *testing.T, dir string, names ...string) []string {
+	t.Helper()
+
+	var paths []string
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+
+	return paths
+}
+
+func readLines(t *testing.T, path string) []string {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func outputPaths(t *testing.T, path string) []string {
+	t.Helper()
+
+	var paths []string
+	for _, line := range readLines(t, path) {
+		var res struct {
+			Path       string                 `json:"path"`
+			Detections []yoloclient.Detection `json:"detections"`
+		}
+		if err := json.Unmarshal([]byte(line), &res); err != nil {
+			t.Fatalf("invalid line %q: %v", line, err)
+		}
+		paths = append(paths, res.Path)
+	}
+	slices.Sort(paths)
+
+	return paths
+}
+
+func testBulkConfig(t *testing.T, output string) *bulkConfig {
+	t.Helper()
+
+	cfg := &bulkConfig{concurrency: 3, output: filepath.Join(t.TempDir(), output), retryPasses: 1}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	return cfg
+}
+
+func TestListImages(t *testing.T) {
+	dir := t.TempDir()
+	writeImages(t, dir, "a.jpg", "b.PNG", "notes.txt", "sub/c.webp", "sub/deep/d.jpeg", "other/e.jpg")
+
+	tests := []struct {
+		name     string
+		patterns []string
+		want     []string
+		wantErr  bool
+	}{
+		{"directory", []string{filepath.Join(dir, "sub")}, []string{"sub/c.webp", "sub/deep/d.jpeg"}, false},
+		{"glob", []string{filepath.Join(dir, "*.jpg")}, []string{"a.jpg"}, false},
+		{"duplicates", []string{dir, filepath.Join(dir, "*.jpg")}, []string{"a.jpg", "b.PNG", "other/e.jpg", "sub/c.webp", "sub/deep/d.jpeg"}, false},
+		{"no match", []string{filepath.Join(dir, "*.gif")}, nil, true},
+		{"invalid pattern", []string{filepath.Join(dir, "[")}, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := listImages(tt.patterns)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("listImages() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			for i := range got {
+				got[i], _ = filepath.Rel(dir, got[i])
+				got[i] = filepath.ToSlash(got[i])
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("listImages() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBulkJob(t *testing.T) {
+	paths := writeImages(t, t.TempDir(), "a.jpg", "b.jpg", "c.jpg", "d.jpg", "e.jpg", "f.jpg", "g.jpg")
+	cfg := testBulkConfig(t, "out.jsonl")
+	detector := &stubDetector{delay: 10 * time.Millisecond}
+
+	summary, err := runBulkJob(context.Background(), detector, cfg, paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := outputPaths(t, cfg.output); !slices.Equal(got, paths) {
+		t.Errorf("output paths = %v, want %v", got, paths)
+	}
+	if got := detector.maxSeen.Load(); got > int32(cfg.concurrency) {
+		t.Errorf("concurrent uploads = %d, want at most %d", got, cfg.concurrency)
+	}
+	if summary.succeeded != len(paths) || len(summary.failures) != 0 {
+		t.Errorf("succeeded = %d, failures = %v, want %d and none", summary.succeeded, summary.failures, len(paths))
+	}
+	if c := summary.counts["cup"]; c == nil || c.images != len(paths) || c.detections != len(paths) {
+		t.Errorf("cup count = %+v, want %d images", c, len(paths))
+	}
+	if c := summary.counts["a.jpg"]; c == nil || c.images != 1 {
+		t.Errorf("a.jpg count = %+v, want 1 image", c)
+	}
+}
+
+func TestBulkJobCSV(t *testing.T) {
+	paths := writeImages(t, t.TempDir(), "a.jpg", "b.jpg")
+	cfg := testBulkConfig(t, "out.csv")
+	if cfg.format != "csv" {
+		t.Fatalf("format = %q, want csv", cfg.format)
+	}
+
+	if _, err := runBulkJob(context.Background(), &stubDetector{}, cfg, paths); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := readLines(t, cfg.output)
+	if want := "path,class,name,confidence,xmin,ymin,xmax,ymax"; lines[0] != want {
+		t.Errorf("header = %q, want %q", lines[0], want)
+	}
+	if len(lines) != 1+2*len(paths) {
+		t.Errorf("got %d lines, want %d", len(lines), 1+2*len(paths))
+	}
+	if want := paths[0] + ",41,cup,0.9,1,2,3,4"; !slices.Contains(lines, want) {
+		t.Errorf("output %q has no line %q", lines, want)
+	}
+}
+
+func TestBulkJobRetry(t *testing.T) {
+	paths := writeImages(t, t.TempDir(), "ok.jpg", "flaky.jpg", "broken.jpg")
+	cfg := testBulkConfig(t, "out.jsonl")
+	detector := &stubDetector{fail: map[string]int{"flaky.jpg": 1, "broken.jpg": 10}}
+
+	summary, err := runBulkJob(context.Background(), detector, cfg, paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := outputPaths(t, cfg.output), []string{paths[1], paths[0]}; !slices.Equal(got, want) {
+		t.Errorf("output paths = %v, want %v", got, want)
+	}
+	if len(summary.failures) != 1 || summary.failures[0].path != paths[2] || !errors.Is(summary.failures[0].err, yoloclient.ErrServer) {
+		t.Errorf("failures = %v, want %s with ErrServer", summary.failures, paths[2])
+	}
+	if got := detector.calls["broken.jpg"]; got != 1+cfg.retryPasses {
+		t.Errorf("broken.jpg sent %d times, want %d", got, 1+cfg.retryPasses)
+	}
+}
+
+func TestBulkJobResume(t *testing.T) {
+	paths := writeImages(t, t.TempDir(), "a.jpg", "b.jpg", "c.jpg", "d.jpg", "e.jpg", "f.jpg")
+	cfg := testBulkConfig(t, "out.jsonl")
+	cfg.concurrency = 1
+
+	// The first run is interrupted during the third image
+	ctx, cancel := context.WithCancel(context.Background())
+	detector := &stubDetector{onDetect: func(filename string) {
+		if filename == "c.jpg" {
+			cancel()
+		}
+	}}
+	summary, err := runBulkJob(ctx, detector, cfg, paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.succeeded != 2 || len(summary.failures) != 0 {
+		t.Fatalf("succeeded = %d, failures = %v, want 2 and none", summary.succeeded, summary.failures)
+	}
+
+	// A crash between the output and the checkpoint leaves a result that
+	// isn't in the checkpoint, and a torn checkpoint line
+	f, err := os.OpenFile(cfg.output, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.WriteString(`{"path":"` + paths[2] + `","detections":[]}` + "\n")
+	_ = f.Close()
+	f, err = os.OpenFile(cfg.checkpoint, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.WriteString(`{"path":"` + paths[2])
+	_ = f.Close()
+
+	detector = &stubDetector{}
+	summary, err = runBulkJob(context.Background(), detector, cfg, paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if summary.resumed != 2 || summary.succeeded != 4 {
+		t.Errorf("resumed = %d, succeeded = %d, want 2 and 4", summary.resumed, summary.succeeded)
+	}
+	if detector.calls["a.jpg"] != 0 || detector.calls["c.jpg"] != 1 {
+		t.Errorf("calls = %v, want none for a.jpg and one for c.jpg", detector.calls)
+	}
+	if got := outputPaths(t, cfg.output); !slices.Equal(got, paths) {
+		t.Errorf("output paths = %v, want each of %v once", got, paths)
+	}
+	if c := summary.counts["cup"]; c == nil || c.images != len(paths) {
+		t.Errorf("cup count = %+v, want %d images including the resumed ones", c, len(paths))
+	}
+
+	// The checkpoint now covers every image, without the torn line
+	if got := readLines(t, cfg.checkpoint); len(got) != len(paths) {
+		t.Errorf("checkpoint has %d lines, want %d", len(got), len(paths))
+	}
+	done, _, _, err := loadCheckpoint(cfg.checkpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(done) != len(paths) {
+		t.Errorf("checkpoint has %d images, want %d", len(done), len(paths))
+	}
+}
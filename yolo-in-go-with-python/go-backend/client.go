@@ -0,0 +1,143 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/flashlabs/kiss-samples/yolo-in-go-with-python/detect"
+	"github.com/flashlabs/kiss-samples/yolo-in-go-with-python/yoloclient"
+)
+
+const (
+	backendPython = "python"
+	backendONNX   = "onnx"
+)
+
+// clientConfig holds the flags of the API client, shared by all modes.
+type clientConfig struct {
+	apiURLs        string
+	timeout        time.Duration
+	retries        int
+	balancing      string
+	healthInterval time.Duration
+	hedge          float64
+}
+
+func newClientConfig(fs *flag.FlagSet) *clientConfig {
+	cfg := &clientConfig{}
+	fs.StringVar(&cfg.apiURLs, "api", yoloAPIURL, "comma-separated base URLs of the YOLO API replicas")
+	fs.DurationVar(&cfg.timeout, "timeout", 30*time.Second, "timeout of a single attempt")
+	fs.IntVar(&cfg.retries, "retries", 2, "retries after server or connection errors")
+	fs.StringVar(&cfg.balancing, "balancing", "round-robin", "replica selection: round-robin or least-outstanding")
+	fs.DurationVar(&cfg.healthInterval, "health-interval", 0, "interval of the replica health checks, 0 disables them")
+	fs.Float64Var(&cfg.hedge, "hedge", 0, "latency percentile after which a request is hedged to another replica, 0 disables hedging")
+
+	return cfg
+}
+
+// newClient creates the client, which must be closed.
+func (c *clientConfig) newClient() (*yoloclient.Client, error) {
+	opts := []yoloclient.Option{
+		yoloclient.WithTimeout(c.timeout),
+		yoloclient.WithRetries(c.retries),
+		yoloclient.WithHealthCheck(c.healthInterval),
+		yoloclient.WithHedging(c.hedge),
+	}
+	switch c.balancing {
+	case "round-robin":
+		opts = append(opts, yoloclient.WithBalancing(yoloclient.RoundRobin))
+	case "least-outstanding":
+		opts = append(opts, yoloclient.WithBalancing(yoloclient.LeastOutstanding))
+	default:
+		return nil, fmt.Errorf("unknown balancing %q, use round-robin or least-outstanding", c.balancing)
+	}
+
+	return yoloclient.NewBalanced(strings.Split(c.apiURLs, ","), opts...)
+}
+
+// onnxConfig holds the flags of the in-process ONNX detector.
+type onnxConfig struct {
+	model      string
+	library    string
+	sessions   int
+	confidence float64
+}
+
+func newONNXConfig(fs *flag.FlagSet) *onnxConfig {
+	library := os.Getenv("ONNXRUNTIME_SHARED_LIBRARY_PATH")
+	if library == "" {
+		library = ortLibraryPath
+	}
+
+	cfg := &onnxConfig{}
+	fs.StringVar(&cfg.model, "model", onnxModelPath, "YOLOv5 or YOLOv8 model exported to ONNX")
+	fs.StringVar(&cfg.library, "ort-lib", library, "ONNX Runtime shared library, ONNXRUNTIME_SHARED_LIBRARY_PATH overrides the default")
+	fs.IntVar(&cfg.sessions, "sessions", 1, "ONNX sessions, the number of images run at once")
+	fs.Float64Var(&cfg.confidence, "conf", detect.DefaultConfidence, "minimum confidence of an ONNX detection")
+
+	return cfg
+}
+
+// newDetector loads the model, which must be closed.
+func (c *onnxConfig) newDetector() (*detect.ONNX, error) {
+	return detect.NewONNX(c.model,
+		detect.WithSharedLibrary(c.library),
+		detect.WithSessions(c.sessions),
+		detect.WithThresholds(c.confidence, detect.DefaultIoU),
+	)
+}
+
+// detectorConfig selects where the model runs: in the Python API or in the
+// process with ONNX Runtime.
+type detectorConfig struct {
+	backend string
+	client  *clientConfig
+	onnx    *onnxConfig
+}
+
+func newDetectorConfig(fs *flag.FlagSet) *detectorConfig {
+	cfg := &detectorConfig{client: newClientConfig(fs), onnx: newONNXConfig(fs)}
+	fs.StringVar(&cfg.backend, "backend", backendPython, "where the model runs: python (the API) or onnx (in the process)")
+
+	return cfg
+}
+
+// closingDetector is a detector holding resources until it is closed.
+type closingDetector interface {
+	detect.Detector
+	Close() error
+}
+
+// newDetector creates the detector of the backend, which must be closed.
+func (c *detectorConfig) newDetector() (closingDetector, error) {
+	switch c.backend {
+	case backendPython:
+		client, err := c.client.newClient()
+		if err != nil {
+			return nil, err
+		}
+
+		return client, nil
+	case backendONNX:
+		onnx, err := c.onnx.newDetector()
+		if err != nil {
+			return nil, err
+		}
+
+		return onnx, nil
+	default:
+		return nil, fmt.Errorf("unknown backend %q, use python or onnx", c.backend)
+	}
+}
+
+// String describes where the detector runs.
+func (c *detectorConfig) String() string {
+	if c.backend == backendONNX {
+		return c.onnx.model
+	}
+
+	return c.client.apiURLs
+}
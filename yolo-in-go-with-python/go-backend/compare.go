@@ -0,0 +1,293 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/flashlabs/kiss-samples/yolo-in-go-with-python/detect"
+)
+
+// runCompare runs the Python API and the ONNX model on the same images and
+// reports how much their boxes agree and how fast each one is.
+func runCompare(args []string) int {
+	fs := flag.NewFlagSet("compare", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: go run . compare [flags] <directory|glob>...")
+		fs.PrintDefaults()
+	}
+	clientCfg := newClientConfig(fs)
+	onnxCfg := newONNXConfig(fs)
+	cfg := &compareConfig{}
+	fs.Float64Var(&cfg.minIoU, "match-iou", 0.5, "IoU from which boxes of the same class match")
+	fs.IntVar(&cfg.warmup, "warmup", 1, "images run before measuring, to load the models")
+	fs.BoolVar(&cfg.verbose, "v", false, "print the boxes of every image")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+
+		return 2
+	}
+
+	paths, err := listImages(fs.Args())
+	if err != nil {
+		log.Println("Error listing images:", err)
+
+		return 1
+	}
+
+	client, err := clientCfg.newClient()
+	if err != nil {
+		log.Println("Error creating client:", err)
+
+		return 2
+	}
+	defer func() {
+		if e := client.Close(); e != nil {
+			log.Println("Failed to close client", e)
+		}
+	}()
+
+	onnx, err := onnxCfg.newDetector()
+	if err != nil {
+		log.Println("Error loading model:", err)
+
+		return 2
+	}
+	defer func() {
+		if e := onnx.Close(); e != nil {
+			log.Println("Failed to close model", e)
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	cfg.out = os.Stdout
+	c := compareDetectors(ctx, client, onnx, paths, cfg)
+	fmt.Printf("Compared %s (python) with %s (onnx) on %d images\n\n", clientCfg.apiURLs, onnxCfg.model, c.images)
+	c.print(os.Stdout, cfg.minIoU)
+
+	if ctx.Err() != nil || len(c.failures) > 0 {
+		return 1
+	}
+
+	return 0
+}
+
+type compareConfig struct {
+	minIoU  float64
+	warmup  int
+	verbose bool
+	out     io.Writer
+}
+
+// agreement counts the boxes of the reference, of the candidate, and the
+// matched ones.
+type agreement struct {
+	reference, candidate, matched int
+}
+
+func (a agreement) recall() float64 {
+	return ratio(a.matched, a.reference)
+}
+
+func (a agreement) precision() float64 {
+	return ratio(a.matched, a.candidate)
+}
+
+// f1 is the share of the boxes of both detectors that matched.
+func (a agreement) f1() float64 {
+	return ratio(2*a.matched, a.reference+a.candidate)
+}
+
+func ratio(a, b int) float64 {
+	if b == 0 {
+		return 1
+	}
+
+	return float64(a) / float64(b)
+}
+
+type comparison struct {
+	images   int
+	failures []bulkFailure
+	agreement
+	classes map[string]*agreement
+	// sums over the matched boxes
+	iou, confidenceDelta float64
+	latency              map[string][]time.Duration
+}
+
+// compareDetectors runs the reference (the Python API) and the candidate
+// (ONNX) one after the other on every image, matching their boxes by IoU.
+func compareDetectors(ctx context.Context, reference, candidate detect.Detector, paths []string, cfg *compareConfig) *comparison {
+	c := &comparison{classes: map[string]*agreement{}, latency: map[string][]time.Duration{}}
+	run := func(name string, d detect.Detector, path string) ([]detect.Detection, error) {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			if e := file.Close(); e != nil {
+				log.Println("Failed to close file", e)
+			}
+		}()
+
+		start := time.Now()
+		detections, err := d.Detect(ctx, file, filepath.Base(path))
+		c.latency[name] = append(c.latency[name], time.Since(start))
+
+		return detections, err
+	}
+
+	for i, path := range paths {
+		if ctx.Err() != nil {
+			break
+		}
+
+		ref, err := run(backendPython, reference, path)
+		if err != nil {
+			c.failures = append(c.failures, bulkFailure{path, fmt.Errorf("python: %w", err)})
+
+			continue
+		}
+		cand, err := run(backendONNX, candidate, path)
+		if err != nil {
+			c.failures = append(c.failures, bulkFailure{path, fmt.Errorf("onnx: %w", err)})
+
+			continue
+		}
+		if i < cfg.warmup {
+			// The first runs load the models, they don't count
+			clear(c.latency)
+		}
+		c.add(path, ref, cand, cfg)
+	}
+
+	return c
+}
+
+func (c *comparison) add(path string, ref, cand []detect.Detection, cfg *compareConfig) {
+	c.images++
+	m := detect.Match(ref, cand, cfg.minIoU)
+
+	class := func(name string) *agreement {
+		a, ok := c.classes[name]
+		if !ok {
+			a = &agreement{}
+			c.classes[name] = a
+		}
+
+		return a
+	}
+	for _, d := range ref {
+		class(d.Name).reference++
+	}
+	for _, d := range cand {
+		class(d.Name).candidate++
+	}
+	for _, p := range m.Pairs {
+		class(ref[p.Reference].Name).matched++
+		c.iou += p.IoU
+		c.confidenceDelta += cand[p.Candidate].Confidence - ref[p.Reference].Confidence
+	}
+	c.reference += len(ref)
+	c.candidate += len(cand)
+	c.matched += len(m.Pairs)
+
+	if cfg.verbose {
+		fmt.Fprintf(cfg.out, "%s: %d python, %d onnx, %d matched\n", path, len(ref), len(cand), len(m.Pairs))
+		for _, i := range m.UnmatchedReference {
+			fmt.Fprintf(cfg.out, "  only python: %s\n", describe(ref[i]))
+		}
+		for _, j := range m.UnmatchedCandidate {
+			fmt.Fprintf(cfg.out, "  only onnx:   %s\n", describe(cand[j]))
+		}
+	}
+}
+
+func describe(d detect.Detection) string {
+	return fmt.Sprintf("%-12s %.2f (%.0f, %.0f, %.0f, %.0f)", d.Name, d.Confidence, d.XMin, d.YMin, d.XMax, d.YMax)
+}
+
+// percentile of sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	return sorted[int(p*float64(len(sorted)-1))]
+}
+
+// print writes the latencies, the agreement overall and per class, and the
+// failed images.
+func (c *comparison) print(out io.Writer, minIoU float64) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "BACKEND\tMEAN\tP50\tP95\tMAX")
+	for _, name := range []string{backendPython, backendONNX} {
+		latency := slices.Sorted(slices.Values(c.latency[name]))
+		var sum time.Duration
+		for _, l := range latency {
+			sum += l
+		}
+		mean := time.Duration(0)
+		if len(latency) > 0 {
+			mean = sum / time.Duration(len(latency))
+		}
+		round := func(d time.Duration) time.Duration { return d.Round(100 * time.Microsecond) }
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", name, round(mean), round(percentile(latency, 0.5)),
+			round(percentile(latency, 0.95)), round(percentile(latency, 1)))
+	}
+	if err := w.Flush(); err != nil {
+		log.Println("Failed to print comparison", err)
+	}
+
+	fmt.Fprintf(out, "\nBoxes: %d python, %d onnx, %d matched with an IoU of %.2f or more\n",
+		c.reference, c.candidate, c.matched, minIoU)
+	fmt.Fprintf(out, "Recall %.1f%%, precision %.1f%%, F1 %.1f%% of the onnx boxes against the python ones\n",
+		100*c.recall(), 100*c.precision(), 100*c.f1())
+	if c.matched > 0 {
+		fmt.Fprintf(out, "Matched boxes: mean IoU %.3f, mean confidence difference %+.3f\n",
+			c.iou/float64(c.matched), c.confidenceDelta/float64(c.matched))
+	}
+
+	names := make([]string, 0, len(c.classes))
+	for name := range c.classes {
+		names = append(names, name)
+	}
+	slices.SortFunc(names, func(a, b string) int {
+		return cmp.Or(c.classes[b].reference-c.classes[a].reference, strings.Compare(a, b))
+	})
+
+	fmt.Fprintln(out)
+	w = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CLASS\tPYTHON\tONNX\tMATCHED\tF1")
+	for _, name := range names {
+		a := c.classes[name]
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%.1f%%\n", name, a.reference, a.candidate, a.matched, 100*a.f1())
+	}
+	if err := w.Flush(); err != nil {
+		log.Println("Failed to print comparison", err)
+	}
+
+	if len(c.failures) > 0 {
+		fmt.Fprintln(out, "\nFailed images:")
+		for _, f := range c.failures {
+			fmt.Fprintf(out, "  %s: %s\n", f.path, f.err)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/flashlabs/kiss-samples/yolo-in-go-with-python/detect"
+)
+
+type detectorFunc func(filename string) ([]detect.Detection, error)
+
+func (f detectorFunc) Detect(_ context.Context, _ io.Reader, filename string) ([]detect.Detection, error) {
+	return f(filename)
+}
+
+func TestCompareDetectors(t *testing.T) {
+	paths := writeImages(t, t.TempDir(), "a.jpg", "b.jpg", "broken.jpg")
+	reference := detectorFunc(func(string) ([]detect.Detection, error) {
+		return []detect.Detection{
+			{XMin: 0, YMin: 0, XMax: 10, YMax: 10, Confidence: 0.8, Class: 41, Name: "cup"},
+			{XMin: 50, YMin: 50, XMax: 60, YMax: 60, Confidence: 0.4, Class: 0, Name: "person"},
+		}, nil
+	})
+	candidate := detectorFunc(func(filename string) ([]detect.Detection, error) {
+		switch filename {
+		case "broken.jpg":
+			return nil, errors.New("boom")
+		case "b.jpg":
+			// Misses the person and sees a dog
+			return []detect.Detection{
+				{XMin: 0, YMin: 0, XMax: 10, YMax: 9, Confidence: 0.9, Class: 41, Name: "cup"},
+				{XMin: 80, YMin: 80, XMax: 90, YMax: 90, Confidence: 0.3, Class: 16, Name: "dog"},
+			}, nil
+		}
+
+		return []detect.Detection{
+			{XMin: 0, YMin: 0, XMax: 10, YMax: 9, Confidence: 0.9, Class: 41, Name: "cup"},
+			{XMin: 50, YMin: 50, XMax: 60, YMax: 60, Confidence: 0.4, Class: 0, Name: "person"},
+		}, nil
+	})
+
+	var verbose bytes.Buffer
+	cfg := &compareConfig{minIoU: 0.5, warmup: 1, verbose: true, out: &verbose}
+	c := compareDetectors(context.Background(), reference, candidate, paths, cfg)
+
+	if c.images != 2 || len(c.failures) != 1 || c.failures[0].path != paths[2] {
+		t.Fatalf("images = %d, failures = %v, want 2 and %s", c.images, c.failures, paths[2])
+	}
+	if want := (agreement{reference: 4, candidate: 4, matched: 3}); c.agreement != want {
+		t.Errorf("agreement = %+v, want %+v", c.agreement, want)
+	}
+	if got := c.f1(); got != 0.75 {
+		t.Errorf("f1() = %v, want 0.75", got)
+	}
+	tests := []struct {
+		class string
+		want  agreement
+	}{
+		{"cup", agreement{reference: 2, candidate: 2, matched: 2}},
+		{"person", agreement{reference: 2, candidate: 1, matched: 1}},
+		{"dog", agreement{reference: 0, candidate: 1, matched: 0}},
+	}
+	for _, tt := range tests {
+		if got := c.classes[tt.class]; got == nil || *got != tt.want {
+			t.Errorf("class %s = %+v, want %+v", tt.class, got, tt.want)
+		}
+	}
+
+	// The warmup image isn't measured, the failed one is
+	if got := len(c.latency[backendPython]); got != 2 {
+		t.Errorf("python latencies = %d, want 2", got)
+	}
+	if !strings.Contains(verbose.String(), "only onnx:   dog") || !strings.Contains(verbose.String(), "only python: person") {
+		t.Errorf("verbose output = %q, want the unmatched boxes of b.jpg", verbose.String())
+	}
+
+	var out bytes.Buffer
+	c.print(&out, cfg.minIoU)
+	for _, want := range []string{"Recall 75.0%, precision 75.0%, F1 75.0%", "person  2", "broken.jpg: onnx: boom"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("print() = %q, want %q", out.String(), want)
+		}
+	}
+}
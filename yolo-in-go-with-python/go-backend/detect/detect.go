@@ -0,0 +1,40 @@
+// Package detect defines the Detector interface shared by the ways to run
+// YOLO from Go: the remote Python API (a yoloclient.Client) and ONNX Runtime
+// in the process (an ONNX). Both return the same Detection type, so the rest
+// of the backend doesn't depend on where the model runs.
+package detect
+
+import (
+	"context"
+	"io"
+
+	"github.com/flashlabs/kiss-samples/yolo-in-go-with-python/yoloclient"
+)
+
+// Detection is an object found in an image, in pixels of the image.
+type Detection = yoloclient.Detection
+
+// Detector runs the detection on an encoded image. Implementations are safe
+// for concurrent use.
+type Detector interface {
+	Detect(ctx context.Context, r io.Reader, filename string) ([]Detection, error)
+}
+
+var (
+	_ Detector = (*yoloclient.Client)(nil)
+	_ Detector = (*ONNX)(nil)
+)
+
+// COCOClasses are the class names of the pretrained YOLOv5 and YOLOv8
+// models, by class ID.
+var COCOClasses = []string{
+	"person", "bicycle", "car", "motorcycle", "airplane", "bus", "train", "truck", "boat",
+	"traffic light", "fire hydrant", "stop sign", "parking meter", "bench", "bird", "cat", "dog", "horse",
+	"sheep", "cow", "elephant", "bear", "zebra", "giraffe", "backpack", "umbrella", "handbag", "tie",
+	"suitcase", "frisbee", "skis", "snowboard", "sports ball", "kite", "baseball bat", "baseball glove",
+	"skateboard", "surfboard", "tennis racket", "bottle", "wine glass", "cup", "fork", "knife", "spoon",
+	"bowl", "banana", "apple", "sandwich", "orange", "broccoli", "carrot", "hot dog", "pizza", "donut",
+	"cake", "chair", "couch", "potted plant", "bed", "dining table", "toilet", "tv", "laptop", "mouse",
+	"remote", "keyboard", "cell phone", "microwave", "oven", "toaster", "sink", "refrigerator", "book",
+	"clock", "vase", "scissors", "teddy bear", "hair drier", "toothbrush",
+}
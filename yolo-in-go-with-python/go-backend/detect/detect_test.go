@@ -0,0 +1,262 @@
+package detect
+
+import (
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+	"slices"
+	"testing"
+)
+
+func box(class int, x1, y1, x2, y2, confidence float64) Detection {
+	return Detection{XMin: x1, YMin: y1, XMax: x2, YMax: y2, Confidence: confidence, Class: class}
+}
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 1e-4
+}
+
+func TestIoU(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b Detection
+		want float64
+	}{
+		{"same", box(0, 0, 0, 10, 10, 1), box(0, 0, 0, 10, 10, 1), 1},
+		{"half", box(0, 0, 0, 10, 10, 1), box(0, 5, 0, 15, 10, 1), 50.0 / 150},
+		{"inside", box(0, 0, 0, 10, 10, 1), box(0, 0, 0, 5, 5, 1), 0.25},
+		{"disjoint", box(0, 0, 0, 10, 10, 1), box(0, 20, 20, 30, 30, 1), 0},
+		{"touching", box(0, 0, 0, 10, 10, 1), box(0, 10, 0, 20, 10, 1), 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IoU(tt.a, tt.b); !near(got, tt.want) {
+				t.Errorf("IoU() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatch(t *testing.T) {
+	reference := []Detection{
+		box(0, 0, 0, 10, 10, 0.9),
+		box(0, 100, 100, 110, 110, 0.8),
+		box(1, 50, 50, 60, 60, 0.7),
+	}
+	candidate := []Detection{
+		// Both overlap the first box, the second one more
+		box(0, 1, 1, 11, 11, 0.8),
+		box(0, 0, 0, 9, 9, 0.6),
+		// Same place, other class
+		box(2, 50, 50, 60, 60, 0.7),
+	}
+
+	m := Match(reference, candidate, 0.5)
+
+	if len(m.Pairs) != 1 || m.Pairs[0].Reference != 0 || m.Pairs[0].Candidate != 1 {
+		t.Fatalf("Match() pairs = %+v, want reference 0 with candidate 1", m.Pairs)
+	}
+	if !near(m.Pairs[0].IoU, 0.81) {
+		t.Errorf("pair IoU = %v, want 0.81", m.Pairs[0].IoU)
+	}
+	if want := []int{1, 2}; !slices.Equal(m.UnmatchedReference, want) {
+		t.Errorf("unmatched reference = %v, want %v", m.UnmatchedReference, want)
+	}
+	if want := []int{0, 2}; !slices.Equal(m.UnmatchedCandidate, want) {
+		t.Errorf("unmatched candidate = %v, want %v", m.UnmatchedCandidate, want)
+	}
+}
+
+func TestLetterbox(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 200, 100))
+	for i := 0; i < len(img.Pix); i += 4 {
+		copy(img.Pix[i:], []byte{255, 0, 51, 255})
+	}
+	size := 64
+	data := make([]float32, 3*size*size)
+
+	lb := letterbox(img, size, data)
+
+	if !near(lb.scale, 0.32) || lb.padX != 0 || lb.padY != 16 {
+		t.Errorf("letterbox() = %+v, want scale 0.32 and a vertical padding of 16", lb)
+	}
+
+	plane := size * size
+	pixel := func(x, y int) [3]float32 {
+		i := y*size + x
+		return [3]float32{data[i], data[plane+i], data[2*plane+i]}
+	}
+	gray := float32(padGray) / 255
+	if got := pixel(0, 0); got != [3]float32{gray, gray, gray} {
+		t.Errorf("padding pixel = %v, want gray", got)
+	}
+	if got := pixel(32, 32); got != [3]float32{1, 0, 0.2} {
+		t.Errorf("image pixel = %v, want the image color", got)
+	}
+
+	x1, y1, x2, y2 := lb.box(-5, 16, 32, 48)
+	if x1 != 0 || y1 != 0 || !near(x2, 100) || !near(y2, 100) {
+		t.Errorf("box() = (%v, %v, %v, %v), want (0, 0, 100, 100)", x1, y1, x2, y2)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	identity := letterboxed{scale: 1, width: 64, height: 64}
+	names := []string{"a", "b"}
+
+	tests := []struct {
+		name   string
+		layout outputLayout
+		data   []float32
+		want   []Detection
+	}{
+		{
+			name:   "yolov5",
+			layout: outputLayout{anchors: 3, classes: 2, objectness: true},
+			data: []float32{
+				32, 32, 20, 20, 0.9, 0.1, 0.8,
+				// Suppressed by the more confident first row
+				33, 32, 20, 20, 0.85, 0.1, 0.8,
+				// Under the objectness threshold
+				10, 10, 4, 4, 0.2, 0.9, 0,
+			},
+			want: []Detection{{XMin: 22, YMin: 22, XMax: 42, YMax: 42, Confidence: 0.72, Class: 1, Name: "b"}},
+		},
+		{
+			name:   "yolov8",
+			layout: outputLayout{anchors: 2, classes: 2},
+			// Column per anchor: cx, cy, w, h, then the class scores
+			data: []float32{
+				10, 50,
+				10, 50,
+				4, 10,
+				4, 10,
+				0.3, 0.1,
+				0.1, 0.2,
+			},
+			want: []Detection{{XMin: 8, YMin: 8, XMax: 12, YMax: 12, Confidence: 0.3, Class: 0, Name: "a"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.layout.decode(tt.data, identity, DefaultConfidence, DefaultIoU, names)
+			if len(got) != len(tt.want) {
+				t.Fatalf("decode() = %+v, want %+v", got, tt.want)
+			}
+			for i, w := range tt.want {
+				g := got[i]
+				if g.Class != w.Class || g.Name != w.Name || !near(g.Confidence, w.Confidence) || IoU(g, w) < 0.999 {
+					t.Errorf("decode()[%d] = %+v, want %+v", i, g, w)
+				}
+			}
+		})
+	}
+}
+
+func TestNewOutputLayout(t *testing.T) {
+	tests := []struct {
+		shape   []int64
+		want    outputLayout
+		wantErr bool
+	}{
+		{[]int64{1, 25200, 85}, outputLayout{anchors: 25200, classes: 80, objectness: true}, false},
+		{[]int64{1, 84, 8400}, outputLayout{anchors: 8400, classes: 80}, false},
+		{[]int64{1, 84}, outputLayout{}, true},
+	}
+
+	for _, tt := range tests {
+		got, err := newOutputLayout(tt.shape)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("newOutputLayout(%v) = %+v, %v, want %+v", tt.shape, got, err, tt.want)
+		}
+	}
+}
+
+func TestNMS(t *testing.T) {
+	got := nms([]Detection{
+		box(0, 0, 0, 10, 10, 0.5),
+		box(0, 1, 1, 11, 11, 0.9),
+		box(1, 0, 0, 10, 10, 0.6),
+		box(0, 50, 50, 60, 60, 0.4),
+	}, DefaultIoU)
+
+	want := []float64{0.9, 0.6, 0.4}
+	if len(got) != len(want) {
+		t.Fatalf("nms() = %+v, want confidences %v", got, want)
+	}
+	for i, c := range want {
+		if got[i].Confidence != c {
+			t.Errorf("nms()[%d].Confidence = %v, want %v", i, got[i].Confidence, c)
+		}
+	}
+}
+
+// TestONNX runs a real model, given by YOLO_ONNX_MODEL, with the library of
+// ONNXRUNTIME_SHARED_LIBRARY_PATH.
+func TestONNX(t *testing.T) {
+	model, library := os.Getenv("YOLO_ONNX_MODEL"), os.Getenv("ONNXRUNTIME_SHARED_LIBRARY_PATH")
+	if model == "" || library == "" {
+		t.Skip("YOLO_ONNX_MODEL and ONNXRUNTIME_SHARED_LIBRARY_PATH are not set")
+	}
+
+	d, err := NewONNX(model, WithSharedLibrary(library), WithSessions(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := d.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	file, err := os.Open("../../example.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = file.Close() }()
+
+	detections, err := d.Detect(context.Background(), file, "example.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, det := range detections {
+		found = found || det.Name == "cup"
+	}
+	if !found {
+		t.Errorf("Detect() = %+v, want a cup", detections)
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Detect(context.Background(), imageReader(t), "gray.png"); !errors.Is(err, ErrClosed) {
+		t.Errorf("Detect() after Close() error = %v, want ErrClosed", err)
+	}
+}
+
+func imageReader(t *testing.T) *os.File {
+	t.Helper()
+
+	img := image.NewGray(image.Rect(0, 0, 8, 8))
+	img.Set(0, 0, color.White)
+	file, err := os.CreateTemp(t.TempDir(), "*.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(file, img); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = file.Close() })
+
+	return file
+}
@@ -0,0 +1,77 @@
+package detect
+
+import (
+	"cmp"
+	"math"
+	"slices"
+)
+
+// IoU is the intersection over union of two boxes.
+func IoU(a, b Detection) float64 {
+	w := math.Min(a.XMax, b.XMax) - math.Max(a.XMin, b.XMin)
+	h := math.Min(a.YMax, b.YMax) - math.Max(a.YMin, b.YMin)
+	if w <= 0 || h <= 0 {
+		return 0
+	}
+	intersection := w * h
+	union := (a.XMax-a.XMin)*(a.YMax-a.YMin) + (b.XMax-b.XMin)*(b.YMax-b.YMin) - intersection
+
+	return intersection / union
+}
+
+// Pair is a box of the reference matched to a box of the candidate, by
+// index.
+type Pair struct {
+	Reference, Candidate int
+	IoU                  float64
+}
+
+// Matching is the result of Match. The unmatched boxes are indexes too.
+type Matching struct {
+	Pairs              []Pair
+	UnmatchedReference []int
+	UnmatchedCandidate []int
+}
+
+// Match pairs the boxes of the same class of two detectors, greedily from
+// the highest IoU, ignoring pairs under minIoU. Each box is in one pair at
+// most.
+func Match(reference, candidate []Detection, minIoU float64) Matching {
+	var pairs []Pair
+	for i, r := range reference {
+		for j, c := range candidate {
+			if r.Class != c.Class {
+				continue
+			}
+			if iou := IoU(r, c); iou >= minIoU {
+				pairs = append(pairs, Pair{Reference: i, Candidate: j, IoU: iou})
+			}
+		}
+	}
+	slices.SortStableFunc(pairs, func(a, b Pair) int {
+		return cmp.Compare(b.IoU, a.IoU)
+	})
+
+	var m Matching
+	usedReference := make([]bool, len(reference))
+	usedCandidate := make([]bool, len(candidate))
+	for _, p := range pairs {
+		if usedReference[p.Reference] || usedCandidate[p.Candidate] {
+			continue
+		}
+		usedReference[p.Reference], usedCandidate[p.Candidate] = true, true
+		m.Pairs = append(m.Pairs, p)
+	}
+	for i, used := range usedReference {
+		if !used {
+			m.UnmatchedReference = append(m.UnmatchedReference, i)
+		}
+	}
+	for j, used := range usedCandidate {
+		if !used {
+			m.UnmatchedCandidate = append(m.UnmatchedCandidate, j)
+		}
+	}
+
+	return m
+}
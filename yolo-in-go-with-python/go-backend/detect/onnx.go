@@ -0,0 +1,270 @@
+package detect
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"sync"
+
+	ort "github.com/yalue/onnxruntime_go"
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	// DefaultConfidence and DefaultIoU are the thresholds of the PyTorch Hub
+	// model behind the Python API, so both detectors keep the same boxes.
+	DefaultConfidence = 0.25
+	DefaultIoU        = 0.45
+
+	// defaultInputSize is used for models with dynamic spatial dimensions
+	defaultInputSize = 640
+)
+
+// ErrClosed is returned by the Detect of a closed ONNX.
+var ErrClosed = errors.New("detector is closed")
+
+// environmentMu guards the initialization of the ORT environment
+var environmentMu sync.Mutex
+
+// ONNX runs a YOLOv5 or YOLOv8 model exported to ONNX with ONNX Runtime in
+// the process. It is safe for concurrent use, up to the number of sessions
+// run at once.
+type ONNX struct {
+	sharedLibrary string
+	sessionCount  int
+	confidence    float64
+	iou           float64
+	names         []string
+
+	inputSize int
+	layout    outputLayout
+	sessions  chan *session
+	all       []*session
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// Option configures an ONNX detector.
+type Option func(*ONNX)
+
+// WithSharedLibrary sets the path of the ONNX Runtime shared library. It is
+// loaded by the first detector of the process.
+func WithSharedLibrary(path string) Option {
+	return func(o *ONNX) {
+		o.sharedLibrary = path
+	}
+}
+
+// WithSessions sets the number of sessions, each with its own tensors, so
+// that up to n images run at once. The default is 1.
+func WithSessions(n int) Option {
+	return func(o *ONNX) {
+		o.sessionCount = n
+	}
+}
+
+// WithThresholds sets the minimum confidence of a detection and the IoU
+// above which non-maximum suppression drops the less confident of two boxes
+// of the same class.
+func WithThresholds(confidence, iou float64) Option {
+	return func(o *ONNX) {
+		o.confidence = confidence
+		o.iou = iou
+	}
+}
+
+// WithClassNames sets the class names of a custom model, by class ID.
+func WithClassNames(names []string) Option {
+	return func(o *ONNX) {
+		o.names = names
+	}
+}
+
+// session owns an ORT session and its tensors.
+type session struct {
+	session *ort.AdvancedSession
+	input   *ort.Tensor[float32]
+	output  *ort.Tensor[float32]
+}
+
+// NewONNX loads the model, which must be closed.
+func NewONNX(model string, opts ...Option) (*ONNX, error) {
+	o := &ONNX{
+		sessionCount: 1,
+		confidence:   DefaultConfidence,
+		iou:          DefaultIoU,
+		names:        COCOClasses,
+		closed:       make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.sessionCount < 1 {
+		return nil, fmt.Errorf("sessions must be at least 1, got %d", o.sessionCount)
+	}
+
+	if err := initEnvironment(o.sharedLibrary); err != nil {
+		return nil, err
+	}
+
+	inputs, outputs, err := ort.GetInputOutputInfo(model)
+	if err != nil {
+		return nil, fmt.Errorf("error reading model inputs and outputs: %w", err)
+	}
+	if len(inputs) != 1 || len(outputs) == 0 {
+		return nil, fmt.Errorf("expected a single input and an output, got %d and %d", len(inputs), len(outputs))
+	}
+
+	inputShape := fixedShape(inputs[0].Dimensions)
+	if len(inputShape) != 4 || inputShape[2] != inputShape[3] {
+		return nil, fmt.Errorf("expected a square [1, 3, size, size] input, got %s", inputShape)
+	}
+	o.inputSize = int(inputShape[2])
+	outputShape := fixedShape(outputs[0].Dimensions)
+	if o.layout, err = newOutputLayout(outputShape); err != nil {
+		return nil, err
+	}
+
+	o.sessions = make(chan *session, o.sessionCount)
+	for range o.sessionCount {
+		s, err := newSession(model, inputs[0].Name, outputs[0].Name, inputShape, outputShape)
+		if err != nil {
+			o.destroy()
+
+			return nil, err
+		}
+		o.all = append(o.all, s)
+		o.sessions <- s
+	}
+
+	return o, nil
+}
+
+// initEnvironment loads the shared library and creates the process-wide ORT
+// environment, unless it was already done.
+func initEnvironment(sharedLibrary string) error {
+	environmentMu.Lock()
+	defer environmentMu.Unlock()
+
+	if ort.IsInitialized() {
+		return nil
+	}
+	if sharedLibrary != "" {
+		ort.SetSharedLibraryPath(sharedLibrary)
+	}
+	if err := ort.InitializeEnvironment(); err != nil {
+		return fmt.Errorf("error initializing ONNX Runtime: %w", err)
+	}
+
+	return nil
+}
+
+// fixedShape replaces dynamic dimensions with a batch of 1 and the default
+// input size.
+func fixedShape(s ort.Shape) ort.Shape {
+	fixed := s.Clone()
+	for i, d := range fixed {
+		if d > 0 {
+			continue
+		}
+		if i == 0 {
+			fixed[i] = 1
+		} else {
+			fixed[i] = defaultInputSize
+		}
+	}
+
+	return fixed
+}
+
+func newSession(model, inputName, outputName string, inputShape, outputShape ort.Shape) (*session, error) {
+	input, err := ort.NewEmptyTensor[float32](inputShape)
+	if err != nil {
+		return nil, fmt.Errorf("error creating input tensor: %w", err)
+	}
+	s := &session{input: input}
+
+	if s.output, err = ort.NewEmptyTensor[float32](outputShape); err != nil {
+		s.destroy()
+
+		return nil, fmt.Errorf("error creating output tensor: %w", err)
+	}
+
+	s.session, err = ort.NewAdvancedSession(model, []string{inputName}, []string{outputName},
+		[]ort.ArbitraryTensor{s.input}, []ort.ArbitraryTensor{s.output}, nil)
+	if err != nil {
+		s.destroy()
+
+		return nil, fmt.Errorf("error creating session: %w", err)
+	}
+
+	return s, nil
+}
+
+func (s *session) destroy() {
+	if s.session != nil {
+		if err := s.session.Destroy(); err != nil {
+			log.Println("Failed to destroy ORT session", err)
+		}
+	}
+	for _, t := range []*ort.Tensor[float32]{s.input, s.output} {
+		if t == nil {
+			continue
+		}
+		if err := t.Destroy(); err != nil {
+			log.Println("Failed to destroy ORT tensor", err)
+		}
+	}
+}
+
+// Detect decodes the image (JPEG, PNG or WebP) and runs the model on the
+// next free session.
+func (o *ONNX) Detect(ctx context.Context, r io.Reader, _ string) ([]Detection, error) {
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding image: %w", err)
+	}
+
+	var s *session
+	select {
+	case s = <-o.sessions:
+	case <-o.closed:
+		return nil, ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() {
+		o.sessions <- s
+	}()
+
+	lb := letterbox(img, o.inputSize, s.input.GetData())
+	if err := s.session.Run(); err != nil {
+		return nil, fmt.Errorf("error running the model: %w", err)
+	}
+
+	return o.layout.decode(s.output.GetData(), lb, o.confidence, o.iou, o.names), nil
+}
+
+// Close waits for the running detections and frees the sessions.
+func (o *ONNX) Close() error {
+	o.closeOnce.Do(func() {
+		close(o.closed)
+		for range o.all {
+			<-o.sessions
+		}
+		o.destroy()
+	})
+
+	return nil
+}
+
+func (o *ONNX) destroy() {
+	for _, s := range o.all {
+		s.destroy()
+	}
+}
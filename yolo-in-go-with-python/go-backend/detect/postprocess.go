@@ -0,0 +1,147 @@
+package detect
+
+import (
+	"cmp"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"slices"
+
+	ort "github.com/yalue/onnxruntime_go"
+	"golang.org/x/image/draw"
+)
+
+// padGray is the value of the letterbox padding, as in YOLOv5 and YOLOv8
+const padGray = 114
+
+// letterboxed maps the model input back to the original image.
+type letterboxed struct {
+	scale         float64
+	padX, padY    float64
+	width, height int
+}
+
+// letterbox resizes the image to fit a size x size square keeping its aspect
+// ratio, pads it with gray and writes it to data as normalized NCHW RGB,
+// like the Ultralytics preprocessing.
+func letterbox(img image.Image, size int, data []float32) letterboxed {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	scale := math.Min(float64(size)/float64(w), float64(size)/float64(h))
+	nw, nh := int(math.Round(float64(w)*scale)), int(math.Round(float64(h)*scale))
+	padX, padY := (size-nw)/2, (size-nh)/2
+
+	canvas := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(canvas, canvas.Bounds(), image.NewUniform(color.RGBA{R: padGray, G: padGray, B: padGray, A: 255}), image.Point{}, draw.Src)
+	draw.BiLinear.Scale(canvas, image.Rect(padX, padY, padX+nw, padY+nh), img, bounds, draw.Src, nil)
+
+	plane := size * size
+	for i := range plane {
+		pixel := canvas.Pix[i*4 : i*4+3]
+		data[i] = float32(pixel[0]) / 255
+		data[plane+i] = float32(pixel[1]) / 255
+		data[2*plane+i] = float32(pixel[2]) / 255
+	}
+
+	return letterboxed{scale: scale, padX: float64(padX), padY: float64(padY), width: w, height: h}
+}
+
+// box maps a box of the model input to the original image, clipped to it.
+func (l letterboxed) box(x1, y1, x2, y2 float64) (float64, float64, float64, float64) {
+	clip := func(v, padding float64, limit int) float64 {
+		return math.Min(math.Max((v-padding)/l.scale, 0), float64(limit))
+	}
+
+	return clip(x1, l.padX, l.width), clip(y1, l.padY, l.height), clip(x2, l.padX, l.width), clip(y2, l.padY, l.height)
+}
+
+// outputLayout is the shape of the detection output of the model:
+// [1, anchors, 5+classes] rows with an objectness score for YOLOv5, or
+// [1, 4+classes, anchors] columns for YOLOv8. Boxes are centers and sizes in
+// input pixels.
+type outputLayout struct {
+	anchors    int
+	classes    int
+	objectness bool
+}
+
+func newOutputLayout(shape ort.Shape) (outputLayout, error) {
+	if len(shape) != 3 {
+		return outputLayout{}, fmt.Errorf("unrecognized output shape %s", shape)
+	}
+	if shape[1] > shape[2] {
+		// [1, 25200, 85]: one row per anchor
+		return outputLayout{anchors: int(shape[1]), classes: int(shape[2]) - 5, objectness: true}, nil
+	}
+
+	// [1, 84, 8400]: one column per anchor point
+	return outputLayout{anchors: int(shape[2]), classes: int(shape[1]) - 4}, nil
+}
+
+// decode returns the detections above the confidence threshold after a
+// per-class non-maximum suppression, most confident first.
+func (l outputLayout) decode(data []float32, lb letterboxed, confidence, iou float64, names []string) []Detection {
+	// value returns the attribute of an anchor, the box, then the objectness
+	// of YOLOv5, then the class scores
+	value := func(anchor, attr int) float64 {
+		if l.objectness {
+			return float64(data[anchor*(l.classes+5)+attr])
+		}
+
+		return float64(data[attr*l.anchors+anchor])
+	}
+	first := 4
+	if l.objectness {
+		first = 5
+	}
+
+	var candidates []Detection
+	for anchor := range l.anchors {
+		objectness := 1.0
+		if l.objectness {
+			if objectness = value(anchor, 4); objectness < confidence {
+				continue
+			}
+		}
+
+		class, score := 0, 0.0
+		for c := range l.classes {
+			if s := value(anchor, first+c); s > score {
+				class, score = c, s
+			}
+		}
+		if score *= objectness; score < confidence {
+			continue
+		}
+
+		cx, cy, w, h := value(anchor, 0), value(anchor, 1), value(anchor, 2), value(anchor, 3)
+		d := Detection{Confidence: score, Class: class, Name: fmt.Sprint(class)}
+		if class < len(names) {
+			d.Name = names[class]
+		}
+		d.XMin, d.YMin, d.XMax, d.YMax = lb.box(cx-w/2, cy-h/2, cx+w/2, cy+h/2)
+		candidates = append(candidates, d)
+	}
+
+	return nms(candidates, iou)
+}
+
+// nms keeps the most confident of the overlapping boxes of each class.
+func nms(candidates []Detection, iou float64) []Detection {
+	slices.SortStableFunc(candidates, func(a, b Detection) int {
+		return cmp.Compare(b.Confidence, a.Confidence)
+	})
+
+	kept := make([]Detection, 0, len(candidates))
+	for _, c := range candidates {
+		overlaps := slices.ContainsFunc(kept, func(k Detection) bool {
+			return k.Class == c.Class && IoU(k, c) > iou
+		})
+		if !overlaps {
+			kept = append(kept, c)
+		}
+	}
+
+	return kept
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/flashlabs/kiss-samples/yolo-in-go-with-python/gateway"
+	"github.com/flashlabs/kiss-samples/yolo-in-go-with-python/yoloclient"
+)
+
+// statsVar is the expvar name of the replica stats.
+const statsVar = "yoloclient"
+
+// runGateway serves the detection gateway until SIGINT or SIGTERM.
+func runGateway(args []string) int {
+	fs := flag.NewFlagSet("gateway", flag.ContinueOnError)
+	listen := fs.String("listen", ":8080", "address to listen on")
+	detectorCfg := newDetectorConfig(fs)
+	cfg := gateway.Config{}
+	fs.Float64Var(&cfg.RateLimit, "rate", 5, "requests per second of a client, 0 disables rate limiting")
+	fs.IntVar(&cfg.RateBurst, "burst", 10, "burst of requests of a client")
+	fs.Int64Var(&cfg.MaxUploadBytes, "max-upload", 10<<20, "largest accepted upload in bytes")
+	fs.IntVar(&cfg.MaxPixels, "max-pixels", 50_000_000, "largest accepted image in pixels")
+	fs.IntVar(&cfg.MaxSide, "max-side", 1280, "longest side of the image forwarded to the API")
+	fs.IntVar(&cfg.CacheSize, "cache-size", 1024, "number of results cached by image content, 0 disables the cache")
+	fs.DurationVar(&cfg.CacheTTL, "cache-ttl", 10*time.Minute, "time a result stays cached")
+	fs.DurationVar(&cfg.DetectTimeout, "detect-timeout", 30*time.Second, "timeout of a detection including the retries")
+	fs.BoolVar(&cfg.DebugVars, "debug-vars", true, "serve the replica stats and other expvar variables on /debug/vars")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	// Keys are read from the environment to keep them out of the process list
+	if keys := os.Getenv("GATEWAY_API_KEYS"); keys != "" {
+		cfg.APIKeys = strings.Split(keys, ",")
+	} else {
+		log.Println("GATEWAY_API_KEYS is not set, the gateway accepts requests without an API key")
+	}
+
+	detector, err := detectorCfg.newDetector()
+	if err != nil {
+		log.Println("Error creating detector:", err)
+
+		return 2
+	}
+	defer func() {
+		if e := detector.Close(); e != nil {
+			log.Println("Failed to close detector", e)
+		}
+	}()
+	if client, ok := detector.(*yoloclient.Client); ok {
+		client.Publish(statsVar)
+	}
+
+	server := &http.Server{
+		Addr:              *listen,
+		Handler:           gateway.New(detector, cfg),
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       time.Minute,
+		WriteTimeout:      cfg.DetectTimeout + 10*time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errs := make(chan error, 1)
+	go func() {
+		log.Printf("Gateway listening on %s, detecting with %s", *listen, detectorCfg)
+		errs <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		log.Println("Error serving:", err)
+
+		return 1
+	case <-ctx.Done():
+	}
+
+	log.Println("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.DetectTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Println("Error shutting down:", err)
+
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,73 @@
+package gateway
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// cache keeps the responses of the most recently used images, keyed by the
+// SHA-256 of the upload.
+type cache struct {
+	size int
+	ttl  time.Duration
+	now  func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type cacheEntry struct {
+	key     string
+	value   Response
+	expires time.Time
+}
+
+func newCache(size int, ttl time.Duration, now func() time.Time) *cache {
+	return &cache{size: size, ttl: ttl, now: now, entries: map[string]*list.Element{}, order: list.New()}
+}
+
+func (c *cache) get(key string) (Response, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return Response{}, false
+	}
+	entry := el.Value.(*cacheEntry)
+	if c.ttl > 0 && !c.now().Before(entry.expires) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+
+		return Response{}, false
+	}
+	c.order.MoveToFront(el)
+
+	return entry.value, true
+}
+
+func (c *cache) put(key string, value Response) {
+	if c.size <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &cacheEntry{key: key, value: value, expires: c.now().Add(c.ttl)}
+	if el, ok := c.entries[key]; ok {
+		el.Value = entry
+		c.order.MoveToFront(el)
+
+		return
+	}
+	c.entries[key] = c.order.PushFront(entry)
+
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
@@ -0,0 +1,356 @@
+// Package gateway is an HTTP service in front of the Python detection API.
+// It authenticates and rate limits the apps, validates and normalizes their
+// uploads, caches the results and answers with a versioned JSON schema that
+// doesn't depend on the pandas columns of the API.
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flashlabs/kiss-samples/yolo-in-go-with-python/detect"
+	"github.com/flashlabs/kiss-samples/yolo-in-go-with-python/yoloclient"
+)
+
+// Version of the response schema. Breaking changes get a new version and a
+// new /vN/detect route.
+const Version = "v1"
+
+// Detector runs the detection on the normalized JPEG, in the Python API or
+// in the process.
+type Detector = detect.Detector
+
+// Config of the gateway. Zero values disable the feature, except for the
+// limits, which get the defaults.
+type Config struct {
+	// APIKeys accepted in the Authorization: Bearer or X-API-Key header.
+	// Without keys the gateway is open.
+	APIKeys []string
+	// RateLimit is the number of requests per second of a client (the API
+	// key, or the IP address of an open gateway), with bursts up to
+	// RateBurst.
+	RateLimit float64
+	RateBurst int
+	// MaxUploadBytes is the largest accepted upload, 10 MiB by default.
+	MaxUploadBytes int64
+	// MaxPixels is the largest accepted image, 50 megapixels by default.
+	MaxPixels int
+	// MaxSide downscales larger images before they are forwarded, 1280 by
+	// default. The boxes are scaled back to the upload.
+	MaxSide int
+	// CacheSize is the number of results cached by image content, with
+	// CacheTTL.
+	CacheSize int
+	CacheTTL  time.Duration
+	// DetectTimeout bounds the call to the detector, 30 seconds by default.
+	DetectTimeout time.Duration
+	// DebugVars serves the expvar variables on /debug/vars, among them the
+	// replica stats of a yoloclient.Client published with Client.Publish.
+	DebugVars bool
+}
+
+func (c *Config) defaults() {
+	if c.MaxUploadBytes <= 0 {
+		c.MaxUploadBytes = 10 << 20
+	}
+	if c.MaxPixels <= 0 {
+		c.MaxPixels = 50_000_000
+	}
+	if c.MaxSide <= 0 {
+		c.MaxSide = 1280
+	}
+	if c.DetectTimeout <= 0 {
+		c.DetectTimeout = 30 * time.Second
+	}
+}
+
+// Response is the body of a successful detection.
+type Response struct {
+	Version    string      `json:"version"`
+	Image      ImageInfo   `json:"image"`
+	Detections []Detection `json:"detections"`
+	// Cached is true when the result came from the cache
+	Cached bool `json:"cached"`
+}
+
+// ImageInfo describes the upload, after its EXIF rotation.
+type ImageInfo struct {
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Format string `json:"format"`
+	SHA256 string `json:"sha256"`
+}
+
+// Detection is a detected object, in pixels of the upright upload.
+type Detection struct {
+	Label      string  `json:"label"`
+	ClassID    int     `json:"class_id"`
+	Confidence float64 `json:"confidence"`
+	Box        Box     `json:"box"`
+}
+
+// Box has the top-left and bottom-right corners.
+type Box struct {
+	X1 float64 `json:"x1"`
+	Y1 float64 `json:"y1"`
+	X2 float64 `json:"x2"`
+	Y2 float64 `json:"y2"`
+}
+
+// ErrorResponse is the body of every failed request.
+type ErrorResponse struct {
+	Version string `json:"version"`
+	Error   struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// Gateway is the http.Handler of the service.
+type Gateway struct {
+	detector Detector
+	cfg      Config
+	keys     map[[sha256.Size]byte]bool
+	limiter  *limiter
+	cache    *cache
+	mux      *http.ServeMux
+}
+
+// New creates the gateway forwarding to the detector.
+func New(detector Detector, cfg Config) *Gateway {
+	cfg.defaults()
+
+	g := &Gateway{
+		detector: detector,
+		cfg:      cfg,
+		keys:     map[[sha256.Size]byte]bool{},
+		limiter:  newLimiter(cfg.RateLimit, cfg.RateBurst, time.Now),
+		cache:    newCache(cfg.CacheSize, cfg.CacheTTL, time.Now),
+		mux:      http.NewServeMux(),
+	}
+	for _, key := range cfg.APIKeys {
+		g.keys[sha256.Sum256([]byte(key))] = true
+	}
+
+	g.mux.HandleFunc("POST /"+Version+"/detect", g.handleDetect)
+	g.mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"status":"ok"}`)
+	})
+	if cfg.DebugVars {
+		g.mux.Handle("GET /debug/vars", expvar.Handler())
+	}
+
+	return g
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.mux.ServeHTTP(w, r)
+}
+
+func (g *Gateway) handleDetect(w http.ResponseWriter, r *http.Request) {
+	client, ok := g.authenticate(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="yolo-gateway"`)
+		writeError(w, http.StatusUnauthorized, "unauthorized", "missing or invalid API key")
+
+		return
+	}
+
+	if allowed, wait := g.limiter.allow(client); !allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		writeError(w, http.StatusTooManyRequests, "rate_limited", "too many requests, retry later")
+
+		return
+	}
+
+	data, err := readUpload(w, r, g.cfg.MaxUploadBytes)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, "too_large", fmt.Sprintf("the upload is larger than %d bytes", g.cfg.MaxUploadBytes))
+		} else {
+			writeError(w, http.StatusBadRequest, "bad_upload", err.Error())
+		}
+
+		return
+	}
+
+	sum := sha256.Sum256(data)
+	key := hex.EncodeToString(sum[:])
+	if resp, ok := g.cache.get(key); ok {
+		resp.Cached = true
+		writeJSON(w, http.StatusOK, resp)
+
+		return
+	}
+
+	norm, err := normalize(data, g.cfg.MaxSide, g.cfg.MaxPixels)
+	switch {
+	case errors.Is(err, errUnsupportedFormat):
+		writeError(w, http.StatusUnsupportedMediaType, "unsupported_format", "the upload must be a JPEG, PNG or WebP image")
+
+		return
+	case errors.Is(err, errTooManyPixels):
+		writeError(w, http.StatusUnprocessableEntity, "too_many_pixels", err.Error())
+
+		return
+	case err != nil:
+		log.Printf("error normalizing image %s: %s", key, err)
+		writeError(w, http.StatusInternalServerError, "internal", "failed to process the image")
+
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), g.cfg.DetectTimeout)
+	defer cancel()
+	detections, err := g.detector.Detect(ctx, bytes.NewReader(norm.jpeg), key+".jpg")
+	if err != nil {
+		g.writeDetectError(w, r, err)
+
+		return
+	}
+
+	resp := Response{
+		Version:    Version,
+		Image:      ImageInfo{Width: norm.width, Height: norm.height, Format: norm.format, SHA256: key},
+		Detections: make([]Detection, 0, len(detections)),
+	}
+	clamp := func(v float64, limit int) float64 {
+		return math.Min(math.Max(v*norm.scale, 0), float64(limit))
+	}
+	for _, d := range detections {
+		resp.Detections = append(resp.Detections, Detection{
+			Label:      d.Name,
+			ClassID:    d.Class,
+			Confidence: d.Confidence,
+			Box: Box{
+				X1: clamp(d.XMin, norm.width),
+				Y1: clamp(d.YMin, norm.height),
+				X2: clamp(d.XMax, norm.width),
+				Y2: clamp(d.YMax, norm.height),
+			},
+		})
+	}
+	g.cache.put(key, resp)
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// authenticate returns the client the request is rate limited as.
+func (g *Gateway) authenticate(r *http.Request) (string, bool) {
+	if len(g.keys) == 0 {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+
+		return host, true
+	}
+
+	key := r.Header.Get("X-API-Key")
+	if auth := r.Header.Get("Authorization"); key == "" && strings.HasPrefix(auth, "Bearer ") {
+		key = strings.TrimPrefix(auth, "Bearer ")
+	}
+	// Comparing hashes doesn't leak the keys through timing
+	sum := sha256.Sum256([]byte(key))
+	if key == "" || !g.keys[sum] {
+		return "", false
+	}
+
+	return "key:" + hex.EncodeToString(sum[:8]), true
+}
+
+// readUpload reads the "image" field of a multipart form, or a raw image
+// body.
+func readUpload(w http.ResponseWriter, r *http.Request, limit int64) ([]byte, error) {
+	// The multipart framing gets a little room on top of the image
+	body := http.MaxBytesReader(w, r.Body, limit+16<<10)
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		return readLimited(body, limit)
+	}
+
+	r.Body = body
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, fmt.Errorf("invalid multipart form: %w", err)
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, errors.New(`the form has no "image" field`)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() == "image" {
+			return readLimited(part, limit)
+		}
+	}
+}
+
+func readLimited(r io.Reader, limit int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, &http.MaxBytesError{Limit: limit}
+	}
+	if len(data) == 0 {
+		return nil, errors.New("the upload is empty")
+	}
+
+	return data, nil
+}
+
+// writeDetectError maps the errors of the detector to the gateway's errors,
+// without leaking the details of the backend.
+func (g *Gateway) writeDetectError(w http.ResponseWriter, r *http.Request, err error) {
+	log.Printf("error detecting %s %s: %s", r.Method, r.URL.Path, err)
+
+	switch {
+	case errors.Is(err, yoloclient.ErrInvalidImage), errors.Is(err, yoloclient.ErrTooLarge):
+		writeError(w, http.StatusUnprocessableEntity, "rejected_image", "the detector couldn't process the image")
+	case errors.Is(err, context.DeadlineExceeded):
+		writeError(w, http.StatusGatewayTimeout, "detector_timeout", "the detector didn't answer in time")
+	case errors.Is(err, context.Canceled):
+		// The client went away, nobody reads the answer
+		writeError(w, 499, "cancelled", "the request was cancelled")
+	default:
+		w.Header().Set("Retry-After", "1")
+		writeError(w, http.StatusServiceUnavailable, "detector_unavailable", "the detector is unavailable")
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	resp := ErrorResponse{Version: Version}
+	resp.Error.Code = code
+	resp.Error.Message = message
+	writeJSON(w, status, resp)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("Failed to write response", err)
+	}
+}
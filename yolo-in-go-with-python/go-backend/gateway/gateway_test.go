@@ -0,0 +1,502 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/flashlabs/kiss-samples/yolo-in-go-with-python/yoloclient"
+)
+
+// pythonStub replaces the Python API: it checks the forwarded JPEG and
+// answers with a box at (10, 20, 100, 200), or with status when it is set.
+type pythonStub struct {
+	status   int
+	calls    atomic.Int32
+	lastSize atomic.Value
+}
+
+func (s *pythonStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.calls.Add(1)
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+
+		return
+	}
+	defer file.Close()
+	cfg, format, err := image.DecodeConfig(file)
+	if err != nil || format != "jpeg" {
+		w.WriteHeader(http.StatusBadRequest)
+
+		return
+	}
+	s.lastSize.Store(image.Pt(cfg.Width, cfg.Height))
+
+	if s.status != 0 {
+		w.WriteHeader(s.status)
+		_, _ = io.WriteString(w, `{"detail":"stub failure"}`)
+
+		return
+	}
+	_, _ = io.WriteString(w, `[{"xmin":10,"ymin":20,"xmax":100,"ymax":200,"confidence":0.9,"class":41,"name":"cup"}]`)
+}
+
+func newTestGateway(t *testing.T, stub *pythonStub, cfg Config) *httptest.Server {
+	t.Helper()
+
+	api := httptest.NewServer(stub)
+	t.Cleanup(api.Close)
+	client, err := yoloclient.New(api.URL, yoloclient.WithRetries(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(New(client, cfg))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func encodeImage(t *testing.T, w, h int, format string) []byte {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	var buf bytes.Buffer
+	var err error
+	if format == "png" {
+		err = png.Encode(&buf, img)
+	} else {
+		err = jpeg.Encode(&buf, img, nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+// upload posts the image as the "image" field of a multipart form.
+func upload(t *testing.T, url string, data []byte, header http.Header) *http.Response {
+	t.Helper()
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, err := writer.CreateFormFile("image", "photo.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = part.Write(data)
+	_ = writer.Close()
+
+	req, err := http.NewRequest(http.MethodPost, url+"/v1/detect", &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+
+	return resp
+}
+
+func decode[T any](t *testing.T, resp *http.Response) T {
+	t.Helper()
+
+	var v T
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		t.Fatalf("invalid JSON response: %s", err)
+	}
+
+	return v
+}
+
+func TestDetect(t *testing.T) {
+	stub := &pythonStub{}
+	server := newTestGateway(t, stub, Config{CacheSize: 10, CacheTTL: time.Minute})
+	data := encodeImage(t, 2560, 1280, "jpeg")
+
+	resp := upload(t, server.URL, data, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	got := decode[Response](t, resp)
+
+	// The image is forwarded at 1280x640 and the boxes scaled back by 2
+	if size := stub.lastSize.Load(); size != image.Pt(1280, 640) {
+		t.Errorf("forwarded image size = %v, want (1280,640)", size)
+	}
+	want := Detection{Label: "cup", ClassID: 41, Confidence: 0.9, Box: Box{X1: 20, Y1: 40, X2: 200, Y2: 400}}
+	if got.Version != "v1" || len(got.Detections) != 1 || got.Detections[0] != want || got.Cached {
+		t.Errorf("response = %+v, want v1 with %+v", got, want)
+	}
+	if got.Image.Width != 2560 || got.Image.Height != 1280 || got.Image.Format != "jpeg" || len(got.Image.SHA256) != 64 {
+		t.Errorf("image = %+v, want the 2560x1280 jpeg upload", got.Image)
+	}
+
+	// The same content is served from the cache
+	cached := decode[Response](t, upload(t, server.URL, data, nil))
+	if !cached.Cached || stub.calls.Load() != 1 {
+		t.Errorf("second upload cached = %t with %d API calls, want a cache hit", cached.Cached, stub.calls.Load())
+	}
+}
+
+func TestDetectRawBody(t *testing.T) {
+	server := newTestGateway(t, &pythonStub{}, Config{})
+
+	resp, err := http.Post(server.URL+"/v1/detect", "image/png", bytes.NewReader(encodeImage(t, 64, 48, "png")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	got := decode[Response](t, resp)
+	if resp.StatusCode != http.StatusOK || got.Image.Format != "png" {
+		t.Fatalf("status = %d, image = %+v, want 200 and a png", resp.StatusCode, got.Image)
+	}
+	// Boxes are clamped to the image
+	if box := got.Detections[0].Box; box != (Box{X1: 10, Y1: 20, X2: 64, Y2: 48}) {
+		t.Errorf("box = %+v, want it clamped to 64x48", box)
+	}
+}
+
+func TestDetectErrors(t *testing.T) {
+	jpg := encodeImage(t, 32, 32, "jpeg")
+
+	tests := []struct {
+		name       string
+		cfg        Config
+		stubStatus int
+		data       []byte
+		header     http.Header
+		wantStatus int
+		wantCode   string
+	}{
+		{
+			name:       "missing key",
+			cfg:        Config{APIKeys: []string{"secret"}},
+			data:       jpg,
+			wantStatus: http.StatusUnauthorized,
+			wantCode:   "unauthorized",
+		},
+		{
+			name:       "wrong key",
+			cfg:        Config{APIKeys: []string{"secret"}},
+			data:       jpg,
+			header:     http.Header{"Authorization": {"Bearer guess"}},
+			wantStatus: http.StatusUnauthorized,
+			wantCode:   "unauthorized",
+		},
+		{
+			name:       "bearer key",
+			cfg:        Config{APIKeys: []string{"other", "secret"}},
+			data:       jpg,
+			header:     http.Header{"Authorization": {"Bearer secret"}},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "api key header",
+			cfg:        Config{APIKeys: []string{"secret"}},
+			data:       jpg,
+			header:     http.Header{"X-Api-Key": {"secret"}},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "too large",
+			cfg:        Config{MaxUploadBytes: 100},
+			data:       jpg,
+			wantStatus: http.StatusRequestEntityTooLarge,
+			wantCode:   "too_large",
+		},
+		{
+			name:       "not an image",
+			data:       []byte("%PDF-1.4"),
+			wantStatus: http.StatusUnsupportedMediaType,
+			wantCode:   "unsupported_format",
+		},
+		{
+			name:       "too many pixels",
+			cfg:        Config{MaxPixels: 1000},
+			data:       jpg,
+			wantStatus: http.StatusUnprocessableEntity,
+			wantCode:   "too_many_pixels",
+		},
+		{
+			name:       "detector rejects the image",
+			stubStatus: http.StatusBadRequest,
+			data:       jpg,
+			wantStatus: http.StatusUnprocessableEntity,
+			wantCode:   "rejected_image",
+		},
+		{
+			name:       "detector fails",
+			stubStatus: http.StatusInternalServerError,
+			data:       jpg,
+			wantStatus: http.StatusServiceUnavailable,
+			wantCode:   "detector_unavailable",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTestGateway(t, &pythonStub{status: tt.stubStatus}, tt.cfg)
+
+			resp := upload(t, server.URL, tt.data, tt.header)
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if tt.wantCode != "" {
+				got := decode[ErrorResponse](t, resp)
+				if got.Version != "v1" || got.Error.Code != tt.wantCode {
+					t.Errorf("error = %+v, want code %s", got, tt.wantCode)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	server := newTestGateway(t, &pythonStub{}, Config{RateLimit: 0.5, RateBurst: 1})
+	jpg := encodeImage(t, 32, 32, "jpeg")
+
+	if resp := upload(t, server.URL, jpg, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("first request status = %d, want 200", resp.StatusCode)
+	}
+	resp := upload(t, server.URL, jpg, nil)
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "2" {
+		t.Errorf("second request status = %d, Retry-After %q, want 429 after 2 seconds", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+}
+
+// stubDetector stands in for the API and never answers.
+type stubDetector struct{}
+
+func (s stubDetector) Detect(ctx context.Context, _ io.Reader, _ string) ([]yoloclient.Detection, error) {
+	<-ctx.Done()
+
+	return nil, ctx.Err()
+}
+
+func TestDetectTimeout(t *testing.T) {
+	server := httptest.NewServer(New(stubDetector{}, Config{DetectTimeout: 10 * time.Millisecond}))
+	defer server.Close()
+
+	resp := upload(t, server.URL, encodeImage(t, 32, 32, "jpeg"), nil)
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("status = %d, want 504", resp.StatusCode)
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := newLimiter(2, 2, func() time.Time { return now })
+
+	for i, want := range []bool{true, true, false} {
+		if got, _ := l.allow("a"); got != want {
+			t.Errorf("request %d allowed = %t, want %t", i, got, want)
+		}
+	}
+	if ok, _ := l.allow("b"); !ok {
+		t.Error("other client was limited")
+	}
+	if _, wait := l.allow("a"); wait != 500*time.Millisecond {
+		t.Errorf("wait = %s, want 500ms for the next token", wait)
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if ok, _ := l.allow("a"); !ok {
+		t.Error("request after the refill was limited")
+	}
+}
+
+func TestCache(t *testing.T) {
+	now := time.Unix(0, 0)
+	c := newCache(2, time.Minute, func() time.Time { return now })
+	resp := func(sha string) Response { return Response{Image: ImageInfo{SHA256: sha}} }
+
+	c.put("a", resp("a"))
+	c.put("b", resp("b"))
+	c.get("a")
+	c.put("c", resp("c"))
+
+	// b was the least recently used
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, ok := c.get(key); ok != want {
+			t.Errorf("get(%q) found = %t, want %t", key, ok, want)
+		}
+	}
+
+	now = now.Add(time.Minute)
+	if _, ok := c.get("a"); ok {
+		t.Error("get() returned an expired entry")
+	}
+}
+
+// withOrientation inserts an EXIF segment with the orientation tag after the
+// SOI marker of a JPEG.
+func withOrientation(data []byte, orientation byte) []byte {
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08" + // big endian header, IFD at 8
+		"\x00\x01" + // one entry
+		"\x01\x12\x00\x03\x00\x00\x00\x01\x00" + string([]byte{orientation}) + "\x00\x00" +
+		"\x00\x00\x00\x00") // no next IFD
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	segment := append([]byte{0xFF, 0xE1, byte((len(payload) + 2) >> 8), byte(len(payload) + 2)}, payload...)
+
+	return append(append(append([]byte{}, data[:2]...), segment...), data[2:]...)
+}
+
+func TestNormalizeOrientation(t *testing.T) {
+	jpg := encodeImage(t, 40, 20, "jpeg")
+
+	for orientation, want := range map[byte]image.Point{1: {40, 20}, 3: {40, 20}, 6: {20, 40}, 8: {20, 40}} {
+		data := withOrientation(jpg, orientation)
+		if got := exifOrientation(data); got != int(orientation) {
+			t.Errorf("exifOrientation() = %d, want %d", got, orientation)
+		}
+
+		n, err := normalize(data, 1280, 1_000_000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := image.Pt(n.width, n.height); got != want {
+			t.Errorf("orientation %d: size = %v, want %v", orientation, got, want)
+		}
+	}
+
+	if got := exifOrientation(jpg); got != 1 {
+		t.Errorf("exifOrientation() without EXIF = %d, want 1", got)
+	}
+}
+
+func TestOrient(t *testing.T) {
+	// A red pixel left of a blue one
+	img := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	red, blue := color.RGBA{R: 255, A: 255}, color.RGBA{B: 255, A: 255}
+	img.Set(0, 0, red)
+	img.Set(1, 0, blue)
+
+	tests := map[int][]color.RGBA{
+		2:  {blue, red}, // mirrored, still 2x1
+		3:  {blue, red}, // rotated 180
+		6:  {red, blue}, // rotated clockwise, 1x2 with red on top
+		8:  {blue, red}, // rotated counter-clockwise, blue on top
+		5:  {red, blue}, // transposed
+		7:  {blue, red}, // transversed
+		4:  {red, blue}, // mirrored vertically, unchanged for one row
+		1:  {red, blue}, // upright
+		9:  {red, blue}, // invalid, unchanged
+		0:  {red, blue}, // missing, unchanged
+		-1: {red, blue}, // invalid, unchanged
+	}
+	for orientation, want := range tests {
+		got := orient(img, orientation)
+		var pixels []color.RGBA
+		b := got.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				pixels = append(pixels, color.RGBAModel.Convert(got.At(x, y)).(color.RGBA))
+			}
+		}
+		if len(pixels) != 2 || pixels[0] != want[0] || pixels[1] != want[1] {
+			t.Errorf("orient(%d) = %v, want %v", orientation, pixels, want)
+		}
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	server := httptest.NewServer(New(stubDetector{}, Config{}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "ok") {
+		t.Errorf("healthz = %d %s, want 200 ok", resp.StatusCode, body)
+	}
+}
+
+func TestDebugVars(t *testing.T) {
+	good, bad := &pythonStub{}, &pythonStub{status: http.StatusServiceUnavailable}
+	var urls []string
+	for _, stub := range []*pythonStub{good, bad} {
+		api := httptest.NewServer(stub)
+		t.Cleanup(api.Close)
+		urls = append(urls, api.URL)
+	}
+	client, err := yoloclient.NewBalanced(urls, yoloclient.WithRetries(0),
+		yoloclient.WithBalancing(yoloclient.RoundRobin), yoloclient.WithCircuitBreaker(1, time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Publish("test_gateway_yoloclient")
+
+	server := httptest.NewServer(New(client, Config{DebugVars: true}))
+	defer server.Close()
+	// One request to every replica
+	for range urls {
+		upload(t, server.URL, encodeImage(t, 64, 64, "jpeg"), nil)
+	}
+
+	resp, err := http.Get(server.URL + "/debug/vars")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	type endpoint struct {
+		URL      string `json:"url"`
+		State    string `json:"state"`
+		Requests int64  `json:"requests"`
+		Failures int64  `json:"failures"`
+		P50      int64  `json:"p50_ns"`
+	}
+	vars := decode[struct {
+		Stats []endpoint `json:"test_gateway_yoloclient"`
+	}](t, resp)
+
+	got := map[string]endpoint{}
+	for _, s := range vars.Stats {
+		got[s.URL] = s
+	}
+	if s := got[urls[0]]; s.State != "closed" || s.Requests != 1 || s.Failures != 0 || s.P50 <= 0 {
+		t.Errorf("healthy replica stats = %+v, want closed with 1 request and a latency", s)
+	}
+	if s := got[urls[1]]; s.State != "open" || s.Failures != 1 || s.P50 <= 0 {
+		t.Errorf("failing replica stats = %+v, want open with 1 failure and a latency", s)
+	}
+}
+
+func TestDebugVarsDisabled(t *testing.T) {
+	server := httptest.NewServer(New(stubDetector{}, Config{}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/debug/vars")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("/debug/vars = %d, want 404 unless enabled", resp.StatusCode)
+	}
+}
@@ -0,0 +1,178 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	_ "image/png"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// jpegQuality of the image forwarded to the detector
+const jpegQuality = 90
+
+var (
+	errUnsupportedFormat = errors.New("unsupported image format")
+	errTooManyPixels     = errors.New("image has too many pixels")
+)
+
+// normalized is an upload converted to what the detector gets: an upright
+// JPEG no larger than the maximum side.
+type normalized struct {
+	jpeg []byte
+	// width and height of the upright upload, which the boxes are scaled to
+	width, height int
+	// scale from the forwarded image to the upload
+	scale  float64
+	format string
+}
+
+// normalize decodes the upload, applies its EXIF orientation, downscales it
+// to maxSide and encodes it as JPEG. Uploads over maxPixels are rejected
+// before they are decoded.
+func normalize(data []byte, maxSide, maxPixels int) (*normalized, error) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, errUnsupportedFormat
+	}
+	if cfg.Width*cfg.Height > maxPixels {
+		return nil, fmt.Errorf("%w: %dx%d, the maximum is %d pixels", errTooManyPixels, cfg.Width, cfg.Height, maxPixels)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errUnsupportedFormat, err)
+	}
+	if format == "jpeg" {
+		img = orient(img, exifOrientation(data))
+	}
+
+	n := &normalized{width: img.Bounds().Dx(), height: img.Bounds().Dy(), scale: 1, format: format}
+	if longest := max(n.width, n.height); maxSide > 0 && longest > maxSide {
+		n.scale = float64(longest) / float64(maxSide)
+		w := max(1, int(float64(n.width)/n.scale+0.5))
+		h := max(1, int(float64(n.height)/n.scale+0.5))
+		dst := image.NewRGBA(image.Rect(0, 0, w, h))
+		draw.CatmullRom.Scale(dst, dst.Bounds(), img, img.Bounds(), draw.Src, nil)
+		img = dst
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpegQuality}); err != nil {
+		return nil, fmt.Errorf("failed to encode image: %w", err)
+	}
+	n.jpeg = buf.Bytes()
+
+	return n, nil
+}
+
+// exifOrientation returns the orientation tag of a JPEG's EXIF data, 1
+// (upright) when there is none.
+func exifOrientation(data []byte) int {
+	// Walk the JPEG segments up to the image data
+	for i := 2; i+4 <= len(data) && data[0] == 0xFF && data[1] == 0xD8; {
+		if data[i] != 0xFF {
+			return 1
+		}
+		marker := data[i+1]
+		if marker == 0xDA || marker == 0xD9 {
+			return 1
+		}
+		size := int(binary.BigEndian.Uint16(data[i+2:]))
+		end := i + 2 + size
+		if size < 2 || end > len(data) {
+			return 1
+		}
+		segment := data[i+4 : end]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiffOrientation(segment[6:])
+		}
+		i = end
+	}
+
+	return 1
+}
+
+// tiffOrientation reads tag 0x0112 of the first IFD of the EXIF TIFF data.
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return 1
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+	for i := range count {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			if v := int(order.Uint16(tiff[entry+8:])); v >= 1 && v <= 8 {
+				return v
+			}
+
+			return 1
+		}
+	}
+
+	return 1
+}
+
+// orient transforms the image so that it is displayed upright, for the EXIF
+// orientations 2 to 8.
+func orient(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	// Orientations 5 to 8 swap the sides
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := range h {
+		for x := range w {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirrored
+				dx, dy = w-1-x, y
+			case 3: // rotated 180
+				dx, dy = w-1-x, h-1-y
+			case 4: // mirrored vertically
+				dx, dy = x, h-1-y
+			case 5: // transposed
+				dx, dy = y, x
+			case 6: // rotated 90 clockwise
+				dx, dy = h-1-y, x
+			case 7: // transversed
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotated 90 counter-clockwise
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+
+	return dst
+}
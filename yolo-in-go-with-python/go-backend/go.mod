@@ -1,3 +1,8 @@
 module github.com/flashlabs/kiss-samples/yolo-in-go-with-python
 
 go 1.24.4
+
+require (
+	github.com/yalue/onnxruntime_go v1.21.0
+	golang.org/x/image v0.30.0
+)
@@ -1,103 +1,127 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
-	"io"
 	"log"
-	"mime/multipart"
-	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/flashlabs/kiss-samples/yolo-in-go-with-python/yoloclient"
 )
 
 const (
-	filePath   = "../example.jpg"
-	yoloAPIURL = "http://localhost:8000/detect"
+	filePath       = "../example.jpg"
+	yoloAPIURL     = "http://localhost:8000"
+	onnxModelPath  = "./yolov5s.onnx"
+	ortLibraryPath = "./onnxruntime_arm64.dylib"
 )
 
-// main is the entry point for the application. It prepares the image,
-// sends it to the YOLO API, and prints the result.
+// main is the entry point for the application. It runs the sub-command given
+// as the first argument, by default it sends an image to the YOLO API and
+// prints the detections.
 func main() {
-	// Prepare the image file as a multipart form
-	body, contentType, err := prepareMultipartForm(filePath)
-	if err != nil {
-		log.Fatal("Error preparing multipart form: ", err)
-	}
+	os.Exit(run(os.Args[1:]))
+}
 
-	// Send the HTTP POST request to the YOLO API
-	respBytes, err := sendYOLORequest(yoloAPIURL, body, contentType)
-	if err != nil {
-		log.Fatal("Error sending YOLO request: ", err)
+// run dispatches to a sub-command and returns the exit code.
+func run(args []string) int {
+	if len(args) > 0 {
+		switch args[0] {
+		case "compare":
+			return runCompare(args[1:])
+		case "bulk":
+			return runBulk(args[1:])
+		case "gateway":
+			return runGateway(args[1:])
+		case "detect":
+			return runDetect(args[1:])
+		}
 	}
 
-	// Print the detection results
-	fmt.Println(string(respBytes))
+	return runDetect(args)
 }
 
-// prepareMultipartForm creates a multipart/form-data body from the given file path.
-// It returns the form body, content type, and any error encountered.
-func prepareMultipartForm(filePath string) (*bytes.Buffer, string, error) {
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
+// runDetect sends a single image to the API and prints the result.
+func runDetect(args []string) int {
+	fs := flag.NewFlagSet("detect", flag.ContinueOnError)
+	image := fs.String("image", filePath, "image to send to the API")
+	detectorCfg := newDetectorConfig(fs)
+	stats := fs.Bool("stats", false, "print the per-replica stats of the python backend at the end")
+	asJSON := fs.Bool("json", false, "print the detections as JSON")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
 
-	// Open the file
-	file, err := os.Open(filePath)
+	detector, err := detectorCfg.newDetector()
 	if err != nil {
-		return nil, "", fmt.Errorf("failed to open file: %w", err)
+		log.Println("Error creating detector:", err)
+
+		return 2
 	}
 	defer func() {
-		if e := file.Close(); e != nil {
-			log.Println("Failed to close file", e)
+		if e := detector.Close(); e != nil {
+			log.Println("Failed to close detector", e)
 		}
 	}()
 
-	// Create a new form file field
-	part, err := writer.CreateFormFile("file", filepath.Base(filePath))
-	if err != nil {
-		return nil, "", fmt.Errorf("failed to create form file: %w", err)
-	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
 
-	// Copy the image data into the form
-	_, err = io.Copy(part, file)
+	// Open the image, the API client streams it without buffering
+	file, err := os.Open(*image)
 	if err != nil {
-		return nil, "", fmt.Errorf("failed to copy file: %w", err)
-	}
+		log.Println("Error opening image:", err)
 
-	// Close the multipart writer
-	if err = writer.Close(); err != nil {
-		log.Println("Failed to close writer", err)
+		return 1
 	}
+	defer func() {
+		if e := file.Close(); e != nil {
+			log.Println("Failed to close file", e)
+		}
+	}()
 
-	return body, writer.FormDataContentType(), nil
-}
-
-// sendYOLORequest sends the image as a multipart POST request to the specified YOLO API.
-// It returns the response body or an error.
-func sendYOLORequest(apiURL string, body *bytes.Buffer, contentType string) ([]byte, error) {
-	// Create a new HTTP POST request with the multipart data
-	req, err := http.NewRequest(http.MethodPost, apiURL, body)
+	detections, err := detector.Detect(ctx, file, filepath.Base(*image))
 	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
-	}
-	req.Header.Set("Content-Type", contentType)
+		log.Println("Error detecting objects:", err)
 
-	// Send the request and get the response
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to execute request: %w", err)
+		return 1
 	}
-	defer func() {
-		if e := resp.Body.Close(); e != nil {
-			log.Println("Failed to close body", e)
+	if client, ok := detector.(*yoloclient.Client); ok && *stats {
+		printStats(client.Stats())
+	}
+
+	// Print the detection results
+	if *asJSON {
+		if err := json.NewEncoder(os.Stdout).Encode(detections); err != nil {
+			log.Println("Error encoding detections:", err)
+
+			return 1
 		}
-	}()
 
-	// Read and return the response body
-	respBytes, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read response body: %w", err)
+		return 0
+	}
+	for _, d := range detections {
+		fmt.Printf("%-12s %.2f (%.0f, %.0f, %.0f, %.0f)\n", d.Name, d.Confidence, d.XMin, d.YMin, d.XMax, d.YMax)
 	}
 
-	return respBytes, nil
+	return 0
+}
+
+// printStats prints the counters and latencies of every replica.
+func printStats(stats []yoloclient.EndpointStats) {
+	w := tabwriter.NewWriter(os.Stderr, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "REPLICA\tHEALTHY\tBREAKER\tREQUESTS\tFAILURES\tHEDGES\tP50\tP99")
+	for _, s := range stats {
+		fmt.Fprintf(w, "%s\t%t\t%s\t%d\t%d\t%d\t%s\t%s\n", s.URL, s.Healthy, s.State, s.Requests, s.Failures, s.Hedges,
+			s.P50.Round(time.Millisecond), s.P99.Round(time.Millisecond))
+	}
+	if err := w.Flush(); err != nil {
+		log.Println("Failed to print stats", err)
+	}
 }
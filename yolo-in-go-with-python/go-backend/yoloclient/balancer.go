@@ -0,0 +1,213 @@
+package yoloclient
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Balancing selects the endpoint for each request.
+type Balancing int
+
+const (
+	// RoundRobin cycles through the available endpoints.
+	RoundRobin Balancing = iota
+	// LeastOutstanding picks the available endpoint with the fewest requests
+	// in flight.
+	LeastOutstanding
+)
+
+// ErrNoEndpoint means every endpoint is unhealthy or has an open circuit
+// breaker.
+var ErrNoEndpoint = errors.New("no available endpoint")
+
+const (
+	// latencyWindow is the number of recent latencies kept per endpoint
+	latencyWindow = 256
+	// hedgeMinSamples is the number of latencies needed before hedging
+	hedgeMinSamples = 20
+)
+
+// endpoint is one replica of the API.
+type endpoint struct {
+	url       string
+	detectURL string
+	breaker   breaker
+
+	healthy     atomic.Bool
+	outstanding atomic.Int64
+	requests    atomic.Int64
+	failures    atomic.Int64
+	hedges      atomic.Int64
+
+	mu        sync.Mutex
+	latencies []time.Duration
+	next      int
+}
+
+// observe adds the latency of a completed request to the window.
+func (e *endpoint) observe(d time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if len(e.latencies) < latencyWindow {
+		e.latencies = append(e.latencies, d)
+
+		return
+	}
+	e.latencies[e.next] = d
+	e.next = (e.next + 1) % latencyWindow
+}
+
+// percentiles returns the nearest-rank percentiles of the recent latencies,
+// or nil with fewer than minSamples of them.
+func (e *endpoint) percentiles(minSamples int, ps ...float64) []time.Duration {
+	e.mu.Lock()
+	sorted := slices.Clone(e.latencies)
+	e.mu.Unlock()
+
+	if len(sorted) == 0 || len(sorted) < minSamples {
+		return nil
+	}
+	slices.Sort(sorted)
+
+	out := make([]time.Duration, len(ps))
+	for i, p := range ps {
+		rank := int(p/100*float64(len(sorted))+0.5) - 1
+		out[i] = sorted[min(max(rank, 0), len(sorted)-1)]
+	}
+
+	return out
+}
+
+// pick returns an endpoint that may take a request, preferring ones not in
+// avoid. With fallback the avoided endpoints are the last resort, so a single
+// replica can be retried. A returned endpoint must be released with finish.
+func (c *Client) pick(avoid []*endpoint, fallback bool) (*endpoint, error) {
+	candidates := c.candidates()
+
+	passes := []bool{true}
+	if fallback {
+		passes = append(passes, false)
+	}
+	for _, preferred := range passes {
+		for _, e := range candidates {
+			if slices.Contains(avoid, e) == preferred || !e.healthy.Load() {
+				continue
+			}
+			allowed, changed := e.breaker.allow(c.now())
+			if changed {
+				c.stateChanged(e)
+			}
+			if allowed {
+				e.outstanding.Add(1)
+				e.requests.Add(1)
+
+				return e, nil
+			}
+		}
+	}
+
+	return nil, ErrNoEndpoint
+}
+
+// candidates orders the endpoints by the balancing policy.
+func (c *Client) candidates() []*endpoint {
+	start := int(c.counter.Add(1)-1) % len(c.endpoints)
+	ordered := append(slices.Clone(c.endpoints[start:]), c.endpoints[:start]...)
+	if c.balancing == LeastOutstanding {
+		outstanding := make(map[*endpoint]int64, len(ordered))
+		for _, e := range ordered {
+			outstanding[e] = e.outstanding.Load()
+		}
+		// Stable, so ties keep the round robin order
+		slices.SortStableFunc(ordered, func(a, b *endpoint) int {
+			return int(outstanding[a] - outstanding[b])
+		})
+	}
+
+	return ordered
+}
+
+// finish records the result of a request to an endpoint picked by pick.
+func (c *Client) finish(e *endpoint, o outcome, latency time.Duration) {
+	e.outstanding.Add(-1)
+	if o == outcomeFailure {
+		e.failures.Add(1)
+	}
+	if o != outcomeIgnored {
+		e.observe(latency)
+	}
+	if e.breaker.record(o, c.now()) {
+		c.stateChanged(e)
+	}
+	if c.observer != nil {
+		c.observer.RequestFinished(e.url, latency, o == outcomeFailure)
+	}
+}
+
+func (c *Client) stateChanged(e *endpoint) {
+	state := e.breaker.current()
+	log.Printf("endpoint %s circuit breaker is %s", e.url, state)
+	if c.observer != nil {
+		c.observer.StateChanged(e.url, state)
+	}
+}
+
+// healthCheck polls GET /health of every endpoint until the context is
+// cancelled. Unhealthy endpoints get no requests.
+func (c *Client) healthCheck(ctx context.Context) {
+	ticker := time.NewTicker(c.healthInterval)
+	defer ticker.Stop()
+
+	for {
+		var wg sync.WaitGroup
+		for _, e := range c.endpoints {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				c.checkEndpoint(ctx, e)
+			}()
+		}
+		wg.Wait()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *Client) checkEndpoint(ctx context.Context, e *endpoint) {
+	ctx, cancel := context.WithTimeout(ctx, c.healthInterval)
+	defer cancel()
+
+	healthy := false
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, e.url+"/health", nil)
+	if err == nil {
+		resp, err := c.httpClient.Do(req)
+		if err == nil {
+			healthy = resp.StatusCode >= 200 && resp.StatusCode <= 299
+			if err := resp.Body.Close(); err != nil {
+				log.Println("Failed to close body", err)
+			}
+		}
+	}
+	if errors.Is(ctx.Err(), context.Canceled) {
+		// The client was closed during the check
+		return
+	}
+
+	if e.healthy.Swap(healthy) != healthy {
+		log.Printf("endpoint %s healthy: %t", e.url, healthy)
+		if c.observer != nil {
+			c.observer.HealthChanged(e.url, healthy)
+		}
+	}
+}
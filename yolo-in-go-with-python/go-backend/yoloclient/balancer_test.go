@@ -0,0 +1,289 @@
+package yoloclient
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	start := time.Unix(0, 0)
+	b := &breaker{threshold: 2, cooldown: time.Second}
+
+	steps := []struct {
+		name        string
+		at          time.Duration
+		record      *outcome
+		wantAllowed bool
+		wantState   State
+	}{
+		{name: "closed", wantAllowed: true, wantState: StateClosed},
+		{name: "first failure", record: ptr(outcomeFailure), wantState: StateClosed},
+		{name: "second failure opens", record: ptr(outcomeFailure), wantState: StateOpen},
+		{name: "open rejects", at: 500 * time.Millisecond, wantAllowed: false, wantState: StateOpen},
+		{name: "probe after the cooldown", at: time.Second, wantAllowed: true, wantState: StateHalfOpen},
+		{name: "one probe at a time", at: time.Second, wantAllowed: false, wantState: StateHalfOpen},
+		{name: "failed probe opens", at: time.Second, record: ptr(outcomeFailure), wantState: StateOpen},
+		{name: "second probe", at: 2 * time.Second, wantAllowed: true, wantState: StateHalfOpen},
+		{name: "ignored probe frees the slot", at: 2 * time.Second, record: ptr(outcomeIgnored), wantState: StateHalfOpen},
+		{name: "third probe", at: 2 * time.Second, wantAllowed: true, wantState: StateHalfOpen},
+		{name: "successful probe closes", at: 2 * time.Second, record: ptr(outcomeSuccess), wantState: StateClosed},
+	}
+
+	for _, s := range steps {
+		now := start.Add(s.at)
+		if s.record != nil {
+			b.record(*s.record, now)
+		} else if allowed, _ := b.allow(now); allowed != s.wantAllowed {
+			t.Fatalf("%s: allow() = %t, want %t", s.name, allowed, s.wantAllowed)
+		}
+		if got := b.current(); got != s.wantState {
+			t.Fatalf("%s: state = %s, want %s", s.name, got, s.wantState)
+		}
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestPick(t *testing.T) {
+	c, err := NewBalanced([]string{"http://a", "http://b", "http://c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b, cc := c.endpoints[0], c.endpoints[1], c.endpoints[2]
+
+	names := func(n int, avoid []*endpoint) string {
+		var got []string
+		for range n {
+			e, err := c.pick(avoid, true)
+			if err != nil {
+				return err.Error()
+			}
+			c.finish(e, outcomeIgnored, 0)
+			got = append(got, strings.TrimPrefix(e.url, "http://"))
+		}
+
+		return strings.Join(got, ",")
+	}
+
+	if got := names(4, nil); got != "a,b,c,a" {
+		t.Errorf("round robin picked %s, want a,b,c,a", got)
+	}
+
+	// The turn of b goes to the next one
+	b.healthy.Store(false)
+	if got := names(3, nil); got != "c,c,a" {
+		t.Errorf("round robin without the unhealthy b picked %s, want c,c,a", got)
+	}
+	b.healthy.Store(true)
+
+	if got := names(2, []*endpoint{a, b}); got != "c,c" {
+		t.Errorf("picked %s avoiding a and b, want c,c", got)
+	}
+	if got := names(1, []*endpoint{a, b, cc}); got == ErrNoEndpoint.Error() {
+		t.Error("pick() found no endpoint when all are avoided, want a fallback")
+	}
+
+	c.balancing = LeastOutstanding
+	a.outstanding.Store(3)
+	b.outstanding.Store(1)
+	cc.outstanding.Store(2)
+	if got := names(1, nil); got != "b" {
+		t.Errorf("least outstanding picked %s, want b", got)
+	}
+
+	for _, e := range c.endpoints {
+		e.healthy.Store(false)
+	}
+	if _, err := c.pick(nil, true); err != ErrNoEndpoint {
+		t.Errorf("pick() error = %v with no healthy endpoint, want ErrNoEndpoint", err)
+	}
+}
+
+// recorder is an Observer keeping the events.
+type recorder struct {
+	mu     sync.Mutex
+	states []string
+	health []string
+	hedged []string
+}
+
+func (r *recorder) StateChanged(endpoint string, state State) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.states = append(r.states, endpoint+" "+state.String())
+}
+
+func (r *recorder) HealthChanged(endpoint string, healthy bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if healthy {
+		r.health = append(r.health, endpoint+" healthy")
+	} else {
+		r.health = append(r.health, endpoint+" unhealthy")
+	}
+}
+
+func (r *recorder) RequestFinished(string, time.Duration, bool) {}
+
+func (r *recorder) Hedged(endpoint string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hedged = append(r.hedged, endpoint)
+}
+
+func TestCircuitBreakerSkipsFailingEndpoint(t *testing.T) {
+	failing, failingCalls := fakeAPI(t, 500, 500, 500, 500, 500, 500)
+	working, _ := fakeAPI(t)
+
+	now := time.Unix(0, 0)
+	obs := &recorder{}
+	c, err := NewBalanced([]string{failing.URL, working.URL},
+		WithBackoff(0, 0), WithCircuitBreaker(2, time.Minute), WithObserver(obs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.now = func() time.Time { return now }
+
+	// Every request alternates, failing ones are retried on the other
+	// endpoint, until the breaker opens after the second failure
+	for range 6 {
+		if _, err := c.Detect(context.Background(), strings.NewReader("jpeg bytes"), "example.jpg"); err != nil {
+			t.Fatalf("Detect() returned error: %s", err)
+		}
+	}
+	if got := failingCalls.Load(); got != 2 {
+		t.Errorf("failing endpoint called %d times, want 2 before the breaker opened", got)
+	}
+
+	// After the cooldown a probe goes to the failing endpoint again
+	now = now.Add(time.Minute)
+	for range 2 {
+		if _, err := c.Detect(context.Background(), strings.NewReader("jpeg bytes"), "example.jpg"); err != nil {
+			t.Fatalf("Detect() returned error: %s", err)
+		}
+	}
+	if got := failingCalls.Load(); got != 3 {
+		t.Errorf("failing endpoint called %d times, want a single probe after the cooldown", got)
+	}
+
+	want := []string{failing.URL + " open", failing.URL + " half-open", failing.URL + " open"}
+	obs.mu.Lock()
+	defer obs.mu.Unlock()
+	if strings.Join(obs.states, ",") != strings.Join(want, ",") {
+		t.Errorf("state changes = %v, want %v", obs.states, want)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	var healthy atomic.Bool
+	var detectCalls atomic.Int32
+	sick := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			if !healthy.Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+
+			return
+		}
+		detectCalls.Add(1)
+		_, _ = io.Copy(io.Discard, r.Body)
+		_, _ = io.WriteString(w, detectResponse)
+	}))
+	defer sick.Close()
+	working, _ := fakeAPI(t)
+
+	obs := &recorder{}
+	c, err := NewBalanced([]string{sick.URL, working.URL}, WithHealthCheck(5*time.Millisecond), WithObserver(obs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	waitFor(t, func() bool { return !c.endpoints[0].healthy.Load() })
+	for range 4 {
+		if _, err := c.Detect(context.Background(), strings.NewReader("jpeg bytes"), "example.jpg"); err != nil {
+			t.Fatalf("Detect() returned error: %s", err)
+		}
+	}
+	if detectCalls.Load() != 0 {
+		t.Errorf("unhealthy endpoint got %d requests, want none", detectCalls.Load())
+	}
+
+	healthy.Store(true)
+	waitFor(t, func() bool { return c.endpoints[0].healthy.Load() })
+
+	obs.mu.Lock()
+	defer obs.mu.Unlock()
+	want := sick.URL + " unhealthy," + sick.URL + " healthy"
+	if strings.Join(obs.health, ",") != want {
+		t.Errorf("health changes = %v, want %s", obs.health, want)
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHedging(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		<-r.Context().Done()
+	}))
+	defer slow.Close()
+	fast, fastCalls := fakeAPI(t)
+
+	obs := &recorder{}
+	c, err := NewBalanced([]string{slow.URL, fast.URL}, WithHedging(90), WithObserver(obs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The slow endpoint used to answer in 10ms
+	for range hedgeMinSamples {
+		c.endpoints[0].observe(10 * time.Millisecond)
+	}
+
+	start := time.Now()
+	got, err := c.Detect(context.Background(), strings.NewReader("jpeg bytes"), "example.jpg")
+	if err != nil {
+		t.Fatalf("Detect() returned error: %s", err)
+	}
+	if len(got) != 1 || time.Since(start) > 2*time.Second {
+		t.Errorf("Detect() = %v after %s, want the hedged answer", got, time.Since(start))
+	}
+	if fastCalls.Load() != 1 {
+		t.Errorf("fast endpoint called %d times, want 1 hedged request", fastCalls.Load())
+	}
+
+	stats := c.Stats()
+	if stats[1].Hedges != 1 || stats[0].Requests != 1 || stats[1].Requests != 1 {
+		t.Errorf("Stats() = %+v, want a request to each endpoint and a hedge", stats)
+	}
+	// The lost request is cancelled and doesn't count as a failure
+	waitFor(t, func() bool { return c.endpoints[0].outstanding.Load() == 0 })
+	if stats := c.Stats(); stats[0].Failures != 0 || stats[0].State != StateClosed {
+		t.Errorf("slow endpoint stats = %+v, want no failure", stats[0])
+	}
+
+	obs.mu.Lock()
+	defer obs.mu.Unlock()
+	if len(obs.hedged) != 1 || obs.hedged[0] != fast.URL {
+		t.Errorf("hedged to %v, want %s", obs.hedged, fast.URL)
+	}
+}
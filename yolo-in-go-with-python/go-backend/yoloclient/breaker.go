@@ -0,0 +1,121 @@
+package yoloclient
+
+import (
+	"sync"
+	"time"
+)
+
+// State is the state of an endpoint's circuit breaker.
+type State int
+
+const (
+	// StateClosed lets all requests through.
+	StateClosed State = iota
+	// StateOpen rejects requests until the cooldown has passed.
+	StateOpen
+	// StateHalfOpen lets a single probe request through, which closes the
+	// breaker on success and opens it again on failure.
+	StateHalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateOpen:
+		return "open"
+	case StateHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+func (s State) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// outcome is how a request ended, as far as the breaker is concerned.
+type outcome int
+
+const (
+	outcomeSuccess outcome = iota
+	outcomeFailure
+	// outcomeIgnored is a request cancelled by the caller or a lost hedge,
+	// which says nothing about the endpoint
+	outcomeIgnored
+)
+
+// breaker opens after threshold consecutive failures.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    State
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// allow reports whether a request may be sent now. In the half-open state
+// only one caller gets through, until its outcome is recorded.
+func (b *breaker) allow(now time.Time) (allowed bool, changed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case StateOpen:
+		if now.Sub(b.openedAt) < b.cooldown {
+			return false, false
+		}
+		b.state = StateHalfOpen
+		b.probing = true
+
+		return true, true
+	case StateHalfOpen:
+		if b.probing {
+			return false, false
+		}
+		b.probing = true
+
+		return true, false
+	default:
+		return true, false
+	}
+}
+
+// record updates the breaker with the outcome of an allowed request and
+// reports whether its state changed.
+func (b *breaker) record(o outcome, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	before := b.state
+	switch {
+	case before == StateOpen:
+		// A request sent before the breaker opened, it stays open until
+		// the cooldown ends
+	case o == outcomeSuccess:
+		b.failures = 0
+		b.state = StateClosed
+	case o == outcomeFailure:
+		b.failures++
+		if before == StateHalfOpen || b.failures >= b.threshold {
+			b.state = StateOpen
+			b.openedAt = now
+		}
+	}
+	if before == StateHalfOpen {
+		b.probing = false
+	}
+
+	return b.state != before
+}
+
+func (b *breaker) current() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state
+}
@@ -0,0 +1,446 @@
+// Package yoloclient calls the YOLOv5 detection API of yolo-api/detect.py.
+package yoloclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultTimeout     = 30 * time.Second
+	defaultRetries     = 2
+	defaultBaseBackoff = 200 * time.Millisecond
+	defaultMaxBackoff  = 5 * time.Second
+
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = 10 * time.Second
+
+	// maxErrorBody limits how much of an error response is kept
+	maxErrorBody = 4 << 10
+)
+
+// Detection is one object found by the model, in the pixel coordinates of
+// the uploaded image. The JSON names are the pandas xyxy columns.
+type Detection struct {
+	XMin       float64 `json:"xmin"`
+	YMin       float64 `json:"ymin"`
+	XMax       float64 `json:"xmax"`
+	YMax       float64 `json:"ymax"`
+	Confidence float64 `json:"confidence"`
+	Class      int     `json:"class"`
+	Name       string  `json:"name"`
+}
+
+// Client sends images to the /detect endpoint of one or more replicas of the
+// API. It is safe for concurrent use.
+type Client struct {
+	endpoints   []*endpoint
+	httpClient  *http.Client
+	timeout     time.Duration
+	retries     int
+	baseBackoff time.Duration
+	maxBackoff  time.Duration
+
+	balancing       Balancing
+	counter         atomic.Uint64
+	healthInterval  time.Duration
+	hedgePercentile float64
+	observer        Observer
+	now             func() time.Time
+
+	stopHealthCheck context.CancelFunc
+	healthCheckDone chan struct{}
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient sets the HTTP client used for the requests. Its own Timeout
+// applies on top of the per attempt timeout.
+func WithHTTPClient(c *http.Client) Option {
+	return func(cl *Client) {
+		cl.httpClient = c
+	}
+}
+
+// WithTimeout sets the timeout of a single attempt, including the upload and
+// reading the response. Zero disables it.
+func WithTimeout(d time.Duration) Option {
+	return func(cl *Client) {
+		cl.timeout = d
+	}
+}
+
+// WithRetries sets how many times a request is retried after a server error
+// or a failed connection.
+func WithRetries(n int) Option {
+	return func(cl *Client) {
+		cl.retries = n
+	}
+}
+
+// WithBackoff sets the backoff between retries. The n-th retry waits a random
+// duration up to base*2^n, capped at max.
+func WithBackoff(base, max time.Duration) Option {
+	return func(cl *Client) {
+		cl.baseBackoff = base
+		cl.maxBackoff = max
+	}
+}
+
+// WithBalancing sets how the endpoint of a request is selected, RoundRobin
+// by default.
+func WithBalancing(b Balancing) Option {
+	return func(cl *Client) {
+		cl.balancing = b
+	}
+}
+
+// WithCircuitBreaker opens the circuit of an endpoint after threshold
+// consecutive failures (server errors, failed connections and timeouts). It
+// gets no requests for the cooldown, then a single probe decides whether it
+// is closed again. The default is 5 failures and 10 seconds.
+func WithCircuitBreaker(threshold int, cooldown time.Duration) Option {
+	return func(cl *Client) {
+		for _, e := range cl.endpoints {
+			e.breaker.threshold = threshold
+			e.breaker.cooldown = cooldown
+		}
+	}
+}
+
+// WithHealthCheck polls GET /health of every endpoint at the interval, and
+// sends no requests to endpoints failing it. The check is off by default, and
+// stopped by Close.
+func WithHealthCheck(interval time.Duration) Option {
+	return func(cl *Client) {
+		cl.healthInterval = interval
+	}
+}
+
+// WithHedging sends a second request to another endpoint when the first one
+// takes longer than the given latency percentile (e.g. 95) of its endpoint,
+// and returns the first success. Hedging needs at least two endpoints and an
+// image implementing io.ReaderAt, and starts once the endpoint has a few
+// recorded latencies.
+func WithHedging(percentile float64) Option {
+	return func(cl *Client) {
+		cl.hedgePercentile = percentile
+	}
+}
+
+// WithObserver reports the client events, e.g. to export them as metrics.
+func WithObserver(o Observer) Option {
+	return func(cl *Client) {
+		cl.observer = o
+	}
+}
+
+// New creates a client for the API at baseURL, e.g. http://localhost:8000.
+func New(baseURL string, opts ...Option) (*Client, error) {
+	return NewBalanced([]string{baseURL}, opts...)
+}
+
+// NewBalanced creates a client spreading the requests over several replicas
+// of the API. Clients with a health check must be closed.
+func NewBalanced(baseURLs []string, opts ...Option) (*Client, error) {
+	if len(baseURLs) == 0 {
+		return nil, errors.New("no API URL")
+	}
+
+	c := &Client{
+		httpClient:  &http.Client{},
+		timeout:     defaultTimeout,
+		retries:     defaultRetries,
+		baseBackoff: defaultBaseBackoff,
+		maxBackoff:  defaultMaxBackoff,
+		now:         time.Now,
+	}
+	for _, u := range baseURLs {
+		if !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+			return nil, fmt.Errorf("invalid API URL %q, expected http:// or https://", u)
+		}
+		u = strings.TrimSuffix(u, "/")
+		e := &endpoint{
+			url:       u,
+			detectURL: u + "/detect",
+			breaker:   breaker{threshold: defaultBreakerThreshold, cooldown: defaultBreakerCooldown},
+		}
+		e.healthy.Store(true)
+		c.endpoints = append(c.endpoints, e)
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	if c.healthInterval > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		c.stopHealthCheck = cancel
+		c.healthCheckDone = make(chan struct{})
+		go func() {
+			defer close(c.healthCheckDone)
+			c.healthCheck(ctx)
+		}()
+	}
+
+	return c, nil
+}
+
+// Close stops the health check.
+func (c *Client) Close() error {
+	if c.stopHealthCheck != nil {
+		c.stopHealthCheck()
+		<-c.healthCheckDone
+	}
+
+	return nil
+}
+
+// Detect uploads the image and returns the detections. The image is streamed,
+// not buffered, so a request can only be retried when r is also an io.Seeker
+// (like an *os.File); other readers get a single attempt. Retries go to
+// another endpoint when there is one.
+func (c *Client) Detect(ctx context.Context, r io.Reader, filename string) ([]Detection, error) {
+	src, err := newSource(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var tried []*endpoint
+	for attempt := 0; ; attempt++ {
+		detections, used, err := c.attempt(ctx, src, filename, tried)
+		tried = append(tried, used...)
+		if err == nil || !src.rewindable() || attempt >= c.retries || !retryable(err) {
+			return detections, err
+		}
+
+		wait := c.backoff(attempt)
+		log.Printf("detect attempt %d failed, retrying in %s: %s", attempt+1, wait, err)
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w (last error: %w)", ctx.Err(), err)
+		case <-time.After(wait):
+		}
+	}
+}
+
+// attempt sends the image to an endpoint, hedged to a second one when it is
+// slow, and returns the endpoints used.
+func (c *Client) attempt(ctx context.Context, src *source, filename string, avoid []*endpoint) ([]Detection, []*endpoint, error) {
+	primary, err := c.pick(avoid, true)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Cancels the lost hedge on return
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		detections []Detection
+		err        error
+	}
+	results := make(chan result, 2)
+	send := func(e *endpoint) {
+		r, err := src.open()
+		if err != nil {
+			c.finish(e, outcomeIgnored, 0)
+			results <- result{err: err}
+
+			return
+		}
+		go func() {
+			start := time.Now()
+			detections, err := c.detect(ctx, e, r, filename)
+			c.finish(e, c.outcome(ctx, err), time.Since(start))
+			results <- result{detections, err}
+		}()
+	}
+
+	var hedge <-chan time.Time
+	if c.hedgePercentile > 0 && src.concurrent() && len(c.endpoints) > 1 {
+		if p := primary.percentiles(hedgeMinSamples, c.hedgePercentile); p != nil {
+			timer := time.NewTimer(p[0])
+			defer timer.Stop()
+			hedge = timer.C
+		}
+	}
+
+	used := []*endpoint{primary}
+	send(primary)
+	pending := 1
+	var firstErr error
+	for {
+		select {
+		case <-hedge:
+			hedge = nil
+			e, err := c.pick(used, false)
+			if err != nil {
+				continue
+			}
+			e.hedges.Add(1)
+			if c.observer != nil {
+				c.observer.Hedged(e.url)
+			}
+			used = append(used, e)
+			send(e)
+			pending++
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				return res.detections, used, nil
+			}
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			if pending == 0 {
+				return nil, used, firstErr
+			}
+		}
+	}
+}
+
+// outcome classifies the result of a request for the circuit breaker.
+func (c *Client) outcome(ctx context.Context, err error) outcome {
+	var srcErr *sourceError
+	switch {
+	case err == nil:
+		return outcomeSuccess
+	case ctx.Err() != nil || errors.As(err, &srcErr):
+		return outcomeIgnored
+	case retryable(err) || errors.Is(err, context.DeadlineExceeded):
+		return outcomeFailure
+	default:
+		// The endpoint answered, e.g. rejected the image
+		return outcomeSuccess
+	}
+}
+
+// detect sends a single request to the endpoint.
+func (c *Client) detect(ctx context.Context, e *endpoint, r io.Reader, filename string) ([]Detection, error) {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	// The multipart body is written into a pipe while the request reads it
+	pr, pw := io.Pipe()
+	writer := multipart.NewWriter(pw)
+	src := &sourceReader{r: r}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pw.CloseWithError(writeForm(writer, src, filename))
+	}()
+	defer func() {
+		// Unblocks the writer when the request ended before reading it all
+		if e := pr.Close(); e != nil {
+			log.Println("Failed to close pipe", e)
+		}
+		<-done
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.detectURL, pr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		pr.CloseWithError(err)
+		<-done
+		if src.err != nil {
+			return nil, &sourceError{Err: src.err}
+		}
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("failed to execute request: %w", ctx.Err())
+		}
+
+		return nil, &ConnectionError{Err: err}
+	}
+	defer func() {
+		if e := resp.Body.Close(); e != nil {
+			log.Println("Failed to close body", e)
+		}
+	}()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, newAPIError(resp)
+	}
+
+	var detections []Detection
+	if err := json.NewDecoder(resp.Body).Decode(&detections); err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("failed to read response: %w", ctx.Err())
+		}
+
+		return nil, fmt.Errorf("%w: %w", ErrInvalidResponse, err)
+	}
+
+	return detections, nil
+}
+
+func writeForm(writer *multipart.Writer, r io.Reader, filename string) error {
+	part, err := writer.CreateFormFile("file", filename)
+	if err != nil {
+		return fmt.Errorf("failed to create form file: %w", err)
+	}
+
+	if _, err := io.Copy(part, r); err != nil {
+		return err
+	}
+
+	return writer.Close()
+}
+
+// sourceReader remembers a read error of the image, to tell it apart from
+// a failed upload.
+type sourceReader struct {
+	r   io.Reader
+	err error
+}
+
+func (s *sourceReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if err != nil && err != io.EOF {
+		s.err = err
+	}
+
+	return n, err
+}
+
+// backoff returns a random wait up to base*2^attempt ("full jitter").
+func (c *Client) backoff(attempt int) time.Duration {
+	ceiling := c.maxBackoff
+	if attempt < 30 {
+		ceiling = min(c.baseBackoff<<attempt, c.maxBackoff)
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+
+	return rand.N(ceiling + 1)
+}
+
+// retryable reports whether a failed attempt may succeed when repeated.
+func retryable(err error) bool {
+	var connErr *ConnectionError
+	if errors.As(err, &connErr) {
+		return true
+	}
+
+	return errors.Is(err, ErrServer)
+}
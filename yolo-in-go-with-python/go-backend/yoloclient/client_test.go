@@ -0,0 +1,276 @@
+package yoloclient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const detectResponse = `[{"xmin":451.7,"ymin":256.8,"xmax":572.8,"ymax":355.9,"confidence":0.86,"class":41,"name":"cup"}]`
+
+// fakeAPI serves /health and /detect, answering with the given statuses in
+// turn and the detections once they are used up.
+func fakeAPI(t *testing.T, statuses ...int) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			_, _ = io.WriteString(w, `{"status":"ok"}`)
+
+			return
+		}
+		if r.URL.Path != "/detect" || r.Method != http.MethodPost {
+			http.NotFound(w, r)
+
+			return
+		}
+
+		call := int(calls.Add(1)) - 1
+
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			_, _ = io.WriteString(w, `{"detail":[{"loc":["body","file"],"msg":"field required"}]}`)
+
+			return
+		}
+		defer file.Close()
+		data, _ := io.ReadAll(file)
+		if header.Filename != "example.jpg" || string(data) != "jpeg bytes" {
+			t.Errorf("got file %q with %q, want example.jpg with the image", header.Filename, data)
+		}
+
+		if call < len(statuses) {
+			w.WriteHeader(statuses[call])
+			_, _ = io.WriteString(w, `{"detail":"model failed"}`)
+
+			return
+		}
+		_, _ = io.WriteString(w, detectResponse)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &calls
+}
+
+func newTestClient(t *testing.T, url string, opts ...Option) *Client {
+	t.Helper()
+
+	c, err := New(url, append([]Option{WithBackoff(time.Millisecond, 5*time.Millisecond)}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+func TestDetect(t *testing.T) {
+	want := []Detection{{XMin: 451.7, YMin: 256.8, XMax: 572.8, YMax: 355.9, Confidence: 0.86, Class: 41, Name: "cup"}}
+
+	tests := []struct {
+		name      string
+		statuses  []int
+		reader    func() io.Reader
+		want      []Detection
+		wantErr   error
+		wantCalls int32
+	}{
+		{
+			name:      "success",
+			reader:    func() io.Reader { return strings.NewReader("jpeg bytes") },
+			want:      want,
+			wantCalls: 1,
+		},
+		{
+			name:      "retries server errors",
+			statuses:  []int{http.StatusInternalServerError, http.StatusBadGateway},
+			reader:    func() io.Reader { return strings.NewReader("jpeg bytes") },
+			want:      want,
+			wantCalls: 3,
+		},
+		{
+			name:      "gives up after the retries",
+			statuses:  []int{500, 500, 500, 500},
+			reader:    func() io.Reader { return strings.NewReader("jpeg bytes") },
+			wantErr:   ErrServer,
+			wantCalls: 3,
+		},
+		{
+			name:      "doesn't retry a plain reader",
+			statuses:  []int{http.StatusServiceUnavailable},
+			reader:    func() io.Reader { return io.MultiReader(strings.NewReader("jpeg bytes")) },
+			wantErr:   ErrServer,
+			wantCalls: 1,
+		},
+		{
+			name:      "client errors aren't retried",
+			statuses:  []int{http.StatusBadRequest},
+			reader:    func() io.Reader { return strings.NewReader("jpeg bytes") },
+			wantErr:   ErrInvalidImage,
+			wantCalls: 1,
+		},
+		{
+			name:      "too large",
+			statuses:  []int{http.StatusRequestEntityTooLarge},
+			reader:    func() io.Reader { return bytes.NewReader([]byte("jpeg bytes")) },
+			wantErr:   ErrTooLarge,
+			wantCalls: 1,
+		},
+		{
+			name:      "rate limited",
+			statuses:  []int{http.StatusTooManyRequests},
+			reader:    func() io.Reader { return strings.NewReader("jpeg bytes") },
+			wantErr:   ErrRateLimited,
+			wantCalls: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, calls := fakeAPI(t, tt.statuses...)
+			c := newTestClient(t, server.URL)
+
+			got, err := c.Detect(context.Background(), tt.reader(), "example.jpg")
+
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Detect() error = %v, want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Detect() = %v, want %v", got, tt.want)
+			}
+			if calls.Load() != tt.wantCalls {
+				t.Errorf("API called %d times, want %d", calls.Load(), tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestDetectAPIError(t *testing.T) {
+	server, _ := fakeAPI(t, http.StatusBadRequest)
+	c := newTestClient(t, server.URL)
+
+	_, err := c.Detect(context.Background(), strings.NewReader("jpeg bytes"), "example.jpg")
+
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("Detect() error = %v, want an *APIError", err)
+	}
+	if apiErr.StatusCode != http.StatusBadRequest || apiErr.Detail != "model failed" {
+		t.Errorf("APIError = %+v, want status 400 and the FastAPI detail", apiErr)
+	}
+}
+
+func TestDetectNotFound(t *testing.T) {
+	server, _ := fakeAPI(t)
+	c := newTestClient(t, server.URL+"/v2")
+
+	_, err := c.Detect(context.Background(), strings.NewReader("jpeg bytes"), "example.jpg")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("Detect() error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestDetectConnectionError(t *testing.T) {
+	server, _ := fakeAPI(t)
+	url := server.URL
+	server.Close()
+
+	c := newTestClient(t, url, WithRetries(1))
+	_, err := c.Detect(context.Background(), strings.NewReader("jpeg bytes"), "example.jpg")
+
+	var connErr *ConnectionError
+	if !errors.As(err, &connErr) {
+		t.Errorf("Detect() error = %v, want a *ConnectionError", err)
+	}
+}
+
+func TestDetectInvalidResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		_, _ = io.WriteString(w, `{"detections":[]}`)
+	}))
+	defer server.Close()
+	c := newTestClient(t, server.URL)
+
+	_, err := c.Detect(context.Background(), strings.NewReader("jpeg bytes"), "example.jpg")
+	if !errors.Is(err, ErrInvalidResponse) {
+		t.Errorf("Detect() error = %v, want ErrInvalidResponse", err)
+	}
+}
+
+func TestDetectTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	c := newTestClient(t, server.URL, WithTimeout(20*time.Millisecond), WithRetries(0))
+	_, err := c.Detect(context.Background(), strings.NewReader("jpeg bytes"), "example.jpg")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Detect() error = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("disk failure")
+}
+
+func TestDetectReadError(t *testing.T) {
+	server, calls := fakeAPI(t)
+	c := newTestClient(t, server.URL)
+
+	_, err := c.Detect(context.Background(), failingReader{}, "example.jpg")
+	if err == nil || !strings.Contains(err.Error(), "disk failure") {
+		t.Errorf("Detect() error = %v, want the read error", err)
+	}
+	var connErr *ConnectionError
+	if errors.As(err, &connErr) {
+		t.Errorf("Detect() error = %v, a read error must not be a connection error", err)
+	}
+	if calls.Load() > 1 {
+		t.Errorf("API called %d times, a read error must not be retried", calls.Load())
+	}
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New("localhost:8000"); err == nil {
+		t.Error("New() accepted a URL without a scheme")
+	}
+
+	c, err := New("http://localhost:8000/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.endpoints[0].detectURL != "http://localhost:8000/detect" {
+		t.Errorf("New() url = %q, want http://localhost:8000/detect", c.endpoints[0].detectURL)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	c := &Client{baseBackoff: 100 * time.Millisecond, maxBackoff: time.Second}
+
+	for attempt, ceiling := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second} {
+		for range 100 {
+			if d := c.backoff(attempt); d < 0 || d > ceiling {
+				t.Fatalf("backoff(%d) = %s, want at most %s", attempt, d, ceiling)
+			}
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package yoloclient
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Errors matched with errors.Is against the errors returned by Detect.
+var (
+	// ErrInvalidImage means the API couldn't read the uploaded image (4xx).
+	ErrInvalidImage = errors.New("invalid image")
+	// ErrTooLarge means the image exceeds the upload limit (413).
+	ErrTooLarge = errors.New("image too large")
+	// ErrRateLimited means the API asked to slow down (429).
+	ErrRateLimited = errors.New("rate limited")
+	// ErrNotFound means the URL doesn't point at the detection API (404).
+	ErrNotFound = errors.New("detect endpoint not found")
+	// ErrServer means the API failed to process the request (5xx). These
+	// are retried.
+	ErrServer = errors.New("server error")
+	// ErrInvalidResponse means a successful response wasn't the expected
+	// list of detections.
+	ErrInvalidResponse = errors.New("invalid response")
+)
+
+// APIError is returned for non-2xx responses. It matches one of the
+// sentinel errors above with errors.Is.
+type APIError struct {
+	StatusCode int
+	// Detail is the FastAPI error detail, or the start of the body when the
+	// response isn't a FastAPI error
+	Detail string
+}
+
+func newAPIError(resp *http.Response) *APIError {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+
+	e := &APIError{StatusCode: resp.StatusCode, Detail: strings.TrimSpace(string(body))}
+	var fastAPI struct {
+		Detail json.RawMessage `json:"detail"`
+	}
+	if json.Unmarshal(body, &fastAPI) == nil && len(fastAPI.Detail) > 0 {
+		// The detail is a string, or a list of validation errors
+		var s string
+		if json.Unmarshal(fastAPI.Detail, &s) == nil {
+			e.Detail = s
+		} else {
+			e.Detail = string(fastAPI.Detail)
+		}
+	}
+
+	return e
+}
+
+func (e *APIError) Error() string {
+	if e.Detail == "" {
+		return fmt.Sprintf("detect API returned %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+
+	return fmt.Sprintf("detect API returned %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Detail)
+}
+
+func (e *APIError) Unwrap() error {
+	switch {
+	case e.StatusCode == http.StatusRequestEntityTooLarge:
+		return ErrTooLarge
+	case e.StatusCode == http.StatusTooManyRequests:
+		return ErrRateLimited
+	case e.StatusCode == http.StatusNotFound || e.StatusCode == http.StatusMethodNotAllowed:
+		return ErrNotFound
+	case e.StatusCode >= 500:
+		return ErrServer
+	case e.StatusCode >= 400:
+		return ErrInvalidImage
+	default:
+		return ErrInvalidResponse
+	}
+}
+
+// ConnectionError is returned when the request couldn't be sent or the
+// connection failed before a response arrived. It is retried.
+type ConnectionError struct {
+	Err error
+}
+
+func (e *ConnectionError) Error() string {
+	return fmt.Sprintf("failed to execute request: %s", e.Err)
+}
+
+func (e *ConnectionError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,91 @@
+package yoloclient
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// source hands out the image for each request. A reader implementing
+// io.ReaderAt and io.Seeker can be read by concurrent hedged requests, an
+// io.Seeker only rewound for a retry, and any other reader read once.
+type source struct {
+	r      io.Reader
+	at     io.ReaderAt
+	seeker io.Seeker
+	start  int64
+	size   int64
+	opened bool
+}
+
+func newSource(r io.Reader) (*source, error) {
+	s := &source{r: r}
+
+	seeker, ok := r.(io.Seeker)
+	if !ok {
+		return s, nil
+	}
+	start, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		// Not seekable after all, e.g. a pipe
+		return s, nil
+	}
+	s.seeker, s.start = seeker, start
+
+	if at, ok := r.(io.ReaderAt); ok {
+		end, err := seeker.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find image size: %w", err)
+		}
+		if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("failed to rewind image: %w", err)
+		}
+		s.at, s.size = at, end-start
+	}
+
+	return s, nil
+}
+
+// rewindable reports whether the image can be sent more than once.
+func (s *source) rewindable() bool {
+	return s.seeker != nil
+}
+
+// concurrent reports whether the image can be sent by parallel requests.
+func (s *source) concurrent() bool {
+	return s.at != nil
+}
+
+// open returns a reader of the whole image. Unless the source is concurrent,
+// the previous reader must be done.
+func (s *source) open() (io.Reader, error) {
+	if s.at != nil {
+		return io.NewSectionReader(s.at, s.start, s.size), nil
+	}
+
+	if s.opened {
+		if s.seeker == nil {
+			return nil, errors.New("image reader can't be rewound")
+		}
+		if _, err := s.seeker.Seek(s.start, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("failed to rewind image: %w", err)
+		}
+	}
+	s.opened = true
+
+	return s.r, nil
+}
+
+// sourceError is a failure to read the image, which isn't retried and says
+// nothing about the endpoint.
+type sourceError struct {
+	Err error
+}
+
+func (e *sourceError) Error() string {
+	return fmt.Sprintf("failed to read image: %s", e.Err)
+}
+
+func (e *sourceError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,68 @@
+package yoloclient
+
+import (
+	"expvar"
+	"time"
+)
+
+// Observer receives the events of the client, e.g. to export them as
+// metrics. The calls are made synchronously from the request path, so they
+// must be fast and must not call back into the client.
+type Observer interface {
+	// StateChanged is called when the circuit breaker of an endpoint
+	// changes state.
+	StateChanged(endpoint string, state State)
+	// HealthChanged is called when the active health check of an endpoint
+	// changes its result.
+	HealthChanged(endpoint string, healthy bool)
+	// RequestFinished is called after every request to an endpoint,
+	// including hedged and retried ones.
+	RequestFinished(endpoint string, latency time.Duration, failed bool)
+	// Hedged is called when a hedged request is sent to an endpoint.
+	Hedged(endpoint string)
+}
+
+// EndpointStats is a snapshot of an endpoint's counters and of the latency
+// percentiles of its recent requests.
+type EndpointStats struct {
+	URL         string        `json:"url"`
+	State       State         `json:"state"`
+	Healthy     bool          `json:"healthy"`
+	Outstanding int64         `json:"outstanding"`
+	Requests    int64         `json:"requests"`
+	Failures    int64         `json:"failures"`
+	Hedges      int64         `json:"hedges"`
+	P50         time.Duration `json:"p50_ns"`
+	P90         time.Duration `json:"p90_ns"`
+	P99         time.Duration `json:"p99_ns"`
+}
+
+// Stats returns the current stats of every endpoint.
+func (c *Client) Stats() []EndpointStats {
+	stats := make([]EndpointStats, len(c.endpoints))
+	for i, e := range c.endpoints {
+		stats[i] = EndpointStats{
+			URL:         e.url,
+			State:       e.breaker.current(),
+			Healthy:     e.healthy.Load(),
+			Outstanding: e.outstanding.Load(),
+			Requests:    e.requests.Load(),
+			Failures:    e.failures.Load(),
+			Hedges:      e.hedges.Load(),
+		}
+		if p := e.percentiles(1, 50, 90, 99); p != nil {
+			stats[i].P50, stats[i].P90, stats[i].P99 = p[0], p[1], p[2]
+		}
+	}
+
+	return stats
+}
+
+// Publish exports the stats as an expvar variable, served with the other
+// variables on /debug/vars. Like expvar.Publish it panics when the name is
+// already used.
+func (c *Client) Publish(name string) {
+	expvar.Publish(name, expvar.Func(func() any {
+		return c.Stats()
+	}))
+}
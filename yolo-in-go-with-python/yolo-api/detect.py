@@ -9,6 +9,11 @@ app = FastAPI()
 # Load the pretrained YOLOv5s model from the Ultralytics repository
 model = torch.hub.load("ultralytics/yolov5", "yolov5s", pretrained=True)
 
+# Health check used by the Go client to stop routing to a broken replica
+@app.get("/health")
+async def health():
+    return {"status": "ok"}
+
 # Define the endpoint to handle object detection requests
 @app.post("/detect")
 async def detect(file: UploadFile = File(...)):